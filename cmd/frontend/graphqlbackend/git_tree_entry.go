@@ -351,6 +351,9 @@ type symbolInfoArgs struct {
 type symbolInfoResolver struct{ symbolInfo *types.SymbolInfo }
 
 func (r *symbolInfoResolver) Definition(ctx context.Context) (*symbolLocationResolver, error) {
+	if r.symbolInfo.Redacted {
+		return nil, nil
+	}
 	return &symbolLocationResolver{location: r.symbolInfo.Definition}, nil
 }
 
@@ -358,6 +361,10 @@ func (r *symbolInfoResolver) Hover(ctx context.Context) (*string, error) {
 	return r.symbolInfo.Hover, nil
 }
 
+func (r *symbolInfoResolver) Redacted() bool {
+	return r.symbolInfo.Redacted
+}
+
 type symbolLocationResolver struct {
 	location types.RepoCommitPathMaybeRange
 }
@@ -11,6 +11,7 @@ import (
 
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/squirrel"
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/types"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/search"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
@@ -19,14 +20,17 @@ func NewHandler(
 	searchFunc types.SearchFunc,
 	handleStatus func(http.ResponseWriter, *http.Request),
 	ctagsBinary string,
+	checker authz.SubRepoPermissionChecker,
 ) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/search", handleSearchWith(searchFunc))
 	mux.HandleFunc("/healthz", handleHealthCheck)
 	mux.HandleFunc("/list-languages", handleListLanguages(ctagsBinary))
-	mux.HandleFunc("/localCodeIntel", squirrel.LocalCodeIntelHandler)
+	mux.HandleFunc("/localCodeIntel", squirrel.NewLocalCodeIntelHandler(checker))
 	mux.HandleFunc("/debugLocalCodeIntel", squirrel.DebugLocalCodeIntelHandler)
-	mux.HandleFunc("/symbolInfo", squirrel.NewSymbolInfoHandler(searchFunc))
+	mux.HandleFunc("/symbolInfo", squirrel.NewSymbolInfoHandler(searchFunc, checker))
+	mux.HandleFunc("/diagnoseResolution", squirrel.NewDiagnoseResolutionHandler(searchFunc, checker))
+	mux.HandleFunc("/squirrelSelfTest", squirrel.SelfTestHandler)
 	if handleStatus != nil {
 		mux.HandleFunc("/status", handleStatus)
 	}
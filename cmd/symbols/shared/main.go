@@ -11,9 +11,14 @@ import (
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/fetcher"
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/gitserver"
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/internal/api"
+	"github.com/sourcegraph/sourcegraph/cmd/symbols/squirrel"
 	"github.com/sourcegraph/sourcegraph/cmd/symbols/types"
 	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/conf/conftypes"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	connections "github.com/sourcegraph/sourcegraph/internal/database/connections/live"
 	"github.com/sourcegraph/sourcegraph/internal/debugserver"
 	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/goroutine"
@@ -79,11 +84,24 @@ func Main(setup SetupFunc) {
 	ready := make(chan struct{})
 	go debugserver.NewServerRoutine(ready).Start()
 
+	// Keep squirrel's kill-switch in sync with the site configuration
+	squirrel.WatchConfig()
+
+	// Initialize sub-repo permissions client, which squirrel filters its results with
+	db, err := frontendDB()
+	if err != nil {
+		logger.Fatal("Failed to connect to frontend database", log.Error(err))
+	}
+	subRepoPermsChecker, err := authz.NewSubRepoPermsClient(db.SubRepoPerms())
+	if err != nil {
+		logger.Fatal("Failed to create sub-repo client", log.Error(err))
+	}
+
 	// Create HTTP server
 	server := httpserver.NewFromAddr(addr, &http.Server{
 		ReadTimeout:  75 * time.Second,
 		WriteTimeout: 10 * time.Minute,
-		Handler:      actor.HTTPMiddleware(ot.HTTPMiddleware(trace.HTTPMiddleware(api.NewHandler(searchFunc, handleStatus, ctagsBinary), conf.DefaultClient()))),
+		Handler:      actor.HTTPMiddleware(ot.HTTPMiddleware(trace.HTTPMiddleware(api.NewHandler(searchFunc, handleStatus, ctagsBinary, subRepoPermsChecker), conf.DefaultClient()))),
 	})
 	routines = append(routines, server)
 
@@ -91,3 +109,14 @@ func Main(setup SetupFunc) {
 	close(ready)
 	goroutine.MonitorBackgroundRoutines(context.Background(), routines...)
 }
+
+func frontendDB() (database.DB, error) {
+	dsn := conf.GetServiceConnectionValueAndRestartOnChange(func(serviceConnections conftypes.ServiceConnections) string {
+		return serviceConnections.PostgresDSN
+	})
+	sqlDB, err := connections.EnsureNewFrontendDB(dsn, "symbols", &observation.TestContext)
+	if err != nil {
+		return nil, err
+	}
+	return database.NewDB(sqlDB), nil
+}
@@ -0,0 +1,43 @@
+package squirrel
+
+import (
+	"context"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// AllSymbolsResult is the result of AllSymbols.
+type AllSymbolsResult struct {
+	Symbols result.Symbols
+	// Files is the number of files whose symbols were collected.
+	Files int
+	// Truncated is true when files were left out because of the cap set with WithMaxFiles.
+	Truncated bool
+}
+
+// AllSymbols collects the top-level symbols of the given files, as getSymbols returns them. Files in
+// unsupported languages are skipped and don't count toward the cap set with WithMaxFiles. Once the
+// cap is reached, the remaining files are left out and the result is marked as truncated, but the
+// symbols of the files that were processed are complete.
+func (s *SquirrelService) AllSymbols(ctx context.Context, paths []types.RepoCommitPath) (AllSymbolsResult, error) {
+	var res AllSymbolsResult
+	for _, path := range paths {
+		if _, err := langSpecForPath(path.Path); err != nil {
+			continue
+		}
+		if s.maxFiles > 0 && res.Files >= s.maxFiles {
+			res.Truncated = true
+			break
+		}
+
+		symbols, err := s.getSymbols(ctx, path)
+		if err != nil {
+			return res, errors.Wrapf(err, "getting symbols of %s", path.Path)
+		}
+		res.Symbols = append(res.Symbols, symbols...)
+		res.Files++
+	}
+	return res, nil
+}
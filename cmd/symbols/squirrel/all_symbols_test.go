@@ -0,0 +1,53 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestAllSymbolsMaxFiles(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	paths := []types.RepoCommitPath{
+		{Repo: "go1", Commit: "abc", Path: "store/store.go"},
+		{Repo: "go1", Commit: "abc", Path: "go.mod"},
+		{Repo: "go1", Commit: "abc", Path: "main.go"},
+		{Repo: "go1", Commit: "abc", Path: "preview.go"},
+	}
+
+	squirrel := New(readFile, nil, WithMaxFiles(2))
+	defer squirrel.Close()
+	got, err := squirrel.AllSymbols(context.Background(), paths)
+	fatalIfError(t, err)
+
+	// The unsupported go.mod doesn't count, so the cap is hit before preview.go.
+	want := result.Symbols{}
+	for _, path := range []types.RepoCommitPath{paths[0], paths[2]} {
+		symbols, err := squirrel.getSymbols(context.Background(), path)
+		fatalIfError(t, err)
+		want = append(want, symbols...)
+	}
+	if !got.Truncated || got.Files != 2 {
+		t.Fatalf("expected 2 files and truncation, got %d files and truncated=%t", got.Files, got.Truncated)
+	}
+	if diff := cmp.Diff(want, got.Symbols); diff != "" {
+		t.Fatalf("unexpected symbols (-want +got):\n%s", diff)
+	}
+
+	// Without a cap, every supported file is processed.
+	uncapped := New(readFile, nil)
+	defer uncapped.Close()
+	all, err := uncapped.AllSymbols(context.Background(), paths)
+	fatalIfError(t, err)
+	if all.Truncated || all.Files != 3 {
+		t.Fatalf("expected 3 files without truncation, got %d files and truncated=%t", all.Files, all.Truncated)
+	}
+}
@@ -103,6 +103,12 @@ func (bs *Breadcrumbs) pretty(w *strings.Builder, readFile ReadFileFunc) {
 	fmt.Fprintln(w, "Breadcrumbs by call tree:")
 	fmt.Fprintln(w)
 
+	if len(*bs) > 0 {
+		if pruned := (*bs)[len(*bs)-1].number - len(*bs); pruned > 0 {
+			fmt.Fprintf(w, "%s\n", color.New(color.Faint).Sprintf("(%d breadcrumbs pruned)", pruned))
+		}
+	}
+
 	for _, b := range *bs {
 		fmt.Fprintf(w, "%s%s%s %s\n", strings.Repeat("| ", b.depth), itermSource(b.file, b.line, "src"), color.RedString("%d", b.number), b.message())
 	}
@@ -123,6 +129,19 @@ func itermSource(absPath string, line int, msg string) string {
 	return ""
 }
 
+// prune removes the oldest nested breadcrumb, or the oldest breadcrumb if none are nested. Top-level
+// breadcrumbs are kept longest because they record the final result of each call.
+func (bs *Breadcrumbs) prune() {
+	i := 0
+	for j, b := range *bs {
+		if b.depth > 0 {
+			i = j
+			break
+		}
+	}
+	*bs = append((*bs)[:i], (*bs)[i+1:]...)
+}
+
 func (bs *Breadcrumbs) prettyPrint(readFile ReadFileFunc) {
 	sb := &strings.Builder{}
 	bs.pretty(sb, readFile)
@@ -145,3 +164,15 @@ func pickBreadcrumbs(breadcrumbs []Breadcrumb, messages []string) []Breadcrumb {
 	}
 	return picked
 }
+
+// materialize returns the breadcrumbs with their messages evaluated, so that they stay readable
+// after the trees they point into are closed.
+func (bs Breadcrumbs) materialize() Breadcrumbs {
+	materialized := make(Breadcrumbs, 0, len(bs))
+	for _, b := range bs {
+		message := b.message()
+		b.message = func() string { return message }
+		materialized = append(materialized, b)
+	}
+	return materialized
+}
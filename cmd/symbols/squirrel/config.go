@@ -0,0 +1,43 @@
+package squirrel
+
+import (
+	"context"
+
+	"go.uber.org/atomic"
+
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+)
+
+// enabledFlag mirrors experimentalFeatures.squirrel. It's checked on every call, so it's kept up
+// to date by WatchConfig instead of reading the site configuration each time.
+var enabledFlag = atomic.NewBool(true)
+
+// WatchConfig keeps squirrel's global kill-switch in sync with the site configuration. It blocks
+// until the configuration is available, so it must not be called from an init function.
+func WatchConfig() {
+	conf.Watch(updateEnabledFlag)
+}
+
+func updateEnabledFlag() {
+	c := conf.Get()
+	enabledFlag.Store(c.ExperimentalFeatures == nil || c.ExperimentalFeatures.Squirrel != "disabled")
+}
+
+// Enabled reports whether squirrel is enabled in the site configuration.
+func Enabled() bool {
+	return enabledFlag.Load()
+}
+
+type bypassCacheKey struct{}
+
+// WithBypassCache returns a context that makes squirrel ignore the symbol cache for calls made
+// with it, both when reading and writing. This is useful when the cache is suspected to be bad.
+func WithBypassCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassCacheKey{}, true)
+}
+
+// bypassCache reports whether the symbol cache should be ignored for the call.
+func bypassCache(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassCacheKey{}).(bool)
+	return bypass
+}
@@ -0,0 +1,83 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+func TestKillSwitch(t *testing.T) {
+	setSquirrel := func(value string) {
+		conf.Mock(&conf.Unified{
+			SiteConfiguration: schema.SiteConfiguration{
+				ExperimentalFeatures: &schema.ExperimentalFeatures{Squirrel: value},
+			},
+		})
+		updateEnabledFlag()
+	}
+	t.Cleanup(func() {
+		conf.Mock(nil)
+		enabledFlag.Store(true)
+	})
+
+	reads := 0
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		reads++
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+	ctx := context.Background()
+	path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "main.go"}
+
+	setSquirrel("disabled")
+	if Enabled() {
+		t.Fatal("expected squirrel to be disabled")
+	}
+	info, err := squirrel.symbolInfo(ctx, types.RepoCommitPathPoint{RepoCommitPath: path})
+	fatalIfError(t, err)
+	payload, err := squirrel.localCodeIntel(ctx, path)
+	fatalIfError(t, err)
+	symbols, err := squirrel.getSymbols(ctx, path)
+	fatalIfError(t, err)
+	if info != nil || payload != nil || symbols != nil {
+		t.Fatal("expected empty results while disabled")
+	}
+	if reads != 0 {
+		t.Fatalf("expected calls to short-circuit, but %d files were read", reads)
+	}
+
+	setSquirrel("enabled")
+	payload, err = squirrel.localCodeIntel(ctx, path)
+	fatalIfError(t, err)
+	if payload == nil || reads == 0 {
+		t.Fatal("expected local code intel once re-enabled")
+	}
+}
+
+func TestBypassCache(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	cache := &fakeSharedCache{values: map[string][]byte{}}
+	squirrel := New(readFile, nil, WithSymbolCache(cache))
+	defer squirrel.Close()
+	path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "store/store.go"}
+
+	// Fill the cache, then bypass it.
+	_, err := squirrel.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	symbols, err := squirrel.getSymbols(WithBypassCache(context.Background()), path)
+	fatalIfError(t, err)
+	if len(symbols) == 0 {
+		t.Fatal("expected symbols")
+	}
+	if cache.hits != 0 || cache.sets != 1 {
+		t.Fatalf("expected the bypassing call to skip the cache, got %d hits and %d sets", cache.hits, cache.sets)
+	}
+}
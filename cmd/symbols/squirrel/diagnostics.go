@@ -0,0 +1,151 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// ResolutionReason says why a point did or didn't resolve to a definition.
+type ResolutionReason string
+
+const (
+	ResolutionResolved            ResolutionReason = "resolved"
+	ResolutionDisabled            ResolutionReason = "disabled"
+	ResolutionUnsupportedLanguage ResolutionReason = "unsupported_language"
+	ResolutionParseFailure        ResolutionReason = "parse_failure"
+	ResolutionNotAnIdentifier     ResolutionReason = "not_an_identifier"
+	ResolutionNoDefinition        ResolutionReason = "no_definition"
+	ResolutionHiddenByPermissions ResolutionReason = "hidden_by_permissions"
+)
+
+// ResolutionDiagnostics explains the outcome of resolving the symbol at a point.
+type ResolutionDiagnostics struct {
+	Reason   ResolutionReason `json:"reason"`
+	Message  string           `json:"message"`
+	NodeType string           `json:"nodeType,omitempty"`
+	Steps    []ResolutionStep `json:"steps,omitempty"`
+}
+
+// ResolutionStep is a breadcrumb left while resolving, in the order it was recorded.
+type ResolutionStep struct {
+	Location types.RepoCommitPathRange `json:"location"`
+	Message  string                    `json:"message"`
+	Depth    int                       `json:"depth"`
+}
+
+// DiagnoseResolution resolves the symbol at the point like SymbolInfo, but instead of the
+// definition it returns why the definition was or wasn't found. Steps in files the actor can't
+// read are left out, and so is anything about a definition in such a file.
+func (f *PermissionFilter) DiagnoseResolution(ctx context.Context, point types.RepoCommitPathPoint) (ResolutionDiagnostics, error) {
+	if !Enabled() {
+		return ResolutionDiagnostics{Reason: ResolutionDisabled, Message: "squirrel is disabled"}, nil
+	}
+
+	if ok, err := f.canRead(ctx, point.RepoCommitPath); err != nil {
+		return ResolutionDiagnostics{}, err
+	} else if !ok {
+		return ResolutionDiagnostics{Reason: ResolutionHiddenByPermissions, Message: "the file is not readable"}, nil
+	}
+
+	f.squirrel.breadcrumbs = []Breadcrumb{}
+	info, err := f.squirrel.symbolInfo(ctx, point)
+	if errors.Is(err, unrecognizedFileExtensionError) || errors.Is(err, unsupportedLanguageError) {
+		return ResolutionDiagnostics{Reason: ResolutionUnsupportedLanguage, Message: err.Error()}, nil
+	}
+	if err != nil {
+		return ResolutionDiagnostics{}, err
+	}
+	steps, err := f.readableSteps(ctx, f.squirrel.breadcrumbs)
+	if err != nil {
+		return ResolutionDiagnostics{}, err
+	}
+
+	if info != nil {
+		// External definitions have no path.
+		if info.Definition.Path != "" {
+			ok, err := f.canRead(ctx, info.Definition.RepoCommitPath)
+			if err != nil {
+				return ResolutionDiagnostics{}, err
+			}
+			if !ok {
+				return ResolutionDiagnostics{
+					Reason:  ResolutionHiddenByPermissions,
+					Message: "a definition was found in a file that is not readable",
+					Steps:   steps,
+				}, nil
+			}
+		}
+		return ResolutionDiagnostics{Reason: ResolutionResolved, Message: "a definition was found", Steps: steps}, nil
+	}
+
+	// Nothing was found, so look at the node at the point to tell why. The lexical fallback doesn't
+	// parse, so an unsupported language means it found nothing either.
+	if _, err := langSpecForPath(point.Path); err != nil {
+		return ResolutionDiagnostics{Reason: ResolutionUnsupportedLanguage, Message: err.Error(), Steps: steps}, nil
+	}
+	root, err := f.squirrel.parse(ctx, point.RepoCommitPath)
+	if err != nil {
+		return ResolutionDiagnostics{}, err
+	}
+	column := f.squirrel.positionEncoding.toByteColumn(lineAt(root.Contents, point.Row), point.Column)
+	node := root.NamedDescendantForPointRange(
+		sitter.Point{Row: uint32(point.Row), Column: uint32(column)},
+		sitter.Point{Row: uint32(point.Row), Column: uint32(column)},
+	)
+	if node == nil {
+		return ResolutionDiagnostics{}, errors.New("node is nil")
+	}
+
+	diagnostics := ResolutionDiagnostics{NodeType: node.Type(), Steps: steps}
+	switch {
+	case insideParseError(node):
+		diagnostics.Reason = ResolutionParseFailure
+		diagnostics.Message = "the file failed to parse around the point"
+	case !isIdentifier(root.LangSpec, node):
+		diagnostics.Reason = ResolutionNotAnIdentifier
+		diagnostics.Message = fmt.Sprintf("the point is on a %s, not an identifier", node.Type())
+	default:
+		diagnostics.Reason = ResolutionNoDefinition
+		diagnostics.Message = fmt.Sprintf("no definition matches %q", node.Content(root.Contents))
+	}
+	return diagnostics, nil
+}
+
+// insideParseError reports whether the node is missing or is inside a subtree that failed to parse.
+func insideParseError(node *sitter.Node) bool {
+	for ; node != nil; node = node.Parent() {
+		if node.IsMissing() || node.Type() == "ERROR" {
+			return true
+		}
+	}
+	return false
+}
+
+// readableSteps converts the breadcrumbs to steps, dropping those in files the actor can't read.
+func (f *PermissionFilter) readableSteps(ctx context.Context, breadcrumbs Breadcrumbs) ([]ResolutionStep, error) {
+	readable := map[types.RepoCommitPath]bool{}
+	for _, b := range breadcrumbs {
+		if _, ok := readable[b.RepoCommitPath]; ok {
+			continue
+		}
+		ok, err := f.canRead(ctx, b.RepoCommitPath)
+		if err != nil {
+			return nil, err
+		}
+		readable[b.RepoCommitPath] = ok
+	}
+
+	var steps []ResolutionStep
+	for _, b := range breadcrumbs {
+		if !readable[b.RepoCommitPath] {
+			continue
+		}
+		steps = append(steps, ResolutionStep{Location: b.RepoCommitPathRange, Message: b.message(), Depth: b.depth})
+	}
+	return steps, nil
+}
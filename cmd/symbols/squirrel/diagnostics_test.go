@@ -0,0 +1,144 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// matchesAll reports whether the path matches all of the patterns.
+func matchesAll(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if match, _ := regexp.MatchString(pattern, path); !match {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDiagnoseResolution(t *testing.T) {
+	files := map[string]string{
+		"main.go": `package main
+
+import "fmt"
+
+func helper() {}
+
+func main() {
+	helper()
+	fmt.Println(missing)
+	secret()
+}
+`,
+		"secret.go": `package main
+
+func secret() {}
+`,
+		"broken.go": `package main
+
+func main() {
+	if undefinedThing {
+`,
+		"notes.mod": "MODULE Notes;\n",
+	}
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		contents, ok := files[path.Path]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return []byte(contents), nil
+	}
+	// Package lookups go through the symbol search.
+	symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		indexer := New(readFile, nil)
+		defer indexer.Close()
+		results := result.Symbols{}
+		for path := range files {
+			if !strings.HasSuffix(path, ".go") || !matchesAll(args.IncludePatterns, path) {
+				continue
+			}
+			symbols, err := indexer.getSymbols(ctx, types.RepoCommitPath{Repo: string(args.Repo), Commit: string(args.CommitID), Path: path})
+			if err != nil {
+				return nil, err
+			}
+			for _, symbol := range symbols {
+				if match, _ := regexp.MatchString(args.Query, symbol.Name); match {
+					results = append(results, symbol)
+				}
+			}
+		}
+		return results, nil
+	}
+	squirrel := New(readFile, symbolSearch)
+	defer squirrel.Close()
+
+	// Deny secret.go.
+	checker := authz.NewMockSubRepoPermissionChecker()
+	checker.EnabledFunc.SetDefaultReturn(true)
+	checker.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content authz.RepoContent) (authz.Perms, error) {
+		if content.Path == "secret.go" {
+			return authz.None, nil
+		}
+		return authz.Read, nil
+	})
+	filter := NewPermissionFilter(squirrel, checker)
+	ctx := actor.WithActor(context.Background(), &actor.Actor{UID: 1})
+
+	// at returns the point at the first occurrence of needle in the file.
+	at := func(path, needle string) types.RepoCommitPathPoint {
+		contents := files[path]
+		i := strings.Index(contents, needle)
+		if i < 0 {
+			t.Fatalf("%q not found in %s", needle, path)
+		}
+		row := strings.Count(contents[:i], "\n")
+		column := i - (strings.LastIndex(contents[:i], "\n") + 1)
+		return types.RepoCommitPathPoint{
+			RepoCommitPath: types.RepoCommitPath{Repo: "foo", Commit: "bar", Path: path},
+			Point:          types.Point{Row: row, Column: column},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		point types.RepoCommitPathPoint
+		want  ResolutionReason
+	}{
+		{"resolved", at("main.go", "helper()\n\tfmt"), ResolutionResolved},
+		{"unsupported language", at("notes.mod", "Notes"), ResolutionUnsupportedLanguage},
+		{"parse failure", at("broken.go", "undefinedThing"), ResolutionParseFailure},
+		{"not an identifier", at("main.go", `"fmt"`), ResolutionNotAnIdentifier},
+		{"no definition", at("main.go", "missing"), ResolutionNoDefinition},
+		{"definition hidden", at("main.go", "secret()"), ResolutionHiddenByPermissions},
+		{"file hidden", at("secret.go", "secret"), ResolutionHiddenByPermissions},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diagnostics, err := filter.DiagnoseResolution(ctx, test.point)
+			fatalIfError(t, err)
+			if diagnostics.Reason != test.want {
+				t.Fatalf("expected reason %s, got %s: %s", test.want, diagnostics.Reason, diagnostics.Message)
+			}
+			for _, step := range diagnostics.Steps {
+				if step.Location.Path == "secret.go" {
+					t.Fatalf("expected no steps in a denied file, got %q at %s", step.Message, step.Location.Path)
+				}
+			}
+		})
+	}
+
+	// The steps come from the breadcrumbs left while resolving.
+	diagnostics, err := filter.DiagnoseResolution(ctx, at("main.go", "helper()\n\tfmt"))
+	fatalIfError(t, err)
+	if len(diagnostics.Steps) == 0 {
+		t.Fatal("expected the steps taken to resolve helper")
+	}
+}
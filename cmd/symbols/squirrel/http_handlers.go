@@ -10,75 +10,95 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/inconshreveable/log15"
 	sitter "github.com/smacker/go-tree-sitter"
 
 	symbolsTypes "github.com/sourcegraph/sourcegraph/cmd/symbols/types"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/types"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
 
-// Responds to /localCodeIntel
-func LocalCodeIntelHandler(w http.ResponseWriter, r *http.Request) {
-	// Read the args from the request body.
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log15.Error("failed to read request body", "err", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	var args types.RepoCommitPath
-	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&args); err != nil {
-		log15.Error("failed to decode request body", "err", err, "body", string(body))
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+var maxSymbols = env.MustGetInt("SQUIRREL_MAX_SYMBOLS", 10000, "maximum number of symbols returned by /localCodeIntel, 0 for no limit")
 
-	squirrel := New(readFileFromGitserver, nil)
-	defer squirrel.Close()
+var treeMemoryLimit = env.MustGetInt("SQUIRREL_TREE_MEMORY_LIMIT", 256<<20, "soft limit in bytes on the estimated memory held by tree-sitter trees, 0 for no limit")
 
-	// Compute the local code intel payload.
-	payload, err := squirrel.localCodeIntel(r.Context(), args)
-	if payload != nil && os.Getenv("SQUIRREL_DEBUG") == "true" {
-		debugStringBuilder := &strings.Builder{}
-		fmt.Fprintln(debugStringBuilder, "👉 /localCodeIntel repo:", args.Repo, "commit:", args.Commit, "path:", args.Path)
-		contents, err := readFileFromGitserver(r.Context(), args)
-		if err != nil {
-			log15.Error("failed to read file from gitserver", "err", err)
-		} else {
-			prettyPrintLocalCodeIntelPayload(debugStringBuilder, *payload, string(contents))
-			fmt.Fprintln(debugStringBuilder, "✅ /localCodeIntel repo:", args.Repo, "commit:", args.Commit, "path:", args.Path)
+// requestContext returns the context of the request, which bypasses the symbol cache when the
+// request has ?bypassCache=true.
+func requestContext(r *http.Request) context.Context {
+	if r.URL.Query().Get("bypassCache") == "true" {
+		return WithBypassCache(r.Context())
+	}
+	return r.Context()
+}
 
-			fmt.Println(" ")
-			fmt.Println(bracket(debugStringBuilder.String()))
-			fmt.Println(" ")
+// Responds to /localCodeIntel. Results are filtered with the checker for the actor of the request.
+func NewLocalCodeIntelHandler(checker authz.SubRepoPermissionChecker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Read the args from the request body.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log15.Error("failed to read request body", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-	}
-	if err != nil {
-		_ = json.NewEncoder(w).Encode(nil)
+		var args types.RepoCommitPath
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&args); err != nil {
+			log15.Error("failed to decode request body", "err", err, "body", string(body))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		squirrel := New(readFileFromGitserver, nil, WithMaxSymbols(maxSymbols), WithTreeMemoryLimit(int64(treeMemoryLimit)))
+		defer squirrel.Close()
+
+		// Compute the local code intel payload.
+		payload, err := NewPermissionFilter(squirrel, checker).LocalCodeIntel(requestContext(r), args)
+		if payload != nil && os.Getenv("SQUIRREL_DEBUG") == "true" {
+			debugStringBuilder := &strings.Builder{}
+			fmt.Fprintln(debugStringBuilder, "👉 /localCodeIntel repo:", args.Repo, "commit:", args.Commit, "path:", args.Path)
+			contents, err := readFileFromGitserver(r.Context(), args)
+			if err != nil {
+				log15.Error("failed to read file from gitserver", "err", err)
+			} else {
+				prettyPrintLocalCodeIntelPayload(debugStringBuilder, *payload, string(contents))
+				fmt.Fprintln(debugStringBuilder, "✅ /localCodeIntel repo:", args.Repo, "commit:", args.Commit, "path:", args.Path)
 
-		// Log the error if it's not an unrecognized file extension or unsupported language error.
-		if !errors.Is(err, unrecognizedFileExtensionError) && !errors.Is(err, unsupportedLanguageError) {
-			log15.Error("failed to generate local code intel payload", "err", err)
+				fmt.Println(" ")
+				fmt.Println(bracket(debugStringBuilder.String()))
+				fmt.Println(" ")
+			}
 		}
+		if err != nil {
+			_ = json.NewEncoder(w).Encode(nil)
 
-		return
-	}
+			// Log the error if it's not an unrecognized file extension or unsupported language error.
+			if !errors.Is(err, unrecognizedFileExtensionError) && !errors.Is(err, unsupportedLanguageError) {
+				log15.Error("failed to generate local code intel payload", "err", err)
+			}
 
-	// Write the response.
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(payload)
-	if err != nil {
-		log15.Error("failed to write response: %s", "error", err)
-		http.Error(w, fmt.Sprintf("failed to generate local code intel payload: %s", err), http.StatusInternalServerError)
-		return
+			return
+		}
+
+		// Write the response.
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(payload)
+		if err != nil {
+			log15.Error("failed to write response: %s", "error", err)
+			http.Error(w, fmt.Sprintf("failed to generate local code intel payload: %s", err), http.StatusInternalServerError)
+			return
+		}
 	}
 }
 
-// Responds to /symbolInfo
-func NewSymbolInfoHandler(symbolSearch symbolsTypes.SearchFunc) func(w http.ResponseWriter, r *http.Request) {
+// Responds to /symbolInfo. Results are filtered with the checker for the actor of the request.
+func NewSymbolInfoHandler(symbolSearch symbolsTypes.SearchFunc, checker authz.SubRepoPermissionChecker) func(w http.ResponseWriter, r *http.Request) {
+	// Concurrent identical requests share their work. All requests read from the same sources.
+	group := NewSymbolInfoGroup()
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Read the args from the request body.
 		body, err := io.ReadAll(r.Body)
@@ -94,10 +114,33 @@ func NewSymbolInfoHandler(symbolSearch symbolsTypes.SearchFunc) func(w http.Resp
 			return
 		}
 
-		// Find the symbol.
-		squirrel := New(readFileFromGitserver, symbolSearch)
+		// Find the symbol, with a preview of the definition if requested with ?previewLines=N.
+		opts := []Option{WithTreeMemoryLimit(int64(treeMemoryLimit)), WithLexicalFallback(), WithSymbolInfoGroup(group)}
+		if context, err := strconv.Atoi(r.URL.Query().Get("previewLines")); err == nil && context >= 0 {
+			opts = append(opts, WithPreviewLines(context))
+		}
+		// Count columns in another encoding if requested with ?positionEncoding=utf-16.
+		switch r.URL.Query().Get("positionEncoding") {
+		case "utf-16":
+			opts = append(opts, WithPositionEncoding(UTF16))
+		case "utf-32":
+			opts = append(opts, WithPositionEncoding(UTF32))
+		}
+		// Include the scopes enclosing the definition if requested with ?scopes=true.
+		if r.URL.Query().Get("scopes") == "true" {
+			opts = append(opts, WithEnclosingScopes())
+		}
+		// Include the signature of callable definitions if requested with ?signature=true.
+		if r.URL.Query().Get("signature") == "true" {
+			opts = append(opts, WithSignatures())
+		}
+		// Include an ID of the definition that is stable across commits if requested with ?stableID=true.
+		if r.URL.Query().Get("stableID") == "true" {
+			opts = append(opts, WithStableIDs())
+		}
+		squirrel := New(readFileFromGitserver, FilterSymbolSearch(symbolSearch, checker), opts...)
 		defer squirrel.Close()
-		result, err := squirrel.symbolInfo(r.Context(), args)
+		result, err := NewPermissionFilter(squirrel, checker).SymbolInfo(requestContext(r), args)
 		if os.Getenv("SQUIRREL_DEBUG") == "true" {
 			debugStringBuilder := &strings.Builder{}
 			fmt.Fprintln(debugStringBuilder, "👉 /symbolInfo repo:", args.Repo, "commit:", args.Commit, "path:", args.Path, "row:", args.Row, "column:", args.Column)
@@ -129,6 +172,65 @@ func NewSymbolInfoHandler(symbolSearch symbolsTypes.SearchFunc) func(w http.Resp
 	}
 }
 
+// Responds to /diagnoseResolution. Results are filtered with the checker for the actor of the request.
+func NewDiagnoseResolutionHandler(symbolSearch symbolsTypes.SearchFunc, checker authz.SubRepoPermissionChecker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Read the args from the request body.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log15.Error("failed to read request body", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var args types.RepoCommitPathPoint
+		if err := json.NewDecoder(bytes.NewReader(body)).Decode(&args); err != nil {
+			log15.Error("failed to decode request body", "err", err, "body", string(body))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Count columns in another encoding if requested with ?positionEncoding=utf-16.
+		opts := []Option{WithTreeMemoryLimit(int64(treeMemoryLimit)), WithLexicalFallback()}
+		switch r.URL.Query().Get("positionEncoding") {
+		case "utf-16":
+			opts = append(opts, WithPositionEncoding(UTF16))
+		case "utf-32":
+			opts = append(opts, WithPositionEncoding(UTF32))
+		}
+		squirrel := New(readFileFromGitserver, FilterSymbolSearch(symbolSearch, checker), opts...)
+		defer squirrel.Close()
+		diagnostics, err := NewPermissionFilter(squirrel, checker).DiagnoseResolution(requestContext(r), args)
+		if err != nil {
+			log15.Error("failed to diagnose resolution", "err", err)
+			http.Error(w, fmt.Sprintf("failed to diagnose resolution: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		// Write the response.
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(diagnostics)
+		if err != nil {
+			log15.Error("failed to write response: %s", "error", err)
+			http.Error(w, fmt.Sprintf("failed to diagnose resolution: %s", err), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Responds to /squirrelSelfTest
+func SelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if err := SelfTest(r.Context()); err != nil {
+		log15.Error("squirrel self-test failed", "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write([]byte("OK")); err != nil {
+		log15.Error("failed to write response to squirrel self-test", "err", err)
+	}
+}
+
 // Response to /debugLocalCodeIntel.
 func DebugLocalCodeIntelHandler(w http.ResponseWriter, r *http.Request) {
 	// Read ?ext=<ext> from the request.
@@ -0,0 +1,936 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func (squirrel *SquirrelService) getDefGo(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	// Import specs resolve to the imported package, including blank and dot imports which bind no
+	// name that could be looked up.
+	if spec := findAncestor(node.Node, "import_spec"); spec != nil {
+		return squirrel.getImportDirGo(ctx, swapNode(node, spec))
+	}
+
+	switch node.Type() {
+	case "identifier", "type_identifier", "field_identifier", "package_identifier":
+		ident := node.Content(node.Contents)
+
+		parent := node.Parent()
+		if parent != nil {
+			switch parent.Type() {
+			case "selector_expression":
+				// Check for field access like x.y or pkg.Y
+				field := parent.ChildByFieldName("field")
+				operand := parent.ChildByFieldName("operand")
+				if field != nil && operand != nil && nodeId(field) == nodeId(node.Node) {
+					found, err := squirrel.getFieldGo(ctx, swapNode(node, operand), ident)
+					if err != nil || found == nil || !squirrel.goMockResolution || !isTestFileGo(node.RepoCommitPath.Path) {
+						return found, err
+					}
+					mock, err := squirrel.getMockMethodGo(ctx, node, *found)
+					if err != nil || mock == nil {
+						return found, err
+					}
+					return mock, nil
+				}
+			case "qualified_type":
+				// Check for qualified types like pkg.T
+				name := parent.ChildByFieldName("name")
+				pkg := parent.ChildByFieldName("package")
+				if name != nil && pkg != nil && nodeId(name) == nodeId(node.Node) {
+					return squirrel.getFieldGo(ctx, swapNode(node, pkg), ident)
+				}
+			case "keyed_element":
+				// Check for keys in composite literals like T{X: 1}
+				if parent.NamedChildCount() > 0 && nodeId(parent.NamedChild(0)) == nodeId(node.Node) && node.Type() == "field_identifier" {
+					literal := findAncestor(parent, "composite_literal")
+					if literal == nil {
+						return nil, nil
+					}
+					ty := literal.ChildByFieldName("type")
+					if ty == nil {
+						return nil, nil
+					}
+					tyDef, err := squirrel.getTypeDefGo(ctx, swapNode(node, ty))
+					if err != nil {
+						return nil, err
+					}
+					return squirrel.lookupFieldGo(ctx, tyDef, ident)
+				}
+			case "field_declaration", "method_spec", "method_declaration":
+				// Field and method names are definitions themselves.
+				if node.Type() == "field_identifier" {
+					return &node, nil
+				}
+			}
+		}
+
+		return squirrel.getDefInScopeGo(ctx, node, ident)
+
+	// No other nodes have a definition
+	default:
+		return nil, nil
+	}
+}
+
+// getDefInScopeGo walks up the scopes enclosing the given node looking for a definition of ident,
+// then falls back to the package and imports.
+func (squirrel *SquirrelService) getDefInScopeGo(ctx context.Context, node Node, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(ident), lazyNodeStringer(&ret))()
+
+	cur := node.Node
+	for {
+		prev := cur
+		cur = cur.Parent()
+		if cur == nil {
+			squirrel.breadcrumb(node, "getDefInScopeGo: ran out of parents")
+			return nil, nil
+		}
+
+		switch cur.Type() {
+		case "source_file":
+			return squirrel.getDefInFileOrPackageGo(ctx, swapNode(node, cur), ident)
+
+		case "block", "expression_case", "default_case", "type_case", "communication_case":
+			if found := findDefInStatementsGo(swapNode(node, cur), prev, ident); found != nil {
+				return found, nil
+			}
+			if cur.Type() == "communication_case" {
+				communication := cur.ChildByFieldName("communication")
+				if communication != nil && communication.Type() == "receive_statement" {
+					if found := findIdentGo(swapNode(node, communication.ChildByFieldName("left")), ident); found != nil {
+						return found, nil
+					}
+				}
+			}
+			if cur.Type() == "type_case" || cur.Type() == "default_case" {
+				// The alias of a type switch is declared in every clause.
+				if typeSwitch := cur.Parent(); typeSwitch != nil && typeSwitch.Type() == "type_switch_statement" {
+					if found := findIdentGo(swapNode(node, typeSwitch.ChildByFieldName("alias")), ident); found != nil {
+						return found, nil
+					}
+				}
+			}
+			continue
+
+		case "function_declaration", "method_declaration", "func_literal":
+			for _, field := range []string{"receiver", "parameters", "result"} {
+				if found := findParamGo(swapNode(node, cur.ChildByFieldName(field)), ident); found != nil {
+					return found, nil
+				}
+			}
+			continue
+
+		case "if_statement", "expression_switch_statement", "type_switch_statement":
+			if found := findDefInStatementGo(swapNode(node, cur.ChildByFieldName("initializer")), ident); found != nil {
+				return found, nil
+			}
+			continue
+
+		case "for_statement":
+			for _, child := range children(cur) {
+				switch child.Type() {
+				case "range_clause":
+					if found := findIdentGo(swapNode(node, child.ChildByFieldName("left")), ident); found != nil {
+						return found, nil
+					}
+				case "for_clause":
+					if found := findDefInStatementGo(swapNode(node, child.ChildByFieldName("initializer")), ident); found != nil {
+						return found, nil
+					}
+				}
+			}
+			continue
+
+		// Skip all other nodes
+		default:
+			continue
+		}
+	}
+}
+
+// findDefInStatementsGo looks for a definition of ident among the statements in the given scope that
+// come before the given child.
+func findDefInStatementsGo(scope Node, before *sitter.Node, ident string) *Node {
+	statements := children(scope.Node)
+	for i := len(statements) - 1; i >= 0; i-- {
+		statement := statements[i]
+		if statement.StartByte() > before.StartByte() {
+			continue
+		}
+		if found := findDefInStatementGo(swapNode(scope, statement), ident); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// findDefInStatementGo returns the name that the given statement declares if it matches ident.
+func findDefInStatementGo(statement Node, ident string) *Node {
+	if statement.Node == nil {
+		return nil
+	}
+	switch statement.Type() {
+	case "short_var_declaration":
+		return findIdentGo(swapNode(statement, statement.ChildByFieldName("left")), ident)
+	case "var_declaration", "const_declaration":
+		for _, spec := range children(statement.Node) {
+			if found := findIdentGo(swapNode(statement, spec), ident); found != nil {
+				return found
+			}
+		}
+	case "type_declaration":
+		for _, spec := range children(statement.Node) {
+			name := spec.ChildByFieldName("name")
+			if name != nil && name.Content(statement.Contents) == ident {
+				return swapNodePtr(statement, name)
+			}
+		}
+	}
+	return nil
+}
+
+// findIdentGo returns the direct child identifier of the given node that matches ident. This works
+// for expression lists, var and const specs, and parameter declarations because the identifiers
+// they declare are their only direct identifier children.
+func findIdentGo(list Node, ident string) *Node {
+	if list.Node == nil {
+		return nil
+	}
+	for _, child := range children(list.Node) {
+		if child.Type() == "identifier" && child.Content(list.Contents) == ident {
+			return swapNodePtr(list, child)
+		}
+	}
+	return nil
+}
+
+// findParamGo looks for a parameter with the given name in a parameter list.
+func findParamGo(params Node, ident string) *Node {
+	if params.Node == nil || params.Type() != "parameter_list" {
+		return nil
+	}
+	for _, param := range children(params.Node) {
+		if found := findIdentGo(swapNode(params, param), ident); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// getDefInFileOrPackageGo looks for a top-level definition of ident in the given file, then in the
+// imports of the file, then in the rest of the package.
+func (squirrel *SquirrelService) getDefInFileOrPackageGo(ctx context.Context, file Node, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(file, String(ident), lazyNodeStringer(&ret))()
+
+	for _, decl := range children(file.Node) {
+		switch decl.Type() {
+		case "function_declaration":
+			name := decl.ChildByFieldName("name")
+			if name != nil && name.Content(file.Contents) == ident {
+				return swapNodePtr(file, name), nil
+			}
+		case "import_declaration":
+			for _, spec := range importSpecsGo(decl) {
+				if importNameGo(swapNode(file, spec)) != ident {
+					continue
+				}
+				return squirrel.getImportDirGo(ctx, swapNode(file, spec))
+			}
+		default:
+			if found := findDefInStatementGo(swapNode(file, decl), ident); found != nil {
+				return found, nil
+			}
+		}
+	}
+
+	found, err := squirrel.getDefInPackageGo(ctx, file.RepoCommitPath, filepath.Dir(file.RepoCommitPath.Path), ident, isTestFileGo(file.RepoCommitPath.Path))
+	if err != nil {
+		return nil, err
+	}
+	if found == nil && builtinsGo[ident] {
+		squirrel.markExternal(file, "builtin."+ident)
+	}
+	return found, nil
+}
+
+// Predeclared identifiers in Go's universe scope.
+var builtinsGo = map[string]bool{
+	"any": true, "bool": true, "byte": true, "comparable": true, "complex64": true, "complex128": true,
+	"error": true, "float32": true, "float64": true, "int": true, "int8": true, "int16": true,
+	"int32": true, "int64": true, "rune": true, "string": true, "uint": true, "uint8": true,
+	"uint16": true, "uint32": true, "uint64": true, "uintptr": true, "true": true, "false": true,
+	"iota": true, "nil": true, "append": true, "cap": true, "close": true, "complex": true,
+	"copy": true, "delete": true, "imag": true, "len": true, "make": true, "new": true,
+	"panic": true, "print": true, "println": true, "real": true, "recover": true,
+}
+
+// getMockMethodGo returns the method of the mockgen-style mock of an interface, if the given
+// definition is an interface method and the package of the reference has a mock for it.
+func (squirrel *SquirrelService) getMockMethodGo(ctx context.Context, ref Node, def Node) (ret *Node, err error) {
+	defer squirrel.onCall(def, String(def.Content(def.Contents)), lazyNodeStringer(&ret))()
+
+	if def.Parent() == nil || def.Parent().Type() != "method_spec" {
+		return nil, nil
+	}
+	typeSpec := findAncestor(def.Node, "type_spec")
+	if typeSpec == nil {
+		return nil, nil
+	}
+	name := typeSpec.ChildByFieldName("name")
+	if name == nil {
+		return nil, nil
+	}
+	mockName := "Mock" + name.Content(def.Contents)
+	return squirrel.symbolSearchFirst(
+		ctx,
+		ref.RepoCommitPath.Repo,
+		ref.RepoCommitPath.Commit,
+		[]string{packagePathPatternGo(filepath.Dir(ref.RepoCommitPath.Path))},
+		"",
+		def.Content(def.Contents),
+		func(symbol result.Symbol) bool { return symbol.Kind == "method" && symbol.Parent == mockName },
+	)
+}
+
+// getDefInPackageGo searches the symbols of the package in the given directory for a top-level
+// definition of ident. Test files are only searched when includeTests is true, because only other
+// test files can refer to their declarations.
+func (squirrel *SquirrelService) getDefInPackageGo(ctx context.Context, repoCommitPath types.RepoCommitPath, dir string, ident string, includeTests bool) (*Node, error) {
+	return squirrel.symbolSearchFirst(
+		ctx,
+		repoCommitPath.Repo,
+		repoCommitPath.Commit,
+		[]string{packagePathPatternGo(dir)},
+		testFileExcludePatternGo(includeTests),
+		ident,
+		func(symbol result.Symbol) bool { return symbol.Kind != "method" },
+	)
+}
+
+// isTestFileGo returns true if the path is a Go test file.
+func isTestFileGo(path string) bool {
+	return strings.HasSuffix(path, "_test.go")
+}
+
+// testFileExcludePatternGo returns a pattern that excludes test files unless includeTests is true.
+func testFileExcludePatternGo(includeTests bool) string {
+	if includeTests {
+		return ""
+	}
+	return `_test\.go$`
+}
+
+// packagePathPatternGo returns a regex that matches the files of the package in the given directory.
+func packagePathPatternGo(dir string) string {
+	if dir == "." || dir == "" {
+		return `^[^/]*\.go$`
+	}
+	return fmt.Sprintf(`^%s/[^/]*\.go$`, regexp.QuoteMeta(dir))
+}
+
+// importSpecsGo returns the import specs in an import declaration.
+func importSpecsGo(decl *sitter.Node) []*sitter.Node {
+	specs := []*sitter.Node{}
+	for _, child := range children(decl) {
+		switch child.Type() {
+		case "import_spec":
+			specs = append(specs, child)
+		case "import_spec_list":
+			for _, spec := range children(child) {
+				if spec.Type() == "import_spec" {
+					specs = append(specs, spec)
+				}
+			}
+		}
+	}
+	return specs
+}
+
+// importPathGo returns the unquoted path of an import spec.
+func importPathGo(spec Node) string {
+	path := spec.ChildByFieldName("path")
+	if path == nil {
+		return ""
+	}
+	unquoted, err := strconv.Unquote(path.Content(spec.Contents))
+	if err != nil {
+		return ""
+	}
+	return unquoted
+}
+
+// importNameGo returns the name that an import spec binds in the file. Unnamed imports are assumed to
+// bind the last element of the import path, minus any major version suffix or go- prefix.
+func importNameGo(spec Node) string {
+	if name := spec.ChildByFieldName("name"); name != nil {
+		return name.Content(spec.Contents)
+	}
+	elems := strings.Split(importPathGo(spec), "/")
+	last := elems[len(elems)-1]
+	if majorVersionRegexGo.MatchString(last) && len(elems) > 1 {
+		last = elems[len(elems)-2]
+	}
+	last = strings.TrimPrefix(last, "go-")
+	last = strings.TrimSuffix(last, ".go")
+	if i := strings.Index(last, ".v"); i > 0 {
+		last = last[:i]
+	}
+	return strings.ReplaceAll(last, "-", "_")
+}
+
+var majorVersionRegexGo = regexp.MustCompile(`^v[0-9]+$`)
+
+// getImportDirGo returns the directory of the imported package if it's in the same repository.
+func (squirrel *SquirrelService) getImportDirGo(ctx context.Context, spec Node) (ret *Node, err error) {
+	defer squirrel.onCall(spec, String(importPathGo(spec)), lazyNodeStringer(&ret))()
+
+	modulePath := squirrel.modulePathGo(ctx, spec.RepoCommitPath)
+	if modulePath == "" {
+		if importPath := importPathGo(spec); isStdlibImportPathGo(importPath) {
+			squirrel.markExternal(spec, importPath)
+		}
+		squirrel.breadcrumb(spec, "getImportDirGo: no module path")
+		return nil, nil
+	}
+
+	importPath := importPathGo(spec)
+	if importPath != modulePath && !strings.HasPrefix(importPath, modulePath+"/") {
+		if isStdlibImportPathGo(importPath) {
+			squirrel.markExternal(spec, importPath)
+		}
+		squirrel.breadcrumb(spec, "getImportDirGo: import is outside of the module")
+		return nil, nil
+	}
+
+	dir := strings.TrimPrefix(strings.TrimPrefix(importPath, modulePath), "/")
+	if dir == "" {
+		dir = "."
+	}
+	return &Node{
+		RepoCommitPath: types.RepoCommitPath{
+			Repo:   spec.RepoCommitPath.Repo,
+			Commit: spec.RepoCommitPath.Commit,
+			Path:   dir,
+		},
+	}, nil
+}
+
+// isStdlibImportPathGo returns true if the import path belongs to the standard library, which is the
+// case when its first element has no dot.
+func isStdlibImportPathGo(importPath string) bool {
+	first := strings.Split(importPath, "/")[0]
+	return first != "" && !strings.Contains(first, ".")
+}
+
+// modulePathGo returns the module path declared in the go.mod file at the root of the repository, or
+// the empty string if there isn't one.
+func (squirrel *SquirrelService) modulePathGo(ctx context.Context, repoCommitPath types.RepoCommitPath) string {
+	contents, err := squirrel.readFile(ctx, types.RepoCommitPath{
+		Repo:   repoCommitPath.Repo,
+		Commit: repoCommitPath.Commit,
+		Path:   "go.mod",
+	})
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
+
+func (squirrel *SquirrelService) getFieldGo(ctx context.Context, object Node, field string) (ret *Node, err error) {
+	defer squirrel.onCall(object, &Tuple{String(object.Type()), String(field)}, lazyNodeStringer(&ret))()
+
+	var ty Type
+	switch object.Type() {
+	case "identifier", "package_identifier":
+		squirrel.external = ""
+		def, err := squirrel.getDefGo(ctx, object)
+		if err != nil {
+			return nil, err
+		}
+		if def == nil {
+			if squirrel.external != "" {
+				// The object is an external package like fmt.
+				squirrel.markExternal(object, squirrel.external+"."+field)
+			}
+			return nil, nil
+		}
+		if def.Node == nil {
+			// The object is an imported package.
+			return squirrel.getDefInPackageGo(ctx, def.RepoCommitPath, def.RepoCommitPath.Path, field, false)
+		}
+		ty, err = squirrel.refToTypeGo(ctx, object, *def)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		ty, err = squirrel.getTypeDefGo(ctx, object)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ty == nil {
+		return nil, nil
+	}
+	return squirrel.lookupFieldGo(ctx, ty, field)
+}
+
+func (squirrel *SquirrelService) lookupFieldGo(ctx context.Context, ty Type, field string) (ret *Node, err error) {
+	defer squirrel.onCall(ty.node(), &Tuple{String(ty.variant()), String(field)}, lazyNodeStringer(&ret))()
+
+	switch ty2 := ty.(type) {
+	case ClassType:
+		typeSpec := ty2.def
+		underlying := typeSpec.ChildByFieldName("type")
+		embedded := []Node{}
+		if underlying != nil {
+			switch underlying.Type() {
+			case "struct_type":
+				for _, list := range children(underlying) {
+					for _, decl := range children(list) {
+						if decl.Type() != "field_declaration" {
+							continue
+						}
+						names := 0
+						for _, name := range children(decl) {
+							if name.Type() != "field_identifier" {
+								continue
+							}
+							names++
+							if name.Content(typeSpec.Contents) == field {
+								return swapNodePtr(typeSpec, name), nil
+							}
+						}
+						if names == 0 {
+							if fieldTy := decl.ChildByFieldName("type"); fieldTy != nil {
+								if embeddedNameGo(swapNode(typeSpec, fieldTy)) == field {
+									return swapNodePtr(typeSpec, fieldTy), nil
+								}
+								embedded = append(embedded, swapNode(typeSpec, fieldTy))
+							}
+						}
+					}
+				}
+			case "interface_type":
+				for _, list := range children(underlying) {
+					for _, spec := range children(list) {
+						switch spec.Type() {
+						case "method_spec":
+							name := spec.ChildByFieldName("name")
+							if name != nil && name.Content(typeSpec.Contents) == field {
+								return swapNodePtr(typeSpec, name), nil
+							}
+						case "type_identifier", "qualified_type":
+							embedded = append(embedded, swapNode(typeSpec, spec))
+						}
+					}
+				}
+			}
+		}
+
+		// Look for methods declared on the type anywhere in its package.
+		name := typeSpec.ChildByFieldName("name")
+		if name != nil {
+			typeName := name.Content(typeSpec.Contents)
+			found, err := squirrel.symbolSearchFirst(
+				ctx,
+				typeSpec.RepoCommitPath.Repo,
+				typeSpec.RepoCommitPath.Commit,
+				[]string{packagePathPatternGo(filepath.Dir(typeSpec.RepoCommitPath.Path))},
+				testFileExcludePatternGo(isTestFileGo(typeSpec.RepoCommitPath.Path)),
+				field,
+				func(symbol result.Symbol) bool { return symbol.Kind == "method" && symbol.Parent == typeName },
+			)
+			if err != nil {
+				return nil, err
+			}
+			if found != nil {
+				return found, nil
+			}
+		}
+
+		// Look for promoted fields and methods.
+		for _, embeddedTy := range embedded {
+			def, err := squirrel.getTypeDefGo(ctx, embeddedTy)
+			if err != nil {
+				return nil, err
+			}
+			if def == nil {
+				continue
+			}
+			found, err := squirrel.lookupFieldGo(ctx, def, field)
+			if err != nil {
+				return nil, err
+			}
+			if found != nil {
+				return found, nil
+			}
+		}
+		return nil, nil
+	case FnType:
+		squirrel.breadcrumb(ty.node(), "lookupFieldGo: unexpected object type")
+		return nil, nil
+	default:
+		squirrel.breadcrumb(ty.node(), fmt.Sprintf("lookupFieldGo: unrecognized type variant %q", ty.variant()))
+		return nil, nil
+	}
+}
+
+// embeddedNameGo returns the field name of an embedded type, e.g. T for *pkg.T.
+func embeddedNameGo(ty Node) string {
+	switch ty.Type() {
+	case "type_identifier":
+		return ty.Content(ty.Contents)
+	case "qualified_type":
+		if name := ty.ChildByFieldName("name"); name != nil {
+			return name.Content(ty.Contents)
+		}
+	case "pointer_type":
+		if ty.NamedChildCount() > 0 {
+			return embeddedNameGo(swapNode(ty, ty.NamedChild(0)))
+		}
+	}
+	return ""
+}
+
+func (squirrel *SquirrelService) getTypeDefGo(ctx context.Context, node Node) (ret Type, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyTypeStringer(&ret))()
+
+	onIdent := func() (Type, error) {
+		found, err := squirrel.getDefGo(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, nil
+		}
+		return squirrel.refToTypeGo(ctx, node, *found)
+	}
+
+	switch node.Type() {
+	case "type_identifier", "identifier", "field_identifier":
+		return onIdent()
+	case "qualified_type":
+		name := node.ChildByFieldName("name")
+		if name == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, name))
+	case "selector_expression":
+		field := node.ChildByFieldName("field")
+		if field == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, field))
+	case "call_expression":
+		fn := node.ChildByFieldName("function")
+		if fn == nil {
+			return nil, nil
+		}
+		fnTy, err := squirrel.getTypeDefGo(ctx, swapNode(node, fn))
+		if err != nil {
+			return nil, err
+		}
+		if fnTy == nil {
+			return nil, nil
+		}
+		switch fnTy2 := fnTy.(type) {
+		case FnType:
+			return fnTy2.ret, nil
+		case ClassType:
+			// A conversion like T(x)
+			return fnTy2, nil
+		default:
+			squirrel.breadcrumb(node, fmt.Sprintf("getTypeDefGo: expected function, got %q", fnTy.variant()))
+			return nil, nil
+		}
+	case "composite_literal", "type_assertion_expression":
+		ty := node.ChildByFieldName("type")
+		if ty == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, ty))
+	case "unary_expression":
+		operand := node.ChildByFieldName("operand")
+		if operand == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, operand))
+	case "pointer_type", "parenthesized_expression":
+		if node.NamedChildCount() == 0 {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, node.NamedChild(0)))
+	case "parameter_list":
+		// Only single results have a usable type.
+		params := children(node.Node)
+		if len(params) != 1 {
+			return nil, nil
+		}
+		ty := params[0].ChildByFieldName("type")
+		if ty == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(node, ty))
+	default:
+		squirrel.breadcrumb(node, fmt.Sprintf("getTypeDefGo: unrecognized node type %q", node.Type()))
+		return nil, nil
+	}
+}
+
+// refToTypeGo returns the type of a reference given its definition. The type usually only depends
+// on the definition, except for the alias of a type switch, which has the type of the case that
+// contains the reference.
+func (squirrel *SquirrelService) refToTypeGo(ctx context.Context, ref Node, def Node) (Type, error) {
+	if switchStmt := typeSwitchOfAliasGo(def); switchStmt != nil {
+		ty := typeSwitchCaseTypeGo(ref.Node, switchStmt, def.Contents)
+		if ty == nil {
+			squirrel.breadcrumb(ref, "refToTypeGo: type switch alias outside of a single-type case")
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(def, ty))
+	}
+	return squirrel.defToTypeGo(ctx, def)
+}
+
+func (squirrel *SquirrelService) defToTypeGo(ctx context.Context, def Node) (Type, error) {
+	if def.Node == nil {
+		return nil, nil
+	}
+	parent := def.Node.Parent()
+	if parent == nil {
+		return nil, nil
+	}
+
+	typeOf := func(n *sitter.Node) (Type, error) {
+		if n == nil {
+			squirrel.breadcrumb(swapNode(def, parent), "defToTypeGo: could not find type")
+			return nil, nil
+		}
+		return squirrel.getTypeDefGo(ctx, swapNode(def, n))
+	}
+
+	switch parent.Type() {
+	case "type_spec":
+		return (Type)(ClassType{def: swapNode(def, parent)}), nil
+	case "function_declaration", "method_declaration", "method_spec":
+		result := parent.ChildByFieldName("result")
+		if result == nil {
+			return (Type)(FnType{ret: nil, noad: swapNode(def, parent)}), nil
+		}
+		retTy, err := typeOf(result)
+		if err != nil {
+			return nil, err
+		}
+		return (Type)(FnType{ret: retTy, noad: swapNode(def, parent)}), nil
+	case "parameter_declaration", "field_declaration":
+		if ty := parent.ChildByFieldName("type"); ty != nil && nodeId(ty) == nodeId(def.Node) {
+			// An embedded field is its own type.
+			return typeOf(def.Node)
+		}
+		return typeOf(parent.ChildByFieldName("type"))
+	case "var_spec", "const_spec":
+		if ty := parent.ChildByFieldName("type"); ty != nil {
+			return typeOf(ty)
+		}
+		return typeOf(nthExpressionGo(parent.ChildByFieldName("value"), identIndexGo(parent, def.Node)))
+	case "expression_list":
+		grandparent := parent.Parent()
+		if grandparent != nil && grandparent.Type() == "short_var_declaration" {
+			right := grandparent.ChildByFieldName("right")
+			if right != nil && right.NamedChildCount() == 1 && parent.NamedChildCount() > 1 {
+				value := right.NamedChild(0)
+				if value.Type() == "type_assertion_expression" {
+					// Checked assertions like x, ok := v.(T)
+					if identIndexGo(parent, def.Node) != 0 {
+						return nil, nil
+					}
+					return typeOf(value)
+				}
+				// Multiple results like x, err := f()
+				return squirrel.getResultTypeDefGo(ctx, swapNode(def, value), identIndexGo(parent, def.Node))
+			}
+			return typeOf(nthExpressionGo(right, identIndexGo(parent, def.Node)))
+		}
+		squirrel.breadcrumb(swapNode(def, parent), "defToTypeGo: unsupported expression list")
+		return nil, nil
+	default:
+		squirrel.breadcrumb(swapNode(def, parent), fmt.Sprintf("defToTypeGo: unrecognized def parent %q", parent.Type()))
+		return nil, nil
+	}
+}
+
+// getResultTypeDefGo returns the type of the nth result of a call expression.
+func (squirrel *SquirrelService) getResultTypeDefGo(ctx context.Context, call Node, n int) (ret Type, err error) {
+	defer squirrel.onCall(call, String(fmt.Sprint(n)), lazyTypeStringer(&ret))()
+
+	if call.Type() != "call_expression" {
+		return nil, nil
+	}
+	fn := call.ChildByFieldName("function")
+	if fn == nil {
+		return nil, nil
+	}
+	if fn.Type() == "selector_expression" {
+		fn = fn.ChildByFieldName("field")
+		if fn == nil {
+			return nil, nil
+		}
+	}
+	def, err := squirrel.getDefGo(ctx, swapNode(call, fn))
+	if err != nil {
+		return nil, err
+	}
+	if def == nil || def.Node == nil || def.Parent() == nil {
+		return nil, nil
+	}
+	result := def.Parent().ChildByFieldName("result")
+	if result == nil || result.Type() != "parameter_list" {
+		return nil, nil
+	}
+	i := 0
+	for _, param := range children(result) {
+		ty := param.ChildByFieldName("type")
+		if ty == nil {
+			continue
+		}
+		// Named results like (a, b int) declare several results at once.
+		names := 0
+		for _, child := range children(param) {
+			if child.Type() == "identifier" {
+				names++
+			}
+		}
+		if names == 0 {
+			names = 1
+		}
+		if n < i+names {
+			return squirrel.getTypeDefGo(ctx, swapNode(*def, ty))
+		}
+		i += names
+	}
+	return nil, nil
+}
+
+// typeSwitchOfAliasGo returns the type switch statement if def is its alias, like x in
+// switch x := v.(type).
+func typeSwitchOfAliasGo(def Node) *sitter.Node {
+	if def.Node == nil || def.Parent() == nil || def.Parent().Type() != "expression_list" {
+		return nil
+	}
+	switchStmt := def.Parent().Parent()
+	if switchStmt == nil || switchStmt.Type() != "type_switch_statement" {
+		return nil
+	}
+	alias := switchStmt.ChildByFieldName("alias")
+	if alias == nil || nodeId(alias) != nodeId(def.Parent()) {
+		return nil
+	}
+	return switchStmt
+}
+
+// typeSwitchCaseTypeGo returns the type of the case of the type switch that contains ref, if the
+// case lists exactly one type.
+func typeSwitchCaseTypeGo(ref *sitter.Node, switchStmt *sitter.Node, contents []byte) *sitter.Node {
+	typeCase := ref
+	for typeCase != nil && (typeCase.Type() != "type_case" || nodeId(typeCase.Parent()) != nodeId(switchStmt)) {
+		typeCase = typeCase.Parent()
+	}
+	if typeCase == nil {
+		return nil
+	}
+	types := []*sitter.Node{}
+	for i := 0; i < int(typeCase.ChildCount()); i++ {
+		child := typeCase.Child(i)
+		if child.Type() == ":" {
+			break
+		}
+		if child.IsNamed() && child.Type() != "comment" {
+			types = append(types, child)
+		}
+	}
+	if len(types) != 1 || types[0].Content(contents) == "nil" {
+		return nil
+	}
+	return types[0]
+}
+
+// identIndexGo returns the index of ident among the identifiers directly under parent.
+func identIndexGo(parent *sitter.Node, ident *sitter.Node) int {
+	i := 0
+	for _, child := range children(parent) {
+		if child.Type() != "identifier" {
+			continue
+		}
+		if nodeId(child) == nodeId(ident) {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+// nthExpressionGo returns the nth expression in an expression list, or nil if there isn't one.
+func nthExpressionGo(list *sitter.Node, n int) *sitter.Node {
+	if list == nil || n < 0 || n >= int(list.NamedChildCount()) {
+		return nil
+	}
+	return list.NamedChild(n)
+}
+
+// getDefGoGenerate resolves a word in a //go:generate directive to a top-level declaration in the
+// package. Tools can interpret their arguments however they like, so the result is a guess.
+func (squirrel *SquirrelService) getDefGoGenerate(ctx context.Context, comment Node, point types.Point) (ret *Node, err error) {
+	defer squirrel.onCall(comment, String(comment.Type()), lazyNodeStringer(&ret))()
+
+	text := comment.Content(comment.Contents)
+	if !strings.HasPrefix(text, goGeneratePrefix) || int(comment.StartPoint().Row) != point.Row {
+		return nil, nil
+	}
+
+	offset := point.Column - int(comment.StartPoint().Column)
+	if offset < 0 || offset >= len(text) {
+		return nil, nil
+	}
+	start, end := wordAt(text, offset)
+	if start == end {
+		return nil, nil
+	}
+
+	// Skip the tool name, only its arguments can be local symbols.
+	args := strings.TrimLeft(text[len(goGeneratePrefix):], " \t")
+	tool := strings.Fields(args)
+	if len(tool) == 0 || start < len(text)-len(args)+len(tool[0]) {
+		return nil, nil
+	}
+
+	file := swapNode(comment, getRoot(comment.Node))
+	found, err := squirrel.getDefInFileOrPackageGo(ctx, file, text[start:end])
+	if err != nil {
+		return nil, err
+	}
+	if found == nil || found.Node == nil {
+		return nil, nil
+	}
+	return found, nil
+}
+
+const goGeneratePrefix = "//go:generate"
@@ -0,0 +1,239 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/regexp"
+
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestGoDefinitions(t *testing.T) {
+	contents := `package shapes
+
+type Point struct {
+	X, Y int
+}
+
+type Named struct {
+	Point
+	Name string
+}
+
+func (p Point) Dist() int { return p.X*p.X + p.Y*p.Y }
+
+func NewNamed(name string) *Named {
+	return &Named{Name: name, Point: Point{X: 1}}
+}
+
+func use(scale int) int {
+	n := NewNamed("a")
+	total := n.Dist() + n.X
+	for i, r := range []int{1} {
+		total += i * r * scale
+	}
+	if total := 2; total > 0 {
+		_ = total
+	}
+	f := func(k int) int { return k + total }
+	return f(n.Point.Y)
+}
+`
+	path := types.RepoCommitPath{Repo: "shapes", Commit: "abc", Path: "resolve.go"}
+	readFile := func(ctx context.Context, p types.RepoCommitPath) ([]byte, error) {
+		if p.Path != path.Path {
+			return nil, os.ErrNotExist
+		}
+		return []byte(contents), nil
+	}
+	// There is a single package, so only the name is matched.
+	indexer := New(readFile, nil)
+	defer indexer.Close()
+	symbols, err := indexer.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		name := strings.TrimSuffix(strings.TrimPrefix(args.Query, "^"), "$")
+		matches := result.Symbols{}
+		for _, symbol := range symbols {
+			if symbol.Name == name {
+				matches = append(matches, symbol)
+			}
+		}
+		return matches, nil
+	}
+	squirrel := New(readFile, symbolSearch)
+	defer squirrel.Close()
+
+	// at returns the point of the nth occurrence of needle, counting from 0.
+	at := func(needle string, n int) types.Point {
+		offset := 0
+		for i := 0; ; i++ {
+			j := strings.Index(contents[offset:], needle)
+			if j < 0 {
+				t.Fatalf("occurrence %d of %q not found", n, needle)
+			}
+			if i == n {
+				offset += j
+				break
+			}
+			offset += j + len(needle)
+		}
+		return types.Point{
+			Row:    strings.Count(contents[:offset], "\n"),
+			Column: offset - (strings.LastIndex(contents[:offset], "\n") + 1),
+		}
+	}
+
+	tests := []struct {
+		name string
+		ref  types.Point
+		def  types.Point
+	}{
+		{"parameter", at("scale", 1), at("scale", 0)},
+		{"local", at("n.Dist", 0), at("n :=", 0)},
+		{"function", at("NewNamed(\"a\")", 0), at("NewNamed(name", 0)},
+		{"range variable", at("r *", 0), at("r := range", 0)},
+		{"shadowed in if", at("total\n", 0), at("total := 2", 0)},
+		{"closure parameter", at("k + total", 0), at("k int", 0)},
+		{"captured by closure", at("total }", 0), at("total := n", 0)},
+		{"composite literal key", at("Name:", 0), at("Name string", 0)},
+		{"promoted method", at("Dist()", 1), at("Dist()", 0)},
+		{"promoted field", at("X\n", 0), at("X, Y", 0)},
+		{"embedded field", at("Point.Y", 0), at("Point\n", 0)},
+		{"field of embedded field", at("Y)", 0), at("Y int", 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: test.ref})
+			fatalIfError(t, err)
+			if got == nil || got.Definition.Range == nil {
+				t.Fatal("expected a definition")
+			}
+			if have := (types.Point{Row: got.Definition.Range.Row, Column: got.Definition.Range.Column}); have != test.def {
+				t.Fatalf("expected the definition at %v, got %v", test.def, have)
+			}
+		})
+	}
+}
+
+func TestGoGenerateHeuristic(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+
+	contents, err := readFile(context.Background(), types.RepoCommitPath{Repo: "go1", Path: "store/store.go"})
+	fatalIfError(t, err)
+	row, column := -1, -1
+	for i, line := range strings.Split(string(contents), "\n") {
+		if strings.HasPrefix(line, "//go:generate") {
+			row, column = i, strings.LastIndex(line, "Store")
+		}
+	}
+	if row == -1 {
+		t.Fatal("no go:generate directive in fixture")
+	}
+	point := types.RepoCommitPathPoint{
+		RepoCommitPath: types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "store/store.go"},
+		Point:          types.Point{Row: row, Column: column},
+	}
+
+	disabled := New(readFile, nil)
+	defer disabled.Close()
+	got, err := disabled.symbolInfo(context.Background(), point)
+	fatalIfError(t, err)
+	if got != nil {
+		t.Fatalf("expected no definition with the heuristic disabled, got %s", got)
+	}
+
+	enabled := New(readFile, nil, WithGoGenerateHeuristic())
+	defer enabled.Close()
+	got, err = enabled.symbolInfo(context.Background(), point)
+	fatalIfError(t, err)
+	if got == nil || got.Definition.Range == nil {
+		t.Fatal("expected a definition with the heuristic enabled")
+	}
+	if !got.LowConfidence {
+		t.Fatal("expected the definition to be marked as low-confidence")
+	}
+}
+
+func TestGoMockResolution(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+
+	// Index the symbols of the package for the symbol search.
+	indexer := New(readFile, nil)
+	defer indexer.Close()
+	allSymbols := result.Symbols{}
+	for _, name := range []string{"store.go", "store_test.go", "mock_store_test.go"} {
+		symbols, err := indexer.getSymbols(context.Background(), types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "mockuse/" + name})
+		fatalIfError(t, err)
+		allSymbols = append(allSymbols, symbols...)
+	}
+	symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		results := result.Symbols{}
+		for _, symbol := range allSymbols {
+			if match, _ := regexp.MatchString(args.Query, symbol.Name); !match {
+				continue
+			}
+			if args.ExcludePattern != "" {
+				if match, _ := regexp.MatchString(args.ExcludePattern, symbol.Path); match {
+					continue
+				}
+			}
+			results = append(results, symbol)
+		}
+		return results, nil
+	}
+
+	// Returns the position of the definition of the Get in s.Get("key") in the given file.
+	resolve := func(squirrel *SquirrelService, path string) string {
+		t.Helper()
+		contents, err := readFile(context.Background(), types.RepoCommitPath{Repo: "go1", Path: path})
+		fatalIfError(t, err)
+		for row, line := range strings.Split(string(contents), "\n") {
+			column := strings.Index(line, "s.Get(")
+			if column == -1 {
+				continue
+			}
+			point := types.RepoCommitPathPoint{
+				RepoCommitPath: types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: path},
+				Point:          types.Point{Row: row, Column: column + len("s.")},
+			}
+			info, err := squirrel.symbolInfo(context.Background(), point)
+			fatalIfError(t, err)
+			if info == nil || info.Definition.Range == nil {
+				t.Fatalf("no definition for Get in %s", path)
+			}
+			return fmt.Sprintf("%s:%d", info.Definition.Path, info.Definition.Row)
+		}
+		t.Fatalf("no call to Get in %s", path)
+		return ""
+	}
+
+	const iface = "mockuse/store.go:4"
+	const mock = "mockuse/mock_store_test.go:15"
+
+	disabled := New(readFile, symbolSearch)
+	defer disabled.Close()
+	if got := resolve(disabled, "mockuse/store_test.go"); got != iface {
+		t.Errorf("disabled: want the interface method %s, got %s", iface, got)
+	}
+
+	enabled := New(readFile, symbolSearch, WithGoMockResolution())
+	defer enabled.Close()
+	if got := resolve(enabled, "mockuse/store_test.go"); got != mock {
+		t.Errorf("enabled in a test file: want the mock method %s, got %s", mock, got)
+	}
+	if got := resolve(enabled, "mockuse/store.go"); got != iface {
+		t.Errorf("enabled outside of tests: want the interface method %s, got %s", iface, got)
+	}
+}
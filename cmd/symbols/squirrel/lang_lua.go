@@ -0,0 +1,431 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// getDefLua finds the definition of an identifier or a require()d module path.
+//
+// The Lua grammar produces a flat tree where a.b.c is a sequence of sibling identifiers, so field
+// accesses are recovered from the text preceding the identifier rather than from the tree.
+func (squirrel *SquirrelService) getDefLua(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	switch node.Type() {
+	case "string", "string_argument":
+		moduleName := requireArgLua(node)
+		if moduleName == "" {
+			return nil, nil
+		}
+		module, err := squirrel.findModuleLua(ctx, node, moduleName)
+		if err != nil || module == nil {
+			return nil, err
+		}
+		return &Node{RepoCommitPath: module.RepoCommitPath}, nil
+
+	case "identifier":
+		chain := fieldChainLua(node)
+		if chain == nil {
+			squirrel.breadcrumb(node, "getDefLua: unsupported expression before identifier")
+			return nil, nil
+		}
+
+		head, err := squirrel.getDefInScopeLua(ctx, node, chain[0])
+		if err != nil || head == nil || len(chain) == 1 {
+			return head, err
+		}
+		return squirrel.getFieldLua(ctx, *head, chain[1:])
+
+	// No other nodes have a definition
+	default:
+		return nil, nil
+	}
+}
+
+// fieldChainLua returns the names in a dotted expression like a.b.c that end at the identifier, or
+// nil if the expression starts with something other than a name, like f().c.
+func fieldChainLua(node Node) []string {
+	chain := []string{textLua(node.Node, node.Contents)}
+	i := int(node.StartByte())
+	for {
+		j := skipSpaceBackwardLua(node.Contents, i)
+		if j == 0 || (node.Contents[j-1] != '.' && node.Contents[j-1] != ':') {
+			return chain
+		}
+		// .. is string concatenation
+		if j >= 2 && node.Contents[j-2] == '.' {
+			return chain
+		}
+		end := skipSpaceBackwardLua(node.Contents, j-1)
+		start := end
+		for start > 0 && isIdentByte(node.Contents[start-1]) {
+			start--
+		}
+		if start == end {
+			return nil
+		}
+		chain = append([]string{string(node.Contents[start:end])}, chain...)
+		i = start
+	}
+}
+
+func skipSpaceBackwardLua(contents []byte, i int) int {
+	for i > 0 && (contents[i-1] == ' ' || contents[i-1] == '\t') {
+		i--
+	}
+	return i
+}
+
+// getDefInScopeLua finds the definition of a name by looking at locals in enclosing blocks,
+// parameters, loop variables, and finally globals.
+func (squirrel *SquirrelService) getDefInScopeLua(ctx context.Context, node Node, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(ident), lazyNodeStringer(&ret))()
+
+	prev := node.Node
+	for cur := node.Parent(); cur != nil; prev, cur = cur, cur.Parent() {
+		switch cur.Type() {
+		case "function_statement", "function":
+			for _, child := range children(cur) {
+				if child.Type() != "parameter_list" {
+					continue
+				}
+				for _, param := range children(child) {
+					if param.Type() == "identifier" && textLua(param, node.Contents) == ident {
+						return swapNodePtr(node, param), nil
+					}
+				}
+			}
+			continue
+
+		case "for_statement":
+			for _, clause := range children(cur) {
+				vars := []*sitter.Node{}
+				switch clause.Type() {
+				case "for_numeric":
+					if v := clause.ChildByFieldName("var"); v != nil {
+						vars = append(vars, v)
+					}
+				case "for_generic":
+					if list := clause.ChildByFieldName("identifier_list"); list != nil {
+						vars = children(list)
+					}
+				}
+				for _, v := range vars {
+					if textLua(v, node.Contents) == ident {
+						return swapNodePtr(node, v), nil
+					}
+				}
+			}
+		}
+
+		// Look for locals declared before the current statement, nearest first. A local function
+		// is also visible in its own body.
+		stmts := children(cur)
+		for i := len(stmts) - 1; i >= 0; i-- {
+			stmt := stmts[i]
+			if nodeId(stmt) == nodeId(prev) && stmt.Type() != "function_statement" {
+				continue
+			}
+			if stmt.StartByte() > prev.StartByte() {
+				continue
+			}
+			if found := localDefLua(stmt, ident, node.Contents); found != nil {
+				return swapNodePtr(node, found), nil
+			}
+		}
+
+		if cur.Type() == "program" {
+			if found := findFieldLua(swapNode(node, cur), []string{ident}); found != nil {
+				return found, nil
+			}
+			// Globals can be defined in any file.
+			return squirrel.symbolSearchFirst(ctx, node.RepoCommitPath.Repo, node.RepoCommitPath.Commit,
+				[]string{`\.lua$`}, "", regexp.QuoteMeta(ident), func(result.Symbol) bool { return true })
+		}
+	}
+
+	squirrel.breadcrumb(node, "getDefInScopeLua: ran out of parents")
+	return nil, nil
+}
+
+// localDefLua returns the name declared by a local statement if it matches ident.
+func localDefLua(stmt *sitter.Node, ident string, contents []byte) *sitter.Node {
+	if !isLocalLua(stmt) {
+		return nil
+	}
+	switch stmt.Type() {
+	case "variable_declaration":
+		for _, name := range declaratorsLua(stmt) {
+			if ids := identsLua(name); len(ids) == 1 && textLua(ids[0], contents) == ident {
+				return ids[0]
+			}
+		}
+	case "function_statement":
+		name := stmt.ChildByFieldName("name")
+		if name != nil && name.Type() == "identifier" && textLua(name, contents) == ident {
+			return name
+		}
+	}
+	return nil
+}
+
+// getFieldLua finds the definition of a field path like b.c on the value defined by def.
+func (squirrel *SquirrelService) getFieldLua(ctx context.Context, def Node, fields []string) (ret *Node, err error) {
+	defer squirrel.onCall(def, String(strings.Join(fields, ".")), lazyNodeStringer(&ret))()
+
+	// Follow local x = require("mod") into the module.
+	if value := valueOfDeclaratorLua(def); value != nil {
+		if moduleName := requireCallLua(swapNode(def, value)); moduleName != "" {
+			module, err := squirrel.findModuleLua(ctx, def, moduleName)
+			if err != nil || module == nil {
+				return nil, err
+			}
+			exported := moduleReturnLua(*module)
+			if exported == nil {
+				squirrel.breadcrumb(*module, "getFieldLua: module does not return a value")
+				return nil, nil
+			}
+			if exported.Type() == "tableconstructor" {
+				return findInTableLua(swapNode(*module, exported), fields), nil
+			}
+			return findFieldLua(*module, append([]string{textLua(exported, module.Contents)}, fields...)), nil
+		}
+	}
+
+	root := swapNode(def, getRoot(def.Node))
+	return findFieldLua(root, append([]string{textLua(def.Node, def.Contents)}, fields...)), nil
+}
+
+// findFieldLua finds the definition of a dotted path like M.a.b in a file: a function M.a.b(), an
+// assignment M.a.b = ..., or a field of a table constructor assigned to a prefix of the path.
+func findFieldLua(file Node, path []string) *Node {
+	var found *sitter.Node
+	walkFilter(file.Node, func(n *sitter.Node) bool {
+		if found != nil {
+			return false
+		}
+		switch n.Type() {
+		case "function_statement":
+			// Local functions are found by getDefInScopeLua.
+			name := n.ChildByFieldName("name")
+			if name == nil || name.Type() != "function_name" {
+				return true
+			}
+			ids := identsLua(name)
+			if identsEqualLua(ids, path, file.Contents) {
+				found = ids[len(ids)-1]
+				return false
+			}
+		case "variable_declaration":
+			values := valuesLua(n)
+			for i, declarator := range declaratorsLua(n) {
+				ids := identsLua(declarator)
+				if len(ids) == 1 && isLocalLua(n) && nodeId(n.Parent()) != nodeId(file.Node) {
+					continue
+				}
+				if identsEqualLua(ids, path, file.Contents) {
+					found = ids[len(ids)-1]
+					return false
+				}
+				if i < len(values) && values[i].Type() == "tableconstructor" && len(ids) < len(path) && identsEqualLua(ids, path[:len(ids)], file.Contents) {
+					if field := findInTableLua(swapNode(file, values[i]), path[len(ids):]); field != nil {
+						found = field.Node
+						return false
+					}
+				}
+			}
+		}
+		return true
+	})
+	if found == nil {
+		return nil
+	}
+	return swapNodePtr(file, found)
+}
+
+// findInTableLua finds a field path in a table constructor like { a = { b = 1 } }.
+func findInTableLua(table Node, path []string) *Node {
+	for _, fieldList := range children(table.Node) {
+		for _, field := range children(fieldList) {
+			if field.Type() != "field" {
+				continue
+			}
+			name := field.ChildByFieldName("name")
+			if name == nil || textLua(name, table.Contents) != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				return swapNodePtr(table, name)
+			}
+			value := field.ChildByFieldName("value")
+			if value == nil || value.Type() != "tableconstructor" {
+				return nil
+			}
+			return findInTableLua(swapNode(table, value), path[1:])
+		}
+	}
+	return nil
+}
+
+// findModuleLua finds the file for a module name like a.b, which is a/b.lua or a/b/init.lua
+// relative to some unknown source root.
+func (squirrel *SquirrelService) findModuleLua(ctx context.Context, node Node, moduleName string) (*Node, error) {
+	pattern := fmt.Sprintf(`(^|/)%s(\.lua|/init\.lua)$`, regexp.QuoteMeta(strings.ReplaceAll(moduleName, ".", "/")))
+	symbols, err := squirrel.symbolSearch(ctx, search.SymbolsParameters{
+		Repo:            api.RepoName(node.RepoCommitPath.Repo),
+		CommitID:        api.CommitID(node.RepoCommitPath.Commit),
+		Query:           ".*",
+		IsRegExp:        true,
+		IsCaseSensitive: true,
+		IncludePatterns: []string{pattern},
+		First:           1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) == 0 {
+		squirrel.breadcrumb(node, "findModuleLua: no module "+moduleName)
+		return nil, nil
+	}
+	return squirrel.parse(ctx, types.RepoCommitPath{
+		Repo:   node.RepoCommitPath.Repo,
+		Commit: node.RepoCommitPath.Commit,
+		Path:   symbols[0].Path,
+	})
+}
+
+// moduleReturnLua returns the value a module returns, e.g. M in return M.
+func moduleReturnLua(module Node) *sitter.Node {
+	for _, child := range children(module.Node) {
+		if child.Type() == "module_return_statement" && child.NamedChildCount() > 0 {
+			return child.NamedChild(0)
+		}
+	}
+	return nil
+}
+
+// requireArgLua returns the module name if the string is the argument of require().
+func requireArgLua(str Node) string {
+	call := str.Parent()
+	if call != nil && call.Type() == "function_arguments" {
+		call = call.Parent()
+	}
+	if call == nil {
+		return ""
+	}
+	return requireCallLua(swapNode(str, call))
+}
+
+// requireCallLua returns the module name if the node is a call like require("mod") or require "mod".
+func requireCallLua(call Node) string {
+	if call.Type() != "function_call" {
+		return ""
+	}
+	prefix := call.ChildByFieldName("prefix")
+	if prefix == nil || textLua(prefix, call.Contents) != "require" {
+		return ""
+	}
+	var arg *sitter.Node
+	for _, child := range children(call.Node) {
+		switch child.Type() {
+		case "string_argument":
+			arg = child
+		case "function_arguments":
+			if child.NamedChildCount() == 1 && child.NamedChild(0).Type() == "string" {
+				arg = child.NamedChild(0)
+			}
+		}
+	}
+	if arg == nil {
+		return ""
+	}
+	return strings.Trim(textLua(arg, call.Contents), `"'`)
+}
+
+// valueOfDeclaratorLua returns the value assigned to the name in local x = value.
+func valueOfDeclaratorLua(name Node) *sitter.Node {
+	declarator := name.Parent()
+	if declarator == nil || declarator.Type() != "variable_declarator" {
+		return nil
+	}
+	declaration := declarator.Parent()
+	if declaration == nil {
+		return nil
+	}
+	values := valuesLua(declaration)
+	for i, d := range declaratorsLua(declaration) {
+		if nodeId(d) == nodeId(declarator) && i < len(values) {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+func isLocalLua(stmt *sitter.Node) bool {
+	for _, child := range children(stmt) {
+		if child.Type() == "local" {
+			return true
+		}
+	}
+	return false
+}
+
+func declaratorsLua(declaration *sitter.Node) []*sitter.Node {
+	declarators := []*sitter.Node{}
+	for _, child := range children(declaration) {
+		if child.Type() == "variable_declarator" {
+			declarators = append(declarators, child)
+		}
+	}
+	return declarators
+}
+
+func valuesLua(declaration *sitter.Node) []*sitter.Node {
+	values := []*sitter.Node{}
+	for _, child := range children(declaration) {
+		switch child.Type() {
+		case "local", "variable_declarator", "comment":
+		default:
+			values = append(values, child)
+		}
+	}
+	return values
+}
+
+func identsLua(node *sitter.Node) []*sitter.Node {
+	ids := []*sitter.Node{}
+	for _, child := range children(node) {
+		if child.Type() == "identifier" {
+			ids = append(ids, child)
+		}
+	}
+	return ids
+}
+
+// textLua returns the text of a node. The Lua grammar sometimes includes the whitespace before a
+// token in the token.
+func textLua(node *sitter.Node, contents []byte) string {
+	return strings.TrimSpace(node.Content(contents))
+}
+
+func identsEqualLua(ids []*sitter.Node, path []string, contents []byte) bool {
+	if len(ids) != len(path) {
+		return false
+	}
+	for i, id := range ids {
+		if textLua(id, contents) != path[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,93 @@
+package squirrel
+
+import (
+	"bytes"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// mojoDeclRegex matches the Mojo keywords that start a declaration line.
+var mojoDeclRegex = regexp.MustCompile(`^([ \t]*)(fn|struct|trait|var|let|alias)[ \t]`)
+
+// mojoHeaderRegex matches the parts of a Mojo function header that Python doesn't have: argument
+// conventions, raises, and compile-time parameters in brackets after the name.
+var mojoHeaderRegex = regexp.MustCompile(`\b(inout|owned|borrowed|mut|read|ref|out|deinit)[ \t]+\w|\braises\b|^[ \t]*(def|fn)[ \t]+\w+(\[[^\]\n]*\])`)
+
+// rewriteMojo rewrites Mojo declarations to Python that declares the same names at the same
+// positions:
+//
+//   - struct and trait become class
+//   - var, let and alias become an empty statement before the name, e.g. var x = 1 becomes 0  ;x = 1
+//   - argument conventions, raises and compile-time parameters are blanked out
+//   - fn becomes def, which is one byte longer, so an edit maps the tree back to the original
+func rewriteMojo(contents []byte) ([]byte, []sitter.EditInput) {
+	rewritten := make([]byte, 0, len(contents)+len(contents)/64)
+	var edits []sitter.EditInput
+	for row, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		line = append([]byte{}, line...)
+
+		if m := mojoHeaderRegex.FindAllSubmatchIndex(line, -1); m != nil && isMojoFunctionHeader(line) {
+			for _, match := range m {
+				switch {
+				case match[2] != -1:
+					// Keep the argument name.
+					blank(line[match[2]:match[3]])
+				case match[6] != -1:
+					blank(line[match[6]:match[7]])
+				default:
+					blank(line[match[0]:match[1]])
+				}
+			}
+		}
+
+		if m := mojoDeclRegex.FindSubmatchIndex(line); m != nil {
+			indent, keyword := m[3], string(line[m[4]:m[5]])
+			switch keyword {
+			case "fn":
+				start := uint32(len(rewritten) + indent)
+				column := uint32(indent)
+				edits = append(edits, sitter.EditInput{
+					StartIndex:  start,
+					OldEndIndex: start + 3,
+					NewEndIndex: start + 2,
+					StartPoint:  sitter.Point{Row: uint32(row), Column: column},
+					OldEndPoint: sitter.Point{Row: uint32(row), Column: column + 3},
+					NewEndPoint: sitter.Point{Row: uint32(row), Column: column + 2},
+				})
+				line = append(append(line[:indent:indent], "def"...), line[m[5]:]...)
+			case "struct":
+				copy(line[indent:], "class ")
+			case "trait":
+				copy(line[indent:], "class")
+			default:
+				// The keyword and the space after it.
+				empty := line[indent:m[1]]
+				blank(empty)
+				empty[0] = '0'
+				empty[len(empty)-1] = ';'
+			}
+		}
+
+		rewritten = append(rewritten, line...)
+	}
+
+	// Later edits first, so that the positions of earlier ones still hold.
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return rewritten, edits
+}
+
+// isMojoFunctionHeader returns true if the line starts a function declaration.
+func isMojoFunctionHeader(line []byte) bool {
+	trimmed := bytes.TrimLeft(line, " \t")
+	return bytes.HasPrefix(trimmed, []byte("fn ")) || bytes.HasPrefix(trimmed, []byte("def "))
+}
+
+// blank overwrites b with spaces.
+func blank(b []byte) {
+	for i := range b {
+		b[i] = ' '
+	}
+}
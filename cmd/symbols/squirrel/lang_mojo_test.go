@@ -0,0 +1,44 @@
+package squirrel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRewriteMojo(t *testing.T) {
+	contents := strings.Join([]string{
+		"struct Point:",
+		"    var x: Int",
+		"    fn move(inout self, owned by: Int) raises:",
+		"        let d = by",
+		"fn id[T: AnyType](x: T) -> T:",
+		"    return x",
+		"alias N = 3",
+		"",
+	}, "\n")
+	want := strings.Join([]string{
+		"class  Point:",
+		"    0  ;x: Int",
+		"    def move(      self,       by: Int)       :",
+		"        0  ;d = by",
+		"def id            (x: T) -> T:",
+		"    return x",
+		"0    ;N = 3",
+		"",
+	}, "\n")
+
+	rewritten, edits := rewriteMojo([]byte(contents))
+	if diff := cmp.Diff(want, string(rewritten)); diff != "" {
+		t.Fatalf("unexpected rewrite (-want +got):\n%s", diff)
+	}
+
+	// Every line keeps its length except for fn, which becomes def.
+	if len(rewritten) != len(contents)+len(edits) || len(edits) != 2 {
+		t.Fatalf("expected an edit for each fn, got %d edits", len(edits))
+	}
+	if edits[0].StartIndex < edits[1].StartIndex {
+		t.Fatal("expected later edits first")
+	}
+}
@@ -0,0 +1,456 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// namespaceOcaml is one of the namespaces OCaml names live in. The same name can refer to a value, a
+// type, a constructor and a module at once.
+type namespaceOcaml string
+
+const (
+	valueNamespaceOcaml       namespaceOcaml = "value"
+	typeNamespaceOcaml        namespaceOcaml = "type"
+	constructorNamespaceOcaml namespaceOcaml = "constructor"
+	moduleNamespaceOcaml      namespaceOcaml = "module"
+)
+
+// namespaceOfOcaml returns the namespace of a name node, or the empty string if it's not a name.
+func namespaceOfOcaml(nodeType string) namespaceOcaml {
+	switch nodeType {
+	case "value_name", "value_pattern":
+		return valueNamespaceOcaml
+	case "type_constructor":
+		return typeNamespaceOcaml
+	case "constructor_name":
+		return constructorNamespaceOcaml
+	case "module_name":
+		return moduleNamespaceOcaml
+	default:
+		return ""
+	}
+}
+
+// getDefOcaml finds the definition of a value, type, constructor or module name.
+//
+// Modules are either defined in the file or are files themselves, in which case the definition is
+// the file. Unqualified names are looked up in enclosing scopes, honoring open.
+func (squirrel *SquirrelService) getDefOcaml(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	ns := namespaceOfOcaml(node.Type())
+	parent := node.Parent()
+	if ns == "" || parent == nil {
+		return nil, nil
+	}
+
+	if isDefOcaml(node.Node) {
+		return &node, nil
+	}
+
+	ident := node.Content(node.Contents)
+	switch parent.Type() {
+	case "module_path", "extended_module_path":
+		module, err := squirrel.getModuleOcaml(ctx, swapNode(node, parent))
+		if err != nil || module == nil {
+			return nil, err
+		}
+		return moduleDefOcaml(*module), nil
+
+	case "value_path", "type_constructor_path", "constructor_path":
+		qualifier := qualifierOcaml(parent)
+		if qualifier == nil {
+			break
+		}
+		module, err := squirrel.getModuleOcaml(ctx, swapNode(node, qualifier))
+		if err != nil || module == nil {
+			return nil, err
+		}
+		items, err := squirrel.moduleItemsOcaml(ctx, *module)
+		if err != nil || items == nil {
+			return nil, err
+		}
+		return squirrel.findInItemsOcaml(ctx, *items, ns, ident, nil)
+	}
+
+	return squirrel.getDefInScopeOcaml(ctx, node, ns, ident)
+}
+
+// isDefOcaml returns true if the name node is where the name is defined rather than a reference.
+func isDefOcaml(node *sitter.Node) bool {
+	parent := node.Parent()
+	switch node.Type() {
+	case "value_pattern":
+		return true
+	case "value_name":
+		return parent.Type() != "value_path"
+	case "type_constructor":
+		return parent.Type() == "type_binding"
+	case "constructor_name":
+		return parent.Type() == "constructor_declaration"
+	case "module_name":
+		return parent.Type() == "module_binding" || parent.Type() == "module_parameter"
+	default:
+		return false
+	}
+}
+
+// qualifierOcaml returns the module path before the name in a path like M.x, or nil if the path is
+// a bare name.
+func qualifierOcaml(path *sitter.Node) *sitter.Node {
+	if path.NamedChildCount() < 2 {
+		return nil
+	}
+	first := path.NamedChild(0)
+	if first.Type() != "module_path" && first.Type() != "extended_module_path" {
+		return nil
+	}
+	return first
+}
+
+// getModuleOcaml resolves a module path like A.B to the definition of the module, which is either the
+// name in a module binding or the root of a file.
+func (squirrel *SquirrelService) getModuleOcaml(ctx context.Context, path Node) (ret *Node, err error) {
+	defer squirrel.onCall(path, String(path.Content(path.Contents)), lazyNodeStringer(&ret))()
+
+	var qualifier, name *sitter.Node
+	for _, child := range children(path.Node) {
+		switch child.Type() {
+		case "module_path", "extended_module_path":
+			qualifier = child
+		case "module_name":
+			name = child
+		}
+	}
+	if name == nil {
+		squirrel.breadcrumb(path, "getModuleOcaml: unsupported module path")
+		return nil, nil
+	}
+	ident := name.Content(path.Contents)
+
+	if qualifier != nil {
+		outer, err := squirrel.getModuleOcaml(ctx, swapNode(path, qualifier))
+		if err != nil || outer == nil {
+			return nil, err
+		}
+		items, err := squirrel.moduleItemsOcaml(ctx, *outer)
+		if err != nil || items == nil {
+			return nil, err
+		}
+		return squirrel.findInItemsOcaml(ctx, *items, moduleNamespaceOcaml, ident, nil)
+	}
+
+	def, err := squirrel.getDefInScopeOcaml(ctx, swapNode(path, name), moduleNamespaceOcaml, ident)
+	if err != nil || def != nil {
+		return def, err
+	}
+	return squirrel.findFileModuleOcaml(ctx, path, ident)
+}
+
+// moduleDefOcaml returns the definition to report for a module. File modules are reported as the
+// file rather than a position in it.
+func moduleDefOcaml(module Node) *Node {
+	if module.Type() == "compilation_unit" {
+		return &Node{RepoCommitPath: module.RepoCommitPath}
+	}
+	return &module
+}
+
+// moduleItemsOcaml returns the node whose children are the items of a module, following aliases
+// like module M = N. It returns nil for modules it can't see into, like functor applications.
+func (squirrel *SquirrelService) moduleItemsOcaml(ctx context.Context, module Node) (ret *Node, err error) {
+	defer squirrel.onCall(module, String(module.Type()), lazyNodeStringer(&ret))()
+
+	if module.Type() == "compilation_unit" {
+		return &module, nil
+	}
+
+	binding := module.Parent()
+	if binding == nil || binding.Type() != "module_binding" {
+		return nil, nil
+	}
+	body := binding.ChildByFieldName("body")
+	if body == nil {
+		return nil, nil
+	}
+	switch body.Type() {
+	case "structure":
+		return swapNodePtr(module, body), nil
+	case "module_path":
+		alias, err := squirrel.getModuleOcaml(ctx, swapNode(module, body))
+		if err != nil || alias == nil {
+			return nil, err
+		}
+		return squirrel.moduleItemsOcaml(ctx, *alias)
+	default:
+		squirrel.breadcrumb(swapNode(module, body), "moduleItemsOcaml: unsupported module body")
+		return nil, nil
+	}
+}
+
+// getDefInScopeOcaml finds the definition of an unqualified name by walking up the enclosing scopes,
+// looking at parameters, pattern variables, let bindings, opened modules and module items.
+func (squirrel *SquirrelService) getDefInScopeOcaml(ctx context.Context, node Node, ns namespaceOcaml, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(ident), lazyNodeStringer(&ret))()
+
+	prev := node.Node
+	for cur := node.Parent(); cur != nil; prev, cur = cur, cur.Parent() {
+		switch cur.Type() {
+		case "let_binding", "fun_expression":
+			if ns != valueNamespaceOcaml {
+				continue
+			}
+			for _, child := range children(cur) {
+				if child.Type() != "parameter" || nodeId(child) == nodeId(prev) {
+					continue
+				}
+				if def := findInPatternOcaml(child, ident, node.Contents); def != nil {
+					return swapNodePtr(node, def), nil
+				}
+			}
+
+		case "match_case":
+			pattern := cur.ChildByFieldName("pattern")
+			if ns != valueNamespaceOcaml || pattern == nil || nodeId(pattern) == nodeId(prev) {
+				continue
+			}
+			if def := findInPatternOcaml(pattern, ident, node.Contents); def != nil {
+				return swapNodePtr(node, def), nil
+			}
+
+		case "module_binding":
+			if ns != moduleNamespaceOcaml {
+				continue
+			}
+			// Functor parameters are in scope in the body.
+			for _, child := range children(cur) {
+				if child.Type() != "module_parameter" {
+					continue
+				}
+				for _, name := range children(child) {
+					if name.Type() == "module_name" && name.Content(node.Contents) == ident {
+						return swapNodePtr(node, name), nil
+					}
+				}
+			}
+
+		case "let_expression", "let_open_expression", "structure", "compilation_unit":
+			def, err := squirrel.findInItemsOcaml(ctx, swapNode(node, cur), ns, ident, prev)
+			if err != nil || def != nil {
+				return def, err
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// findInItemsOcaml finds the definition of a name among the items of a structure, a file, or the
+// bindings of a let ... in or let open ... in expression.
+//
+// When from is nil, the name is being looked up from outside, so the last definition wins and
+// opened modules are ignored because open doesn't export anything. Otherwise, only items before
+// from are visible, including the item containing from if it's a let rec, and opened modules are
+// searched too.
+func (squirrel *SquirrelService) findInItemsOcaml(ctx context.Context, items Node, ns namespaceOcaml, ident string, from *sitter.Node) (ret *Node, err error) {
+	defer squirrel.onCall(items, String(ident), lazyNodeStringer(&ret))()
+
+	all := children(items.Node)
+	for i := len(all) - 1; i >= 0; i-- {
+		item := all[i]
+
+		if from != nil && item.StartByte() > from.StartByte() {
+			continue
+		}
+		contains := from != nil && nodeId(item) == nodeId(from)
+		if contains && !isRecOcaml(item) {
+			continue
+		}
+
+		if def := itemDefOcaml(item, ns, ident, items.Contents); def != nil {
+			return swapNodePtr(items, def), nil
+		}
+
+		switch item.Type() {
+		case "open_module":
+			if from == nil {
+				continue
+			}
+		case "include_module":
+		default:
+			continue
+		}
+		var path *sitter.Node
+		for _, child := range children(item) {
+			if child.Type() == "module_path" {
+				path = child
+			}
+		}
+		if path == nil {
+			continue
+		}
+		module, err := squirrel.getModuleOcaml(ctx, swapNode(items, path))
+		if err != nil {
+			return nil, err
+		}
+		if module == nil {
+			continue
+		}
+		moduleItems, err := squirrel.moduleItemsOcaml(ctx, *module)
+		if err != nil {
+			return nil, err
+		}
+		if moduleItems == nil {
+			continue
+		}
+		def, err := squirrel.findInItemsOcaml(ctx, *moduleItems, ns, ident, nil)
+		if err != nil || def != nil {
+			return def, err
+		}
+	}
+
+	return nil, nil
+}
+
+// isRecOcaml returns true if the item is a let rec, whose bindings are visible in themselves.
+func isRecOcaml(item *sitter.Node) bool {
+	if item.Type() != "value_definition" {
+		return false
+	}
+	for i := 0; i < int(item.ChildCount()); i++ {
+		if item.Child(i).Type() == "rec" {
+			return true
+		}
+	}
+	return false
+}
+
+// itemDefOcaml returns the name node if the item defines the name in the namespace.
+func itemDefOcaml(item *sitter.Node, ns namespaceOcaml, ident string, contents []byte) *sitter.Node {
+	matches := func(name *sitter.Node) bool {
+		return name != nil && name.Content(contents) == ident
+	}
+
+	switch ns {
+	case valueNamespaceOcaml:
+		switch item.Type() {
+		case "value_definition":
+			for _, binding := range children(item) {
+				if binding.Type() != "let_binding" {
+					continue
+				}
+				if pattern := binding.ChildByFieldName("pattern"); pattern != nil {
+					if def := findInPatternOcaml(pattern, ident, contents); def != nil {
+						return def
+					}
+				}
+			}
+		case "external":
+			for _, child := range children(item) {
+				if child.Type() == "value_name" && matches(child) {
+					return child
+				}
+			}
+		}
+
+	case typeNamespaceOcaml:
+		if item.Type() == "type_definition" {
+			for _, binding := range children(item) {
+				if name := binding.ChildByFieldName("name"); binding.Type() == "type_binding" && matches(name) {
+					return name
+				}
+			}
+		}
+
+	case constructorNamespaceOcaml:
+		var decls []*sitter.Node
+		switch item.Type() {
+		case "type_definition":
+			for _, binding := range children(item) {
+				if body := binding.ChildByFieldName("body"); binding.Type() == "type_binding" && body != nil && body.Type() == "variant_declaration" {
+					decls = append(decls, children(body)...)
+				}
+			}
+		case "exception_definition":
+			decls = children(item)
+		}
+		for _, decl := range decls {
+			if decl.Type() != "constructor_declaration" {
+				continue
+			}
+			for _, name := range children(decl) {
+				if name.Type() == "constructor_name" && matches(name) {
+					return name
+				}
+			}
+		}
+
+	case moduleNamespaceOcaml:
+		if item.Type() == "module_definition" {
+			for _, binding := range children(item) {
+				if name := binding.ChildByFieldName("name"); binding.Type() == "module_binding" && matches(name) {
+					return name
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// findInPatternOcaml returns the variable in the pattern that binds the name, skipping expressions
+// nested in the pattern like the default value of an optional parameter.
+func findInPatternOcaml(pattern *sitter.Node, ident string, contents []byte) *sitter.Node {
+	switch pattern.Type() {
+	case "value_name", "value_pattern":
+		if pattern.Content(contents) == ident {
+			return pattern
+		}
+		return nil
+	case "value_path", "type_constructor_path":
+		return nil
+	}
+	for _, child := range children(pattern) {
+		if def := findInPatternOcaml(child, ident, contents); def != nil {
+			return def
+		}
+	}
+	return nil
+}
+
+// findFileModuleOcaml finds the file that defines a top-level module. Module Foo is defined in foo.ml
+// or Foo.ml anywhere in the repository.
+func (squirrel *SquirrelService) findFileModuleOcaml(ctx context.Context, node Node, moduleName string) (*Node, error) {
+	first, rest := moduleName[:1], moduleName[1:]
+	pattern := fmt.Sprintf(`(^|/)[%s%s]%s\.ml$`, regexp.QuoteMeta(strings.ToLower(first)), regexp.QuoteMeta(first), regexp.QuoteMeta(rest))
+	symbols, err := squirrel.symbolSearch(ctx, search.SymbolsParameters{
+		Repo:            api.RepoName(node.RepoCommitPath.Repo),
+		CommitID:        api.CommitID(node.RepoCommitPath.Commit),
+		Query:           ".*",
+		IsRegExp:        true,
+		IsCaseSensitive: true,
+		IncludePatterns: []string{pattern},
+		First:           1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) == 0 {
+		squirrel.breadcrumb(node, "findFileModuleOcaml: no module "+moduleName)
+		return nil, nil
+	}
+	return squirrel.parse(ctx, types.RepoCommitPath{
+		Repo:   node.RepoCommitPath.Repo,
+		Commit: node.RepoCommitPath.Commit,
+		Path:   symbols[0].Path,
+	})
+}
@@ -0,0 +1,646 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+func (squirrel *SquirrelService) getDefPython(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	switch node.Type() {
+	case "identifier":
+		ident := node.Content(node.Contents)
+
+		// Check for attribute access like self.x or Foo.bar
+		parent := node.Parent()
+		if parent != nil && parent.Type() == "attribute" {
+			object := parent.ChildByFieldName("object")
+			attribute := parent.ChildByFieldName("attribute")
+			if object != nil && attribute != nil && nodeId(attribute) == nodeId(node.Node) {
+				return squirrel.getFieldPython(ctx, swapNode(node, object), ident)
+			}
+		}
+
+		// Check for names imported with from ... import ...
+		if importFrom := findAncestor(node.Node, "import_from_statement"); importFrom != nil {
+			moduleName := importFrom.ChildByFieldName("module_name")
+			if moduleName != nil && isAncestor(moduleName, node.Node) {
+				squirrel.breadcrumb(node, "getDefPython: module names are not supported")
+				return nil, nil
+			}
+			return squirrel.followImportPython(ctx, node)
+		}
+
+		cur := node.Node
+		inFunction := false
+		for {
+			prev := cur
+			cur = cur.Parent()
+			if cur == nil {
+				squirrel.breadcrumb(node, "getDefPython: ran out of parents")
+				return nil, nil
+			}
+
+			switch cur.Type() {
+			case "module":
+				found := findDefInScopePython(swapNode(node, cur), ident)
+				if found == nil {
+					if builtinsPython[ident] {
+						squirrel.markExternal(node, "builtins."+ident)
+					}
+					squirrel.breadcrumb(node, "getDefPython: not found in module")
+					return nil, nil
+				}
+				return squirrel.followImportPython(ctx, *found)
+
+			case "function_definition":
+				// The name of the function belongs to the enclosing scope.
+				name := cur.ChildByFieldName("name")
+				if name != nil && nodeId(name) == nodeId(prev) {
+					continue
+				}
+				if found := findParamPython(swapNode(node, cur), ident); found != nil {
+					return found, nil
+				}
+				body := cur.ChildByFieldName("body")
+				if body != nil {
+					if found := findDefInScopePython(swapNode(node, body), ident); found != nil {
+						return squirrel.followImportPython(ctx, *found)
+					}
+				}
+				inFunction = true
+				continue
+
+			case "lambda":
+				if found := findParamPython(swapNode(node, cur), ident); found != nil {
+					return found, nil
+				}
+				inFunction = true
+				continue
+
+			case "class_definition":
+				// The class body is not visible from within its methods.
+				if inFunction {
+					continue
+				}
+				body := cur.ChildByFieldName("body")
+				if body != nil && nodeId(body) == nodeId(prev) {
+					if found := findDefInScopePython(swapNode(node, body), ident); found != nil {
+						return squirrel.followImportPython(ctx, *found)
+					}
+				}
+				continue
+
+			case "list_comprehension":
+				fallthrough
+			case "set_comprehension":
+				fallthrough
+			case "dictionary_comprehension":
+				fallthrough
+			case "generator_expression":
+				query := `[
+					(for_in_clause left: (identifier) @ident)
+					(for_in_clause left: (pattern_list (identifier) @ident))
+					(for_in_clause left: (tuple_pattern (identifier) @ident))
+				]`
+				captures, err := allCaptures(query, swapNode(node, cur))
+				if err != nil {
+					return nil, err
+				}
+				for _, capture := range captures {
+					if capture.Content(capture.Contents) == ident {
+						return swapNodePtr(node, capture.Node), nil
+					}
+				}
+				continue
+
+			// Skip all other nodes
+			default:
+				continue
+			}
+		}
+
+	// No other nodes have a definition
+	default:
+		return nil, nil
+	}
+}
+
+// Commonly used names in Python's builtins module.
+var builtinsPython = map[string]bool{
+	"abs": true, "all": true, "any": true, "bool": true, "bytes": true, "callable": true, "dict": true,
+	"dir": true, "enumerate": true, "Exception": true, "filter": true, "float": true, "frozenset": true,
+	"getattr": true, "hasattr": true, "hash": true, "id": true, "input": true, "int": true,
+	"isinstance": true, "issubclass": true, "iter": true, "len": true, "list": true, "map": true,
+	"max": true, "min": true, "next": true, "object": true, "open": true, "print": true,
+	"property": true, "range": true, "repr": true, "reversed": true, "round": true, "set": true,
+	"setattr": true, "sorted": true, "staticmethod": true, "classmethod": true, "str": true,
+	"sum": true, "super": true, "tuple": true, "type": true, "zip": true, "None": true,
+	"True": true, "False": true, "KeyError": true, "ValueError": true, "TypeError": true,
+}
+
+// findParamPython looks for a parameter with the given name in a function or lambda.
+func findParamPython(fn Node, ident string) *Node {
+	params := fn.ChildByFieldName("parameters")
+	if params == nil {
+		return nil
+	}
+	for _, param := range children(params) {
+		name := param
+		switch param.Type() {
+		case "identifier":
+		case "typed_parameter":
+			name = param.NamedChild(0)
+		case "default_parameter":
+			fallthrough
+		case "typed_default_parameter":
+			name = param.ChildByFieldName("name")
+		case "list_splat_pattern":
+			fallthrough
+		case "dictionary_splat_pattern":
+			name = param.NamedChild(0)
+		default:
+			continue
+		}
+		if name == nil || name.Type() != "identifier" {
+			continue
+		}
+		if name.Content(fn.Contents) == ident {
+			return swapNodePtr(fn, name)
+		}
+	}
+	return nil
+}
+
+// findDefInScopePython looks for a binding of the given name in a scope (a module, class body, or
+// function body) without descending into nested scopes.
+func findDefInScopePython(scope Node, ident string) *Node {
+	var found *sitter.Node
+	check := func(n *sitter.Node) {
+		if found == nil && n != nil && n.Type() == "identifier" && n.Content(scope.Contents) == ident {
+			found = n
+		}
+	}
+	walkFilter(scope.Node, func(n *sitter.Node) bool {
+		if found != nil {
+			return false
+		}
+		switch n.Type() {
+		case "function_definition":
+			fallthrough
+		case "class_definition":
+			check(n.ChildByFieldName("name"))
+			return nodeId(n) == nodeId(scope.Node)
+		case "lambda":
+			return false
+		case "assignment":
+			checkPatternPython(n.ChildByFieldName("left"), check)
+		case "for_statement":
+			checkPatternPython(n.ChildByFieldName("left"), check)
+		case "import_from_statement":
+			for _, name := range importedNamesPython(n) {
+				check(name)
+			}
+			return false
+		case "import_statement":
+			for _, name := range importedNamesPython(n) {
+				check(name)
+			}
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return nil
+	}
+	return swapNodePtr(scope, found)
+}
+
+// checkPatternPython calls check on every identifier bound by an assignment target.
+func checkPatternPython(pattern *sitter.Node, check func(*sitter.Node)) {
+	if pattern == nil {
+		return
+	}
+	switch pattern.Type() {
+	case "identifier":
+		check(pattern)
+	case "pattern_list":
+		fallthrough
+	case "tuple_pattern":
+		fallthrough
+	case "list_pattern":
+		for _, child := range children(pattern) {
+			checkPatternPython(child, check)
+		}
+	}
+}
+
+// importedNamesPython returns the identifiers that an import statement binds.
+func importedNamesPython(importNode *sitter.Node) []*sitter.Node {
+	names := []*sitter.Node{}
+	moduleName := importNode.ChildByFieldName("module_name")
+	for _, child := range children(importNode) {
+		if moduleName != nil && nodeId(child) == nodeId(moduleName) {
+			continue
+		}
+		switch child.Type() {
+		case "aliased_import":
+			if alias := child.ChildByFieldName("alias"); alias != nil {
+				names = append(names, alias)
+			}
+		case "dotted_name":
+			if importNode.Type() == "import_from_statement" {
+				names = append(names, child.NamedChild(int(child.NamedChildCount())-1))
+			} else {
+				names = append(names, child.NamedChild(0))
+			}
+		}
+	}
+	return names
+}
+
+// followImportPython resolves a binding created by an import to its definition in the imported
+// module, and returns other bindings as-is.
+func (squirrel *SquirrelService) followImportPython(ctx context.Context, def Node) (*Node, error) {
+	importFrom := findAncestor(def.Node, "import_from_statement")
+	if importFrom == nil {
+		return &def, nil
+	}
+
+	name := def.Content(def.Contents)
+	if parent := def.Parent(); parent != nil && parent.Type() == "aliased_import" {
+		if original := parent.ChildByFieldName("name"); original != nil {
+			name = original.Content(def.Contents)
+		}
+	}
+
+	found, err := squirrel.getDefInModulePython(ctx, swapNode(def, importFrom), name)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return &def, nil
+	}
+	return found, nil
+}
+
+// getDefInModulePython finds the top-level definition of ident in the module imported by the given
+// import_from_statement.
+func (squirrel *SquirrelService) getDefInModulePython(ctx context.Context, importFrom Node, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(importFrom, &Tuple{String(importFrom.Type()), String(ident)}, lazyNodeStringer(&ret))()
+
+	moduleName := importFrom.ChildByFieldName("module_name")
+	if moduleName == nil {
+		return nil, nil
+	}
+
+	return squirrel.symbolSearchOne(
+		ctx,
+		importFrom.RepoCommitPath.Repo,
+		importFrom.RepoCommitPath.Commit,
+		[]string{modulePathPatternPython(importFrom.RepoCommitPath.Path, moduleName, importFrom.Contents)},
+		ident,
+	)
+}
+
+// modulePathPatternPython returns a regex that matches the file path(s) of a Python module.
+func modulePathPatternPython(currentPath string, moduleName *sitter.Node, contents []byte) string {
+	components := []string{}
+	dots := 0
+	walk(moduleName, func(n *sitter.Node) {
+		switch n.Type() {
+		case "import_prefix":
+			dots = len(n.Content(contents))
+		case "identifier":
+			components = append(components, n.Content(contents))
+		}
+	})
+
+	suffix := regexp.QuoteMeta(strings.Join(components, "/"))
+	if len(components) == 0 {
+		suffix = "__init__"
+	}
+	exts := `\.py`
+	if langSpec, _ := langSpecForPath(currentPath); langSpec.name == "mojo" {
+		// Mojo can import both Mojo and Python modules.
+		exts = `\.(mojo|🔥|py)`
+	}
+	suffix += "(" + exts + "|/__init__" + exts + ")$"
+
+	if dots == 0 {
+		// Absolute imports are relative to some unknown source root.
+		return "(^|/)" + suffix
+	}
+
+	dir := filepath.Dir(currentPath)
+	for i := 1; i < dots; i++ {
+		dir = filepath.Dir(dir)
+	}
+	if dir == "." {
+		return "^" + suffix
+	}
+	return fmt.Sprintf("^%s/%s", regexp.QuoteMeta(dir), suffix)
+}
+
+func (squirrel *SquirrelService) getFieldPython(ctx context.Context, object Node, field string) (ret *Node, err error) {
+	defer squirrel.onCall(object, &Tuple{String(object.Type()), String(field)}, lazyNodeStringer(&ret))()
+
+	ty, err := squirrel.getTypeDefPython(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	if ty == nil {
+		return nil, nil
+	}
+	return squirrel.lookupFieldPython(ctx, ty, field)
+}
+
+func (squirrel *SquirrelService) lookupFieldPython(ctx context.Context, ty Type, field string) (ret *Node, err error) {
+	defer squirrel.onCall(ty.node(), &Tuple{String(ty.variant()), String(field)}, lazyNodeStringer(&ret))()
+
+	switch ty2 := ty.(type) {
+	case ClassType:
+		body := ty2.def.ChildByFieldName("body")
+		if body == nil {
+			return nil, nil
+		}
+
+		// Methods, properties, nested classes, and class attributes
+		if found := findDefInScopePython(swapNode(ty2.def, body), field); found != nil {
+			return squirrel.followImportPython(ctx, *found)
+		}
+
+		// Instance attributes assigned through the receiver, e.g. self.x = ...
+		for _, child := range children(body) {
+			fn := unwrapDecoratedPython(child)
+			if fn == nil || fn.Type() != "function_definition" {
+				continue
+			}
+			receiver := receiverNamePython(swapNode(ty2.def, fn))
+			if receiver == "" {
+				continue
+			}
+			var found *Node
+			walk(fn, func(n *sitter.Node) {
+				if found != nil || n.Type() != "assignment" {
+					return
+				}
+				left := n.ChildByFieldName("left")
+				if left == nil || left.Type() != "attribute" {
+					return
+				}
+				object := left.ChildByFieldName("object")
+				attribute := left.ChildByFieldName("attribute")
+				if object == nil || attribute == nil {
+					return
+				}
+				if object.Content(ty2.def.Contents) == receiver && attribute.Content(ty2.def.Contents) == field {
+					found = swapNodePtr(ty2.def, attribute)
+				}
+			})
+			if found != nil {
+				return found, nil
+			}
+		}
+
+		// Inherited members, in method resolution order (depth-first, left to right)
+		for _, super := range getSuperclassesPython(ty2.def) {
+			superTy, err := squirrel.getTypeDefPython(ctx, super)
+			if err != nil {
+				return nil, err
+			}
+			if superTy == nil {
+				continue
+			}
+			found, err := squirrel.lookupFieldPython(ctx, superTy, field)
+			if err != nil {
+				return nil, err
+			}
+			if found != nil {
+				return found, nil
+			}
+		}
+		return nil, nil
+	default:
+		squirrel.breadcrumb(ty.node(), fmt.Sprintf("lookupFieldPython: unexpected object type %s", ty.variant()))
+		return nil, nil
+	}
+}
+
+func (squirrel *SquirrelService) getTypeDefPython(ctx context.Context, node Node) (ret Type, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyTypeStringer(&ret))()
+
+	switch node.Type() {
+	case "identifier":
+		found, err := squirrel.getDefPython(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, nil
+		}
+		return squirrel.defToTypePython(ctx, *found)
+	case "attribute":
+		object := node.ChildByFieldName("object")
+		attribute := node.ChildByFieldName("attribute")
+		if object == nil || attribute == nil {
+			return nil, nil
+		}
+		found, err := squirrel.getFieldPython(ctx, swapNode(node, object), attribute.Content(node.Contents))
+		if err != nil {
+			return nil, err
+		}
+		if found == nil {
+			return nil, nil
+		}
+		return squirrel.defToTypePython(ctx, *found)
+	case "call":
+		function := node.ChildByFieldName("function")
+		if function == nil {
+			return nil, nil
+		}
+		if function.Type() == "identifier" && function.Content(node.Contents) == "super" {
+			class := findAncestor(node.Node, "class_definition")
+			if class == nil {
+				return nil, nil
+			}
+			supers := getSuperclassesPython(swapNode(node, class))
+			if len(supers) == 0 {
+				return nil, nil
+			}
+			return squirrel.getTypeDefPython(ctx, supers[0])
+		}
+		ty, err := squirrel.getTypeDefPython(ctx, swapNode(node, function))
+		if err != nil {
+			return nil, err
+		}
+		if ty == nil {
+			return nil, nil
+		}
+		switch ty2 := ty.(type) {
+		case ClassType:
+			return ty2, nil
+		case FnType:
+			return ty2.ret, nil
+		default:
+			squirrel.breadcrumb(ty.node(), fmt.Sprintf("getTypeDefPython: expected class or function, got %q", ty.variant()))
+			return nil, nil
+		}
+	case "type":
+		if node.NamedChildCount() == 0 {
+			return nil, nil
+		}
+		return squirrel.getTypeDefPython(ctx, swapNode(node, node.NamedChild(0)))
+	case "parenthesized_expression":
+		if node.NamedChildCount() == 0 {
+			return nil, nil
+		}
+		return squirrel.getTypeDefPython(ctx, swapNode(node, node.NamedChild(0)))
+	default:
+		squirrel.breadcrumb(node, fmt.Sprintf("getTypeDefPython: unrecognized node type %q", node.Type()))
+		return nil, nil
+	}
+}
+
+func (squirrel *SquirrelService) defToTypePython(ctx context.Context, def Node) (Type, error) {
+	parent := def.Node.Parent()
+	if parent == nil {
+		return nil, nil
+	}
+	switch parent.Type() {
+	case "class_definition":
+		return (Type)(ClassType{def: swapNode(def, parent)}), nil
+	case "function_definition":
+		fnType := FnType{noad: swapNode(def, parent)}
+		if retTyNode := parent.ChildByFieldName("return_type"); retTyNode != nil {
+			retTy, err := squirrel.getTypeDefPython(ctx, swapNode(def, retTyNode))
+			if err != nil {
+				return nil, err
+			}
+			fnType.ret = retTy
+		}
+		// Accessing a property evaluates to its return value.
+		if isPropertyPython(swapNode(def, parent)) {
+			return fnType.ret, nil
+		}
+		return (Type)(fnType), nil
+	case "parameters":
+		// The first parameter of a method is the receiver (self or cls).
+		fn := parent.Parent()
+		if fn == nil || fn.Type() != "function_definition" || parent.NamedChildCount() == 0 || nodeId(parent.NamedChild(0)) != nodeId(def.Node) {
+			return nil, nil
+		}
+		class := enclosingClassOfMethodPython(fn)
+		if class == nil {
+			return nil, nil
+		}
+		return (Type)(ClassType{def: swapNode(def, class)}), nil
+	case "typed_parameter":
+		fallthrough
+	case "typed_default_parameter":
+		tyNode := parent.ChildByFieldName("type")
+		if tyNode == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefPython(ctx, swapNode(def, tyNode))
+	case "assignment":
+		if tyNode := parent.ChildByFieldName("type"); tyNode != nil {
+			return squirrel.getTypeDefPython(ctx, swapNode(def, tyNode))
+		}
+		right := parent.ChildByFieldName("right")
+		if right == nil {
+			return nil, nil
+		}
+		return squirrel.getTypeDefPython(ctx, swapNode(def, right))
+	case "attribute":
+		// An instance attribute like self.x = ...
+		grandparent := parent.Parent()
+		if grandparent == nil || grandparent.Type() != "assignment" {
+			return nil, nil
+		}
+		return squirrel.defToTypePython(ctx, swapNode(def, parent))
+	default:
+		squirrel.breadcrumb(swapNode(def, parent), fmt.Sprintf("defToTypePython: unrecognized def parent %q", parent.Type()))
+		return nil, nil
+	}
+}
+
+// receiverNamePython returns the name of the first parameter of a method (usually self or cls).
+func receiverNamePython(fn Node) string {
+	params := fn.ChildByFieldName("parameters")
+	if params == nil || params.NamedChildCount() == 0 {
+		return ""
+	}
+	first := params.NamedChild(0)
+	if first.Type() != "identifier" {
+		return ""
+	}
+	return first.Content(fn.Contents)
+}
+
+// enclosingClassOfMethodPython returns the class_definition that directly contains the given
+// function_definition, or nil if it's not a method.
+func enclosingClassOfMethodPython(fn *sitter.Node) *sitter.Node {
+	cur := fn.Parent()
+	if cur != nil && cur.Type() == "decorated_definition" {
+		cur = cur.Parent()
+	}
+	if cur == nil || cur.Type() != "block" {
+		return nil
+	}
+	cur = cur.Parent()
+	if cur == nil || cur.Type() != "class_definition" {
+		return nil
+	}
+	return cur
+}
+
+// unwrapDecoratedPython returns the definition inside a decorated_definition.
+func unwrapDecoratedPython(node *sitter.Node) *sitter.Node {
+	if node.Type() == "decorated_definition" {
+		return node.ChildByFieldName("definition")
+	}
+	return node
+}
+
+// isPropertyPython returns true if the function_definition is decorated with @property.
+func isPropertyPython(fn Node) bool {
+	decorated := fn.Parent()
+	if decorated == nil || decorated.Type() != "decorated_definition" {
+		return false
+	}
+	for _, child := range children(decorated) {
+		if child.Type() != "decorator" || child.NamedChildCount() == 0 {
+			continue
+		}
+		decorator := child.NamedChild(0)
+		if decorator.Type() == "identifier" && decorator.Content(fn.Contents) == "property" {
+			return true
+		}
+	}
+	return false
+}
+
+// getSuperclassesPython returns the base class expressions of a class_definition.
+func getSuperclassesPython(class Node) []Node {
+	supers := []Node{}
+	superclasses := class.ChildByFieldName("superclasses")
+	if superclasses == nil {
+		return supers
+	}
+	for _, child := range children(superclasses) {
+		switch child.Type() {
+		case "identifier":
+			fallthrough
+		case "attribute":
+			supers = append(supers, swapNode(class, child))
+		}
+	}
+	return supers
+}
@@ -0,0 +1,119 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestPythonMembers(t *testing.T) {
+	contents := `class Animal:
+    legs = 4
+
+    def speak(self):
+        return "..."
+
+    def describe(self):
+        return self.speak()
+
+
+class Dog(Animal):
+    kind = "dog"
+
+    def __init__(self, name):
+        self.name = name
+
+    def speak(self):
+        return self.name + super().speak()
+
+    @property
+    def title(self):
+        return self.name.title()
+
+    @classmethod
+    def create(cls):
+        return cls(cls.kind + str(cls.legs))
+
+    @classmethod
+    def puppy(cls):
+        return cls.create()
+
+    def show(self):
+        return self.title + self.describe()
+
+
+class Puppy(Dog):
+    def wag(self):
+        return self.legs
+
+
+d = Dog("rex")
+d.title
+d.describe()
+Puppy.create()
+`
+	path := types.RepoCommitPath{Repo: "animals", Commit: "abc", Path: "animals.py"}
+	readFile := func(ctx context.Context, p types.RepoCommitPath) ([]byte, error) {
+		if p.Path != path.Path {
+			return nil, os.ErrNotExist
+		}
+		return []byte(contents), nil
+	}
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+
+	// at returns the point of the nth occurrence of needle, counting from 0.
+	at := func(needle string, n int) types.Point {
+		offset := 0
+		for i := 0; ; i++ {
+			j := strings.Index(contents[offset:], needle)
+			if j < 0 {
+				t.Fatalf("occurrence %d of %q not found", n, needle)
+			}
+			if i == n {
+				offset += j
+				break
+			}
+			offset += j + len(needle)
+		}
+		return types.Point{
+			Row:    strings.Count(contents[:offset], "\n"),
+			Column: offset - (strings.LastIndex(contents[:offset], "\n") + 1),
+		}
+	}
+
+	tests := []struct {
+		name string
+		ref  types.Point
+		def  types.Point
+	}{
+		{"self attribute", at("name + super", 0), at("name = name", 0)},
+		{"self attribute in another method", at("name.title", 0), at("name = name", 0)},
+		{"self method", at("speak()\n\n\nclass Dog", 0), at("speak(self)", 0)},
+		{"super method", at("speak()\n\n    @property", 0), at("speak(self)", 0)},
+		{"cls attribute", at("kind +", 0), at("kind =", 0)},
+		{"inherited cls attribute", at("legs))", 0), at("legs =", 0)},
+		{"cls method", at("create()\n\n    def show", 0), at("create(cls)", 0)},
+		{"property on self", at("title +", 0), at("title(self)", 0)},
+		{"property on an instance", at("title\nd.", 0), at("title(self)", 0)},
+		{"inherited method on self", at("describe()\n\n\nclass Puppy", 0), at("describe(self)", 0)},
+		{"inherited method on an instance", at("describe()\nPuppy", 0), at("describe(self)", 0)},
+		{"attribute inherited twice", at("legs\n", 0), at("legs =", 0)},
+		{"classmethod inherited by a subclass", at("create()\n", 1), at("create(cls)", 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: test.ref})
+			fatalIfError(t, err)
+			if got == nil || got.Definition.Range == nil {
+				t.Fatal("expected a definition")
+			}
+			if have := (types.Point{Row: got.Definition.Range.Row, Column: got.Definition.Range.Column}); have != test.def {
+				t.Fatalf("expected the definition at %v, got %v", test.def, have)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// getDefShader finds the definition of a name in CUDA, GLSL or HLSL, which are parsed with the C++
+// grammar. Names are looked up in enclosing blocks, parameters, the top level of the file, and then
+// the top level of #included files. An #include path resolves to the included file.
+func (squirrel *SquirrelService) getDefShader(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	switch node.Type() {
+	case "identifier", "type_identifier":
+		return squirrel.getDefInScopeShader(ctx, node, node.Content(node.Contents))
+
+	case "string_literal", "system_lib_string":
+		parent := node.Parent()
+		if parent == nil || parent.Type() != "preproc_include" {
+			return nil, nil
+		}
+		file, err := squirrel.findIncludeShader(ctx, node, includePathShader(node))
+		if err != nil || file == nil {
+			return nil, err
+		}
+		return &Node{RepoCommitPath: file.RepoCommitPath}, nil
+
+	// No other nodes have a definition
+	default:
+		return nil, nil
+	}
+}
+
+// getDefInScopeShader walks up from the node to the top of the file looking for a declaration of
+// the name.
+func (squirrel *SquirrelService) getDefInScopeShader(ctx context.Context, node Node, ident string) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(ident), lazyNodeStringer(&ret))()
+
+	for cur := node.Parent(); cur != nil; cur = cur.Parent() {
+		switch cur.Type() {
+		case "compound_statement":
+			// Only declarations up to the reference are in scope.
+			for _, child := range children(cur) {
+				if child.StartByte() > node.StartByte() {
+					break
+				}
+				if found := findInDeclarationShader(child, ident, node.Contents); found != nil {
+					return swapNodePtr(node, found), nil
+				}
+			}
+
+		case "for_statement":
+			if init := cur.ChildByFieldName("initializer"); init != nil {
+				if found := findInDeclarationShader(init, ident, node.Contents); found != nil {
+					return swapNodePtr(node, found), nil
+				}
+			}
+
+		case "function_definition":
+			if found := findParamShader(cur, ident, node.Contents); found != nil {
+				return swapNodePtr(node, found), nil
+			}
+
+		case "translation_unit":
+			return squirrel.findInFileShader(ctx, swapNode(node, cur), ident, map[string]struct{}{})
+		}
+	}
+
+	return nil, nil
+}
+
+// findInFileShader looks for a top-level declaration of the name in the file, then in the files it
+// #includes. Visited files are skipped so that include cycles terminate.
+func (squirrel *SquirrelService) findInFileShader(ctx context.Context, file Node, ident string, visited map[string]struct{}) (*Node, error) {
+	if _, ok := visited[file.RepoCommitPath.Path]; ok {
+		return nil, nil
+	}
+	visited[file.RepoCommitPath.Path] = struct{}{}
+
+	// Prefer definitions over prototypes and extern declarations.
+	var prototype *sitter.Node
+	for _, child := range children(file.Node) {
+		found := findInDeclarationShader(child, ident, file.Contents)
+		if found == nil {
+			continue
+		}
+		if child.Type() == "declaration" && isFunctionDeclarationShader(child) {
+			if prototype == nil {
+				prototype = found
+			}
+			continue
+		}
+		return swapNodePtr(file, found), nil
+	}
+
+	for _, child := range children(file.Node) {
+		if child.Type() != "preproc_include" {
+			continue
+		}
+		pathNode := child.ChildByFieldName("path")
+		if pathNode == nil {
+			continue
+		}
+		included, err := squirrel.findIncludeShader(ctx, swapNode(file, pathNode), includePathShader(swapNode(file, pathNode)))
+		if err != nil {
+			return nil, err
+		}
+		if included == nil {
+			continue
+		}
+		found, err := squirrel.findInFileShader(ctx, *included, ident, visited)
+		if err != nil || found != nil {
+			return found, err
+		}
+	}
+
+	if prototype != nil {
+		return swapNodePtr(file, prototype), nil
+	}
+	return nil, nil
+}
+
+// findIncludeShader finds the file for an #include path, first relative to the including file and
+// then anywhere in the repository, since include directories are configured in the build.
+func (squirrel *SquirrelService) findIncludeShader(ctx context.Context, node Node, includePath string) (*Node, error) {
+	if includePath == "" {
+		return nil, nil
+	}
+
+	relative := path.Join(path.Dir(node.RepoCommitPath.Path), includePath)
+	for _, pattern := range []string{
+		fmt.Sprintf("^%s$", regexp.QuoteMeta(relative)),
+		fmt.Sprintf("(^|/)%s$", regexp.QuoteMeta(path.Clean(includePath))),
+	} {
+		symbols, err := squirrel.symbolSearch(ctx, search.SymbolsParameters{
+			Repo:            api.RepoName(node.RepoCommitPath.Repo),
+			CommitID:        api.CommitID(node.RepoCommitPath.Commit),
+			Query:           ".*",
+			IsRegExp:        true,
+			IsCaseSensitive: true,
+			IncludePatterns: []string{pattern},
+			First:           1,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(symbols) == 0 {
+			continue
+		}
+		return squirrel.parse(ctx, types.RepoCommitPath{
+			Repo:   node.RepoCommitPath.Repo,
+			Commit: node.RepoCommitPath.Commit,
+			Path:   symbols[0].Path,
+		})
+	}
+
+	squirrel.breadcrumb(node, "findIncludeShader: no file "+includePath)
+	return nil, nil
+}
+
+// includePathShader returns the path in an #include "path" or #include <path>.
+func includePathShader(node Node) string {
+	return strings.Trim(node.Content(node.Contents), `"<>`)
+}
+
+// findInDeclarationShader returns the name node if the node declares the name.
+func findInDeclarationShader(node *sitter.Node, ident string, contents []byte) *sitter.Node {
+	matches := func(name *sitter.Node) bool {
+		return name != nil && name.Content(contents) == ident
+	}
+
+	switch node.Type() {
+	case "declaration", "field_declaration":
+		if ty := node.ChildByFieldName("type"); ty != nil && ty.Type() == "struct_specifier" {
+			if found := findInDeclarationShader(ty, ident, contents); found != nil {
+				return found
+			}
+		}
+		if name := qualifiedNameShader(node); name != nil {
+			if matches(name) {
+				return name
+			}
+			return nil
+		}
+		for _, child := range children(node) {
+			if name := declaratorNameShader(child); matches(name) {
+				return name
+			}
+		}
+
+	case "function_definition":
+		if name := declaratorNameShader(node.ChildByFieldName("declarator")); matches(name) {
+			return name
+		}
+
+	case "struct_specifier":
+		// Only a struct with a body declares it, struct S x; refers to it.
+		if node.ChildByFieldName("body") == nil {
+			return nil
+		}
+		if name := node.ChildByFieldName("name"); matches(name) {
+			return name
+		}
+
+	case "type_definition":
+		if ty := node.ChildByFieldName("type"); ty != nil && ty.Type() == "struct_specifier" {
+			if found := findInDeclarationShader(ty, ident, contents); found != nil {
+				return found
+			}
+		}
+		if name := node.ChildByFieldName("declarator"); matches(name) {
+			return name
+		}
+
+	case "preproc_def", "preproc_function_def":
+		if name := node.ChildByFieldName("name"); matches(name) {
+			return name
+		}
+	}
+
+	return nil
+}
+
+// qualifiedNameShader returns the name in a declaration with qualifiers the C++ grammar doesn't
+// know, like uniform vec3 x; in GLSL. Depending on how the grammar recovers, the name is either the
+// declarator or inside an ERROR after it, but either way it is the last identifier. Returns nil if
+// the declaration parsed cleanly.
+func qualifiedNameShader(declaration *sitter.Node) *sitter.Node {
+	var last *sitter.Node
+	hasError := false
+	for _, child := range children(declaration) {
+		switch child.Type() {
+		case "ERROR":
+			hasError = true
+			for _, grandchild := range children(child) {
+				if grandchild.Type() == "identifier" {
+					last = grandchild
+				}
+			}
+		case "identifier":
+			last = child
+		}
+	}
+	if !hasError {
+		return nil
+	}
+	return last
+}
+
+// findParamShader returns the parameter of the function with the given name.
+func findParamShader(function *sitter.Node, ident string, contents []byte) *sitter.Node {
+	declarator := function.ChildByFieldName("declarator")
+	for declarator != nil && declarator.Type() != "function_declarator" {
+		declarator = innerDeclaratorShader(declarator)
+	}
+	if declarator == nil {
+		return nil
+	}
+	params := declarator.ChildByFieldName("parameters")
+	if params == nil {
+		return nil
+	}
+	for _, param := range children(params) {
+		if name := declaratorNameShader(param.ChildByFieldName("declarator")); name != nil && name.Content(contents) == ident {
+			return name
+		}
+	}
+	return nil
+}
+
+// isFunctionDeclarationShader returns true for prototypes like void f(int x);
+func isFunctionDeclarationShader(declaration *sitter.Node) bool {
+	for _, child := range children(declaration) {
+		for cur := child; cur != nil; cur = innerDeclaratorShader(cur) {
+			if cur.Type() == "function_declarator" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// declaratorNameShader returns the name declared by a declarator like *x, x[4], x = 1 or f(int y).
+func declaratorNameShader(declarator *sitter.Node) *sitter.Node {
+	for cur := declarator; cur != nil; cur = innerDeclaratorShader(cur) {
+		if cur.Type() == "identifier" || cur.Type() == "field_identifier" {
+			return cur
+		}
+	}
+	return nil
+}
+
+// innerDeclaratorShader returns the declarator nested in the given one, or nil if there is none.
+func innerDeclaratorShader(declarator *sitter.Node) *sitter.Node {
+	switch declarator.Type() {
+	case "init_declarator", "pointer_declarator", "array_declarator", "function_declarator":
+		return declarator.ChildByFieldName("declarator")
+	case "reference_declarator", "parenthesized_declarator":
+		if declarator.NamedChildCount() > 0 {
+			return declarator.NamedChild(0)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestShaderSymbols(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+
+	for path, want := range map[string][]string{
+		"shaders/main.frag":              {"lightDir", "sun", "normal", "color", "main"},
+		"shaders/include/lighting.glsl":  {"Light", "shade"},
+		"shaders/include/constants.glsl": {"AMBIENT"},
+		"cuda/kernel.cu":                 {"scale", "launch"},
+		"hlsl/common.hlsli":              {"tint"},
+	} {
+		symbols, err := squirrel.getSymbols(context.Background(), types.RepoCommitPath{Repo: "shader1", Commit: "abc", Path: path})
+		fatalIfError(t, err)
+		got := []string{}
+		for _, symbol := range symbols {
+			got = append(got, symbol.Name)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected symbols in %s (-want +got):\n%s", path, diff)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package squirrel
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/grafana/regexp"
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// getDefStarlark finds definitions in Bazel BUILD and .bzl files. Besides Python-style names, it
+// resolves labels of targets like //pkg:target and :target to the name of the target in its BUILD
+// file, and load() statements to the loaded file and its symbols.
+func (squirrel *SquirrelService) getDefStarlark(ctx context.Context, node Node) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	switch node.Type() {
+	case "string":
+		label := unquoteStarlark(node.Content(node.Contents))
+		load := loadCallStarlark(node.Node, node.Contents)
+		if load == nil {
+			return squirrel.getTargetStarlark(ctx, node, label)
+		}
+		// The first argument of load() is the file, the others are symbols in it.
+		args := load.ChildByFieldName("arguments")
+		if args != nil && args.NamedChildCount() > 0 && nodeId(args.NamedChild(0)) == nodeId(node.Node) {
+			return squirrel.getFileStarlark(ctx, node, label)
+		}
+		file := loadedFileStarlark(load, node.Contents)
+		return squirrel.getDefInFileStarlark(ctx, node, file, label)
+
+	case "identifier":
+		found, err := squirrel.getDefPython(ctx, node)
+		if err != nil || found != nil {
+			return found, err
+		}
+		return squirrel.getLoadedStarlark(ctx, node, node.Content(node.Contents))
+
+	default:
+		return nil, nil
+	}
+}
+
+// getLoadedStarlark finds the definition of a name bound by a load() statement at the top of the
+// file, either as load("//pkg:file.bzl", "name") or as load("//pkg:file.bzl", name = "original").
+func (squirrel *SquirrelService) getLoadedStarlark(ctx context.Context, node Node, ident string) (*Node, error) {
+	module := node.Node
+	for module.Parent() != nil {
+		module = module.Parent()
+	}
+
+	for _, statement := range children(module) {
+		if statement.Type() != "expression_statement" || statement.NamedChildCount() == 0 {
+			continue
+		}
+		load := statement.NamedChild(0)
+		if !isLoadCallStarlark(load, node.Contents) {
+			continue
+		}
+		args := load.ChildByFieldName("arguments")
+		if args == nil {
+			continue
+		}
+		for i, arg := range children(args) {
+			if i == 0 {
+				continue
+			}
+			switch {
+			case arg.Type() == "string" && unquoteStarlark(arg.Content(node.Contents)) == ident:
+				return squirrel.getDefInFileStarlark(ctx, node, loadedFileStarlark(load, node.Contents), ident)
+			case arg.Type() == "keyword_argument":
+				name := arg.ChildByFieldName("name")
+				value := arg.ChildByFieldName("value")
+				if name == nil || value == nil || value.Type() != "string" || name.Content(node.Contents) != ident {
+					continue
+				}
+				return squirrel.getDefInFileStarlark(ctx, node, loadedFileStarlark(load, node.Contents), unquoteStarlark(value.Content(node.Contents)))
+			}
+		}
+	}
+
+	squirrel.breadcrumb(node, "getLoadedStarlark: not loaded")
+	return nil, nil
+}
+
+// getFileStarlark returns the root of the file with the given label, relative to the file of the
+// node.
+func (squirrel *SquirrelService) getFileStarlark(ctx context.Context, node Node, label string) (*Node, error) {
+	pkg, target, ok := parseLabelStarlark(label, node.RepoCommitPath.Path)
+	if !ok {
+		squirrel.breadcrumb(node, "getFileStarlark: unsupported label")
+		return nil, nil
+	}
+	return squirrel.parse(ctx, types.RepoCommitPath{
+		Repo:   node.RepoCommitPath.Repo,
+		Commit: node.RepoCommitPath.Commit,
+		Path:   path.Join(pkg, target),
+	})
+}
+
+// getDefInFileStarlark finds the top-level definition of ident in the file with the given label.
+func (squirrel *SquirrelService) getDefInFileStarlark(ctx context.Context, node Node, fileLabel string, ident string) (*Node, error) {
+	pkg, target, ok := parseLabelStarlark(fileLabel, node.RepoCommitPath.Path)
+	if !ok {
+		squirrel.breadcrumb(node, "getDefInFileStarlark: unsupported label")
+		return nil, nil
+	}
+	return squirrel.symbolSearchOne(
+		ctx,
+		node.RepoCommitPath.Repo,
+		node.RepoCommitPath.Commit,
+		[]string{"^" + regexp.QuoteMeta(path.Join(pkg, target)) + "$"},
+		regexp.QuoteMeta(ident),
+	)
+}
+
+// getTargetStarlark finds the name of the target with the given label in its BUILD file.
+func (squirrel *SquirrelService) getTargetStarlark(ctx context.Context, node Node, label string) (*Node, error) {
+	pkg, target, ok := parseLabelStarlark(label, node.RepoCommitPath.Path)
+	if !ok {
+		squirrel.breadcrumb(node, "getTargetStarlark: not a label")
+		return nil, nil
+	}
+	dir := ""
+	if pkg != "" {
+		dir = regexp.QuoteMeta(pkg) + "/"
+	}
+	return squirrel.symbolSearchOne(
+		ctx,
+		node.RepoCommitPath.Repo,
+		node.RepoCommitPath.Commit,
+		[]string{"^" + dir + `BUILD(\.bazel)?$`},
+		regexp.QuoteMeta(target),
+	)
+}
+
+// parseLabelStarlark splits a label like //pkg:target, //pkg or :target into the package directory
+// and the target name. Relative labels are in the package of currentPath. Labels in other
+// repositories, like @repo//pkg:target, aren't supported.
+func parseLabelStarlark(label string, currentPath string) (pkg string, target string, ok bool) {
+	switch {
+	case strings.HasPrefix(label, "//"):
+		var found bool
+		pkg, target, found = strings.Cut(strings.TrimPrefix(label, "//"), ":")
+		if !found {
+			// //pkg is short for //pkg:pkg.
+			target = path.Base(pkg)
+		}
+		return pkg, target, target != ""
+	case strings.HasPrefix(label, ":"):
+		pkg = path.Dir(currentPath)
+		if pkg == "." {
+			pkg = ""
+		}
+		return pkg, strings.TrimPrefix(label, ":"), len(label) > 1
+	default:
+		return "", "", false
+	}
+}
+
+// loadCallStarlark returns the load() call that the string is an argument of, or nil.
+func loadCallStarlark(str *sitter.Node, contents []byte) *sitter.Node {
+	args := str.Parent()
+	if args != nil && args.Type() == "keyword_argument" {
+		args = args.Parent()
+	}
+	if args == nil || args.Type() != "argument_list" {
+		return nil
+	}
+	if call := args.Parent(); isLoadCallStarlark(call, contents) {
+		return call
+	}
+	return nil
+}
+
+// isLoadCallStarlark returns true if the node is a call to load().
+func isLoadCallStarlark(node *sitter.Node, contents []byte) bool {
+	if node == nil || node.Type() != "call" {
+		return false
+	}
+	fn := node.ChildByFieldName("function")
+	return fn != nil && fn.Type() == "identifier" && fn.Content(contents) == "load"
+}
+
+// loadedFileStarlark returns the label of the file loaded by a load() call.
+func loadedFileStarlark(load *sitter.Node, contents []byte) string {
+	args := load.ChildByFieldName("arguments")
+	if args == nil || args.NamedChildCount() == 0 {
+		return ""
+	}
+	return unquoteStarlark(args.NamedChild(0).Content(contents))
+}
+
+// unquoteStarlark returns the contents of a string literal.
+func unquoteStarlark(s string) string {
+	return strings.Trim(s, `"'`)
+}
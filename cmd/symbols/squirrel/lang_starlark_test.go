@@ -0,0 +1,56 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestParseLabelStarlark(t *testing.T) {
+	for _, tc := range []struct {
+		label  string
+		pkg    string
+		target string
+		ok     bool
+	}{
+		{label: "//lib:util", pkg: "lib", target: "util", ok: true},
+		{label: "//lib/util", pkg: "lib/util", target: "util", ok: true},
+		{label: "//:root", pkg: "", target: "root", ok: true},
+		{label: ":helpers", pkg: "app", target: "helpers", ok: true},
+		{label: "@other//lib:util", ok: false},
+		{label: "util.cc", ok: false},
+	} {
+		pkg, target, ok := parseLabelStarlark(tc.label, "app/BUILD.bazel")
+		if pkg != tc.pkg || target != tc.target || ok != tc.ok {
+			t.Errorf("%s: want (%q, %q, %t), got (%q, %q, %t)", tc.label, tc.pkg, tc.target, tc.ok, pkg, target, ok)
+		}
+	}
+}
+
+func TestLoadedFileStarlark(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	path := types.RepoCommitPath{Repo: "bazel1", Commit: "abc", Path: "app/BUILD.bazel"}
+	contents, err := readFile(context.Background(), path)
+	fatalIfError(t, err)
+	line := strings.Split(string(contents), "\n")[0]
+
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+	info, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{
+		RepoCommitPath: path,
+		Point:          types.Point{Row: 0, Column: strings.Index(line, "defs.bzl")},
+	})
+	fatalIfError(t, err)
+	if info == nil || info.Definition.Range == nil {
+		t.Fatal("expected the label of load() to resolve to the loaded file")
+	}
+	if info.Definition.Path != "tools/defs.bzl" || info.Definition.Row != 0 {
+		t.Fatalf("expected the start of tools/defs.bzl, got %s at row %d", info.Definition.Path, info.Definition.Row)
+	}
+}
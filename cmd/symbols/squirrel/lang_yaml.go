@@ -0,0 +1,315 @@
+package squirrel
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// getDefYaml finds the definition of the Ansible variable or role referenced at the given point.
+// YAML itself has no references beyond anchors, so this relies on Ansible conventions: variables are
+// referenced in Jinja expressions like {{ var }} and defined under vars:, set_fact:, register:, or
+// in a role's vars/main.yml and defaults/main.yml, and roles live in a roles/ directory.
+func (squirrel *SquirrelService) getDefYaml(ctx context.Context, node Node, point types.Point) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(node.Type()), lazyNodeStringer(&ret))()
+
+	switch node.Type() {
+	case "string_scalar", "double_quote_scalar", "single_quote_scalar":
+		if role := roleReferenceAnsible(node); role != "" {
+			return &Node{
+				RepoCommitPath: types.RepoCommitPath{
+					Repo:   node.RepoCommitPath.Repo,
+					Commit: node.RepoCommitPath.Commit,
+					Path:   filepath.Join(rolesDirAnsible(node.RepoCommitPath.Path), role),
+				},
+			}, nil
+		}
+
+		name := variableAtPointAnsible(node, point)
+		if name == "" {
+			return nil, nil
+		}
+		return squirrel.getVarDefAnsible(ctx, node, name)
+
+	// No other nodes have a definition
+	default:
+		return nil, nil
+	}
+}
+
+// variableAtPointAnsible returns the name of the variable referenced at the given point in a scalar,
+// or the empty string if the point isn't on a variable.
+func variableAtPointAnsible(scalar Node, point types.Point) string {
+	offset := pointToOffset(scalar.Contents, point) - int(scalar.StartByte())
+	text := scalar.Content(scalar.Contents)
+	if offset < 0 || offset >= len(text) {
+		return ""
+	}
+
+	// Only look inside Jinja expressions, or whole values of keys that take bare expressions.
+	open := strings.LastIndex(text[:offset], "{{")
+	inJinja := open != -1 && !strings.Contains(text[open:offset], "}}")
+	if !inJinja && !contains(bareExpressionKeysAnsible, keyOfValueYaml(scalar.Node, scalar.Contents)) {
+		return ""
+	}
+
+	start, end := wordAt(text, offset)
+	if start == end {
+		return ""
+	}
+	name := text[start:end]
+
+	// Skip attributes like x.y, filters like x | default, function calls like lookup(...), and
+	// keywords.
+	before := strings.TrimRight(text[:start], " ")
+	after := strings.TrimLeft(text[end:], " ")
+	if strings.HasSuffix(before, ".") || strings.HasSuffix(before, "|") || strings.HasPrefix(after, "(") {
+		return ""
+	}
+	if contains(jinjaKeywordsAnsible, name) || name[0] >= '0' && name[0] <= '9' {
+		return ""
+	}
+	return name
+}
+
+// Keys whose values are Jinja expressions without {{ }}.
+var bareExpressionKeysAnsible = []string{"when", "failed_when", "changed_when", "until", "that"}
+
+var jinjaKeywordsAnsible = []string{"and", "or", "not", "in", "is", "if", "else", "true", "false", "none", "True", "False", "None"}
+
+// getVarDefAnsible looks for the definition of a variable in the current file, the role that
+// contains the file, and the roles that the file applies.
+func (squirrel *SquirrelService) getVarDefAnsible(ctx context.Context, node Node, name string) (ret *Node, err error) {
+	defer squirrel.onCall(node, String(name), lazyNodeStringer(&ret))()
+
+	file := swapNode(node, getRoot(node.Node))
+	if found := findVarInFileAnsible(file, name); found != nil {
+		return found, nil
+	}
+
+	roles := []string{}
+	if role := enclosingRoleAnsible(node.RepoCommitPath.Path); role != "" {
+		roles = append(roles, role)
+	}
+	walk(file.Node, func(n *sitter.Node) {
+		if role := roleReferenceAnsible(swapNode(file, n)); role != "" && !contains(roles, role) {
+			roles = append(roles, role)
+		}
+	})
+
+	for _, role := range roles {
+		// Role vars take precedence over role defaults.
+		for _, dir := range []string{"vars", "defaults"} {
+			path := filepath.Join(rolesDirAnsible(node.RepoCommitPath.Path), role, dir, "main.yml")
+			varsFile, err := squirrel.parse(ctx, types.RepoCommitPath{
+				Repo:   node.RepoCommitPath.Repo,
+				Commit: node.RepoCommitPath.Commit,
+				Path:   path,
+			})
+			if err != nil {
+				squirrel.breadcrumb(node, "getVarDefAnsible: could not read "+path)
+				continue
+			}
+			for _, pair := range topLevelPairsYaml(varsFile.Node) {
+				key := scalarLeafYaml(pair.ChildByFieldName("key"))
+				if key != nil && scalarTextYaml(key, varsFile.Contents) == name {
+					return swapNodePtr(*varsFile, key), nil
+				}
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// findVarInFileAnsible looks for a variable defined under vars: or set_fact:, or by register:.
+func findVarInFileAnsible(file Node, name string) *Node {
+	var found *sitter.Node
+	walkFilter(file.Node, func(n *sitter.Node) bool {
+		if found != nil {
+			return false
+		}
+		if n.Type() != "block_mapping_pair" && n.Type() != "flow_pair" {
+			return true
+		}
+		key := scalarLeafYaml(n.ChildByFieldName("key"))
+		value := n.ChildByFieldName("value")
+		if key == nil || value == nil {
+			return true
+		}
+		switch scalarTextYaml(key, file.Contents) {
+		case "vars", "set_fact":
+			for _, pair := range mappingPairsYaml(value) {
+				varKey := scalarLeafYaml(pair.ChildByFieldName("key"))
+				if varKey != nil && scalarTextYaml(varKey, file.Contents) == name {
+					found = varKey
+					return false
+				}
+			}
+		case "register":
+			if leaf := scalarLeafYaml(value); leaf != nil && scalarTextYaml(leaf, file.Contents) == name {
+				found = leaf
+				return false
+			}
+		}
+		return true
+	})
+	if found == nil {
+		return nil
+	}
+	return swapNodePtr(file, found)
+}
+
+// roleReferenceAnsible returns the name of the role if the scalar refers to one, i.e. it's an item
+// in a roles: list, the value of role:, or the name: of an include_role: or import_role:.
+func roleReferenceAnsible(scalar Node) string {
+	switch scalar.Type() {
+	case "string_scalar", "double_quote_scalar", "single_quote_scalar":
+	default:
+		return ""
+	}
+
+	// Climb from the scalar to its flow_node.
+	flowNode := scalar.Parent()
+	for flowNode != nil && flowNode.Type() != "flow_node" {
+		flowNode = flowNode.Parent()
+	}
+	if flowNode == nil || flowNode.Parent() == nil {
+		return ""
+	}
+	name := scalarTextYaml(scalar.Node, scalar.Contents)
+
+	switch keyOfValueYaml(scalar.Node, scalar.Contents) {
+	case "role":
+		return name
+	case "name":
+		// The pair is in a mapping that's the value of include_role: or import_role:.
+		pair := flowNode.Parent()
+		if pair.Parent() != nil && contains([]string{"include_role", "import_role"}, keyOfValueYaml(pair.Parent(), scalar.Contents)) {
+			return name
+		}
+		return ""
+	case "roles":
+		if flowNode.Parent().Type() == "block_sequence_item" {
+			return name
+		}
+		return ""
+	default:
+		return ""
+	}
+}
+
+// keyOfValueYaml returns the key of the nearest mapping pair whose value contains the node, looking
+// through sequences, or the empty string if the node is inside a nested mapping or there is no key.
+func keyOfValueYaml(node *sitter.Node, contents []byte) string {
+	for cur := node; cur != nil; cur = cur.Parent() {
+		parent := cur.Parent()
+		if parent == nil {
+			return ""
+		}
+		switch parent.Type() {
+		case "block_mapping_pair", "flow_pair":
+			value := parent.ChildByFieldName("value")
+			if value == nil || nodeId(value) != nodeId(cur) {
+				return ""
+			}
+			key := scalarLeafYaml(parent.ChildByFieldName("key"))
+			if key == nil {
+				return ""
+			}
+			return scalarTextYaml(key, contents)
+		case "block_mapping", "flow_mapping":
+			// The node is inside a mapping, so it isn't a whole value.
+			return ""
+		}
+	}
+	return ""
+}
+
+// enclosingRoleAnsible returns the name of the role that contains the path, if any.
+func enclosingRoleAnsible(path string) string {
+	elems := strings.Split(path, "/")
+	for i := len(elems) - 2; i >= 0; i-- {
+		if elems[i] == "roles" {
+			return elems[i+1]
+		}
+	}
+	return ""
+}
+
+// rolesDirAnsible returns the roles/ directory that applies to the path: the one containing it, or
+// the one next to it.
+func rolesDirAnsible(path string) string {
+	elems := strings.Split(path, "/")
+	for i := len(elems) - 2; i >= 0; i-- {
+		if elems[i] == "roles" {
+			return strings.Join(elems[:i+1], "/")
+		}
+	}
+	return filepath.Join(filepath.Dir(path), "roles")
+}
+
+// topLevelPairsYaml returns the pairs of the top-level mappings of each document in a YAML stream.
+func topLevelPairsYaml(stream *sitter.Node) []*sitter.Node {
+	pairs := []*sitter.Node{}
+	for _, document := range children(stream) {
+		if document.Type() != "document" {
+			continue
+		}
+		for _, child := range children(document) {
+			pairs = append(pairs, mappingPairsYaml(child)...)
+		}
+	}
+	return pairs
+}
+
+// mappingPairsYaml returns the pairs of a mapping value.
+func mappingPairsYaml(value *sitter.Node) []*sitter.Node {
+	pairs := []*sitter.Node{}
+	for _, mapping := range children(value) {
+		if mapping.Type() != "block_mapping" && mapping.Type() != "flow_mapping" {
+			continue
+		}
+		for _, pair := range children(mapping) {
+			if pair.Type() == "block_mapping_pair" || pair.Type() == "flow_pair" {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	return pairs
+}
+
+// scalarLeafYaml descends from a flow node to the scalar inside it.
+func scalarLeafYaml(node *sitter.Node) *sitter.Node {
+	for node != nil {
+		switch node.Type() {
+		case "string_scalar", "double_quote_scalar", "single_quote_scalar":
+			return node
+		case "flow_node", "plain_scalar":
+			if node.NamedChildCount() != 1 {
+				return nil
+			}
+			node = node.NamedChild(0)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// scalarTextYaml returns the text of a scalar without quotes.
+func scalarTextYaml(scalar *sitter.Node, contents []byte) string {
+	text := scalar.Content(contents)
+	switch scalar.Type() {
+	case "double_quote_scalar":
+		return strings.TrimSuffix(strings.TrimPrefix(text, `"`), `"`)
+	case "single_quote_scalar":
+		return strings.TrimSuffix(strings.TrimPrefix(text, `'`), `'`)
+	default:
+		return text
+	}
+}
@@ -12,9 +12,13 @@ import (
 	"github.com/smacker/go-tree-sitter/golang"
 	"github.com/smacker/go-tree-sitter/java"
 	"github.com/smacker/go-tree-sitter/javascript"
+	"github.com/smacker/go-tree-sitter/lua"
+	"github.com/smacker/go-tree-sitter/ocaml"
+	"github.com/smacker/go-tree-sitter/php"
 	"github.com/smacker/go-tree-sitter/python"
 	"github.com/smacker/go-tree-sitter/ruby"
 	"github.com/smacker/go-tree-sitter/typescript/tsx"
+	"github.com/smacker/go-tree-sitter/yaml"
 )
 
 //go:embed language-file-extensions.json
@@ -44,6 +48,12 @@ var extToLang = func() map[string]string {
 	return m
 }()
 
+// Mapping from the name of files without an extension to language name.
+var fileNameToLang = map[string]string{
+	"BUILD":     "starlark",
+	"WORKSPACE": "starlark",
+}
+
 // Info about a language.
 type LangSpec struct {
 	name         string
@@ -52,6 +62,19 @@ type LangSpec struct {
 	// localsQuery is a tree-sitter localsQuery that finds scopes and defs.
 	localsQuery          string
 	topLevelSymbolsQuery string
+	// borrowedGrammar is set when the grammar is for a related language, so parse errors are
+	// expected around syntax it doesn't know.
+	borrowedGrammar bool
+	// caseInsensitive reports whether an identifier refers to its definition regardless of case.
+	// It is nil for languages where all identifiers are case-sensitive.
+	caseInsensitive func(identifier *sitter.Node) bool
+	// identifierTypes are node types that can refer to a symbol besides the ones every grammar
+	// shares, such as PHP's names.
+	identifierTypes []string
+	// rewrite turns the contents into something the grammar can parse, for borrowed grammars. The
+	// edits map the rewritten contents back to the original, in the order to apply them to the
+	// tree. It is nil when the contents are parsed as they are.
+	rewrite func(contents []byte) (rewritten []byte, edits []sitter.EditInput)
 }
 
 // Info about comments in a language.
@@ -67,6 +90,23 @@ var javaStyleStripRegex = regexp.MustCompile(`^//|^\s*\*/?|^/\*\*|\*/$`)
 var javaStyleIgnoreRegex = regexp.MustCompile(`^\s*(/\*\*|\*/)\s*$`)
 
 // Mapping from language name to language specification.
+// cppLocalsQuery is shared by the languages parsed with the C++ grammar.
+const cppLocalsQuery = `
+(compound_statement) @scope ; { ... }
+(for_statement)      @scope ; for (int i = 0; ...) ...
+(for_range_loop)     @scope ; for (int x : xs) ...
+(catch_clause)       @scope ; catch (e) ...
+(lambda_expression)  @scope ; [](auto x) { ... }
+
+(declaration                    declarator: (identifier) @definition)                        ; int x;
+(init_declarator                declarator: (identifier) @definition)                        ; int x = 5;
+(parameter_declaration          declarator: (identifier) @definition)                        ; [](auto x) { ... }
+(parameter_declaration          declarator: (reference_declarator (identifier) @definition)) ; [](int& x) { ... }
+(parameter_declaration          declarator: (pointer_declarator   (identifier) @definition)) ; [](int* x) { ... }
+(optional_parameter_declaration declarator: (identifier) @definition)                        ; [](auto x = 5) { ... }
+(for_range_loop declarator: (identifier) @definition)									     ; for (int x : xs) ...
+`
+
 var langToLangSpec = map[string]LangSpec{
 	"java": {
 		name:     "java",
@@ -124,6 +164,15 @@ var langToLangSpec = map[string]LangSpec{
 (short_var_declaration left: (expression_list (identifier) @definition)) ; x, y := ...
 (range_clause          left: (expression_list (identifier) @definition)) ; for i := range ... { ... }
 (receive_statement     left: (expression_list (identifier) @definition)) ; case x := <-ch: ...
+`,
+		topLevelSymbolsQuery: `
+(source_file (function_declaration name: (identifier) @symbol))
+(source_file (type_declaration (type_spec name: (type_identifier) @symbol)))
+(source_file (var_declaration (var_spec name: (identifier) @symbol)))
+(source_file (const_declaration (const_spec name: (identifier) @symbol)))
+(source_file (method_declaration
+  receiver: (parameter_list (parameter_declaration type: [(type_identifier) @parent (pointer_type (type_identifier) @parent)]))
+  name: (field_identifier) @method))
 `,
 	},
 	"csharp": {
@@ -159,23 +208,50 @@ var langToLangSpec = map[string]LangSpec{
 			stripRegex:    regexp.MustCompile(`^#`),
 			codeFenceName: "python",
 		},
-		localsQuery: `
-(function_definition)     @scope ; def f(): ...
-(lambda)                  @scope ; lambda ...: ...
-(generator_expression)    @scope ; (x for x in xs)
-(list_comprehension)      @scope ; [x for x in xs]
-
-(parameters                    (identifier) @definition)                                   ; def f(x): ...
-(typed_parameter               (identifier) @definition)                                   ; def f(x: bool): ...
-(default_parameter       name: (identifier) @definition)                                   ; def f(x = False): ...
-(typed_default_parameter name: (identifier) @definition)                                   ; def f(x: bool = False): ...
-(except_clause                 (identifier) (identifier) @definition)                      ; except Exception as e: ...
-(expression_statement          (assignment left: (identifier) @definition))                ; x = ...
-(expression_statement          (assignment left: (pattern_list (identifier) @definition))) ; x, y = ...
-(for_statement           left: (identifier) @definition)                                   ; for x in ...: ...
-(for_statement           left: (pattern_list (identifier) @definition))                    ; for x, y in ...: ...
-(for_in_clause           left: (identifier) @definition)                                   ; (... for x in xs)
-(for_in_clause           left: (pattern_list (identifier) @definition))                    ; (... for x, y in xs)
+		localsQuery: pythonLocalsQuery,
+		topLevelSymbolsQuery: `
+(module (function_definition name: (identifier) @symbol))
+(module (class_definition    name: (identifier) @symbol))
+(module (decorated_definition definition: (function_definition name: (identifier) @symbol)))
+(module (decorated_definition definition: (class_definition    name: (identifier) @symbol)))
+(module (expression_statement (assignment left: (identifier) @symbol)))
+`,
+	},
+	"starlark": {
+		name:     "starlark",
+		language: python.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    regexp.MustCompile(`^#`),
+			codeFenceName: "starlark",
+		},
+		// Starlark is a dialect of Python.
+		borrowedGrammar: true,
+		localsQuery:     pythonLocalsQuery,
+		topLevelSymbolsQuery: `
+(module (function_definition name: (identifier) @symbol))
+(module (expression_statement (assignment left: (identifier) @symbol)))
+(module (expression_statement (call arguments: (argument_list (keyword_argument name: (identifier) @keyword value: (string) @symbol)))))
+`,
+	},
+	"mojo": {
+		name:     "mojo",
+		language: python.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    regexp.MustCompile(`^#`),
+			codeFenceName: "mojo",
+		},
+		// Mojo is a superset of Python. Its own syntax is rewritten to Python before parsing.
+		borrowedGrammar: true,
+		rewrite:         rewriteMojo,
+		localsQuery:     pythonLocalsQuery,
+		topLevelSymbolsQuery: `
+(module (function_definition name: (identifier) @symbol))
+(module (class_definition    name: (identifier) @symbol))
+(module (decorated_definition definition: (function_definition name: (identifier) @symbol)))
+(module (decorated_definition definition: (class_definition    name: (identifier) @symbol)))
+(module (expression_statement (assignment left: (identifier) @symbol)))
 `,
 	},
 	"javascript": {
@@ -255,22 +331,11 @@ var langToLangSpec = map[string]LangSpec{
 			ignoreRegex:   javaStyleIgnoreRegex,
 			codeFenceName: "cpp",
 		},
-		localsQuery: `
-(compound_statement) @scope ; { ... }
-(for_statement)      @scope ; for (int i = 0; ...) ...
-(for_range_loop)     @scope ; for (int x : xs) ...
-(catch_clause)       @scope ; catch (e) ...
-(lambda_expression)  @scope ; [](auto x) { ... }
-
-(declaration                    declarator: (identifier) @definition)                        ; int x;
-(init_declarator                declarator: (identifier) @definition)                        ; int x = 5;
-(parameter_declaration          declarator: (identifier) @definition)                        ; [](auto x) { ... }
-(parameter_declaration          declarator: (reference_declarator (identifier) @definition)) ; [](int& x) { ... }
-(parameter_declaration          declarator: (pointer_declarator   (identifier) @definition)) ; [](int* x) { ... }
-(optional_parameter_declaration declarator: (identifier) @definition)                        ; [](auto x = 5) { ... }
-(for_range_loop declarator: (identifier) @definition)									     ; for (int x : xs) ...
-`,
+		localsQuery: cppLocalsQuery,
 	},
+	"cuda": shaderLangSpec("cuda"),
+	"glsl": shaderLangSpec("glsl"),
+	"hlsl": shaderLangSpec("hlsl"),
 	"ruby": {
 		name:     "ruby",
 		language: ruby.GetLanguage(),
@@ -295,4 +360,163 @@ var langToLangSpec = map[string]LangSpec{
 (for                  pattern: (identifier) @definition) ; for i in 1..5 ...
 `,
 	},
+	"lua": {
+		name:     "lua",
+		language: lua.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    regexp.MustCompile(`^--(\[\[)?|\]\]$`),
+			codeFenceName: "lua",
+		},
+		localsQuery: `
+(function_statement) @scope ; function f(x) ... end
+(function)           @scope ; function(x) ... end
+(do_statement)       @scope ; do ... end
+(while_statement)    @scope ; while ... do ... end
+(repeat_statement)   @scope ; repeat ... until ...
+(if_statement)       @scope ; if ... then ... end
+(for_statement)      @scope ; for i = 1, 5 do ... end
+
+(parameter_list                    (identifier) @definition)                      ; function(x) ... end
+(variable_declaration (local) name: (variable_declarator . (identifier) @definition .)) ; local x = ...
+(function_statement   (local) name: (identifier) @definition)                      ; local function f() ... end
+(for_numeric                  var:  (identifier) @definition)                      ; for i = 1, 5 do ... end
+(for_generic identifier_list: (identifier_list (identifier) @definition))          ; for k, v in pairs(t) do ... end
+`,
+		topLevelSymbolsQuery: `
+(program (function_statement           name: (function_name)       @symbol))                          ; function M.f() ... end
+(program (function_statement   (local) name: (identifier)          @symbol))                          ; local function f() ... end
+(program (variable_declaration         name: (variable_declarator) @symbol value: (tableconstructor))) ; M = {}
+(program (module_return_statement (tableconstructor (fieldlist (field name: (identifier) @symbol)))))         ; return { f = ... }
+`,
+	},
+	"ocaml": {
+		name:     "ocaml",
+		language: ocaml.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    regexp.MustCompile(`^\(\*\*?|\*\)$`),
+			codeFenceName: "ocaml",
+		},
+		localsQuery: `
+(let_binding (parameter)) @scope ; let f x = ...
+(let_expression)          @scope ; let x = ... in ...
+(fun_expression)          @scope ; fun x -> ...
+(match_case)              @scope ; | Some x -> ...
+
+(let_binding pattern: (value_name) @definition)                          ; let x = ...
+(let_binding pattern: (_ (value_name) @definition))                      ; let (x, y) = ...
+(parameter pattern: (value_pattern) @definition)                         ; fun x -> ...
+(parameter pattern: (typed_pattern (value_pattern) @definition))         ; fun (x : int) -> ...
+(match_case pattern: (value_pattern) @definition)                        ; | x -> ...
+(match_case pattern: (_ (value_pattern) @definition))                    ; | Some x -> ...
+`,
+		topLevelSymbolsQuery: `
+(compilation_unit (value_definition (let_binding pattern: (value_name) @symbol)))          ; let f x = ...
+(compilation_unit (external (value_name) @symbol))                                         ; external f : ... = "..."
+(compilation_unit (type_definition (type_binding name: (type_constructor) @symbol)))       ; type t = ...
+(compilation_unit (exception_definition (constructor_declaration (constructor_name) @symbol))) ; exception E
+(compilation_unit (module_definition (module_binding name: (module_name) @symbol)))        ; module M = ...
+(compilation_unit (module_type_definition name: (module_type_name) @symbol))               ; module type S = ...
+(compilation_unit (class_definition (class_binding name: (class_name) @symbol)))           ; class c = ...
+`,
+	},
+	"php": {
+		name:     "php",
+		language: php.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    javaStyleStripRegex,
+			ignoreRegex:   javaStyleIgnoreRegex,
+			codeFenceName: "php",
+		},
+		caseInsensitive: caseInsensitivePhp,
+		identifierTypes: []string{"name"},
+		localsQuery: `
+(function_definition)                    @scope ; function f() { ... }
+(method_declaration)                     @scope ; class C { function f() { ... } }
+(anonymous_function_creation_expression) @scope ; function () use ($x) { ... }
+
+(function_definition         name: (name) @definition)                      ; function f() { ... }
+(class_declaration           name: (name) @definition)                      ; class C { ... }
+(simple_parameter            name: (variable_name (name) @definition))      ; function f($x) { ... }
+(assignment_expression       left: (variable_name (name) @definition))      ; $x = ...
+(foreach_statement (_) (variable_name (name) @definition))                  ; foreach ($xs as $x) ...
+(foreach_statement (pair (variable_name (name) @definition)))               ; foreach ($xs as $k => $v) ...
+(foreach_statement (pair (_) (variable_name (name) @definition)))           ; foreach ($xs as $k => $v) ...
+`,
+		topLevelSymbolsQuery: `
+(program (function_definition  name: (name) @symbol))
+(program (class_declaration     name: (name) @symbol))
+(program (interface_declaration name: (name) @symbol))
+(program (trait_declaration     name: (name) @symbol))
+`,
+	},
+	"yaml": {
+		name:     "yaml",
+		language: yaml.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    regexp.MustCompile(`^#`),
+			codeFenceName: "yaml",
+		},
+		localsQuery: `
+(anchor (anchor_name) @definition) ; key: &name ...
+`,
+	},
+}
+
+// caseInsensitivePhp returns true for PHP function and class names, which are case-insensitive,
+// and false for variables, which are not.
+func caseInsensitivePhp(identifier *sitter.Node) bool {
+	parent := identifier.Parent()
+	return parent == nil || parent.Type() != "variable_name"
+}
+
+// pythonLocalsQuery finds scopes and defs in Python, and in Starlark which is parsed with the same
+// grammar.
+const pythonLocalsQuery = `
+(function_definition)     @scope ; def f(): ...
+(lambda)                  @scope ; lambda ...: ...
+(generator_expression)    @scope ; (x for x in xs)
+(list_comprehension)      @scope ; [x for x in xs]
+
+(parameters                    (identifier) @definition)                                   ; def f(x): ...
+(typed_parameter               (identifier) @definition)                                   ; def f(x: bool): ...
+(default_parameter       name: (identifier) @definition)                                   ; def f(x = False): ...
+(typed_default_parameter name: (identifier) @definition)                                   ; def f(x: bool = False): ...
+(except_clause                 (identifier) (identifier) @definition)                      ; except Exception as e: ...
+(expression_statement          (assignment left: (identifier) @definition))                ; x = ...
+(expression_statement          (assignment left: (pattern_list (identifier) @definition))) ; x, y = ...
+(for_statement           left: (identifier) @definition)                                   ; for x in ...: ...
+(for_statement           left: (pattern_list (identifier) @definition))                    ; for x, y in ...: ...
+(for_in_clause           left: (identifier) @definition)                                   ; (... for x in xs)
+(for_in_clause           left: (pattern_list (identifier) @definition))                    ; (... for x, y in xs)
+`
+
+// shaderLangSpec returns the spec for a GPU language. There are no grammars for CUDA, GLSL or
+// HLSL, but the C++ grammar recovers from their extensions (qualifiers like __global__ or uniform,
+// HLSL semantics) well enough to find the declarations around them.
+func shaderLangSpec(name string) LangSpec {
+	return LangSpec{
+		name:     name,
+		language: cpp.GetLanguage(),
+		commentStyle: CommentStyle{
+			nodeTypes:     []string{"comment"},
+			stripRegex:    javaStyleStripRegex,
+			ignoreRegex:   javaStyleIgnoreRegex,
+			codeFenceName: name,
+		},
+		localsQuery:     cppLocalsQuery,
+		borrowedGrammar: true,
+		topLevelSymbolsQuery: `
+(translation_unit (function_definition declarator: (function_declarator declarator: (identifier) @symbol)))
+(translation_unit (function_definition declarator: (pointer_declarator declarator: (function_declarator declarator: (identifier) @symbol))))
+(translation_unit (struct_specifier name: (type_identifier) @symbol body: (field_declaration_list)))
+(translation_unit (type_definition declarator: (type_identifier) @symbol))
+(translation_unit (declaration declarator: (identifier) @symbol))
+(translation_unit (declaration declarator: (init_declarator declarator: (identifier) @symbol)))
+(translation_unit (preproc_def name: (identifier) @symbol))
+`,
+	}
 }
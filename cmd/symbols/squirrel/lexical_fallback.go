@@ -0,0 +1,133 @@
+package squirrel
+
+import (
+	"context"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/grafana/regexp"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// WithLexicalFallback makes symbolInfo fall back to a lexical heuristic in files of languages that
+// have no tree-sitter grammar, like ALGOL or Modula-2, instead of returning nothing. The identifier at
+// the point is looked up among the indexed symbols of the same file, then of the whole repository,
+// and resolves only when exactly one symbol has that name. Such definitions are marked as
+// low-confidence and have no hover.
+func WithLexicalFallback() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.lexicalFallback = true
+	}
+}
+
+// lexicalSymbolInfo finds the definition of the identifier at the point without parsing the file.
+func (squirrel *SquirrelService) lexicalSymbolInfo(ctx context.Context, point types.RepoCommitPathPoint) (*types.SymbolInfo, error) {
+	if squirrel.symbolSearch == nil {
+		return nil, nil
+	}
+
+	contents, err := squirrel.readFile(ctx, point.RepoCommitPath)
+	if err != nil {
+		return nil, err
+	}
+	line := lineAt(contents, point.Row)
+	ident := identifierAt(line, squirrel.positionEncoding.toByteColumn(line, point.Column))
+	if ident == "" {
+		return nil, nil
+	}
+
+	// Prefer a definition in the same file, then anywhere in the repository.
+	var symbol *result.Symbol
+	for _, include := range [][]string{{"^" + regexp.QuoteMeta(point.Path) + "$"}, nil} {
+		symbol, err = squirrel.lexicalSymbolSearch(ctx, point.RepoCommitPath, include, ident)
+		if err != nil || symbol != nil {
+			break
+		}
+	}
+	if err != nil || symbol == nil {
+		return nil, err
+	}
+
+	def := types.RepoCommitPath{Repo: point.Repo, Commit: point.Commit, Path: symbol.Path}
+	defContents := contents
+	if def.Path != point.Path {
+		defContents, err = squirrel.readFile(ctx, def)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rnge := squirrel.positionEncoding.fromByteRange(defContents, types.Range{
+		Row:    symbol.Line,
+		Column: symbol.Character,
+		Length: len(symbol.Name),
+	})
+
+	var preview []string
+	if squirrel.previewContext >= 0 {
+		preview = previewLines(defContents, symbol.Line, squirrel.previewContext)
+	}
+
+	return &types.SymbolInfo{
+		Definition:    types.RepoCommitPathMaybeRange{RepoCommitPath: def, Range: &rnge},
+		LowConfidence: true,
+		PreviewLines:  preview,
+	}, nil
+}
+
+// lexicalSymbolSearch returns the only symbol named ident in the files matching include, or nil when
+// there is none or the name is ambiguous.
+func (squirrel *SquirrelService) lexicalSymbolSearch(ctx context.Context, repoCommitPath types.RepoCommitPath, include []string, ident string) (*result.Symbol, error) {
+	symbols, err := squirrel.symbolSearch(ctx, search.SymbolsParameters{
+		Repo:            api.RepoName(repoCommitPath.Repo),
+		CommitID:        api.CommitID(repoCommitPath.Commit),
+		Query:           "^" + regexp.QuoteMeta(ident) + "$",
+		IsRegExp:        true,
+		IsCaseSensitive: true,
+		IncludePatterns: include,
+		First:           2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) != 1 {
+		return nil, nil
+	}
+	return &symbols[0], nil
+}
+
+// identifierAt returns the run of letters, digits and underscores around the byte column of the line.
+func identifierAt(line []byte, column int) string {
+	isIdentRune := func(r rune) bool {
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	if column < 0 || column > len(line) {
+		return ""
+	}
+
+	start := column
+	for start > 0 {
+		r, size := utf8.DecodeLastRune(line[:start])
+		if !isIdentRune(r) {
+			break
+		}
+		start -= size
+	}
+	end := column
+	for end < len(line) {
+		r, size := utf8.DecodeRune(line[end:])
+		if !isIdentRune(r) {
+			break
+		}
+		end += size
+	}
+
+	ident := string(line[start:end])
+	if r, _ := utf8.DecodeRuneInString(ident); ident == "" || unicode.IsDigit(r) {
+		return ""
+	}
+	return ident
+}
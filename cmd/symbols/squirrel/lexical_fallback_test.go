@@ -0,0 +1,134 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/regexp"
+
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestLexicalFallback(t *testing.T) {
+	// Modula-2 has no tree-sitter grammar.
+	files := map[string]string{
+		"Lists.mod": `IMPLEMENTATION MODULE Lists;
+
+PROCEDURE AppendItem(VAR list: List; item: INTEGER);
+BEGIN
+END AppendItem;
+
+PROCEDURE Init;
+END Init;
+
+END Lists.
+`,
+		"Main.mod": `MODULE Main;
+FROM Lists IMPORT AppendItem;
+
+PROCEDURE Init;
+END Init;
+
+BEGIN
+  Init;
+  AppendItem(l, 42);
+  Reset(l)
+END Main.
+`,
+		"Queues.mod": `MODULE Queues;
+PROCEDURE Reset;
+END Reset;
+END Queues.
+`,
+		"Stacks.mod": `MODULE Stacks;
+PROCEDURE Reset;
+END Reset;
+END Stacks.
+`,
+	}
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return []byte(files[path.Path]), nil
+	}
+
+	// Index the procedures like ctags would.
+	symbols := result.Symbols{}
+	for path, contents := range files {
+		for row, line := range strings.Split(contents, "\n") {
+			if name, ok := strings.CutPrefix(line, "PROCEDURE "); ok {
+				name = regexp.MustCompile(`^\w+`).FindString(name)
+				symbols = append(symbols, result.Symbol{Name: name, Path: path, Line: row, Character: len("PROCEDURE "), Kind: "procedure"})
+			}
+		}
+	}
+	symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		results := result.Symbols{}
+	nextSymbol:
+		for _, symbol := range symbols {
+			for _, include := range args.IncludePatterns {
+				if !regexp.MustCompile(include).MatchString(symbol.Path) {
+					continue nextSymbol
+				}
+			}
+			if regexp.MustCompile(args.Query).MatchString(symbol.Name) {
+				results = append(results, symbol)
+			}
+		}
+		return results, nil
+	}
+
+	// Returns the position of the definition of the first occurrence of ident in Main.mod, after the
+	// given prefix, with the point in the middle of the identifier.
+	main := types.RepoCommitPath{Repo: "modula", Commit: "abc", Path: "Main.mod"}
+	resolve := func(squirrel *SquirrelService, prefix, ident string) (*types.SymbolInfo, error) {
+		t.Helper()
+		for row, line := range strings.Split(files[main.Path], "\n") {
+			if strings.HasPrefix(line, prefix+ident) {
+				point := types.Point{Row: row, Column: len(prefix) + len(ident)/2}
+				return squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: main, Point: point})
+			}
+		}
+		t.Fatalf("no %s in %s", ident, main.Path)
+		return nil, nil
+	}
+
+	squirrel := New(readFile, symbolSearch, WithLexicalFallback())
+	defer squirrel.Close()
+
+	for _, tc := range []struct {
+		name   string
+		prefix string
+		ident  string
+		want   string
+	}{
+		{name: "unique in the repository", prefix: "  ", ident: "AppendItem", want: "Lists.mod:2:10"},
+		{name: "same file first", prefix: "  ", ident: "Init", want: "Main.mod:3:10"},
+		{name: "ambiguous", prefix: "  ", ident: "Reset", want: ""},
+		{name: "not indexed", prefix: "FROM ", ident: "Lists", want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			info, err := resolve(squirrel, tc.prefix, tc.ident)
+			fatalIfError(t, err)
+			got := ""
+			if info != nil {
+				if !info.LowConfidence {
+					t.Fatal("expected a lexical definition to be low-confidence")
+				}
+				got = fmt.Sprintf("%s:%d:%d", info.Definition.Path, info.Definition.Row, info.Definition.Column)
+			}
+			if got != tc.want {
+				t.Fatalf("want definition %q, got %q", tc.want, got)
+			}
+		})
+	}
+
+	// Without the fallback, files of unsupported languages are an error as before.
+	strict := New(readFile, symbolSearch)
+	defer strict.Close()
+	if _, err := resolve(strict, "  ", "AppendItem"); err == nil {
+		t.Fatal("expected an error without the lexical fallback")
+	}
+}
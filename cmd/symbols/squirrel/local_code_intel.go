@@ -30,18 +30,39 @@ type PartialSymbol struct {
 
 // Computes the local code intel payload, which is a list of symbols.
 func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitPath types.RepoCommitPath) (*types.LocalCodeIntelPayload, error) {
+	if !Enabled() {
+		return nil, nil
+	}
+
 	// Parse the file.
 	root, err := squirrel.parse(ctx, repoCommitPath)
 	if err != nil {
 		return nil, err
 	}
 
+	symbols, err := localSymbols(root)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := false
+	if squirrel.maxSymbols > 0 && len(symbols) > squirrel.maxSymbols {
+		symbols = symbols[:squirrel.maxSymbols]
+		truncated = true
+	}
+
+	return &types.LocalCodeIntelPayload{Symbols: symbols, Truncated: truncated}, nil
+}
+
+// localSymbols resolves the identifiers in the file against the definitions in their scopes, and
+// returns the symbols sorted by definition.
+func localSymbols(root *Node) ([]types.Symbol, error) {
 	// Collect scopes
 	rootScopeId := nodeId(root.Node)
 	scopes := map[NodeId]Scope{
 		rootScopeId: {},
 	}
-	err = forEachCapture(root.LangSpec.localsQuery, root, func(captureName string, node Node) {
+	err := forEachCapture(root.LangSpec.localsQuery, root, func(captureName string, node Node) {
 		if captureName == "scope" {
 			scopes[nodeId(node.Node)] = map[SymbolName]*PartialSymbol{}
 			return
@@ -60,7 +81,7 @@ func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitP
 				// Found the scope.
 				if scope, ok := scopes[nodeId(cur)]; ok {
 					// Get the symbol name.
-					symbolName := SymbolName(node.Content(node.Contents))
+					symbolName := symbolNameOf(root.LangSpec, node.Node, node.Contents)
 
 					// Skip the symbol if it's already defined.
 					if _, ok := scope[symbolName]; ok {
@@ -69,9 +90,9 @@ func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitP
 
 					// Put the symbol in the scope.
 					scope[symbolName] = &PartialSymbol{
-						Name:  string(symbolName),
+						Name:  strings.TrimSpace(node.Content(node.Contents)),
 						Hover: findHover(node),
-						Def:   nodeToRange(node.Node),
+						Def:   trimRange(nodeToRange(node.Node), node.Content(node.Contents)),
 						Refs:  map[types.Range]struct{}{},
 					}
 
@@ -87,13 +108,12 @@ func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitP
 
 	// Collect refs by walking the entire tree.
 	walk(root.Node, func(node *sitter.Node) {
-		// Only collect identifiers.
-		if !strings.Contains(node.Type(), "identifier") {
+		if !isIdentifier(root.LangSpec, node) {
 			return
 		}
 
 		// Get the symbol name.
-		symbolName := SymbolName(node.Content(root.Contents))
+		symbolName := symbolNameOf(root.LangSpec, node, root.Contents)
 
 		// Find the nearest scope (if it exists).
 		for cur := node; cur != nil; cur = cur.Parent() {
@@ -105,7 +125,7 @@ func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitP
 				}
 
 				// Put the ref in the scope.
-				scope[symbolName].Refs[nodeToRange(node)] = struct{}{}
+				scope[symbolName].Refs[trimRange(nodeToRange(node), node.Content(root.Contents))] = struct{}{}
 
 				// Done.
 				return
@@ -132,7 +152,39 @@ func (squirrel *SquirrelService) localCodeIntel(ctx context.Context, repoCommitP
 		}
 	}
 
-	return &types.LocalCodeIntelPayload{Symbols: symbols}, nil
+	// Sort the symbols so that truncation is deterministic.
+	sort.Slice(symbols, func(i, j int) bool {
+		if symbols[i].Def != symbols[j].Def {
+			return isLessRange(symbols[i].Def, symbols[j].Def)
+		}
+		return symbols[i].Name < symbols[j].Name
+	})
+
+	return symbols, nil
+}
+
+// isIdentifier returns true if the node can refer to a symbol. OCaml calls them value names and
+// value patterns, and other languages list theirs in the LangSpec.
+func isIdentifier(langSpec LangSpec, node *sitter.Node) bool {
+	if strings.Contains(node.Type(), "identifier") || node.Type() == "value_name" || node.Type() == "value_pattern" {
+		return true
+	}
+	for _, nodeType := range langSpec.identifierTypes {
+		if node.Type() == nodeType {
+			return true
+		}
+	}
+	return false
+}
+
+// symbolNameOf returns the name that the identifier is matched against definitions by. Case is
+// folded for identifiers that the language treats as case-insensitive.
+func symbolNameOf(langSpec LangSpec, identifier *sitter.Node, contents []byte) SymbolName {
+	name := strings.TrimSpace(identifier.Content(contents))
+	if langSpec.caseInsensitive != nil && langSpec.caseInsensitive(identifier) {
+		name = strings.ToLower(name)
+	}
+	return SymbolName(name)
 }
 
 // Pretty prints the local code intel payload for debugging.
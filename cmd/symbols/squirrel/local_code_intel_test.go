@@ -336,6 +336,54 @@ def f(p1, p2 = 3, *p3, **p4)
 		puts e
 	end
 end
+`},
+		{
+			path: "test.lua",
+			contents: `
+--             v f.f def
+--             v f.f ref
+--               vv f.p1 def
+--               vv f.p1 ref
+--                   vv f.p2 def
+--                   vv f.p2 ref
+local function f(p1, p2)
+  local x = p1 -- < "x" f.x def < "x" f.x ref < "p1" f.p1 ref
+  for i = 1, x do print(i) end -- < "i" f.i def < "i" f.i ref < "x" f.x ref < "i)" f.i ref
+  for k, val in pairs(x) do print(k) end -- < "k" f.k def < "k" f.k ref < "val" f.val def < "val" f.val ref < "x)" f.x ref < "k)" f.k ref
+end
+`},
+		{
+			path: "test.ml",
+			contents: `
+let scale w = (* < "scale" s.scale def < "scale" s.scale ref < "w" s.w def < "w" s.w ref *)
+  let sq = w *. w in (* < "sq" s.sq def < "sq" s.sq ref < "w *" s.w ref < "w in" s.w ref *)
+  match sq with (* < "sq" s.sq ref *)
+  | 0.0 -> 0.0
+  | n -> n +. 1.0 (* < "n" s.n def < "n" s.n ref < "n +" s.n ref *)
+`},
+		{
+			path: "test.php",
+			contents: `<?php
+function countdown($n) { // < "countdown" c.countdown def < "countdown" c.countdown ref < "n) {" c.n def < "n) {" c.n ref
+  $N = $n - 1; // < "N =" c.N def < "N =" c.N ref < "n -" c.n ref
+  return COUNTDOWN($N); // < "COUNTDOWN" c.countdown ref < "N)" c.N ref
+}
+class Greeter {} // < "Greeter" g.Greeter def < "Greeter" g.Greeter ref
+$g = new GREETER(); // < "g =" g.g def < "g =" g.g ref < "GREETER" g.Greeter ref
+`},
+		{
+			// Go and Python are case-sensitive, so a ref that differs only in case is unresolved.
+			path: "test_case.go",
+			contents: `
+func f(n int) int { // < "n int" f.n def < "n int" f.n ref
+	return N
+}
+`},
+		{
+			path: "test_case.py",
+			contents: `
+def f(n): # < "n)" f.n def < "n)" f.n ref
+  return N
 `},
 	}
 
@@ -381,6 +429,45 @@ end
 	}
 }
 
+func TestLocalCodeIntelMaxSymbols(t *testing.T) {
+	lines := []string{"package p", "", "func f() {"}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("\tv%02d := %d", i, i))
+	}
+	lines = append(lines, "}")
+	contents := strings.Join(lines, "\n")
+
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return []byte(contents), nil
+	}
+	path := types.RepoCommitPath{Repo: "foo", Commit: "bar", Path: "test.go"}
+
+	uncapped := New(readFile, nil)
+	defer uncapped.Close()
+	full, err := uncapped.localCodeIntel(context.Background(), path)
+	fatalIfError(t, err)
+	if full.Truncated || len(full.Symbols) != 20 {
+		t.Fatalf("expected 20 symbols without truncation, got %d (truncated: %v)", len(full.Symbols), full.Truncated)
+	}
+
+	for i := 0; i < 3; i++ {
+		capped := New(readFile, nil, WithMaxSymbols(5))
+		payload, err := capped.localCodeIntel(context.Background(), path)
+		capped.Close()
+		fatalIfError(t, err)
+		if !payload.Truncated {
+			t.Fatal("expected the payload to be marked as truncated")
+		}
+		names := []string{}
+		for _, symbol := range payload.Symbols {
+			names = append(names, symbol.Name)
+		}
+		if diff := cmp.Diff([]string{"v00", "v01", "v02", "v03", "v04"}, names); diff != "" {
+			t.Fatalf("expected the first symbols in the file (-want +got):\n%s", diff)
+		}
+	}
+}
+
 func getLocalCodeIntel(t *testing.T, path types.RepoCommitPath, contents string) *types.LocalCodeIntelPayload {
 	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
 		return []byte(contents), nil
@@ -0,0 +1,120 @@
+package squirrel
+
+import (
+	"context"
+
+	symbolsTypes "github.com/sourcegraph/sourcegraph/cmd/symbols/types"
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// PermissionFilter wraps a SquirrelService and hides results that point at paths the actor in the
+// context can't read. This keeps the resolver itself unaware of sub-repo permissions.
+type PermissionFilter struct {
+	squirrel *SquirrelService
+	checker  authz.SubRepoPermissionChecker
+}
+
+// NewPermissionFilter returns a PermissionFilter that checks paths with the given checker.
+func NewPermissionFilter(squirrel *SquirrelService, checker authz.SubRepoPermissionChecker) *PermissionFilter {
+	return &PermissionFilter{squirrel: squirrel, checker: checker}
+}
+
+// SymbolInfo returns the definition of the symbol at the given point. It returns nil if the actor
+// can't read the file containing the point or the file containing the definition.
+func (f *PermissionFilter) SymbolInfo(ctx context.Context, point types.RepoCommitPathPoint) (*types.SymbolInfo, error) {
+	if ok, err := f.canRead(ctx, point.RepoCommitPath); err != nil || !ok {
+		return nil, err
+	}
+
+	info, err := f.squirrel.sharedSymbolInfo(ctx, point)
+	if err != nil || info == nil {
+		return info, err
+	}
+
+	// External definitions have no path.
+	if info.Definition.Path == "" {
+		return info, nil
+	}
+	ok, err := f.canRead(ctx, info.Definition.RepoCommitPath)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Say that there is a definition without saying anything about it.
+		return &types.SymbolInfo{Redacted: true}, nil
+	}
+	return info, nil
+}
+
+// LocalCodeIntel returns the local code intel of a file, or nil if the actor can't read it. All
+// ranges in the payload are in the same file, so nothing else needs to be filtered.
+func (f *PermissionFilter) LocalCodeIntel(ctx context.Context, path types.RepoCommitPath) (*types.LocalCodeIntelPayload, error) {
+	if ok, err := f.canRead(ctx, path); err != nil || !ok {
+		return nil, err
+	}
+	return f.squirrel.localCodeIntel(ctx, path)
+}
+
+// DocumentSymbols returns the top-level symbols of a file, or nil if the actor can't read it.
+func (f *PermissionFilter) DocumentSymbols(ctx context.Context, path types.RepoCommitPath) (result.Symbols, error) {
+	if ok, err := f.canRead(ctx, path); err != nil || !ok {
+		return nil, err
+	}
+	return f.squirrel.getSymbols(ctx, path)
+}
+
+// FilterSymbolSearch wraps a symbol search so that files the actor in the context can't read
+// contribute no symbols to the results. Otherwise denied files would still be revealed by symbol
+// search, even though their definitions are hidden. Note that fewer than args.First results may be
+// returned when some are filtered out.
+func FilterSymbolSearch(symbolSearch symbolsTypes.SearchFunc, checker authz.SubRepoPermissionChecker) symbolsTypes.SearchFunc {
+	return func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		symbols, err := symbolSearch(ctx, args)
+		if err != nil || len(symbols) == 0 {
+			return symbols, err
+		}
+
+		paths := []string{}
+		seen := map[string]struct{}{}
+		for _, symbol := range symbols {
+			if _, ok := seen[symbol.Path]; !ok {
+				seen[symbol.Path] = struct{}{}
+				paths = append(paths, symbol.Path)
+			}
+		}
+		allowed, err := authz.FilterActorPaths(ctx, checker, actor.FromContext(ctx), args.Repo, paths)
+		if err != nil {
+			return nil, err
+		}
+		allowedSet := make(map[string]struct{}, len(allowed))
+		for _, path := range allowed {
+			allowedSet[path] = struct{}{}
+		}
+
+		filtered := make(result.Symbols, 0, len(symbols))
+		for _, symbol := range symbols {
+			if _, ok := allowedSet[symbol.Path]; ok {
+				filtered = append(filtered, symbol)
+			}
+		}
+		return filtered, nil
+	}
+}
+
+// canRead reports whether the actor in the context can read the file.
+func (f *PermissionFilter) canRead(ctx context.Context, path types.RepoCommitPath) (bool, error) {
+	perms, err := authz.ActorPermissions(ctx, f.checker, actor.FromContext(ctx), authz.RepoContent{
+		Repo:   api.RepoName(path.Repo),
+		Path:   path.Path,
+		Commit: api.CommitID(path.Commit),
+	})
+	if err != nil {
+		return false, err
+	}
+	return perms.Include(authz.Read), nil
+}
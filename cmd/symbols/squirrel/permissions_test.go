@@ -0,0 +1,196 @@
+package squirrel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestPermissionFilter(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+
+	// Deny everything in Ansible roles and the Lua util module.
+	checker := authz.NewMockSubRepoPermissionChecker()
+	checker.EnabledFunc.SetDefaultReturn(true)
+	checker.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content authz.RepoContent) (authz.Perms, error) {
+		if strings.HasPrefix(content.Path, "roles/") || strings.HasPrefix(content.Path, "lib/util/") {
+			return authz.None, nil
+		}
+		return authz.Read, nil
+	})
+	filter := NewPermissionFilter(squirrel, checker)
+	ctx := actor.WithActor(context.Background(), &actor.Actor{UID: 1})
+
+	// findRef returns the location of the first ref annotation for the symbol.
+	findRef := func(path types.RepoCommitPath, symbol string) types.RepoCommitPathPoint {
+		contents, err := readFile(ctx, path)
+		fatalIfError(t, err)
+		for _, a := range collectAnnotations(path, string(contents)) {
+			if a.symbol == symbol && contains(a.tags, "ref") {
+				return a.repoCommitPathPoint
+			}
+		}
+		t.Fatalf("no ref annotation for %s", symbol)
+		return types.RepoCommitPathPoint{}
+	}
+	site := types.RepoCommitPath{Repo: "ansible1", Commit: "abc", Path: "site.yml"}
+	tasks := types.RepoCommitPath{Repo: "ansible1", Commit: "abc", Path: "roles/web/tasks/main.yml"}
+
+	t.Run("SymbolInfo", func(t *testing.T) {
+		// Defined in a readable file.
+		info, err := filter.SymbolInfo(ctx, findRef(site, "ans.http_port"))
+		fatalIfError(t, err)
+		if info == nil || info.Redacted {
+			t.Fatal("expected the definition of http_port")
+		}
+
+		// Defined in a denied file.
+		point := findRef(site, "ans.app_user")
+		info, err = squirrel.symbolInfo(ctx, point)
+		fatalIfError(t, err)
+		if info == nil {
+			t.Fatal("expected the unfiltered service to find the definition of app_user")
+		}
+		info, err = filter.SymbolInfo(ctx, point)
+		fatalIfError(t, err)
+		if info == nil {
+			t.Fatal("expected a redacted result rather than nil")
+		}
+		if diff := cmp.Diff(types.SymbolInfo{Redacted: true}, *info); diff != "" {
+			t.Fatalf("expected the definition to be hidden (-want +got):\n%s", diff)
+		}
+
+		// Requested from a denied file.
+		info, err = filter.SymbolInfo(ctx, findRef(tasks, "ans.app_home"))
+		fatalIfError(t, err)
+		if info != nil {
+			t.Fatal("expected no result for a point in a denied file")
+		}
+	})
+
+	t.Run("LocalCodeIntel", func(t *testing.T) {
+		payload, err := filter.LocalCodeIntel(ctx, site)
+		fatalIfError(t, err)
+		if payload == nil {
+			t.Fatal("expected local code intel for a readable file")
+		}
+		payload, err = filter.LocalCodeIntel(ctx, tasks)
+		fatalIfError(t, err)
+		if payload != nil {
+			t.Fatal("expected no local code intel for a denied file")
+		}
+	})
+
+	t.Run("FilterSymbolSearch", func(t *testing.T) {
+		// Index every file of the Lua repo, including the denied one.
+		all := result.Symbols{}
+		for _, path := range []string{"main.lua", "lib/shapes.lua", "lib/util/init.lua"} {
+			symbols, err := squirrel.getSymbols(ctx, types.RepoCommitPath{Repo: "lua1", Commit: "abc", Path: path})
+			fatalIfError(t, err)
+			all = append(all, symbols...)
+		}
+		denied := 0
+		for _, symbol := range all {
+			if strings.HasPrefix(symbol.Path, "lib/util/") {
+				denied++
+			}
+		}
+		if denied == 0 {
+			t.Fatal("expected the denied file to have symbols")
+		}
+		symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+			return all, nil
+		}
+
+		symbols, err := FilterSymbolSearch(symbolSearch, checker)(ctx, search.SymbolsParameters{Repo: "lua1"})
+		fatalIfError(t, err)
+		if len(symbols) == 0 {
+			t.Fatal("expected symbols from readable files")
+		}
+		for _, symbol := range symbols {
+			if strings.HasPrefix(symbol.Path, "lib/util/") {
+				t.Fatalf("symbol %s from denied file %s was not filtered", symbol.Name, symbol.Path)
+			}
+		}
+	})
+
+	t.Run("rules not synced", func(t *testing.T) {
+		unsynced := authz.NewMockSubRepoPermissionChecker()
+		unsynced.EnabledFunc.SetDefaultReturn(true)
+		unsynced.PermissionsFunc.SetDefaultReturn(authz.None, authz.ErrSubRepoPermsNotSynced)
+		filter := NewPermissionFilter(squirrel, unsynced)
+
+		info, err := filter.SymbolInfo(ctx, findRef(site, "ans.http_port"))
+		fatalIfError(t, err)
+		if info != nil {
+			t.Fatal("expected no result for a file whose rules aren't synced")
+		}
+		payload, err := filter.LocalCodeIntel(ctx, site)
+		fatalIfError(t, err)
+		if payload != nil {
+			t.Fatal("expected no local code intel for a file whose rules aren't synced")
+		}
+	})
+
+	t.Run("DocumentSymbols", func(t *testing.T) {
+		symbols, err := filter.DocumentSymbols(ctx, types.RepoCommitPath{Repo: "lua1", Commit: "abc", Path: "lib/shapes.lua"})
+		fatalIfError(t, err)
+		if len(symbols) == 0 {
+			t.Fatal("expected symbols for a readable file")
+		}
+		symbols, err = filter.DocumentSymbols(ctx, types.RepoCommitPath{Repo: "lua1", Commit: "abc", Path: "lib/util/init.lua"})
+		fatalIfError(t, err)
+		if symbols != nil {
+			t.Fatal("expected no symbols for a denied file")
+		}
+	})
+}
+
+func TestHandlersFilterWithChecker(t *testing.T) {
+	// The checker denies everything, so the handlers answer without reading any files.
+	checker := authz.NewMockSubRepoPermissionChecker()
+	checker.EnabledFunc.SetDefaultReturn(true)
+	checker.PermissionsFunc.SetDefaultReturn(authz.None, nil)
+	point := `{"repo":"foo","commit":"abc","path":"secret.go","row":0,"column":0}`
+
+	for _, tc := range []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		want    string
+	}{
+		{"localCodeIntel", NewLocalCodeIntelHandler(checker), "null"},
+		{"symbolInfo", NewSymbolInfoHandler(nil, checker), "null"},
+		{"diagnoseResolution", NewDiagnoseResolutionHandler(nil, checker), `"reason":"hidden_by_permissions"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := len(checker.PermissionsFunc.History())
+			ctx := actor.WithActor(context.Background(), &actor.Actor{UID: 1})
+			r := httptest.NewRequest("POST", "/"+tc.name, strings.NewReader(point)).WithContext(ctx)
+			w := httptest.NewRecorder()
+			tc.handler(w, r)
+
+			if len(checker.PermissionsFunc.History()) == calls {
+				t.Fatal("expected the handler to check permissions with the given checker")
+			}
+			if body := w.Body.String(); !strings.Contains(body, tc.want) {
+				t.Fatalf("expected the response to contain %s, got %s", tc.want, body)
+			}
+		})
+	}
+}
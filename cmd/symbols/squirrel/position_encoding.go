@@ -0,0 +1,100 @@
+package squirrel
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// PositionEncoding is the unit that columns are counted in. Tree-sitter counts bytes, but editors
+// speaking LSP usually count UTF-16 code units.
+type PositionEncoding int
+
+const (
+	// UTF8 counts bytes. This is the default.
+	UTF8 PositionEncoding = iota
+	// UTF16 counts UTF-16 code units, so characters outside the Basic Multilingual Plane count twice.
+	UTF16
+	// UTF32 counts code points.
+	UTF32
+)
+
+// WithPositionEncoding makes symbolInfo and getSymbols count columns in the given encoding, both in
+// the point given to symbolInfo and in the returned positions.
+func WithPositionEncoding(encoding PositionEncoding) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.positionEncoding = encoding
+	}
+}
+
+// lineAt returns the contents of the given row, without the newline.
+func lineAt(contents []byte, row int) []byte {
+	start := pointToOffset(contents, types.Point{Row: row})
+	if start > len(contents) {
+		return nil
+	}
+	line := contents[start:]
+	if end := bytes.IndexByte(line, '\n'); end != -1 {
+		line = line[:end]
+	}
+	return line
+}
+
+// unitsOf returns the number of units the rune counts for in the encoding.
+func (encoding PositionEncoding) unitsOf(r rune, size int) int {
+	switch encoding {
+	case UTF16:
+		if r >= 0x10000 {
+			return 2
+		}
+		return 1
+	case UTF32:
+		return 1
+	default:
+		return size
+	}
+}
+
+// fromByteColumn converts a byte column in the line to the encoding.
+func (encoding PositionEncoding) fromByteColumn(line []byte, column int) int {
+	if encoding == UTF8 {
+		return column
+	}
+	if column > len(line) {
+		column = len(line)
+	}
+	units := 0
+	for i := 0; i < column; {
+		r, size := utf8.DecodeRune(line[i:])
+		units += encoding.unitsOf(r, size)
+		i += size
+	}
+	return units
+}
+
+// toByteColumn converts a column in the encoding to a byte column in the line.
+func (encoding PositionEncoding) toByteColumn(line []byte, column int) int {
+	if encoding == UTF8 {
+		return column
+	}
+	units := 0
+	i := 0
+	for i < len(line) && units < column {
+		r, size := utf8.DecodeRune(line[i:])
+		units += encoding.unitsOf(r, size)
+		i += size
+	}
+	return i
+}
+
+// fromByteRange converts a range with byte columns in contents to the encoding.
+func (encoding PositionEncoding) fromByteRange(contents []byte, rnge types.Range) types.Range {
+	if encoding == UTF8 {
+		return rnge
+	}
+	line := lineAt(contents, rnge.Row)
+	start := encoding.fromByteColumn(line, rnge.Column)
+	end := encoding.fromByteColumn(line, rnge.Column+rnge.Length)
+	return types.Range{Row: rnge.Row, Column: start, Length: end - start}
+}
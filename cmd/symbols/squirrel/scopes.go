@@ -0,0 +1,99 @@
+package squirrel
+
+import (
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// scopeKinds maps the node types of named declarations that can enclose other symbols to the kind
+// reported for them, across all languages.
+var scopeKinds = map[string]string{
+	"namespace_definition":    "namespace",
+	"namespace_declaration":   "namespace",
+	"module":                  "module",
+	"mod_item":                "module",
+	"object_definition":       "object",
+	"class":                   "class",
+	"class_declaration":       "class",
+	"class_definition":        "class",
+	"class_specifier":         "class",
+	"interface_declaration":   "interface",
+	"enum_declaration":        "enum",
+	"struct_specifier":        "struct",
+	"struct_item":             "struct",
+	"struct_declaration":      "struct",
+	"trait_item":              "trait",
+	"trait_definition":        "trait",
+	"constructor_declaration": "constructor",
+	"method":                  "method",
+	"method_declaration":      "method",
+	"method_definition":       "method",
+	"function_declaration":    "function",
+	"function_definition":     "function",
+	"function_item":           "function",
+}
+
+// enclosingScopes returns the named declarations around the node, outermost first. When the node
+// is the name of a declaration, that declaration is left out.
+func enclosingScopes(node *sitter.Node, contents []byte) []types.SymbolScope {
+	var scopes []types.SymbolScope
+	for cur := node.Parent(); cur != nil; cur = cur.Parent() {
+		if name := scopeName(cur); name != nil && nodeId(name) != nodeId(node) {
+			scopes = append(scopes, types.SymbolScope{
+				Name: strings.TrimSpace(name.Content(contents)),
+				Kind: scopeKinds[cur.Type()],
+			})
+		}
+		// A Go method is scoped to its receiver type, also when it is the symbol itself.
+		if receiver := receiverTypeGo(cur, contents); receiver != "" {
+			scopes = append(scopes, types.SymbolScope{Name: receiver, Kind: "type"})
+		}
+	}
+
+	// Collected innermost first.
+	for i, j := 0, len(scopes)-1; i < j; i, j = i+1, j-1 {
+		scopes[i], scopes[j] = scopes[j], scopes[i]
+	}
+	return scopes
+}
+
+// scopeName returns the name of a declaration that can enclose other symbols, or nil if the node is
+// not one or is anonymous.
+func scopeName(node *sitter.Node) *sitter.Node {
+	if _, ok := scopeKinds[node.Type()]; !ok {
+		return nil
+	}
+	if name := node.ChildByFieldName("name"); name != nil {
+		return name
+	}
+	// C and C++ functions are named by their declarator.
+	if node.Type() == "function_definition" {
+		return declaratorNameShader(node.ChildByFieldName("declarator"))
+	}
+	return nil
+}
+
+// receiverTypeGo returns the receiver type name of a Go method declaration, or "" for any other
+// node.
+func receiverTypeGo(node *sitter.Node, contents []byte) string {
+	if node.Type() != "method_declaration" {
+		return ""
+	}
+	receiver := node.ChildByFieldName("receiver")
+	if receiver == nil {
+		return ""
+	}
+	for _, param := range children(receiver) {
+		ty := param.ChildByFieldName("type")
+		if ty != nil && ty.Type() == "pointer_type" && ty.NamedChildCount() > 0 {
+			ty = ty.NamedChild(0)
+		}
+		if ty != nil && ty.Type() == "type_identifier" {
+			return ty.Content(contents)
+		}
+	}
+	return ""
+}
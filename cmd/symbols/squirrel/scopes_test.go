@@ -0,0 +1,100 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestEnclosingScopes(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+
+	t.Run("symbolInfo", func(t *testing.T) {
+		path := types.RepoCommitPath{Repo: "java1", Commit: "abc", Path: "src/scopes/Outer.java"}
+		contents, err := readFile(context.Background(), path)
+		fatalIfError(t, err)
+		lines := strings.Split(string(contents), "\n")
+		// at returns the point of the last occurrence of substr on the first line containing line.
+		at := func(line, substr string) types.Point {
+			for row, l := range lines {
+				if strings.Contains(l, line) {
+					return types.Point{Row: row, Column: strings.LastIndex(l, substr)}
+				}
+			}
+			t.Fatalf("no line containing %q", line)
+			return types.Point{}
+		}
+
+		method := []types.SymbolScope{
+			{Name: "Outer", Kind: "class"},
+			{Name: "Inner", Kind: "class"},
+			{Name: "count", Kind: "method"},
+		}
+		for _, tc := range []struct {
+			name  string
+			point types.Point
+			want  []types.SymbolScope
+		}{
+			{name: "local", point: at("return total", "total"), want: method},
+			{name: "parameter", point: at("i < limit", "limit"), want: method},
+			{name: "loop variable", point: at("total += i", "i"), want: method},
+			{name: "nested class", point: at("class Inner", "Inner"), want: []types.SymbolScope{{Name: "Outer", Kind: "class"}}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				squirrel := New(readFile, nil, WithEnclosingScopes())
+				defer squirrel.Close()
+				info, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: tc.point})
+				fatalIfError(t, err)
+				if info == nil {
+					t.Fatal("no symbolInfo")
+				}
+				if diff := cmp.Diff(tc.want, info.Scope); diff != "" {
+					t.Fatalf("unexpected scope (-want +got):\n%s", diff)
+				}
+			})
+		}
+
+		squirrel := New(readFile, nil)
+		defer squirrel.Close()
+		info, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: at("return total", "total")})
+		fatalIfError(t, err)
+		if info == nil || info.Scope != nil {
+			t.Fatalf("expected no scope by default, got %v", info)
+		}
+	})
+
+	t.Run("getSymbols", func(t *testing.T) {
+		path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "mockuse/mock_store_test.go"}
+		scopes := func(opts ...Option) map[string][]types.SymbolScope {
+			squirrel := New(readFile, nil, opts...)
+			defer squirrel.Close()
+			symbols, err := squirrel.getSymbols(context.Background(), path)
+			fatalIfError(t, err)
+			scopes := map[string][]types.SymbolScope{}
+			for _, symbol := range symbols {
+				scopes[symbol.Name] = symbol.Scope
+			}
+			return scopes
+		}
+
+		got := scopes(WithEnclosingScopes())
+		if diff := cmp.Diff([]types.SymbolScope{{Name: "MockStore", Kind: "type"}}, got["Get"]); diff != "" {
+			t.Fatalf("unexpected scope of the method (-want +got):\n%s", diff)
+		}
+		if got["MockStore"] != nil {
+			t.Fatalf("expected no scope for a top-level type, got %v", got["MockStore"])
+		}
+
+		if got := scopes(); got["Get"] != nil {
+			t.Fatalf("expected no scope by default, got %v", got["Get"])
+		}
+	})
+}
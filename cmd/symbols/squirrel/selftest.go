@@ -0,0 +1,83 @@
+package squirrel
+
+import (
+	"context"
+	"sort"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// A minimal file that defines at least one local symbol in a language.
+type selfTestFixture struct {
+	ext      string
+	contents string
+	symbol   string
+}
+
+// Mapping from language name to the fixture used to check its grammar.
+var langToSelfTestFixture = map[string]selfTestFixture{
+	"java":       {ext: "java", contents: "class C { void f() { int x = 1; } }", symbol: "x"},
+	"go":         {ext: "go", contents: "package p\nfunc f() { var x int }", symbol: "x"},
+	"csharp":     {ext: "cs", contents: "class C { void F() { var x = 1; } }", symbol: "x"},
+	"python":     {ext: "py", contents: "def f():\n    x = 1\n", symbol: "x"},
+	"starlark":   {ext: "bzl", contents: "def f():\n    x = 1\n", symbol: "x"},
+	"mojo":       {ext: "mojo", contents: "fn f():\n    var x = 1\n", symbol: "x"},
+	"javascript": {ext: "js", contents: "function f() { const x = 1; }", symbol: "x"},
+	"typescript": {ext: "ts", contents: "function f() { const x = 1; }", symbol: "x"},
+	"cpp":        {ext: "cpp", contents: "void f() { int x = 1; }", symbol: "x"},
+	"ruby":       {ext: "rb", contents: "def f\n  x = 1\nend\n", symbol: "x"},
+	"lua":        {ext: "lua", contents: "local x = 1\n", symbol: "x"},
+	"cuda":       {ext: "cu", contents: "__global__ void f() { int x = 1; }", symbol: "x"},
+	"glsl":       {ext: "glsl", contents: "void main() { float x = 1.0; }", symbol: "x"},
+	"hlsl":       {ext: "hlsl", contents: "void main() { float x = 1.0; }", symbol: "x"},
+	"ocaml":      {ext: "ml", contents: "let f () = let x = 1 in x\n", symbol: "x"},
+	"php":        {ext: "php", contents: "<?php\nfunction f() { $x = 1; }\n", symbol: "x"},
+	"yaml":       {ext: "yml", contents: "a: &x 1\n", symbol: "x"},
+}
+
+// SelfTest checks that every registered grammar can parse a trivial snippet and extract a symbol
+// from it. It returns an error naming each language that failed.
+func SelfTest(ctx context.Context) error {
+	langs := []string{}
+	for lang := range langToLangSpec {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	var errs errors.MultiError
+	for _, lang := range langs {
+		if err := selfTestLang(ctx, lang); err != nil {
+			errs = errors.Append(errs, errors.Wrapf(err, "language %s", lang))
+		}
+	}
+	return errs
+}
+
+// selfTestLang runs the self-test for a single language.
+func selfTestLang(ctx context.Context, lang string) error {
+	fixture, ok := langToSelfTestFixture[lang]
+	if !ok {
+		return errors.New("no self-test fixture")
+	}
+
+	readFile := func(context.Context, types.RepoCommitPath) ([]byte, error) {
+		return []byte(fixture.contents), nil
+	}
+
+	squirrel := New(readFile, nil)
+	squirrel.errorOnParseFailure = true
+	defer squirrel.Close()
+
+	payload, err := squirrel.localCodeIntel(ctx, types.RepoCommitPath{Repo: "selftest", Commit: "selftest", Path: "selftest." + fixture.ext})
+	if err != nil {
+		return err
+	}
+
+	for _, symbol := range payload.Symbols {
+		if symbol.Name == fixture.symbol {
+			return nil
+		}
+	}
+	return errors.Newf("symbol %q not found", fixture.symbol)
+}
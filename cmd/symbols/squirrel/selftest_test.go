@@ -0,0 +1,33 @@
+package squirrel
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/smacker/go-tree-sitter/java"
+)
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(context.Background()); err != nil {
+		t.Fatalf("expected self-test to pass, got: %s", err)
+	}
+
+	// Deliberately break the Go grammar by parsing Go with the Java grammar.
+	original := langToLangSpec["go"]
+	broken := original
+	broken.language = java.GetLanguage()
+	langToLangSpec["go"] = broken
+	t.Cleanup(func() { langToLangSpec["go"] = original })
+
+	err := SelfTest(context.Background())
+	if err == nil {
+		t.Fatal("expected self-test to fail with a broken grammar")
+	}
+	if !strings.Contains(err.Error(), "language go") {
+		t.Fatalf("expected error to name the go language, got: %s", err)
+	}
+	if strings.Contains(err.Error(), "language java") {
+		t.Fatalf("expected error to only name broken languages, got: %s", err)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	sitter "github.com/smacker/go-tree-sitter"
+	"golang.org/x/sync/singleflight"
 
 	symbolsTypes "github.com/sourcegraph/sourcegraph/cmd/symbols/types"
+	"github.com/sourcegraph/sourcegraph/internal/actor"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
 	"github.com/sourcegraph/sourcegraph/internal/types"
@@ -29,18 +32,130 @@ type SquirrelService struct {
 	closables           []func()
 	errorOnParseFailure bool
 	depth               int
+	goGenerateHeuristic bool
+	goMockResolution    bool
+	lowConfidence       bool
+	externalMarkers     bool
+	external            string
+	symbolCache         SymbolCache
+	maxSymbols          int
+	maxFiles            int
+	previewContext      int
+	positionEncoding    PositionEncoding
+	enclosingScopes     bool
+	signatures          bool
+	maxBreadcrumbs      int
+	breadcrumbCount     int
+	treeMemoryLimit     int64
+	evictableTrees      []*trackedTree
+	lexicalFallback     bool
+	stableIDs           bool
+	symbolInfoGroup     *SymbolInfoGroup
+}
+
+// Option configures a SquirrelService.
+type Option func(*SquirrelService)
+
+// WithGoGenerateHeuristic enables resolving arguments of //go:generate directives to declarations in
+// the same package. Such definitions are marked as low-confidence.
+func WithGoGenerateHeuristic() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.goGenerateHeuristic = true
+	}
+}
+
+// WithGoMockResolution makes references to interface methods in Go test files resolve to the
+// method of a mockgen-style mock of the interface (MockX for interface X) in the same package,
+// when there is one.
+func WithGoMockResolution() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.goMockResolution = true
+	}
+}
+
+// WithExternalMarkers makes references to standard library and built-in symbols, which are not
+// defined in the repository, return a definition marked as external instead of nothing.
+func WithExternalMarkers() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.externalMarkers = true
+	}
+}
+
+// WithMaxSymbols caps the number of symbols returned by localCodeIntel. Payloads that exceed the cap
+// are marked as truncated. A cap of 0 means no cap.
+func WithMaxSymbols(max int) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.maxSymbols = max
+	}
+}
+
+// WithMaxFiles caps the number of files AllSymbols processes in one call. Results that hit the cap
+// are marked as truncated. A cap of 0 means no cap.
+func WithMaxFiles(max int) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.maxFiles = max
+	}
+}
+
+// WithPreviewLines makes symbolInfo include a preview of the definition: its line plus up to context
+// lines before and after it. Previews are omitted by default.
+func WithPreviewLines(context int) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.previewContext = context
+	}
+}
+
+// WithEnclosingScopes makes getSymbols and symbolInfo include the chain of symbols enclosing each
+// symbol or definition, like namespace > class > method, for breadcrumbs.
+func WithEnclosingScopes() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.enclosingScopes = true
+	}
+}
+
+// WithSignatures makes symbolInfo include the one-line signature of definitions that are functions,
+// methods or constructors, for hovers.
+func WithSignatures() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.signatures = true
+	}
+}
+
+// WithStableIDs makes getSymbols and symbolInfo include an ID for each symbol or definition that
+// doesn't depend on its position, so it stays the same across commits while the symbol keeps its
+// name, kind and enclosing scopes. See stableID.
+func WithStableIDs() Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.stableIDs = true
+	}
+}
+
+// WithMaxBreadcrumbs caps the number of breadcrumbs kept for debugging. Once the cap is reached,
+// the oldest nested breadcrumbs are pruned first, so the top-level calls that carry the final result
+// are kept. A cap of 0 means no cap.
+func WithMaxBreadcrumbs(max int) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.maxBreadcrumbs = max
+	}
 }
 
 // Creates a new SquirrelService.
-func New(readFile ReadFileFunc, symbolSearch symbolsTypes.SearchFunc) *SquirrelService {
-	return &SquirrelService{
+func New(readFile ReadFileFunc, symbolSearch symbolsTypes.SearchFunc, opts ...Option) *SquirrelService {
+	squirrel := &SquirrelService{
 		readFile:            readFile,
 		symbolSearch:        symbolSearch,
 		breadcrumbs:         []Breadcrumb{},
 		parser:              sitter.NewParser(),
 		closables:           []func(){},
 		errorOnParseFailure: false,
+		symbolCache:         defaultSymbolCache,
+		previewContext:      -1,
+		symbolInfoGroup:     NewSymbolInfoGroup(),
+	}
+	for _, opt := range opts {
+		opt(squirrel)
 	}
+	return squirrel
 }
 
 // Remember to free memory allocated by tree-sitter.
@@ -53,35 +168,64 @@ func (squirrel *SquirrelService) Close() {
 
 // symbolInfo finds the symbol at the given point in a file.
 func (squirrel *SquirrelService) symbolInfo(ctx context.Context, point types.RepoCommitPathPoint) (*types.SymbolInfo, error) {
+	if !Enabled() {
+		return nil, nil
+	}
+
+	squirrel.lowConfidence = false
+	squirrel.external = ""
+
 	// First, find the definition.
 	var def *types.RepoCommitPathMaybeRange
 	{
 		// Parse the file and find the starting node.
 		root, err := squirrel.parse(ctx, point.RepoCommitPath)
+		if squirrel.lexicalFallback && (errors.Is(err, unrecognizedFileExtensionError) || errors.Is(err, unsupportedLanguageError)) {
+			return squirrel.lexicalSymbolInfo(ctx, point)
+		}
 		if err != nil {
 			return nil, err
 		}
+		column := squirrel.positionEncoding.toByteColumn(lineAt(root.Contents, point.Row), point.Column)
 		startNode := root.NamedDescendantForPointRange(
-			sitter.Point{Row: uint32(point.Row), Column: uint32(point.Column)},
-			sitter.Point{Row: uint32(point.Row), Column: uint32(point.Column)},
+			sitter.Point{Row: uint32(point.Row), Column: uint32(column)},
+			sitter.Point{Row: uint32(point.Row), Column: uint32(column)},
 		)
 		if startNode == nil {
 			return nil, errors.New("node is nil")
 		}
 
 		// Now find the definition.
-		found, err := squirrel.getDef(ctx, swapNode(*root, startNode))
+		var found *Node
+		switch {
+		case startNode.Type() == "comment":
+			found, err = squirrel.getDefInComment(ctx, swapNode(*root, startNode), point.Point)
+		case root.LangSpec.name == "yaml":
+			// References in YAML are inside scalars, so the point matters.
+			found, err = squirrel.getDefYaml(ctx, swapNode(*root, startNode), point.Point)
+		default:
+			found, err = squirrel.getDef(ctx, swapNode(*root, startNode))
+		}
 		if err != nil {
 			return nil, err
 		}
 		if found == nil {
+			if squirrel.externalMarkers && squirrel.external != "" {
+				return &types.SymbolInfo{
+					Definition: types.RepoCommitPathMaybeRange{
+						RepoCommitPath: types.RepoCommitPath{Repo: point.Repo, Commit: point.Commit},
+					},
+					External:      true,
+					QualifiedName: squirrel.external,
+				}, nil
+			}
 			return nil, nil
 		}
 		def = &types.RepoCommitPathMaybeRange{
 			RepoCommitPath: found.RepoCommitPath,
 		}
 		if found.Node != nil {
-			rnge := nodeToRange(found.Node)
+			rnge := trimRange(nodeToRange(found.Node), found.Content(found.Contents))
 			def.Range = &rnge
 		}
 	}
@@ -93,8 +237,9 @@ func (squirrel *SquirrelService) symbolInfo(ctx context.Context, point types.Rep
 	if def.Range == nil {
 		hover := fmt.Sprintf("Directory %s", def.RepoCommitPath.Path)
 		return &types.SymbolInfo{
-			Definition: *def,
-			Hover:      &hover,
+			Definition:    *def,
+			Hover:         &hover,
+			LowConfidence: squirrel.lowConfidence,
 		}, nil
 	}
 
@@ -117,13 +262,158 @@ func (squirrel *SquirrelService) symbolInfo(ctx context.Context, point types.Rep
 	result := findHover(swapNode(*root, endNode))
 	hover := &result
 
+	// The preview reuses the contents read to find the hover.
+	var preview []string
+	if squirrel.previewContext >= 0 {
+		preview = previewLines(root.Contents, def.Row, squirrel.previewContext)
+	}
+
+	var scope []types.SymbolScope
+	if squirrel.enclosingScopes {
+		scope = enclosingScopes(endNode, root.Contents)
+	}
+
+	var signature string
+	if squirrel.signatures {
+		signature = renderSignature(endNode, root.Contents)
+	}
+
+	var id string
+	if squirrel.stableIDs {
+		id, err = squirrel.stableIDAt(ctx, def.RepoCommitPath, *def.Range)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Positions have been in bytes so far.
+	rnge := squirrel.positionEncoding.fromByteRange(root.Contents, *def.Range)
+	def.Range = &rnge
+
 	// We have a def, and maybe a hover.
 	return &types.SymbolInfo{
-		Definition: *def,
-		Hover:      hover,
+		Definition:    *def,
+		Hover:         hover,
+		LowConfidence: squirrel.lowConfidence,
+		PreviewLines:  preview,
+		Scope:         scope,
+		Signature:     signature,
+		StableID:      id,
 	}, nil
 }
 
+// SymbolInfoGroup deduplicates concurrent identical symbolInfo calls of the SquirrelServices it is
+// given to with WithSymbolInfoGroup. Calls are identical when they have the same point, options and
+// actor, so the services must read files and search symbols from the same sources.
+type SymbolInfoGroup struct {
+	group singleflight.Group
+	// joined is called when a call joins the group, for tests.
+	joined func()
+}
+
+// NewSymbolInfoGroup creates an empty SymbolInfoGroup.
+func NewSymbolInfoGroup() *SymbolInfoGroup {
+	return &SymbolInfoGroup{}
+}
+
+// WithSymbolInfoGroup makes the SquirrelService share symbolInfo results with the other services in
+// the group, instead of only among its own concurrent calls.
+func WithSymbolInfoGroup(group *SymbolInfoGroup) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.symbolInfoGroup = group
+	}
+}
+
+// sharedSymbolInfoTimeout bounds the shared work of sharedSymbolInfo, which doesn't stop when the
+// caller that started it goes away.
+const sharedSymbolInfoTimeout = time.Minute
+
+// sharedSymbolInfo is like symbolInfo, but concurrent calls for the same point share one computation.
+// Calls only share when they have the same options and actor, because both can change the result.
+// The work runs on a fork of the service with its own context, so a caller that gives up doesn't
+// fail the others, and each caller gets its own copy of the result and the breadcrumbs.
+func (squirrel *SquirrelService) sharedSymbolInfo(ctx context.Context, point types.RepoCommitPathPoint) (*types.SymbolInfo, error) {
+	key := fmt.Sprintf("%s %d:%d actor:%d goGenerate:%t goMock:%t external:%t preview:%d encoding:%d scopes:%t signatures:%t lexical:%t stableIDs:%t bypass:%t",
+		point.RepoCommitPath, point.Row, point.Column,
+		actor.FromContext(ctx).UID,
+		squirrel.goGenerateHeuristic, squirrel.goMockResolution, squirrel.externalMarkers, squirrel.previewContext, squirrel.positionEncoding, squirrel.enclosingScopes, squirrel.signatures, squirrel.lexicalFallback, squirrel.stableIDs,
+		bypassCache(ctx),
+	)
+	results := squirrel.symbolInfoGroup.group.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, sharedSymbolInfoTimeout)
+		defer cancel()
+		worker := squirrel.fork()
+		defer worker.Close()
+		info, err := worker.symbolInfo(ctx, point)
+		return sharedSymbolInfoResult{info: info, breadcrumbs: worker.breadcrumbs.materialize()}, err
+	})
+	if squirrel.symbolInfoGroup.joined != nil {
+		squirrel.symbolInfoGroup.joined()
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-results:
+		shared, _ := r.Val.(sharedSymbolInfoResult)
+		squirrel.breadcrumbs = append(squirrel.breadcrumbs, shared.breadcrumbs...)
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return copySymbolInfo(shared.info), nil
+	}
+}
+
+// sharedSymbolInfoResult is what the callers of sharedSymbolInfo share.
+type sharedSymbolInfoResult struct {
+	info        *types.SymbolInfo
+	breadcrumbs Breadcrumbs
+}
+
+// fork returns a service with the same sources and options but none of the state of a call, so that
+// it can do work that outlives this one.
+func (squirrel *SquirrelService) fork() *SquirrelService {
+	forked := *squirrel
+	forked.breadcrumbs = []Breadcrumb{}
+	forked.parser = sitter.NewParser()
+	forked.closables = []func(){}
+	forked.depth = 0
+	forked.lowConfidence = false
+	forked.external = ""
+	forked.breadcrumbCount = 0
+	forked.evictableTrees = nil
+	return &forked
+}
+
+// copySymbolInfo returns a deep copy of info, so that callers sharing it can change their copy.
+func copySymbolInfo(info *types.SymbolInfo) *types.SymbolInfo {
+	if info == nil {
+		return nil
+	}
+	copied := *info
+	if info.Definition.Range != nil {
+		rnge := *info.Definition.Range
+		copied.Definition.Range = &rnge
+	}
+	if info.Hover != nil {
+		hover := *info.Hover
+		copied.Hover = &hover
+	}
+	copied.PreviewLines = append([]string(nil), info.PreviewLines...)
+	copied.Scope = append([]types.SymbolScope(nil), info.Scope...)
+	return &copied
+}
+
+// detachedContext has the values of its parent, but not its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key any) any         { return c.parent.Value(key) }
+
 // How to read a file from gitserver.
 func readFileFromGitserver(ctx context.Context, repoCommitPath types.RepoCommitPath) ([]byte, error) {
 	cmd := gitserver.NewClient(nil).GitCommand(api.RepoName(repoCommitPath.Repo), "cat-file", "blob", repoCommitPath.Commit+":"+repoCommitPath.Path)
@@ -154,9 +444,19 @@ func (squirrel *SquirrelService) getDef(ctx context.Context, node Node) (*Node,
 	switch node.LangSpec.name {
 	case "java":
 		return squirrel.getDefJava(ctx, node)
-	// case "go":
+	case "python", "mojo":
+		return squirrel.getDefPython(ctx, node)
+	case "starlark":
+		return squirrel.getDefStarlark(ctx, node)
+	case "go":
+		return squirrel.getDefGo(ctx, node)
+	case "lua":
+		return squirrel.getDefLua(ctx, node)
+	case "ocaml":
+		return squirrel.getDefOcaml(ctx, node)
+	case "cuda", "glsl", "hlsl":
+		return squirrel.getDefShader(ctx, node)
 	// case "csharp":
-	// case "python":
 	// case "javascript":
 	// case "typescript":
 	// case "cpp":
@@ -167,6 +467,36 @@ func (squirrel *SquirrelService) getDef(ctx context.Context, node Node) (*Node,
 	}
 }
 
+// getDefInComment finds the definition of a word in a comment using language-specific heuristics.
+// Definitions found this way are marked as low-confidence.
+func (squirrel *SquirrelService) getDefInComment(ctx context.Context, comment Node, point types.Point) (*Node, error) {
+	var found *Node
+	var err error
+	switch comment.LangSpec.name {
+	case "go":
+		if !squirrel.goGenerateHeuristic {
+			return nil, nil
+		}
+		found, err = squirrel.getDefGoGenerate(ctx, comment, point)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if found != nil {
+		squirrel.lowConfidence = true
+	}
+	return found, nil
+}
+
+// markExternal records that the symbol being resolved is defined outside of the repository, e.g. in
+// the standard library, under the given qualified name.
+func (squirrel *SquirrelService) markExternal(node Node, qualifiedName string) {
+	squirrel.breadcrumb(node, fmt.Sprintf("external symbol %s", qualifiedName))
+	squirrel.external = qualifiedName
+}
+
 func (squirrel *SquirrelService) onCall(node Node, arg fmt.Stringer, ret func() fmt.Stringer) func() {
 	caller := ""
 	pc, _, _, ok := runtime.Caller(1)
@@ -209,11 +539,15 @@ func (squirrel *SquirrelService) breadcrumbWithOpts(node Node, message func() st
 		},
 		length:  nodeLength(node.Node),
 		message: message,
-		number:  len(squirrel.breadcrumbs) + 1,
+		number:  squirrel.breadcrumbCount + 1,
 		depth:   squirrel.depth,
 		file:    file,
 		line:    line,
 	}
 
+	squirrel.breadcrumbCount++
 	squirrel.breadcrumbs = append(squirrel.breadcrumbs, breadcrumb)
+	if squirrel.maxBreadcrumbs > 0 && len(squirrel.breadcrumbs) > squirrel.maxBreadcrumbs {
+		squirrel.breadcrumbs.prune()
+	}
 }
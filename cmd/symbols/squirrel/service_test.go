@@ -2,9 +2,12 @@ package squirrel
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/fatih/color"
@@ -14,6 +17,7 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/search"
 	"github.com/sourcegraph/sourcegraph/internal/search/result"
 	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
 
 func init() {
@@ -62,6 +66,10 @@ func TestNonLocalDefinition(t *testing.T) {
 			annotations = append(annotations, collectAnnotations(repoCommitPath, string(contents))...)
 
 			symbols, err := tempSquirrel.getSymbols(context.Background(), repoCommitPath)
+			if errors.Is(err, unrecognizedFileExtensionError) || errors.Is(err, unsupportedLanguageError) {
+				// Not source code, e.g. a go.mod file
+				return nil
+			}
 			fatalIfErrorLabel(t, err, "getSymbols")
 			allSymbols = append(allSymbols, symbols...)
 
@@ -83,6 +91,13 @@ func TestNonLocalDefinition(t *testing.T) {
 					}
 				}
 			}
+			if args.ExcludePattern != "" {
+				match, err := regexp.MatchString(args.ExcludePattern, s.Path)
+				fatalIfErrorLabel(t, err, "matching a pattern")
+				if match {
+					continue nextSymbol
+				}
+			}
 			match, err := regexp.MatchString(args.Query, s.Name)
 			if err != nil {
 				return nil, err
@@ -94,7 +109,7 @@ func TestNonLocalDefinition(t *testing.T) {
 		return results, nil
 	}
 
-	squirrel := New(readFile, ss)
+	squirrel := New(readFile, ss, WithGoGenerateHeuristic())
 	squirrel.errorOnParseFailure = true
 	defer squirrel.Close()
 
@@ -216,3 +231,309 @@ func groupBySymbolAndTag(annotations []annotation) map[string]map[string][]annot
 
 	return grouped
 }
+
+func TestExternalMarkers(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	noSymbols := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		return nil, nil
+	}
+
+	tests := []struct {
+		repo, path, substr string
+		want               string
+	}{
+		{repo: "go1", path: "greet.go", substr: "Println", want: "fmt.Println"},
+		{repo: "go1", path: "greet.go", substr: "len", want: "builtin.len"},
+		{repo: "python1", path: "shapes/show.py", substr: "print", want: "builtins.print"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			contents, err := readFile(context.Background(), types.RepoCommitPath{Repo: test.repo, Path: test.path})
+			fatalIfError(t, err)
+			point := types.RepoCommitPathPoint{RepoCommitPath: types.RepoCommitPath{Repo: test.repo, Commit: "abc", Path: test.path}}
+			for row, line := range strings.Split(string(contents), "\n") {
+				if column := strings.Index(line, test.substr); column != -1 {
+					point.Point = types.Point{Row: row, Column: column}
+					break
+				}
+			}
+
+			disabled := New(readFile, noSymbols)
+			defer disabled.Close()
+			got, err := disabled.symbolInfo(context.Background(), point)
+			fatalIfError(t, err)
+			if got != nil {
+				t.Fatalf("expected no symbolInfo without external markers, got %s", got)
+			}
+
+			enabled := New(readFile, noSymbols, WithExternalMarkers())
+			defer enabled.Close()
+			got, err = enabled.symbolInfo(context.Background(), point)
+			fatalIfError(t, err)
+			if got == nil {
+				t.Fatal("expected an external symbolInfo")
+			}
+			if !got.External || got.QualifiedName != test.want || got.Definition.Range != nil {
+				t.Fatalf("expected external %s without a range, got %+v", test.want, *got)
+			}
+		})
+	}
+}
+
+func TestSymbolInfoPreviewLines(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	// The reference to answer on the line after its definition.
+	point := types.RepoCommitPathPoint{
+		RepoCommitPath: types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "preview.go"},
+		Point:          types.Point{Row: 4, Column: 8},
+	}
+
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "disabled by default",
+			want: nil,
+		},
+		{
+			name: "definition line only",
+			opts: []Option{WithPreviewLines(0)},
+			want: []string{"\tanswer := 42"},
+		},
+		{
+			name: "with context",
+			opts: []Option{WithPreviewLines(1)},
+			want: []string{"func preview() int {", "\tanswer := 42", "\treturn answer"},
+		},
+		{
+			name: "window larger than the file",
+			opts: []Option{WithPreviewLines(10)},
+			want: []string{"package main", "", "func preview() int {", "\tanswer := 42", "\treturn answer", "}"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			squirrel := New(readFile, nil, tc.opts...)
+			defer squirrel.Close()
+
+			info, err := squirrel.symbolInfo(context.Background(), point)
+			fatalIfError(t, err)
+			if info == nil {
+				t.Fatal("no symbolInfo")
+			}
+			if diff := cmp.Diff(tc.want, info.PreviewLines); diff != "" {
+				t.Fatalf("unexpected preview (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSharedSymbolInfo(t *testing.T) {
+	point := types.RepoCommitPathPoint{
+		RepoCommitPath: types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "preview.go"},
+		Point:          types.Point{Row: 4, Column: 8},
+	}
+
+	// Count the reads of a single resolution.
+	var mu sync.Mutex
+	reads := 0
+	countingReadFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	squirrel := New(countingReadFile, nil)
+	want, err := squirrel.symbolInfo(context.Background(), point)
+	fatalIfError(t, err)
+	squirrel.Close()
+	readsPerResolution := reads
+	reads = 0
+
+	// Hold up the reads until every request has joined the group, so they all overlap.
+	release := make(chan struct{})
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		<-release
+		return countingReadFile(ctx, path)
+	}
+	group := NewSymbolInfoGroup()
+	joined := make(chan struct{})
+	group.joined = func() { joined <- struct{}{} }
+
+	// The request that starts the work gives up before it's done.
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		squirrel := New(readFile, nil, WithSymbolInfoGroup(group))
+		defer squirrel.Close()
+		_, err := squirrel.sharedSymbolInfo(leaderCtx, point)
+		leaderErr <- err
+	}()
+	<-joined
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([]*types.SymbolInfo, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			squirrel := New(readFile, nil, WithSymbolInfoGroup(group))
+			defer squirrel.Close()
+			info, err := squirrel.sharedSymbolInfo(context.Background(), point)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = info
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		<-joined
+	}
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the canceled request to fail with context.Canceled, got %v", err)
+	}
+	close(release)
+	wg.Wait()
+
+	if reads != readsPerResolution {
+		t.Fatalf("expected the resolution to run once (%d reads), got %d reads", readsPerResolution, reads)
+	}
+	for _, got := range results {
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected symbolInfo (-want +got):\n%s", diff)
+		}
+	}
+
+	// Each request gets its own copy.
+	results[0].Definition.Range.Row++
+	if diff := cmp.Diff(want, results[1]); diff != "" {
+		t.Fatalf("changing one result changed another (-want +got):\n%s", diff)
+	}
+
+	// Services that aren't given a group don't share with each other.
+	reads = 0
+	group.joined = nil
+	for i := 0; i < 2; i++ {
+		squirrel := New(countingReadFile, nil)
+		_, err := squirrel.sharedSymbolInfo(context.Background(), point)
+		fatalIfError(t, err)
+		squirrel.Close()
+	}
+	if reads != 2*readsPerResolution {
+		t.Fatalf("expected separate services to resolve separately (%d reads), got %d reads", 2*readsPerResolution, reads)
+	}
+}
+
+func TestPositionEncoding(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	// Each line has an emoji (4 bytes, 2 UTF-16 units) and an é (2 bytes, 1 UTF-16 unit) before the
+	// symbol.
+	path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "unicode.go"}
+
+	for _, tc := range []struct {
+		name      string
+		encoding  PositionEncoding
+		refColumn int
+		defColumn int
+		symColumn int
+	}{
+		{name: "utf-8", encoding: UTF8, refColumn: 21, defColumn: 14, symColumn: 17},
+		{name: "utf-16", encoding: UTF16, refColumn: 18, defColumn: 11, symColumn: 14},
+		{name: "utf-32", encoding: UTF32, refColumn: 17, defColumn: 10, symColumn: 13},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			squirrel := New(readFile, nil, WithPositionEncoding(tc.encoding))
+			defer squirrel.Close()
+
+			point := types.RepoCommitPathPoint{RepoCommitPath: path, Point: types.Point{Row: 6, Column: tc.refColumn}}
+			info, err := squirrel.symbolInfo(context.Background(), point)
+			fatalIfError(t, err)
+			if info == nil || info.Definition.Range == nil {
+				t.Fatal("no definition")
+			}
+			want := types.Range{Row: 5, Column: tc.defColumn, Length: 6}
+			if diff := cmp.Diff(want, *info.Definition.Range); diff != "" {
+				t.Fatalf("unexpected definition range (-want +got):\n%s", diff)
+			}
+
+			symbols, err := squirrel.getSymbols(context.Background(), path)
+			fatalIfError(t, err)
+			found := false
+			for _, symbol := range symbols {
+				if symbol.Name == "unicodeTarget" {
+					found = true
+					if symbol.Line != 2 || symbol.Character != tc.symColumn {
+						t.Fatalf("unexpected unicodeTarget position %d:%d, want 2:%d", symbol.Line, symbol.Character, tc.symColumn)
+					}
+				}
+			}
+			if !found {
+				t.Fatal("unicodeTarget not found")
+			}
+		})
+	}
+}
+
+func TestMaxBreadcrumbs(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	path := types.RepoCommitPath{Repo: "java1", Commit: "abc", Path: "src/sub/Sample.java"}
+	contents, err := readFile(context.Background(), path)
+	fatalIfError(t, err)
+	// C1.C2.f2 resolves through the outer class, the nested class and its field.
+	point := types.RepoCommitPathPoint{RepoCommitPath: path}
+	for row, line := range strings.Split(string(contents), "\n") {
+		if strings.Contains(line, "C1.C2.f2;") {
+			point.Point = types.Point{Row: row, Column: strings.LastIndex(line, "f2")}
+		}
+	}
+
+	resolve := func(opts ...Option) (*types.SymbolInfo, Breadcrumbs) {
+		squirrel := New(readFile, nil, opts...)
+		defer squirrel.Close()
+		info, err := squirrel.symbolInfo(context.Background(), point)
+		fatalIfError(t, err)
+		if info == nil {
+			t.Fatal("no symbolInfo")
+		}
+		return info, squirrel.breadcrumbs
+	}
+
+	const max = 3
+	want, all := resolve()
+	if len(all) <= max {
+		t.Fatalf("expected the resolution to leave more than %d breadcrumbs, got %d", max, len(all))
+	}
+
+	got, kept := resolve(WithMaxBreadcrumbs(max))
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("the cap changed the result (-want +got):\n%s", diff)
+	}
+	if len(kept) != max {
+		t.Fatalf("want %d breadcrumbs, got %d", max, len(kept))
+	}
+	// The top-level call that records the final result is kept, along with the latest steps.
+	if kept[0].number != 1 || kept[0].message() != all[0].message() {
+		t.Fatalf("want the first breadcrumb kept, got #%d %q", kept[0].number, kept[0].message())
+	}
+	if last := kept[len(kept)-1]; last.number != len(all) {
+		t.Fatalf("want the last breadcrumb to be #%d, got #%d", len(all), last.number)
+	}
+
+	sb := &strings.Builder{}
+	kept.pretty(sb, readFile)
+	if want := fmt.Sprintf("(%d breadcrumbs pruned)", len(all)-max); !strings.Contains(sb.String(), want) {
+		t.Fatalf("expected the output to mention %q", want)
+	}
+}
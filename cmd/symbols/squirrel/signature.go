@@ -0,0 +1,50 @@
+package squirrel
+
+import (
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// signatureEndFields are the fields that can end the header of a callable declaration without a
+// body.
+var signatureEndFields = []string{"result", "return_type", "type", "parameters", "declarator", "name"}
+
+// renderSignature returns the header of the function, method or constructor named by the node,
+// e.g. func Foo(ctx context.Context, x int) (Bar, error), on one line. It returns "" when the node
+// doesn't name a callable.
+func renderSignature(name *sitter.Node, contents []byte) string {
+	// The nearest enclosing declaration has to be a callable named by the node.
+	decl := name.Parent()
+	for decl != nil && scopeName(decl) == nil {
+		decl = decl.Parent()
+	}
+	if decl == nil || nodeId(scopeName(decl)) != nodeId(name) {
+		return ""
+	}
+	switch scopeKinds[decl.Type()] {
+	case "function", "method", "constructor":
+	default:
+		return ""
+	}
+
+	// The header runs up to the body. Ruby has no body field, and declarations without a body, like
+	// abstract methods, end with their last part.
+	var end uint32
+	if body := decl.ChildByFieldName("body"); body != nil {
+		end = body.StartByte()
+	} else {
+		for _, field := range signatureEndFields {
+			if child := decl.ChildByFieldName(field); child != nil && child.EndByte() > end {
+				end = child.EndByte()
+			}
+		}
+	}
+
+	if end <= decl.StartByte() {
+		return ""
+	}
+	signature := strings.Join(strings.Fields(string(contents[decl.StartByte():end])), " ")
+	// Python puts a colon before the body.
+	return strings.TrimSuffix(signature, ":")
+}
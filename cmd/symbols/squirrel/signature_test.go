@@ -0,0 +1,71 @@
+package squirrel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestSignature(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		repo   string
+		path   string
+		line   string
+		substr string
+		want   string
+	}{
+		{name: "go function", repo: "go1", path: "signature.go", line: "bar, _ := Foo", substr: "Foo", want: "func Foo(ctx context.Context, x int) (Bar, error)"},
+		{name: "go method", repo: "go1", path: "store/memory.go", line: "func (s *MemoryStore) Get", substr: "Get", want: "func (s *MemoryStore) Get(id int) (*Widget, error)"},
+		{name: "java method", repo: "java1", path: "src/scopes/Outer.java", line: "int count", substr: "count", want: "int count(int limit)"},
+		{name: "python method", repo: "python1", path: "shapes/base.py", line: "def greet", substr: "greet", want: "def greet(self)"},
+		{name: "go variable", repo: "go1", path: "signature.go", line: "_ = bar", substr: "bar", want: ""},
+		{name: "go type", repo: "go1", path: "signature.go", line: "type Bar", substr: "Bar", want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := types.RepoCommitPath{Repo: tc.repo, Commit: "abc", Path: tc.path}
+			contents, err := readFile(context.Background(), path)
+			fatalIfError(t, err)
+			var point *types.Point
+			for row, line := range strings.Split(string(contents), "\n") {
+				if strings.Contains(line, tc.line) {
+					point = &types.Point{Row: row, Column: strings.Index(line, tc.substr)}
+					break
+				}
+			}
+			if point == nil {
+				t.Fatalf("no line containing %q", tc.line)
+			}
+
+			squirrel := New(readFile, nil, WithSignatures())
+			defer squirrel.Close()
+			info, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: *point})
+			fatalIfError(t, err)
+			if info == nil {
+				t.Fatal("no symbolInfo")
+			}
+			if info.Signature != tc.want {
+				t.Fatalf("want signature %q, got %q", tc.want, info.Signature)
+			}
+		})
+	}
+
+	t.Run("off by default", func(t *testing.T) {
+		path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "store/memory.go"}
+		squirrel := New(readFile, nil)
+		defer squirrel.Close()
+		info, err := squirrel.symbolInfo(context.Background(), types.RepoCommitPathPoint{RepoCommitPath: path, Point: types.Point{Row: 10, Column: 22}})
+		fatalIfError(t, err)
+		if info == nil || info.Signature != "" {
+			t.Fatalf("expected no signature by default, got %v", info)
+		}
+	})
+}
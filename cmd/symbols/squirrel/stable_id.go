@@ -0,0 +1,40 @@
+package squirrel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// stableID derives an ID for the symbol from its path, its enclosing scopes, its name and its kind,
+// but not its position, so moving the symbol within its file keeps the ID. The scopes have to be set
+// on the symbol.
+func stableID(symbol result.Symbol) string {
+	parts := []string{symbol.Path}
+	for _, scope := range symbol.Scope {
+		parts = append(parts, scope.Kind+" "+scope.Name)
+	}
+	parts = append(parts, symbol.Kind+" "+symbol.Name)
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// stableIDAt returns the stable ID of the symbol of the file whose name is at the given byte range, or
+// "" when there is no such symbol, e.g. for a local variable.
+func (squirrel *SquirrelService) stableIDAt(ctx context.Context, path types.RepoCommitPath, rnge types.Range) (string, error) {
+	symbols, _, err := squirrel.getSymbolsInBytes(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	for _, symbol := range symbols {
+		if symbol.Line == rnge.Row && symbol.Character == rnge.Column {
+			return stableID(symbol), nil
+		}
+	}
+	return "", nil
+}
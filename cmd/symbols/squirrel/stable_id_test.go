@@ -0,0 +1,117 @@
+package squirrel
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/regexp"
+
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestStableID(t *testing.T) {
+	// Between the two versions, a function is added above the methods, so they move down.
+	versions := map[string]string{
+		"v1": `package store
+
+type Store struct{}
+
+func (s *Store) Get(id int) int { return id }
+
+type Cache struct{}
+
+func (c *Cache) Get(id int) int { return id }
+
+func use(s *Store) int { return s.Get(1) }
+`,
+		"v2": `package store
+
+func helper() {}
+
+type Store struct{}
+
+// Get returns the item.
+func (s *Store) Get(id int) int { return id }
+
+type Cache struct{}
+
+func (c *Cache) Get(id int) int { return id }
+
+func use(s *Store) int { return s.Get(1) }
+`,
+	}
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return []byte(versions[path.Commit]), nil
+	}
+	// Method lookups go through the symbol search.
+	symbolSearch := func(ctx context.Context, args search.SymbolsParameters) (result.Symbols, error) {
+		indexer := New(readFile, nil)
+		defer indexer.Close()
+		symbols, err := indexer.getSymbols(ctx, types.RepoCommitPath{Repo: string(args.Repo), Commit: string(args.CommitID), Path: "store.go"})
+		if err != nil {
+			return nil, err
+		}
+		results := result.Symbols{}
+		for _, symbol := range symbols {
+			if match, _ := regexp.MatchString(args.Query, symbol.Name); match {
+				results = append(results, symbol)
+			}
+		}
+		return results, nil
+	}
+	squirrel := New(readFile, symbolSearch, WithStableIDs(), WithSymbolCache(&fakeSharedCache{values: map[string][]byte{}}))
+	defer squirrel.Close()
+
+	// Returns the symbol that is the method Get of the given receiver at the given version.
+	getMethod := func(commit, receiver string) result.Symbol {
+		t.Helper()
+		symbols, err := squirrel.getSymbols(context.Background(), types.RepoCommitPath{Repo: "repo", Commit: commit, Path: "store.go"})
+		fatalIfError(t, err)
+		lines := strings.Split(versions[commit], "\n")
+		for _, symbol := range symbols {
+			if symbol.Name == "Get" && strings.Contains(lines[symbol.Line], "*"+receiver+")") {
+				if symbol.StableID == "" {
+					t.Fatalf("no stable ID for %s.Get", receiver)
+				}
+				return symbol
+			}
+		}
+		t.Fatalf("no method %s.Get at %s", receiver, commit)
+		return result.Symbol{}
+	}
+
+	before, after := getMethod("v1", "Store"), getMethod("v2", "Store")
+	if before.Line == after.Line {
+		t.Fatalf("expected the method to move, but it's on line %d in both versions", before.Line)
+	}
+	if before.StableID != after.StableID {
+		t.Fatalf("expected the stable ID to be unchanged after moving, got %s and %s", before.StableID, after.StableID)
+	}
+	if other := getMethod("v2", "Cache"); other.StableID == after.StableID {
+		t.Fatal("expected methods of different types to have different stable IDs")
+	}
+
+	// symbolInfo reports the same ID for the definition of a reference.
+	for commit, symbol := range map[string]result.Symbol{"v1": before, "v2": after} {
+		lines := strings.Split(versions[commit], "\n")
+		for row, line := range lines {
+			if column := strings.Index(line, "s.Get(1)"); column != -1 {
+				point := types.RepoCommitPathPoint{
+					RepoCommitPath: types.RepoCommitPath{Repo: "repo", Commit: commit, Path: "store.go"},
+					Point:          types.Point{Row: row, Column: column + len("s.")},
+				}
+				info, err := squirrel.symbolInfo(context.Background(), point)
+				fatalIfError(t, err)
+				if info == nil || info.Definition.Range == nil || info.Definition.Row != symbol.Line {
+					t.Fatalf("expected the definition of s.Get at %s to be on line %d, got %v", commit, symbol.Line, info)
+				}
+				if info.StableID != symbol.StableID {
+					t.Fatalf("expected the definition at %s to have stable ID %s, got %q", commit, symbol.StableID, info.StableID)
+				}
+			}
+		}
+	}
+}
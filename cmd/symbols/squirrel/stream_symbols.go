@@ -0,0 +1,77 @@
+package squirrel
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// StreamSymbols is like getSymbols, but calls f on each symbol in document order as soon as it is
+// found instead of returning them all at the end. An error from f stops the walk and is returned.
+// The symbols are only cached when the walk completes.
+func (s *SquirrelService) StreamSymbols(ctx context.Context, repoCommitPath types.RepoCommitPath, f func(result.Symbol) error) error {
+	if !Enabled() {
+		return nil
+	}
+
+	langSpec, err := langSpecForPath(repoCommitPath.Path)
+	if err != nil {
+		return err
+	}
+
+	contents, err := s.readFile(ctx, repoCommitPath)
+	if err != nil {
+		return err
+	}
+
+	emit := func(symbol result.Symbol) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.stableIDs {
+			symbol.StableID = stableID(symbol)
+		}
+		if !s.enclosingScopes {
+			symbol.Scope = nil
+		}
+		if s.positionEncoding != UTF8 {
+			symbol.Character = s.positionEncoding.fromByteColumn(lineAt(contents, symbol.Line), symbol.Character)
+		}
+		return f(symbol)
+	}
+
+	key := symbolCacheKey(repoCommitPath, contents)
+	bypass := bypassCache(ctx)
+	if !bypass {
+		if b, ok := s.symbolCache.Get(key); ok {
+			var symbols result.Symbols
+			if err := json.Unmarshal(b, &symbols); err == nil {
+				for _, symbol := range symbols {
+					if err := emit(symbol); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+		}
+	}
+
+	symbols := result.Symbols{}
+	err = s.parseForSymbols(ctx, repoCommitPath, langSpec, contents, func(root *Node) error {
+		return walkSymbols(root, func(symbol result.Symbol) error {
+			symbols = append(symbols, symbol)
+			return emit(symbol)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if b, err := json.Marshal(symbols); err == nil && !bypass {
+		s.symbolCache.Set(key, b)
+	}
+
+	return nil
+}
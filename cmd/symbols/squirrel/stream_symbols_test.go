@@ -0,0 +1,92 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+func TestStreamSymbols(t *testing.T) {
+	contents := &strings.Builder{}
+	fmt.Fprintln(contents, "package big")
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(contents, "func f%d() {}\n", i)
+	}
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return []byte(contents.String()), nil
+	}
+	path := types.RepoCommitPath{Repo: "big", Commit: "abc", Path: "big.go"}
+	ctx := context.Background()
+
+	reference := New(readFile, nil)
+	defer reference.Close()
+	want, err := reference.getSymbols(ctx, path)
+	fatalIfError(t, err)
+
+	cache := &fakeSharedCache{values: map[string][]byte{}}
+	squirrel := New(readFile, nil, WithSymbolCache(cache))
+	defer squirrel.Close()
+
+	t.Run("abort", func(t *testing.T) {
+		errStop := errors.New("stop")
+		calls := 0
+		err := squirrel.StreamSymbols(ctx, path, func(result.Symbol) error {
+			calls++
+			if calls == 3 {
+				return errStop
+			}
+			return nil
+		})
+		if !errors.Is(err, errStop) {
+			t.Fatalf("expected the callback's error, got %v", err)
+		}
+		if calls != 3 {
+			t.Fatalf("expected the walk to stop after 3 symbols, got %d", calls)
+		}
+		if cache.sets != 0 {
+			t.Fatal("expected an aborted walk not to be cached")
+		}
+	})
+
+	t.Run("incremental", func(t *testing.T) {
+		got := result.Symbols{}
+		err := squirrel.StreamSymbols(ctx, path, func(symbol result.Symbol) error {
+			// Symbols are cached once the walk completes, so an empty cache means that the symbol
+			// arrived while the walk was still going.
+			if cache.sets != 0 {
+				t.Fatalf("symbol %s arrived after the walk completed", symbol.Name)
+			}
+			got = append(got, symbol)
+			return nil
+		})
+		fatalIfError(t, err)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected symbols (-want +got):\n%s", diff)
+		}
+		if cache.sets != 1 {
+			t.Fatalf("expected the symbols to be cached once, got %d", cache.sets)
+		}
+	})
+
+	t.Run("from the cache", func(t *testing.T) {
+		got := result.Symbols{}
+		err := squirrel.StreamSymbols(ctx, path, func(symbol result.Symbol) error {
+			got = append(got, symbol)
+			return nil
+		})
+		fatalIfError(t, err)
+		if cache.hits == 0 {
+			t.Fatal("expected a cache hit")
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("unexpected symbols (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package squirrel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/sourcegraph/sourcegraph/internal/search/result"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// SymbolCache stores the symbols extracted from files, serialized as JSON. Keys include the repo,
+// commit, path, and a hash of the file contents, so entries never go stale. *rcache.Cache satisfies
+// this interface, which allows replicas to share results through Redis.
+type SymbolCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, b []byte)
+}
+
+// memorySymbolCache is an in-process SymbolCache backed by an LRU cache.
+type memorySymbolCache struct {
+	cache *lru.Cache
+}
+
+// NewMemorySymbolCache creates an in-process SymbolCache that holds up to size files.
+func NewMemorySymbolCache(size int) (SymbolCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &memorySymbolCache{cache: cache}, nil
+}
+
+func (c *memorySymbolCache) Get(key string) ([]byte, bool) {
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+func (c *memorySymbolCache) Set(key string, b []byte) {
+	c.cache.Add(key, b)
+}
+
+// entries returns the cached entries, oldest first, so that adding them back in order keeps the
+// most recently used ones.
+func (c *memorySymbolCache) entries() []symbolCacheEntry {
+	var entries []symbolCacheEntry
+	for _, key := range c.cache.Keys() {
+		if v, ok := c.cache.Peek(key); ok {
+			entries = append(entries, symbolCacheEntry{Key: key.(string), Symbols: v.([]byte)})
+		}
+	}
+	return entries
+}
+
+const defaultSymbolCacheSize = 1000
+
+// defaultSymbolCache is shared by all SquirrelServices that aren't given a cache.
+var defaultSymbolCache = func() SymbolCache {
+	cache, err := NewMemorySymbolCache(defaultSymbolCacheSize)
+	if err != nil {
+		panic(err)
+	}
+	return cache
+}()
+
+// WithSymbolCache makes the SquirrelService store extracted symbols in the given cache instead of the
+// default in-process cache.
+func WithSymbolCache(cache SymbolCache) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.symbolCache = cache
+	}
+}
+
+// symbolCacheKey returns the cache key for the symbols of a file with the given contents.
+func symbolCacheKey(repoCommitPath types.RepoCommitPath, contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return fmt.Sprintf("%s@%s:%s#%s", repoCommitPath.Repo, repoCommitPath.Commit, repoCommitPath.Path, hex.EncodeToString(sum[:]))
+}
+
+// symbolCacheSnapshotVersion is bumped when the snapshot format or the extracted symbols change, so
+// that snapshots written by older versions are discarded.
+const symbolCacheSnapshotVersion = 2
+
+// symbolCacheSnapshot is the on-disk form of a symbol cache, written by SaveCache.
+type symbolCacheSnapshot struct {
+	Version int
+	Entries []symbolCacheEntry
+}
+
+type symbolCacheEntry struct {
+	Key string
+	// ContentHash is the hash of Symbols, so that a corrupt entry can be told apart from a good one.
+	ContentHash string
+	Symbols     json.RawMessage
+}
+
+// enumerableSymbolCache is implemented by SymbolCaches that can list their entries, which SaveCache
+// needs.
+type enumerableSymbolCache interface {
+	entries() []symbolCacheEntry
+}
+
+// SaveCache writes the symbol cache to a file at path, so that it can be loaded with LoadCache after
+// a restart instead of parsing the files again. Only the extracted symbols are saved, not the syntax
+// trees. It fails if the cache can't list its entries, like external caches.
+func (s *SquirrelService) SaveCache(path string) error {
+	cache, ok := s.symbolCache.(enumerableSymbolCache)
+	if !ok {
+		return errors.Newf("symbol cache %T can't be saved", s.symbolCache)
+	}
+
+	snapshot := symbolCacheSnapshot{Version: symbolCacheSnapshotVersion}
+	for _, entry := range cache.entries() {
+		entry.ContentHash = payloadHash(entry.Symbols)
+		snapshot.Entries = append(snapshot.Entries, entry)
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a partial snapshot behind.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating symbol cache snapshot")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing symbol cache snapshot")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing symbol cache snapshot")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "writing symbol cache snapshot")
+}
+
+// LoadCache adds the entries of a file written by SaveCache to the symbol cache. Entries whose symbols
+// don't match their hash or don't decode are discarded, as is the whole file when it was written by
+// another version. A missing file is not an error, so that the first start
+// works.
+func (s *SquirrelService) LoadCache(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading symbol cache snapshot")
+	}
+
+	var snapshot symbolCacheSnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return errors.Wrap(err, "decoding symbol cache snapshot")
+	}
+	if snapshot.Version != symbolCacheSnapshotVersion {
+		return nil
+	}
+
+	for _, entry := range snapshot.Entries {
+		if entry.ContentHash != payloadHash(entry.Symbols) {
+			continue
+		}
+		var symbols result.Symbols
+		if err := json.Unmarshal(entry.Symbols, &symbols); err != nil {
+			continue
+		}
+		s.symbolCache.Set(entry.Key, entry.Symbols)
+	}
+	return nil
+}
+
+// payloadHash returns the hash of the serialized symbols of a snapshot entry.
+func payloadHash(symbols []byte) string {
+	sum := sha256.Sum256(symbols)
+	return hex.EncodeToString(sum[:])
+}
+
+// PrewarmStats reports the work done by Prewarm.
+type PrewarmStats struct {
+	// Files is the number of files parsed.
+	Files int
+	// Symbols is the number of symbols extracted from them.
+	Symbols int
+	// Skipped is the number of files that were already cached or aren't supported.
+	Skipped int
+	// EstimatedBytes is the size of the serialized symbols.
+	EstimatedBytes int
+}
+
+// Prewarm extracts the symbols of the given files into the symbol cache so that later requests
+// don't have to parse them. With dryRun, the files are still parsed but nothing is cached, which
+// tells operators how much a real run would add to the cache.
+func (s *SquirrelService) Prewarm(ctx context.Context, paths []types.RepoCommitPath, dryRun bool) (PrewarmStats, error) {
+	var stats PrewarmStats
+	for _, path := range paths {
+		langSpec, err := langSpecForPath(path.Path)
+		if err != nil {
+			stats.Skipped++
+			continue
+		}
+
+		contents, err := s.readFile(ctx, path)
+		if err != nil {
+			return stats, err
+		}
+		key := symbolCacheKey(path, contents)
+		if _, ok := s.symbolCache.Get(key); ok {
+			stats.Skipped++
+			continue
+		}
+
+		var symbols result.Symbols
+		err = s.parseForSymbols(ctx, path, langSpec, contents, func(root *Node) (err error) {
+			symbols, err = extractSymbols(root)
+			return err
+		})
+		if err != nil {
+			return stats, err
+		}
+		b, err := json.Marshal(symbols)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Files++
+		stats.Symbols += len(symbols)
+		stats.EstimatedBytes += len(key) + len(b)
+		if !dryRun {
+			s.symbolCache.Set(key, b)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,203 @@
+package squirrel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// fakeSharedCache is a SymbolCache that counts hits, like an external cache shared by replicas.
+type fakeSharedCache struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	hits   int
+	sets   int
+}
+
+func (c *fakeSharedCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.values[key]
+	if ok {
+		c.hits++
+	}
+	return b, ok
+}
+
+func (c *fakeSharedCache) Set(key string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = b
+	c.sets++
+}
+
+func TestSharedSymbolCache(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "store/store.go"}
+	shared := &fakeSharedCache{values: map[string][]byte{}}
+
+	// The first pod parses the file and fills the shared cache.
+	pod1 := New(readFile, nil, WithSymbolCache(shared))
+	defer pod1.Close()
+	want, err := pod1.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	if len(want) == 0 {
+		t.Fatal("expected symbols")
+	}
+	if shared.hits != 0 || shared.sets != 1 {
+		t.Fatalf("expected a miss and a set, got %d hits and %d sets", shared.hits, shared.sets)
+	}
+
+	// The second pod gets the symbols from the shared cache without parsing.
+	pod2 := New(readFile, nil, WithSymbolCache(shared))
+	defer pod2.Close()
+	got, err := pod2.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	if shared.hits != 1 || shared.sets != 1 {
+		t.Fatalf("expected a hit, got %d hits and %d sets", shared.hits, shared.sets)
+	}
+	if len(pod2.closables) != 0 {
+		t.Fatal("expected the second pod not to parse the file")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected symbols from the shared cache (-want +got):\n%s", diff)
+	}
+
+	// Changing the contents changes the key.
+	changed := New(func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		contents, err := readFile(ctx, path)
+		return append(contents, []byte("\nfunc Extra() {}\n")...), err
+	}, nil, WithSymbolCache(shared))
+	defer changed.Close()
+	_, err = changed.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	if shared.sets != 2 {
+		t.Fatalf("expected changed contents to miss the cache, got %d sets", shared.sets)
+	}
+}
+
+func TestPrewarmDryRun(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	paths := []types.RepoCommitPath{
+		{Repo: "go1", Commit: "abc", Path: "store/store.go"},
+		{Repo: "go1", Commit: "abc", Path: "main.go"},
+		{Repo: "go1", Commit: "abc", Path: "go.mod"},
+	}
+	cache := &fakeSharedCache{values: map[string][]byte{}}
+	squirrel := New(readFile, nil, WithSymbolCache(cache))
+	defer squirrel.Close()
+
+	wantSymbols := 0
+	for _, path := range paths[:2] {
+		symbols, err := New(readFile, nil, WithSymbolCache(&fakeSharedCache{values: map[string][]byte{}})).getSymbols(context.Background(), path)
+		fatalIfError(t, err)
+		wantSymbols += len(symbols)
+	}
+
+	dry, err := squirrel.Prewarm(context.Background(), paths, true)
+	fatalIfError(t, err)
+	if dry.Files != 2 || dry.Skipped != 1 || dry.Symbols != wantSymbols || dry.EstimatedBytes == 0 {
+		t.Fatalf("unexpected dry run stats %+v, want 2 files, 1 skipped, %d symbols", dry, wantSymbols)
+	}
+	if len(cache.values) != 0 {
+		t.Fatalf("expected the cache to be empty after a dry run, got %d entries", len(cache.values))
+	}
+
+	// A real run does the same work and fills the cache with what the dry run reported.
+	full, err := squirrel.Prewarm(context.Background(), paths, false)
+	fatalIfError(t, err)
+	if diff := cmp.Diff(dry, full); diff != "" {
+		t.Fatal(diff)
+	}
+	size := 0
+	for key, b := range cache.values {
+		size += len(key) + len(b)
+	}
+	if len(cache.values) != 2 || size != full.EstimatedBytes {
+		t.Fatalf("expected 2 entries taking %d bytes, got %d entries taking %d bytes", full.EstimatedBytes, len(cache.values), size)
+	}
+}
+
+func TestSaveAndLoadCache(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	path := types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "store/store.go"}
+	snapshot := filepath.Join(t.TempDir(), "symbols.json")
+
+	newService := func() *SquirrelService {
+		cache, err := NewMemorySymbolCache(10)
+		fatalIfError(t, err)
+		return New(readFile, nil, WithSymbolCache(cache))
+	}
+
+	before := newService()
+	defer before.Close()
+	want, err := before.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	fatalIfError(t, before.SaveCache(snapshot))
+
+	// After a restart, the loaded symbols are used without parsing.
+	after := newService()
+	defer after.Close()
+	fatalIfError(t, after.LoadCache(snapshot))
+	got, err := after.getSymbols(context.Background(), path)
+	fatalIfError(t, err)
+	if len(after.closables) != 0 {
+		t.Fatal("expected the loaded cache to avoid parsing the file")
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected symbols from the loaded cache (-want +got):\n%s", diff)
+	}
+
+	// An entry whose symbols don't match its hash is discarded, even if they still decode.
+	b, err := os.ReadFile(snapshot)
+	fatalIfError(t, err)
+	var good symbolCacheSnapshot
+	fatalIfError(t, json.Unmarshal(b, &good))
+	for name, corrupt := range map[string]func(entry *symbolCacheEntry){
+		"stale hash": func(entry *symbolCacheEntry) {
+			entry.ContentHash = strings.Repeat("0", 64)
+		},
+		"flipped payload byte": func(entry *symbolCacheEntry) {
+			i := bytes.Index(entry.Symbols, []byte(`"Name":"`)) + len(`"Name":"`)
+			entry.Symbols = append(json.RawMessage{}, entry.Symbols...)
+			entry.Symbols[i]++
+		},
+	} {
+		s := symbolCacheSnapshot{Version: good.Version, Entries: append([]symbolCacheEntry{}, good.Entries...)}
+		corrupt(&s.Entries[0])
+		b, err := json.Marshal(s)
+		fatalIfError(t, err)
+		fatalIfError(t, os.WriteFile(snapshot, b, 0600))
+		stale := newService()
+		defer stale.Close()
+		fatalIfError(t, stale.LoadCache(snapshot))
+		_, err = stale.getSymbols(context.Background(), path)
+		fatalIfError(t, err)
+		if len(stale.closables) == 0 {
+			t.Fatalf("%s: expected the corrupt entry to be discarded", name)
+		}
+	}
+
+	// A missing snapshot is not an error, but a cache that can't be listed can't be saved.
+	fatalIfError(t, newService().LoadCache(filepath.Join(t.TempDir(), "missing.json")))
+	shared := New(readFile, nil, WithSymbolCache(&fakeSharedCache{values: map[string][]byte{}}))
+	defer shared.Close()
+	if err := shared.SaveCache(snapshot); err == nil {
+		t.Fatal("expected an error saving a cache that can't be listed")
+	}
+}
@@ -0,0 +1,138 @@
+package squirrel
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// Graph is the reference graph of a single file.
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a symbol defined in the file.
+type GraphNode struct {
+	Name string `json:"name"`
+	// Kind is the kind reported by getSymbols, and is empty for local symbols.
+	Kind  string      `json:"kind,omitempty"`
+	Range types.Range `json:"range"`
+}
+
+// GraphEdge goes from a reference to its definition.
+type GraphEdge struct {
+	Name string      `json:"name"`
+	From types.Range `json:"from"`
+	// To is nil when the definition is not in the file. The edge is then dangling: the symbol may be
+	// defined in another file, or nowhere at all.
+	To *types.Range `json:"to,omitempty"`
+}
+
+// FileSymbolGraph returns the symbols defined in a file as nodes, and every reference in the file
+// as an edge to its definition. References are resolved against the local scopes first, then
+// against the top-level symbols from getSymbols by name. Anything else becomes a dangling edge.
+func (squirrel *SquirrelService) FileSymbolGraph(ctx context.Context, path types.RepoCommitPath) (Graph, error) {
+	if !Enabled() {
+		return Graph{}, nil
+	}
+
+	root, err := squirrel.parse(ctx, path)
+	if err != nil {
+		return Graph{}, err
+	}
+
+	locals, err := localSymbols(root)
+	if err != nil {
+		return Graph{}, err
+	}
+
+	topLevel, _, err := squirrel.getSymbolsInBytes(ctx, path)
+	if err != nil {
+		return Graph{}, err
+	}
+
+	graph := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+
+	// Nodes, keyed by their range so that symbols found both ways are only added once.
+	nodes := map[types.Range]int{}
+	addNode := func(node GraphNode) {
+		if i, ok := nodes[node.Range]; ok {
+			if graph.Nodes[i].Kind == "" {
+				graph.Nodes[i].Kind = node.Kind
+			}
+			return
+		}
+		nodes[node.Range] = len(graph.Nodes)
+		graph.Nodes = append(graph.Nodes, node)
+	}
+	for _, symbol := range locals {
+		addNode(GraphNode{Name: symbol.Name, Range: symbol.Def})
+	}
+	topLevelByName := map[string]types.Range{}
+	for _, symbol := range topLevel {
+		rnge := types.Range{Row: symbol.Line, Column: symbol.Character, Length: len(symbol.Name)}
+		addNode(GraphNode{Name: symbol.Name, Kind: symbol.Kind, Range: rnge})
+		if _, ok := topLevelByName[symbol.Name]; !ok {
+			topLevelByName[symbol.Name] = rnge
+		}
+	}
+
+	// Edges from local resolution.
+	resolved := map[types.Range]struct{}{}
+	for _, symbol := range locals {
+		def := symbol.Def
+		for _, ref := range symbol.Refs {
+			resolved[ref] = struct{}{}
+			if ref == def {
+				continue
+			}
+			graph.Edges = append(graph.Edges, GraphEdge{Name: symbol.Name, From: ref, To: &def})
+		}
+	}
+
+	// Edges for the remaining identifiers.
+	walk(root.Node, func(node *sitter.Node) {
+		if !isIdentifier(root.LangSpec, node) {
+			return
+		}
+		name := strings.TrimSpace(node.Content(root.Contents))
+		ref := trimRange(nodeToRange(node), node.Content(root.Contents))
+		if _, ok := resolved[ref]; ok {
+			return
+		}
+		if _, ok := nodes[ref]; ok {
+			return
+		}
+		edge := GraphEdge{Name: name, From: ref}
+		if def, ok := topLevelByName[name]; ok {
+			edge.To = &def
+		}
+		graph.Edges = append(graph.Edges, edge)
+	})
+
+	sort.Slice(graph.Nodes, func(i, j int) bool {
+		return isLessRange(graph.Nodes[i].Range, graph.Nodes[j].Range)
+	})
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		return isLessRange(graph.Edges[i].From, graph.Edges[j].From)
+	})
+
+	// Positions have been in bytes so far.
+	for i := range graph.Nodes {
+		graph.Nodes[i].Range = squirrel.positionEncoding.fromByteRange(root.Contents, graph.Nodes[i].Range)
+	}
+	for i := range graph.Edges {
+		graph.Edges[i].From = squirrel.positionEncoding.fromByteRange(root.Contents, graph.Edges[i].From)
+		if graph.Edges[i].To != nil {
+			to := squirrel.positionEncoding.fromByteRange(root.Contents, *graph.Edges[i].To)
+			graph.Edges[i].To = &to
+		}
+	}
+
+	return graph, nil
+}
@@ -0,0 +1,71 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestFileSymbolGraph(t *testing.T) {
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return os.ReadFile(filepath.Join("test_repos", path.Repo, path.Path))
+	}
+	squirrel := New(readFile, nil)
+	defer squirrel.Close()
+
+	graph, err := squirrel.FileSymbolGraph(context.Background(), types.RepoCommitPath{Repo: "go1", Commit: "abc", Path: "graph.go"})
+	fatalIfError(t, err)
+
+	nodes := []string{}
+	for _, node := range graph.Nodes {
+		nodes = append(nodes, fmt.Sprintf("%s %s %s", node.Name, node.Kind, node.Range))
+	}
+	wantNodes := []string{
+		"counter  2:5:7",
+		"newCounter  4:5:10",
+		"c  5:1:1",
+		"c  9:6:1",
+		"inc method 9:18:3",
+		"graph  11:5:5",
+		"c  12:1:1",
+	}
+	if diff := cmp.Diff(wantNodes, nodes); diff != "" {
+		t.Fatalf("unexpected nodes (-want +got):\n%s", diff)
+	}
+
+	edges := []string{}
+	for _, edge := range graph.Edges {
+		to := "dangling"
+		if edge.To != nil {
+			to = edge.To.String()
+		}
+		edges = append(edges, fmt.Sprintf("%s %s -> %s", edge.Name, edge.From, to))
+	}
+	wantEdges := []string{
+		"main 0:8:4 -> dangling",
+		"n 2:21:1 -> dangling",
+		"int 2:23:3 -> dangling",
+		"counter 4:19:7 -> 2:5:7",
+		"counter 5:7:7 -> 2:5:7",
+		"c 6:8:1 -> 5:1:1",
+		"counter 9:9:7 -> 2:5:7",
+		"c 9:26:1 -> 9:6:1",
+		"n 9:28:1 -> dangling",
+		"int 11:13:3 -> dangling",
+		"newCounter 12:6:10 -> 4:5:10",
+		"c 13:1:1 -> 12:1:1",
+		"inc 13:3:3 -> 9:18:3",
+		"c 14:8:1 -> 12:1:1",
+		"n 14:10:1 -> dangling",
+		"missing 14:14:7 -> dangling",
+	}
+	if diff := cmp.Diff(wantEdges, edges); diff != "" {
+		t.Fatalf("unexpected edges (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,9 @@
+"""Macros shared across packages."""
+
+#   vvvvvvvv bzl.my_macro def
+def my_macro(name, deps = []):
+    native.cc_binary(name = name, deps = deps)
+
+#   vvvvvv bzl.helper def
+def helper(name):
+    native.filegroup(name = name)
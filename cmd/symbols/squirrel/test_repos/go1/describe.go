@@ -0,0 +1,29 @@
+package main
+
+import "example.com/go1/store"
+
+type labeler interface { // < "labeler" go.labeler def
+	Label() string // < "Label" go.labeler.Label def
+}
+
+type named string // < "named" go.named def
+
+func (n named) shout() string { // < "shout" go.named.shout def
+	return string(n) + "!"
+}
+
+func describe(v interface{}) string {
+	if l, ok := v.(labeler); ok { // < "labeler" go.labeler ref
+		return l.Label() // < "Label" go.labeler.Label ref
+	}
+	if w, ok := v.(*store.Widget); ok { // < "Widget" go.Widget ref
+		return w.Label() // < "Label" go.Widget.Label ref
+	}
+	switch x := v.(type) {
+	case named: // < "named" go.named ref
+		return x.shout() // < "shout" go.named.shout ref
+	case store.Store, *store.MemoryStore: // < "Store" go.Store ref < "MemoryStore" go.MemoryStore ref
+		return "store"
+	}
+	return ""
+}
@@ -0,0 +1,3 @@
+module example.com/go1
+
+go 1.18
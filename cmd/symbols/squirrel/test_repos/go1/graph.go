@@ -0,0 +1,16 @@
+package main
+
+type counter struct{ n int }
+
+func newCounter() *counter {
+	c := &counter{}
+	return c
+}
+
+func (c *counter) inc() { c.n++ }
+
+func graph() int {
+	c := newCounter()
+	c.inc()
+	return c.n + missing
+}
@@ -0,0 +1,34 @@
+package limits
+
+const MaxItems = 8 // < "MaxItems" go.MaxItems def
+
+const Shift = 2 // < "Shift" go.Shift def
+
+type Kind int
+
+const (
+	KindA Kind = iota // < "KindA" go.KindA def
+	KindB             // < "KindB" go.KindB def
+)
+
+var buffer [MaxItems]int // < "MaxItems" go.MaxItems ref
+
+func Describe(k Kind) string {
+	switch k {
+	case KindA: // < "KindA" go.KindA ref
+		return "a"
+	case KindB, Kind(MaxItems): // < "KindB" go.KindB ref < "MaxItems" go.MaxItems ref
+		return "b"
+	}
+	return ""
+}
+
+func Mask() int {
+	const width = 4                    // < "width" go.width def
+	var bits [width << Shift]bool      // < "width" go.width ref < "Shift" go.Shift ref
+	return len(bits) | 1<<Shift | 0x10 // < "Shift" go.Shift ref
+}
+
+type Batch struct {
+	items [MaxItems]string // < "MaxItems" go.MaxItems ref
+}
@@ -0,0 +1,11 @@
+package main
+
+import "example.com/go1/store"
+
+func main() {
+	s := store.NewMemoryStore() // < "store" store path < "NewMemoryStore" go.NewMemoryStore ref
+	w, _ := s.Get(1)            // < "Get" go.MemoryStore.Get ref
+	println(w.Label(), w.ID)    // < "Label" go.Widget.Label ref < "ID" go.Widget.ID ref
+	var st store.Store = s      // < "Store" go.Store ref
+	st.Get(2)                   // < "Get" go.Store.Get ref
+}
@@ -0,0 +1,10 @@
+package mockuse
+
+// Store is mocked with mockgen.
+type Store interface {
+	Get(key string) string
+}
+
+func lookup(s Store) string {
+	return s.Get("key")
+}
@@ -0,0 +1,6 @@
+package mockuse
+
+func testLookup() {
+	var s Store = NewMockStore()
+	_ = s.Get("key")
+}
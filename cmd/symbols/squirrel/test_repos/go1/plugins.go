@@ -0,0 +1,9 @@
+package main
+
+import (
+	_ "example.com/go1/limits"   // < "_" limits path
+	lim "example.com/go1/limits" // < "lim" limits path < "example" limits path
+)
+
+// Importing limits for its side effects runs its init functions before main's.
+var _ = lim.MaxItems // < "MaxItems" go.MaxItems ref
@@ -0,0 +1,6 @@
+package main
+
+func preview() int {
+	answer := 42
+	return answer
+}
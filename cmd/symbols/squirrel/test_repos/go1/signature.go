@@ -0,0 +1,16 @@
+package main
+
+import "context"
+
+type Bar struct{}
+
+// Foo has its parameters split across lines.
+func Foo(ctx context.Context,
+	x int) (Bar, error) {
+	return Bar{}, nil
+}
+
+func useFoo() {
+	bar, _ := Foo(context.Background(), 1)
+	_ = bar
+}
@@ -0,0 +1,10 @@
+package store
+
+import "testing"
+
+func newTestStore(t *testing.T) *MemoryStore { // < "newTestStore" go.newTestStore def
+	t.Helper()
+	s := NewMemoryStore()
+	s.widgets[1] = &Widget{ID: 1, Name: "one"}
+	return s
+}
@@ -0,0 +1,15 @@
+package store
+
+type MemoryStore struct { // < "MemoryStore" go.MemoryStore def
+	widgets map[int]*Widget // < "widgets" go.MemoryStore.widgets def
+}
+
+func NewMemoryStore() *MemoryStore { // < "NewMemoryStore" go.NewMemoryStore def
+	return &MemoryStore{widgets: map[int]*Widget{}} // < "MemoryStore" go.MemoryStore ref < "widgets" go.MemoryStore.widgets ref
+}
+
+func (s *MemoryStore) Get(id int) (*Widget, error) { // < "Get" go.MemoryStore.Get def
+	return s.widgets[id], nil // < "widgets" go.MemoryStore.widgets ref
+}
+
+var _ Store = &MemoryStore{} // < "Store =" go.Store ref
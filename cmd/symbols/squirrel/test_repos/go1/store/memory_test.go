@@ -0,0 +1,12 @@
+package store
+
+import "testing"
+
+func TestMemoryStore(t *testing.T) {
+	t.Run("get", func(t *testing.T) {
+		s := newTestStore(t)                      // < "newTestStore" go.newTestStore ref
+		if w, _ := s.Get(1); w.Label() != "one" { // < "Label" go.Widget.Label ref
+			t.Fatal("wrong widget")
+		}
+	})
+}
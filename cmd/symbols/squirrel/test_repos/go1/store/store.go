@@ -0,0 +1,19 @@
+package store
+
+//go:generate mockgen -destination=mock_store.go -package=store . Store
+//                                                                ^^^^^ go.Store ref
+
+// Store persists widgets.
+type Store interface { // < "Store" go.Store def
+	Get(id int) (*Widget, error) // < "Get" go.Store.Get def < "Widget" go.Widget ref
+}
+
+// Widget is a stored thing.
+type Widget struct { // < "Widget" go.Widget def
+	ID   int // < "ID" go.Widget.ID def
+	Name string
+}
+
+func (w *Widget) Label() string { // < "Label" go.Widget.Label def
+	return w.Name
+}
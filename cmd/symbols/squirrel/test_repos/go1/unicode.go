@@ -0,0 +1,8 @@
+package main
+
+var /* 😀é */ unicodeTarget = 1
+
+func unicode() int {
+	/* 😀é */ target := 1
+	/* 😀é */ return target + unicodeTarget
+}
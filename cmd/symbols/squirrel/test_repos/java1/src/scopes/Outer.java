@@ -0,0 +1,15 @@
+package scopes;
+
+class Outer {
+
+    class Inner {
+
+        int count(int limit) {
+            int total = 0;
+            for (int i = 0; i < limit; i++) {
+                total += i;
+            }
+            return total;
+        }
+    }
+}
@@ -0,0 +1,6 @@
+return {
+  area = function(w, h) return w * h end, -- < "area" lua.area def
+  units = { -- < "units" lua.units def
+    metric = "cm", -- < "metric" lua.metric def
+  },
+}
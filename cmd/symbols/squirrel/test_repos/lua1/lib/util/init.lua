@@ -0,0 +1,14 @@
+local M = {} -- < "M" lua.util_M def
+M.nested = {} -- < "M" lua.util_M ref
+
+local prefix = "> " -- < "prefix" lua.prefix def
+
+function M.say(msg) -- < "say" lua.say def
+  print(prefix .. msg) -- < "prefix" lua.prefix ref
+end
+
+function M.nested.deep(x) -- < "deep" lua.deep def
+  return M.say(x) -- < "say" lua.say ref
+end
+
+return M
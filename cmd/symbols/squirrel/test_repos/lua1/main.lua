@@ -0,0 +1,18 @@
+local util = require("util")
+--                   ^^^^^^ lib/util/init.lua path
+local shapes = require "shapes" -- < "shapes" lua.shapes def
+--                     ^^^^^^^^ lib/shapes.lua path
+
+local function helper(size) -- < "helper" lua.helper def
+  for k = 1, size do -- < "k" lua.k def
+    util.say(k) -- < "k" lua.k ref
+  end
+  return size -- < "size" lua.size ref
+end
+
+helper(shapes.area(2, 3)) -- < "area" lua.area ref
+util.nested.deep(shapes.units.metric) -- < "metric" lua.metric ref
+util.nested.deep("x") -- < "deep" lua.deep ref
+util.say("y") -- < "say" lua.say ref
+print(shapes.units) -- < "shapes" lua.shapes ref
+helper(1) -- < "helper" lua.helper ref
@@ -0,0 +1,9 @@
+open Shapes (* < "Shapes" shapes.ml path *)
+
+let double_area s = (* < "double_area" ml.double_area def *)
+  2.0 *. area s (* < "area" ml.area ref *)
+
+let rec sum_areas shapes = (* < "sum_areas" ml.sum_areas def *)
+  match shapes with
+  | [] -> 0.0
+  | first :: rest -> sum_areas rest +. area first (* < "sum_areas" ml.sum_areas ref *)
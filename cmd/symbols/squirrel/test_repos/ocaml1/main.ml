@@ -0,0 +1,14 @@
+module S = Shapes (* < "S" ml.S def < "Shapes" shapes.ml path *)
+module U = Util (* < "Util" geometry/util.ml path *)
+
+let tau = 2.0 *. S.pi (* < "pi" ml.pi ref *)
+
+let describe (value : Shapes.shape) = (* < "shape" ml.shape ref *)
+  let doubled = U.double_area value in (* < "double_area" ml.double_area ref *)
+  doubled
+
+let () =
+  let circle = S.Round 1.0 in (* < "circle" ml.circle def < "S" ml.S ref < "Round" ml.Round ref *)
+  let d = describe circle in (* < "circle" ml.circle ref *)
+  let open Shapes.Units in (* < "Units" ml.Units ref *)
+  print_float (d *. scale *. Shapes.pi) (* < "scale" ml.scale ref < "pi" ml.pi ref *)
@@ -0,0 +1,14 @@
+let pi = 3.14159 (* < "pi" ml.pi def *)
+
+type shape = (* < "shape" ml.shape def *)
+  | Round of float (* < "Round" ml.Round def *)
+  | Square of float
+
+module Units = struct (* < "Units" ml.Units def *)
+  let scale = 2.0 (* < "scale" ml.scale def *)
+end
+
+let area s = (* < "area" ml.area def < "s" ml.s def *)
+  match s with (* < "s" ml.s ref *)
+  | Round radius -> pi *. radius *. radius (* < "radius" ml.radius def < "pi" ml.pi ref *)
+  | Square side -> side *. side
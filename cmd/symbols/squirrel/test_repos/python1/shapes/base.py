@@ -0,0 +1,5 @@
+#     vvvv py.Base def
+class Base:
+    #   vvvvv py.Base.greet def
+    def greet(self):
+        return "hello"
@@ -0,0 +1,2 @@
+def show(shape):
+    print(len(shape.describe()))
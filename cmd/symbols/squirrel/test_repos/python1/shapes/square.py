@@ -0,0 +1,41 @@
+#                 vvvv py.Base ref
+from .base import Base
+
+
+#     vvvvvv py.Square def
+#            vvvv py.Base ref
+class Square(Base):
+#   vvvv py.Square.unit def
+    unit = 1
+
+    def __init__(self, side):
+        #    vvvv py.Square.side def
+        self.side = side
+
+    @property
+    #   vvvv py.Square.area def
+    def area(self):
+        #           vvvv py.Square.side ref
+        #                       vvvv py.Square.side ref
+        return self.side * self.side
+
+    @classmethod
+    #   vvvvvv py.Square.create def
+    def create(cls):
+        #              vvvv py.Square.unit ref
+        return cls(cls.unit)
+
+    def describe(self):
+        #           vvvvv py.Base.greet ref
+        #                              vvvv py.Square.area ref
+        return self.greet() + str(self.area)
+
+
+#   vvvvvv py.Square ref
+s = Square(2)
+# vvvv py.Square.area ref
+s.area
+# vvvvv py.Base.greet ref
+s.greet()
+#      vvvvvv py.Square.create ref
+Square.create()
@@ -0,0 +1,5 @@
+__device__ float square(float x) { // < "square" cu.square def
+	return x * x;
+}
+
+float square(float x); // < "square" cu.square.proto def
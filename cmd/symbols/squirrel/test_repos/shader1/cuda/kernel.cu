@@ -0,0 +1,10 @@
+#include "common.cuh"
+
+__global__ void scale(float *xs, int n) { // < "scale" cu.scale def < "xs" cu.xs def < "n)" cu.n def
+	int idx = blockIdx.x * blockDim.x + threadIdx.x; // < "idx" cu.idx def
+	if (idx < n) xs[idx] = square(xs[idx]); // < "idx" cu.idx ref < "n)" cu.n ref < "square" cu.square ref
+}
+
+void launch(float *ys, int m) { // < "ys" cu.ys def
+	scale<<<1, m>>>(ys, m); // < "scale" cu.scale ref < "ys" cu.ys ref
+}
@@ -0,0 +1,3 @@
+float4 tint(float4 c) { // < "tint" hlsl.tint def
+	return c * 0.5;
+}
@@ -0,0 +1,5 @@
+#include "common.hlsli"
+
+float4 main(float4 pos : SV_Position) : SV_Target {
+	return tint(pos); // < "tint" hlsl.tint ref
+}
@@ -0,0 +1 @@
+const float AMBIENT = 0.1; // < "AMBIENT" glsl.AMBIENT def
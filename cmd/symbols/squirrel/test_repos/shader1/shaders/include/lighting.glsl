@@ -0,0 +1,10 @@
+#include "constants.glsl"
+
+struct Light { // < "Light" glsl.Light def
+	vec3 dir;
+	float power;
+};
+
+float shade(vec3 normal, vec3 dir) { // < "shade" glsl.shade def < "dir" glsl.shade.dir def
+	return max(dot(normal, dir), AMBIENT); // < "dir" glsl.shade.dir ref < "AMBIENT" glsl.AMBIENT ref
+}
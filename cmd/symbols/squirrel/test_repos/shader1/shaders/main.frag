@@ -0,0 +1,15 @@
+#version 330 core
+#include "include/lighting.glsl" // < "include/" shaders/include/lighting.glsl path
+
+uniform vec3 lightDir; // < "lightDir" glsl.lightDir def
+uniform Light sun; // < "Light" glsl.Light ref
+in vec3 normal; // < "normal" glsl.normal def
+out vec4 color;
+
+void main() {
+	float d = shade(normal, lightDir); // < "d" glsl.d def < "shade" glsl.shade ref < "normal" glsl.normal ref < "lightDir" glsl.lightDir ref
+	for (int k = 0; k < 4; k++) { // < "k" glsl.k def
+		d *= AMBIENT * float(k); // < "d" glsl.d ref < "AMBIENT" glsl.AMBIENT ref < "k" glsl.k ref
+	}
+	color = vec4(d);
+}
@@ -0,0 +1,72 @@
+package squirrel
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// estimatedTreeBytesPerSourceByte approximates the memory tree-sitter allocates for a tree per byte
+// of source. Trees live outside of the Go heap, so the garbage collector doesn't see them.
+const estimatedTreeBytesPerSourceByte = 8
+
+// treeMemoryBytes is the estimated memory held by live tree-sitter trees across all
+// SquirrelServices.
+var treeMemoryBytes int64
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: "src",
+	Name:      "squirrel_tree_sitter_bytes",
+	Help:      "The estimated memory held by live tree-sitter trees, which the Go runtime doesn't account for.",
+}, func() float64 {
+	return float64(atomic.LoadInt64(&treeMemoryBytes))
+})
+
+// WithTreeMemoryLimit sets a soft limit on the estimated memory held by tree-sitter trees across all
+// SquirrelServices. Once a parse goes over the limit, trees that were only parsed to extract symbols
+// are freed right away rather than when the service is closed, since their symbols are kept
+// serialized in the symbol cache. Trees still needed to resolve a definition are never freed early,
+// which is why the limit is soft. A limit of 0 means no limit.
+func WithTreeMemoryLimit(bytes int64) Option {
+	return func(squirrel *SquirrelService) {
+		squirrel.treeMemoryLimit = bytes
+	}
+}
+
+// trackedTree is a tree-sitter tree whose estimated memory is counted in treeMemoryBytes until it
+// is closed.
+type trackedTree struct {
+	tree   *sitter.Tree
+	bytes  int64
+	closed bool
+}
+
+func trackTree(tree *sitter.Tree, contents []byte) *trackedTree {
+	bytes := int64(len(contents)) * estimatedTreeBytesPerSourceByte
+	atomic.AddInt64(&treeMemoryBytes, bytes)
+	return &trackedTree{tree: tree, bytes: bytes}
+}
+
+// close frees the tree. It's safe to call more than once.
+func (t *trackedTree) close() {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.tree.Close()
+	atomic.AddInt64(&treeMemoryBytes, -t.bytes)
+}
+
+// evictTrees frees the oldest trees that were only parsed to extract symbols until the estimated
+// tree memory is under the limit, or there are none left.
+func (s *SquirrelService) evictTrees() {
+	if s.treeMemoryLimit <= 0 {
+		return
+	}
+	for len(s.evictableTrees) > 0 && atomic.LoadInt64(&treeMemoryBytes) > s.treeMemoryLimit {
+		s.evictableTrees[0].close()
+		s.evictableTrees = s.evictableTrees[1:]
+	}
+}
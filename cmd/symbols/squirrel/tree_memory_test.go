@@ -0,0 +1,68 @@
+package squirrel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestTreeMemoryLimit(t *testing.T) {
+	// Other tests may leave services open, so measure relative to what's already tracked.
+	baseline := atomic.LoadInt64(&treeMemoryBytes)
+
+	large := &strings.Builder{}
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(large, "func F%d(x int) int { return x + %d }\n", i, i)
+	}
+	readFile := func(ctx context.Context, path types.RepoCommitPath) ([]byte, error) {
+		return []byte("package large\n" + large.String()), nil
+	}
+	treeBytes := int64(len("package large\n")+large.Len()) * estimatedTreeBytesPerSourceByte
+
+	cache, err := NewMemorySymbolCache(100)
+	fatalIfError(t, err)
+	limit := baseline + 3*treeBytes
+	squirrel := New(readFile, nil, WithSymbolCache(cache), WithTreeMemoryLimit(limit))
+
+	for i := 0; i < 20; i++ {
+		path := types.RepoCommitPath{Repo: "large", Commit: "abc", Path: fmt.Sprintf("f%d.go", i)}
+		symbols, err := squirrel.getSymbols(context.Background(), path)
+		fatalIfError(t, err)
+		if len(symbols) != 2000 {
+			t.Fatalf("expected 2000 symbols in %s, got %d", path.Path, len(symbols))
+		}
+		if got := atomic.LoadInt64(&treeMemoryBytes); got > limit {
+			t.Fatalf("expected tree memory to stay under the limit of %d bytes after %d files, got %d", limit, i+1, got)
+		}
+	}
+	if len(squirrel.closables) != 20 {
+		t.Fatalf("expected 20 parses, got %d", len(squirrel.closables))
+	}
+
+	// The symbols of evicted trees are still served from the cache without parsing again.
+	_, err = squirrel.getSymbols(context.Background(), types.RepoCommitPath{Repo: "large", Commit: "abc", Path: "f0.go"})
+	fatalIfError(t, err)
+	if len(squirrel.closables) != 20 {
+		t.Fatal("expected cached symbols to avoid parsing")
+	}
+
+	squirrel.Close()
+	if got := atomic.LoadInt64(&treeMemoryBytes); got != baseline {
+		t.Fatalf("expected closing the service to release all trees, got %d bytes over the baseline", got-baseline)
+	}
+
+	// Without a limit, every tree is kept until the service is closed.
+	unlimited := New(readFile, nil, WithSymbolCache(&fakeSharedCache{values: map[string][]byte{}}))
+	for i := 0; i < 5; i++ {
+		_, err := unlimited.getSymbols(context.Background(), types.RepoCommitPath{Repo: "large", Commit: "abc", Path: fmt.Sprintf("f%d.go", i)})
+		fatalIfError(t, err)
+	}
+	if got := atomic.LoadInt64(&treeMemoryBytes) - baseline; got != 5*treeBytes {
+		t.Fatalf("expected 5 trees to be tracked without a limit, got %d bytes", got)
+	}
+	unlimited.Close()
+}
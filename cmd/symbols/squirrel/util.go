@@ -1,7 +1,9 @@
 package squirrel
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"path/filepath"
 	"runtime"
@@ -35,6 +37,26 @@ func walkFilter(node *sitter.Node, f func(node *sitter.Node) bool) {
 	}
 }
 
+// findAncestor returns the nearest ancestor of the given type.
+func findAncestor(node *sitter.Node, ty string) *sitter.Node {
+	for cur := node.Parent(); cur != nil; cur = cur.Parent() {
+		if cur.Type() == ty {
+			return cur
+		}
+	}
+	return nil
+}
+
+// isAncestor returns true if ancestor contains node.
+func isAncestor(ancestor *sitter.Node, node *sitter.Node) bool {
+	for cur := node; cur != nil; cur = cur.Parent() {
+		if nodeId(cur) == nodeId(ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
 // nodeId returns the ID of the node.
 func nodeId(node *sitter.Node) NodeId {
 	return NodeId(fmt.Sprint(nodeToRange(node)))
@@ -94,6 +116,37 @@ func spacesToColumn(s string, column int) int {
 	return total
 }
 
+// pointToOffset converts a point in the contents of a file to a byte offset.
+func pointToOffset(contents []byte, point types.Point) int {
+	offset := 0
+	for row := 0; row < point.Row; row++ {
+		i := bytes.IndexByte(contents[offset:], '\n')
+		if i == -1 {
+			return len(contents)
+		}
+		offset += i + 1
+	}
+	return offset + point.Column
+}
+
+// wordAt returns the bounds of the identifier-like word in text that contains the given byte offset.
+// The bounds are equal if there is no word at the offset.
+func wordAt(text string, offset int) (start, end int) {
+	start, end = offset, offset
+	for start > 0 && isIdentByte(text[start-1]) {
+		start--
+	}
+	for end < len(text) && isIdentByte(text[end]) {
+		end++
+	}
+	return start, end
+}
+
+// isIdentByte returns true if the byte can be part of an identifier in most languages.
+func isIdentByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b >= 0x80
+}
+
 // colorSprintfFunc is a color printing function.
 type colorSprintfFunc func(a ...any) string
 
@@ -173,6 +226,41 @@ func allCaptures(query string, node Node) ([]Node, error) {
 	return captures, nil
 }
 
+// forEachMatch runs the given tree-sitter query on the given node and calls f(captures) for each
+// match, where captures maps capture names to the captured nodes.
+func forEachMatch(query string, node Node, f func(captures map[string]Node)) error {
+	return forEachMatchUntil(query, node, func(captures map[string]Node) error {
+		f(captures)
+		return nil
+	})
+}
+
+// forEachMatchUntil is like forEachMatch, but stops at the first error from f and returns it.
+func forEachMatchUntil(query string, node Node, f func(captures map[string]Node) error) error {
+	sitterQuery, err := sitter.NewQuery([]byte(query), node.LangSpec.language)
+	if err != nil {
+		return errors.Newf("failed to parse query: %s\n%s", err, query)
+	}
+	defer sitterQuery.Close()
+	cursor := sitter.NewQueryCursor()
+	defer cursor.Close()
+	cursor.Exec(sitterQuery, node.Node)
+
+	match, hasMatch := cursor.NextMatch()
+	for hasMatch {
+		captures := map[string]Node{}
+		for _, capture := range match.Captures {
+			captures[sitterQuery.CaptureNameForId(capture.Index)] = swapNode(node, capture.Node)
+		}
+		if err := f(captures); err != nil {
+			return err
+		}
+		match, hasMatch = cursor.NextMatch()
+	}
+
+	return nil
+}
+
 // nodeToRange returns the range of the node.
 func nodeToRange(node *sitter.Node) types.Range {
 	length := 1
@@ -186,6 +274,27 @@ func nodeToRange(node *sitter.Node) types.Range {
 	}
 }
 
+// trimRange moves the start of a range past leading whitespace in its text. Some grammars (e.g. Lua)
+// attach the whitespace before a token to the token.
+func trimRange(rnge types.Range, text string) types.Range {
+	for _, r := range text {
+		switch r {
+		case '\n':
+			rnge.Row++
+			rnge.Column = 0
+		case ' ', '\t', '\r':
+			rnge.Column++
+			rnge.Length--
+		default:
+			if rnge.Length < 1 {
+				rnge.Length = 1
+			}
+			return rnge
+		}
+	}
+	return rnge
+}
+
 // nodeLength returns the length of the node.
 func nodeLength(node *sitter.Node) int {
 	length := 1
@@ -240,75 +349,234 @@ var unsupportedLanguageError = errors.New("unsupported language")
 
 // Parses a file and returns info about it.
 func (s *SquirrelService) parse(ctx context.Context, repoCommitPath types.RepoCommitPath) (*Node, error) {
-	ext := strings.TrimPrefix(filepath.Ext(repoCommitPath.Path), ".")
+	langSpec, err := langSpecForPath(repoCommitPath.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := s.readFile(ctx, repoCommitPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parseContents(ctx, repoCommitPath, langSpec, contents)
+}
+
+// langSpecForPath returns the language specification for the file at the given path.
+func langSpecForPath(path string) (LangSpec, error) {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
 
 	langName, ok := extToLang[ext]
 	if !ok {
-		return nil, unrecognizedFileExtensionError
+		langName, ok = fileNameToLang[filepath.Base(path)]
+	}
+	if !ok {
+		return LangSpec{}, unrecognizedFileExtensionError
 	}
 
 	langSpec, ok := langToLangSpec[langName]
 	if !ok {
-		return nil, unsupportedLanguageError
+		return LangSpec{}, unsupportedLanguageError
 	}
 
-	s.parser.SetLanguage(langSpec.language)
+	return langSpec, nil
+}
 
-	contents, err := s.readFile(ctx, repoCommitPath)
+// parseContents parses the given contents of a file.
+func (s *SquirrelService) parseContents(ctx context.Context, repoCommitPath types.RepoCommitPath, langSpec LangSpec, contents []byte) (*Node, error) {
+	root, _, err := s.parseTracked(ctx, repoCommitPath, langSpec, contents)
+	return root, err
+}
+
+// parseForSymbols parses the given contents of a file and calls f on the root. The tree is only
+// needed by f, so it may be freed as soon as f returns when tree memory is over the limit.
+func (s *SquirrelService) parseForSymbols(ctx context.Context, repoCommitPath types.RepoCommitPath, langSpec LangSpec, contents []byte, f func(root *Node) error) error {
+	root, tree, err := s.parseTracked(ctx, repoCommitPath, langSpec, contents)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	err = f(root)
+	s.evictableTrees = append(s.evictableTrees, tree)
+	s.evictTrees()
+	return err
+}
 
-	tree, err := s.parser.ParseCtx(ctx, nil, contents)
+// parseTracked is parseContents that also returns the tree, which is closed with the service.
+func (s *SquirrelService) parseTracked(ctx context.Context, repoCommitPath types.RepoCommitPath, langSpec LangSpec, contents []byte) (*Node, *trackedTree, error) {
+	s.parser.SetLanguage(langSpec.language)
+
+	source := contents
+	var edits []sitter.EditInput
+	if langSpec.rewrite != nil {
+		source, edits = langSpec.rewrite(contents)
+	}
+
+	sitterTree, err := s.parser.ParseCtx(ctx, nil, source)
 	if err != nil {
-		return nil, errors.Newf("failed to parse file contents: %s", err)
+		return nil, nil, errors.Newf("failed to parse file contents: %s", err)
+	}
+	// Map the positions in the tree back to the original contents.
+	for _, edit := range edits {
+		sitterTree.Edit(edit)
 	}
-	s.closables = append(s.closables, tree.Close)
+	tree := trackTree(sitterTree, contents)
+	s.closables = append(s.closables, tree.close)
 
-	root := tree.RootNode()
+	root := sitterTree.RootNode()
 	if root == nil {
-		return nil, errors.New("root is nil")
+		return nil, nil, errors.New("root is nil")
 	}
-	if s.errorOnParseFailure && root.HasError() {
-		return nil, errors.Newf("parse failure in %+v", repoCommitPath)
+	if s.errorOnParseFailure && root.HasError() && !langSpec.borrowedGrammar {
+		return nil, nil, errors.Newf("parse failure in %+v", repoCommitPath)
 	}
 
-	return &Node{RepoCommitPath: repoCommitPath, Node: root, Contents: contents, LangSpec: langSpec}, nil
+	return &Node{RepoCommitPath: repoCommitPath, Node: root, Contents: contents, LangSpec: langSpec}, tree, nil
 }
 
+// getSymbols returns the top-level symbols in a file, using the symbol cache when possible.
 func (s *SquirrelService) getSymbols(ctx context.Context, repoCommitPath types.RepoCommitPath) (result.Symbols, error) {
-	root, err := s.parse(context.Background(), repoCommitPath)
+	if !Enabled() {
+		return nil, nil
+	}
+
+	symbols, contents, err := s.getSymbolsInBytes(ctx, repoCommitPath)
 	if err != nil {
 		return nil, err
 	}
 
-	symbols := result.Symbols{}
+	for i := range symbols {
+		if s.stableIDs {
+			symbols[i].StableID = stableID(symbols[i])
+		}
+		if !s.enclosingScopes {
+			symbols[i].Scope = nil
+		}
+	}
 
-	query := root.LangSpec.topLevelSymbolsQuery
-	if query == "" {
+	return s.encodeSymbols(symbols, contents), nil
+}
+
+// getSymbolsInBytes is getSymbols with byte columns. It also returns the file contents.
+func (s *SquirrelService) getSymbolsInBytes(ctx context.Context, repoCommitPath types.RepoCommitPath) (result.Symbols, []byte, error) {
+	langSpec, err := langSpecForPath(repoCommitPath.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	contents, err := s.readFile(ctx, repoCommitPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := symbolCacheKey(repoCommitPath, contents)
+	bypass := bypassCache(ctx)
+	if !bypass {
+		if b, ok := s.symbolCache.Get(key); ok {
+			var symbols result.Symbols
+			if err := json.Unmarshal(b, &symbols); err == nil {
+				return symbols, contents, nil
+			}
+		}
+	}
+
+	var symbols result.Symbols
+	err = s.parseForSymbols(ctx, repoCommitPath, langSpec, contents, func(root *Node) (err error) {
+		symbols, err = extractSymbols(root)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if b, err := json.Marshal(symbols); err == nil && !bypass {
+		s.symbolCache.Set(key, b)
+	}
+
+	return symbols, contents, nil
+}
+
+// encodeSymbols converts the symbol columns from bytes to the position encoding. The cache always
+// holds byte columns so that it can be shared between encodings.
+func (s *SquirrelService) encodeSymbols(symbols result.Symbols, contents []byte) result.Symbols {
+	if s.positionEncoding == UTF8 {
+		return symbols
+	}
+	for i := range symbols {
+		line := lineAt(contents, symbols[i].Line)
+		symbols[i].Character = s.positionEncoding.fromByteColumn(line, symbols[i].Character)
+	}
+	return symbols
+}
+
+// extractSymbols runs the top-level symbols query of the language on the file.
+func extractSymbols(root *Node) (result.Symbols, error) {
+	if root.LangSpec.topLevelSymbolsQuery == "" {
 		return nil, nil
 	}
 
-	captures, err := allCaptures(query, *root)
+	symbols := result.Symbols{}
+	err := walkSymbols(root, func(symbol result.Symbol) error {
+		symbols = append(symbols, symbol)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, capture := range captures {
-		symbols = append(symbols, result.Symbol{
-			Name:        capture.Node.Content(root.Contents),
+
+	return symbols, nil
+}
+
+// walkSymbols calls f on each top-level symbol in document order, and stops at the first error.
+func walkSymbols(root *Node, f func(result.Symbol) error) error {
+	query := root.LangSpec.topLevelSymbolsQuery
+	if query == "" {
+		return nil
+	}
+
+	return forEachMatchUntil(query, *root, func(captures map[string]Node) error {
+		kind := ""
+		capture, ok := captures["symbol"]
+		if !ok {
+			// Methods are indexed under their receiver type so they can be told apart from functions.
+			capture, ok = captures["method"]
+			if !ok {
+				return nil
+			}
+			kind = "method"
+		}
+		// Shader qualifiers like uniform confuse the borrowed C++ grammar about which identifier is
+		// the name.
+		if root.LangSpec.borrowedGrammar && capture.Node.Parent() != nil && capture.Node.Parent().Type() == "declaration" {
+			if name := qualifiedNameShader(capture.Node.Parent()); name != nil {
+				capture = swapNode(capture, name)
+			}
+		}
+		// Bazel targets are the name arguments of top-level calls.
+		if keyword, ok := captures["keyword"]; ok && keyword.Content(root.Contents) != "name" {
+			return nil
+		}
+		name := strings.TrimSpace(capture.Node.Content(root.Contents))
+		if capture.Node.Type() == "string" {
+			name = unquoteStarlark(name)
+		}
+		parent := ""
+		if parentCapture, ok := captures["parent"]; ok {
+			parent = parentCapture.Content(root.Contents)
+		}
+		return f(result.Symbol{
+			Name:        name,
 			Path:        root.RepoCommitPath.Path,
 			Line:        int(capture.Node.StartPoint().Row),
 			Character:   int(capture.Node.StartPoint().Column),
-			Kind:        "",
+			Kind:        kind,
 			Language:    root.LangSpec.name,
-			Parent:      "",
+			Parent:      parent,
 			ParentKind:  "",
+			Scope:       enclosingScopes(capture.Node, root.Contents),
 			Signature:   "",
 			FileLimited: false,
 		})
-	}
-
-	return symbols, nil
+	})
 }
 
 func fatalIfError(t *testing.T, err error) {
@@ -336,15 +604,33 @@ func children(node *sitter.Node) []*sitter.Node {
 	return children
 }
 
+// previewLines returns the given row of contents with up to context lines before and after it. The
+// window is clamped to the file, so it's smaller near the start and end of the file.
+func previewLines(contents []byte, row int, context int) []string {
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if row < 0 || row >= len(lines) {
+		return nil
+	}
+	start := row - context
+	if start < 0 {
+		start = 0
+	}
+	end := row + context + 1
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return lines[start:end]
+}
+
 func snippet(node *Node) string {
 	contextChars := 5
-	start := node.StartByte() - uint32(contextChars)
+	start := int(node.StartByte()) - contextChars
 	if start < 0 {
 		start = 0
 	}
-	end := node.StartByte() + uint32(contextChars)
-	if end > uint32(len(node.Contents)) {
-		end = uint32(len(node.Contents))
+	end := int(node.StartByte()) + contextChars
+	if end > len(node.Contents) {
+		end = len(node.Contents)
 	}
 	ret := string(node.Contents[start:end])
 	ret = strings.ReplaceAll(ret, "\n", "\\n")
@@ -399,7 +685,35 @@ func (s *SquirrelService) symbolSearchOne(ctx context.Context, repo string, comm
 	if len(symbols) == 0 {
 		return nil, nil
 	}
-	symbol := symbols[0]
+	return s.symbolToNode(ctx, repo, commit, symbols[0])
+}
+
+// symbolSearchFirst is like symbolSearchOne, but it also takes an exclude pattern and returns the
+// first symbol for which keep returns true.
+func (s *SquirrelService) symbolSearchFirst(ctx context.Context, repo string, commit string, include []string, exclude string, ident string, keep func(result.Symbol) bool) (*Node, error) {
+	symbols, err := s.symbolSearch(ctx, search.SymbolsParameters{
+		Repo:            api.RepoName(repo),
+		CommitID:        api.CommitID(commit),
+		Query:           fmt.Sprintf("^%s$", ident),
+		IsRegExp:        true,
+		IsCaseSensitive: true,
+		IncludePatterns: include,
+		ExcludePattern:  exclude,
+		First:           100,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, symbol := range symbols {
+		if keep(symbol) {
+			return s.symbolToNode(ctx, repo, commit, symbol)
+		}
+	}
+	return nil, nil
+}
+
+// symbolToNode parses the file containing the symbol and returns the node at its position.
+func (s *SquirrelService) symbolToNode(ctx context.Context, repo string, commit string, symbol result.Symbol) (*Node, error) {
 	file, err := s.parse(ctx, types.RepoCommitPath{
 		Repo:   repo,
 		Commit: commit,
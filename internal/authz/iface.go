@@ -48,8 +48,57 @@ import (
 type SubRepoPermissions struct {
 	PathIncludes []string
 	PathExcludes []string
+	// GlobMode controls whether wildcards in the rules above match across
+	// directories. The zero value is GlobStrict.
+	GlobMode GlobMode
+	// PathIncludeRegexps and PathExcludeRegexps are rules in regexp syntax, for
+	// patterns that globs can't express. They must match the whole path, and are
+	// combined with the glob rules above: a path is excluded if any exclude of
+	// either kind matches it, and otherwise included if any include does.
+	PathIncludeRegexps []string
+	PathExcludeRegexps []string
+	// BranchRules add rules for content on the branches they match. Content
+	// without a branch is only checked against the rules above.
+	BranchRules []BranchRule
+	// LineRules narrow access to some files the rules above allow down to ranges
+	// of lines, see ActorReadableLineRanges. The first rule matching a path
+	// applies.
+	LineRules []LineRule
 }
 
+// LineRule limits the readable lines of the files matching Path, a glob compiled
+// in the GlobMode of the enclosing rules, to Ranges. Lines outside the ranges
+// are meant to be redacted.
+type LineRule struct {
+	Path   string
+	Ranges []LineRange
+}
+
+// BranchRule scopes path rules to the branches matching a glob, for example to
+// exclude `secrets/**` on `release/*`. Its excludes take precedence over all
+// includes, and its includes grant paths that the repo-wide rules don't
+// exclude. Globs are compiled in the GlobMode of the enclosing rules.
+type BranchRule struct {
+	Branch       string
+	PathIncludes []string
+	PathExcludes []string
+}
+
+// GlobMode controls how wildcards in a set of sub-repo permission rules treat the
+// path separator.
+type GlobMode int
+
+const (
+	// GlobStrict compiles rules with `/` as the separator, so `*` and `?` never
+	// match it. For example `secrets/*` matches `secrets/a.txt` but not
+	// `secrets/a/b.txt`, which needs `secrets/**`. This is the default.
+	GlobStrict GlobMode = iota
+	// GlobCrossDirectory compiles rules without a separator, so `*` and `?` also
+	// match `/`. For example `secrets/*` matches both `secrets/a.txt` and
+	// `secrets/a/b.txt`, and `*.txt` matches text files at any depth.
+	GlobCrossDirectory
+)
+
 // ExternalUserPermissions is a collection of accessible repository/project IDs
 // (on code host). It contains exact IDs, as well as prefixes to both include
 // and exclude IDs.
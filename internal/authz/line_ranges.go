@@ -0,0 +1,95 @@
+package authz
+
+import (
+	"context"
+	"sort"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// LineRange is a range of lines in a file. Lines are 1-based and both ends are
+// inclusive.
+type LineRange struct {
+	Start int
+	End   int
+}
+
+// LineRangePermissionChecker is implemented by a SubRepoPermissionChecker whose
+// rules can restrict access to ranges of lines within a file, rather than only to
+// whole paths. SubRepoPermsClient implements it with LineRules.
+type LineRangePermissionChecker interface {
+	// ReadableLineRanges returns the ranges of lines in the content that the user
+	// can read, given that the file has lineCount lines. It is only called for
+	// content the user can read according to Permissions. If no line-level rules
+	// apply to the content, ok is false and the whole file is readable.
+	ReadableLineRanges(ctx context.Context, userID int32, content RepoContent, lineCount int) (ranges []LineRange, ok bool, err error)
+}
+
+// ActorReadableLineRanges returns the ranges of lines in the file at path that the
+// actor can read, given that the file has lineCount lines, so that callers can
+// redact the rest. The ranges are sorted and don't overlap.
+//
+// When the checker doesn't implement LineRangePermissionChecker, or no line-level
+// rules apply to the file, the result is either the whole file or nothing,
+// depending on the path-level rules.
+func ActorReadableLineRanges(ctx context.Context, checker SubRepoPermissionChecker, a *actor.Actor, repo api.RepoName, path string, lineCount int) ([]LineRange, error) {
+	if lineCount <= 0 {
+		return nil, nil
+	}
+	content := RepoContent{Repo: repo, Path: path}
+	perms, outcome, err := ActorPermissionsOutcome(ctx, checker, a, content)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking sub-repo permissions")
+	}
+	if !perms.Include(Read) {
+		return nil, nil
+	}
+
+	whole := []LineRange{{Start: 1, End: lineCount}}
+	// Line-level rules only apply when the actor's own rules were checked, not
+	// when access was granted regardless of them.
+	lineChecker, ok := checker.(LineRangePermissionChecker)
+	if outcome != OutcomeAllowed || !ok {
+		return whole, nil
+	}
+	ranges, ok, err := lineChecker.ReadableLineRanges(ctx, a.UID, content, lineCount)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking line-level sub-repo permissions")
+	}
+	if !ok {
+		return whole, nil
+	}
+	return normalizeLineRanges(ranges, lineCount), nil
+}
+
+// normalizeLineRanges clips the ranges to the lines of a file with lineCount
+// lines, drops empty ranges, and merges ranges that overlap or touch.
+func normalizeLineRanges(ranges []LineRange, lineCount int) []LineRange {
+	clipped := make([]LineRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start < 1 {
+			r.Start = 1
+		}
+		if r.End > lineCount {
+			r.End = lineCount
+		}
+		if r.Start <= r.End {
+			clipped = append(clipped, r)
+		}
+	}
+	sort.Slice(clipped, func(i, j int) bool { return clipped[i].Start < clipped[j].Start })
+
+	merged := make([]LineRange, 0, len(clipped))
+	for _, r := range clipped {
+		if last := len(merged) - 1; last >= 0 && r.Start <= merged[last].End+1 {
+			if r.End > merged[last].End {
+				merged[last].End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -0,0 +1,145 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+// lineRangeChecker is a SubRepoPermissionChecker with line-level rules for some paths.
+type lineRangeChecker struct {
+	*MockSubRepoPermissionChecker
+	rules map[string][]LineRange
+}
+
+func (c *lineRangeChecker) ReadableLineRanges(ctx context.Context, userID int32, content RepoContent, lineCount int) ([]LineRange, bool, error) {
+	if content.Path == "broken.go" {
+		return nil, false, errors.New("boom")
+	}
+	ranges, ok := c.rules[content.Path]
+	return ranges, ok, nil
+}
+
+func TestActorReadableLineRanges(t *testing.T) {
+	newMock := func() *MockSubRepoPermissionChecker {
+		mock := NewMockSubRepoPermissionChecker()
+		mock.EnabledFunc.SetDefaultReturn(true)
+		mock.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+			switch content.Path {
+			case "denied.go":
+				return None, nil
+			case "unsynced.go":
+				return None, ErrSubRepoPermsNotSynced
+			}
+			return Read, nil
+		})
+		return mock
+	}
+	checker := &lineRangeChecker{
+		MockSubRepoPermissionChecker: newMock(),
+		rules: map[string][]LineRange{
+			// Out of order, overlapping, touching and out of bounds ranges.
+			"partial.go": {{Start: 40, End: 60}, {Start: 0, End: 5}, {Start: 3, End: 10}, {Start: 11, End: 12}, {Start: 90, End: 120}},
+			"hidden.go":  {},
+		},
+	}
+
+	user := actor.FromUser(1)
+	for _, tc := range []struct {
+		name    string
+		checker SubRepoPermissionChecker
+		actor   *actor.Actor
+		path    string
+		want    []LineRange
+		wantErr bool
+	}{
+		{name: "line rules", checker: checker, actor: user, path: "partial.go", want: []LineRange{{1, 12}, {40, 60}, {90, 100}}},
+		{name: "line rules hide everything", checker: checker, actor: user, path: "hidden.go", want: []LineRange{}},
+		{name: "path rules only", checker: checker, actor: user, path: "other.go", want: []LineRange{{1, 100}}},
+		{name: "path denied", checker: checker, actor: user, path: "denied.go", want: nil},
+		{name: "rules not synced", checker: checker, actor: user, path: "unsynced.go", want: nil},
+		{name: "no line support", checker: newMock(), actor: user, path: "partial.go", want: []LineRange{{1, 100}}},
+		{name: "internal actor", checker: checker, actor: actor.FromContext(actor.WithInternalActor(context.Background())), path: "partial.go", want: []LineRange{{1, 100}}},
+		{name: "error", checker: checker, actor: user, path: "broken.go", wantErr: true},
+		{name: "unauthenticated", checker: checker, actor: &actor.Actor{}, path: "partial.go", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ActorReadableLineRanges(context.Background(), tc.checker, tc.actor, "repo", tc.path, 100)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestSubRepoPermsClientLineRanges(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"repo": {
+			PathIncludes: []string{"**"},
+			PathExcludes: []string{"secrets/**"},
+			LineRules: []LineRule{
+				{Path: "config/*.yaml", Ranges: []LineRange{{Start: 20, End: 30}, {Start: 1, End: 10}}},
+				{Path: "config/**", Ranges: []LineRange{}},
+				// Never applies, the path is denied.
+				{Path: "secrets/**", Ranges: []LineRange{{Start: 1, End: 100}}},
+			},
+		},
+	}, nil)
+	getter.RepoSupportedFunc.SetDefaultReturn(true, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	user := actor.FromUser(1)
+	for _, tc := range []struct {
+		path string
+		want []LineRange
+	}{
+		{path: "config/app.yaml", want: []LineRange{{1, 10}, {20, 30}}},
+		{path: "config/nested/app.yaml", want: []LineRange{}},
+		{path: "main.go", want: []LineRange{{1, 50}}},
+		{path: "secrets/key.pem", want: nil},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			got, err := ActorReadableLineRanges(ctx, client, user, "repo", tc.path, 50)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+
+	enabled, err := client.EnabledForUser(ctx, 1, "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Fatal("want line rules to count as restricting the repo")
+	}
+}
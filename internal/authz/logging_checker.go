@@ -0,0 +1,101 @@
+package authz
+
+import (
+	"context"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/log"
+)
+
+// loggingChecker is a SubRepoPermissionChecker that logs every Permissions call
+// of another checker.
+type loggingChecker struct {
+	base   SubRepoPermissionChecker
+	logger log.Logger
+}
+
+var _ SubRepoPermissionChecker = &loggingChecker{}
+var _ SubRepoPermsBypasser = &loggingChecker{}
+
+// WithLogging returns a SubRepoPermissionChecker that logs the inputs, result
+// and duration of every Permissions call to checker at debug level, for
+// debugging access issues. Paths are passed through RedactPath. All other calls
+// go to checker unchanged.
+func WithLogging(checker SubRepoPermissionChecker, logger log.Logger) SubRepoPermissionChecker {
+	return &loggingChecker{base: checker, logger: logger}
+}
+
+func (c *loggingChecker) Permissions(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+	began := time.Now()
+	perms, err := c.base.Permissions(ctx, userID, content)
+
+	fields := []log.Field{
+		log.Int("userID", int(userID)),
+		log.String("repo", string(content.Repo)),
+		log.String("path", RedactPath(content.Path)),
+		log.String("perms", perms.String()),
+		log.Duration("duration", time.Since(began)),
+	}
+	if content.Commit != "" {
+		fields = append(fields, log.String("commit", string(content.Commit)))
+	}
+	if !content.Time.IsZero() {
+		fields = append(fields, log.Time("time", content.Time))
+	}
+	if err != nil {
+		fields = append(fields, log.Error(err))
+	}
+	c.logger.Debug("sub-repo permissions check", fields...)
+
+	return perms, err
+}
+
+// FilterContents logs a single line for the whole batch, with the number of
+// contents and how many of them were readable, rather than a line per path.
+func (c *loggingChecker) FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+	began := time.Now()
+	perms, err := c.base.FilterContents(ctx, userID, contents)
+
+	readable := 0
+	for _, p := range perms {
+		if p.Include(Read) {
+			readable++
+		}
+	}
+	fields := []log.Field{
+		log.Int("userID", int(userID)),
+		log.Int("contents", len(contents)),
+		log.Int("readable", readable),
+		log.Duration("duration", time.Since(began)),
+	}
+	if err != nil {
+		fields = append(fields, log.Error(err))
+	}
+	c.logger.Debug("sub-repo permissions batch check", fields...)
+
+	return perms, err
+}
+
+func (c *loggingChecker) Enabled() bool {
+	return c.base.Enabled()
+}
+
+func (c *loggingChecker) EnabledForRepoId(ctx context.Context, repoId api.RepoID) (bool, error) {
+	return c.base.EnabledForRepoId(ctx, repoId)
+}
+
+func (c *loggingChecker) EnabledForRepo(ctx context.Context, repo api.RepoName) (bool, error) {
+	return c.base.EnabledForRepo(ctx, repo)
+}
+
+func (c *loggingChecker) EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	return c.base.EnabledForUser(ctx, userID, repo)
+}
+
+// Bypassed lets actors bypass sub-repo permissions if the base checker does.
+func (c *loggingChecker) Bypassed(ctx context.Context, a *actor.Actor, content RepoContent) bool {
+	b, ok := c.base.(SubRepoPermsBypasser)
+	return ok && b.Bypassed(ctx, a, content)
+}
@@ -0,0 +1,80 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+	"github.com/sourcegraph/sourcegraph/lib/log"
+	"github.com/sourcegraph/sourcegraph/lib/log/logtest"
+)
+
+func TestWithLogging(t *testing.T) {
+	base := NewMockSubRepoPermissionChecker()
+	base.EnabledFunc.SetDefaultReturn(true)
+	base.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+		switch content.Path {
+		case "/broken":
+			return None, errors.New("boom")
+		case "/secret":
+			return None, nil
+		}
+		return Read, nil
+	})
+
+	logger, exportLogs := logtest.Captured(t)
+	checker := WithLogging(base, logger)
+	if !checker.Enabled() {
+		t.Fatal("expected Enabled to be passed through")
+	}
+
+	ctx := context.Background()
+	for _, tc := range []struct {
+		path      string
+		wantPerms Perms
+		wantErr   bool
+	}{
+		{path: "/readme", wantPerms: Read},
+		{path: "/secret", wantPerms: None},
+		{path: "/broken", wantPerms: None, wantErr: true},
+	} {
+		perms, err := checker.Permissions(ctx, 7, RepoContent{Repo: "sample", Path: tc.path})
+		if perms != tc.wantPerms || (err != nil) != tc.wantErr {
+			t.Fatalf("%s: got %s, %v", tc.path, perms, err)
+		}
+	}
+
+	logs := exportLogs()
+	if len(logs) != 3 {
+		t.Fatalf("want 3 log entries, got %d", len(logs))
+	}
+	type entry struct {
+		Perms string
+		Path  string
+		Error bool
+	}
+	var got []entry
+	for _, l := range logs {
+		if l.Level != log.LevelDebug {
+			t.Errorf("want debug level, got %s", l.Level)
+		}
+		if l.Fields["userID"] != int64(7) || l.Fields["repo"] != "sample" {
+			t.Errorf("missing userID or repo in %v", l.Fields)
+		}
+		if _, ok := l.Fields["duration"]; !ok {
+			t.Errorf("missing duration in %v", l.Fields)
+		}
+		_, hasErr := l.Fields["error"]
+		got = append(got, entry{Perms: l.Fields["perms"].(string), Path: l.Fields["path"].(string), Error: hasErr})
+	}
+	want := []entry{
+		{Perms: Read.String(), Path: RedactPath("/readme")},
+		{Perms: None.String(), Path: RedactPath("/secret")},
+		{Perms: None.String(), Path: RedactPath("/broken"), Error: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected log entries (-want +got):\n%s", diff)
+	}
+}
@@ -26,6 +26,12 @@ type MockSubRepoPermissionChecker struct {
 	// EnabledForRepoIdFunc is an instance of a mock function object
 	// controlling the behavior of the method EnabledForRepoId.
 	EnabledForRepoIdFunc *SubRepoPermissionCheckerEnabledForRepoIdFunc
+	// EnabledForUserFunc is an instance of a mock function object
+	// controlling the behavior of the method EnabledForUser.
+	EnabledForUserFunc *SubRepoPermissionCheckerEnabledForUserFunc
+	// FilterContentsFunc is an instance of a mock function object
+	// controlling the behavior of the method FilterContents.
+	FilterContentsFunc *SubRepoPermissionCheckerFilterContentsFunc
 	// PermissionsFunc is an instance of a mock function object controlling
 	// the behavior of the method Permissions.
 	PermissionsFunc *SubRepoPermissionCheckerPermissionsFunc
@@ -51,6 +57,16 @@ func NewMockSubRepoPermissionChecker() *MockSubRepoPermissionChecker {
 				return
 			},
 		},
+		EnabledForUserFunc: &SubRepoPermissionCheckerEnabledForUserFunc{
+			defaultHook: func(context.Context, int32, api.RepoName) (r0 bool, r1 error) {
+				return
+			},
+		},
+		FilterContentsFunc: &SubRepoPermissionCheckerFilterContentsFunc{
+			defaultHook: func(context.Context, int32, []RepoContent) (r0 map[RepoContent]Perms, r1 error) {
+				return
+			},
+		},
 		PermissionsFunc: &SubRepoPermissionCheckerPermissionsFunc{
 			defaultHook: func(context.Context, int32, RepoContent) (r0 Perms, r1 error) {
 				return
@@ -79,6 +95,16 @@ func NewStrictMockSubRepoPermissionChecker() *MockSubRepoPermissionChecker {
 				panic("unexpected invocation of MockSubRepoPermissionChecker.EnabledForRepoId")
 			},
 		},
+		EnabledForUserFunc: &SubRepoPermissionCheckerEnabledForUserFunc{
+			defaultHook: func(context.Context, int32, api.RepoName) (bool, error) {
+				panic("unexpected invocation of MockSubRepoPermissionChecker.EnabledForUser")
+			},
+		},
+		FilterContentsFunc: &SubRepoPermissionCheckerFilterContentsFunc{
+			defaultHook: func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error) {
+				panic("unexpected invocation of MockSubRepoPermissionChecker.FilterContents")
+			},
+		},
 		PermissionsFunc: &SubRepoPermissionCheckerPermissionsFunc{
 			defaultHook: func(context.Context, int32, RepoContent) (Perms, error) {
 				panic("unexpected invocation of MockSubRepoPermissionChecker.Permissions")
@@ -101,6 +127,12 @@ func NewMockSubRepoPermissionCheckerFrom(i SubRepoPermissionChecker) *MockSubRep
 		EnabledForRepoIdFunc: &SubRepoPermissionCheckerEnabledForRepoIdFunc{
 			defaultHook: i.EnabledForRepoId,
 		},
+		EnabledForUserFunc: &SubRepoPermissionCheckerEnabledForUserFunc{
+			defaultHook: i.EnabledForUser,
+		},
+		FilterContentsFunc: &SubRepoPermissionCheckerFilterContentsFunc{
+			defaultHook: i.FilterContents,
+		},
 		PermissionsFunc: &SubRepoPermissionCheckerPermissionsFunc{
 			defaultHook: i.Permissions,
 		},
@@ -433,6 +465,236 @@ func (c SubRepoPermissionCheckerEnabledForRepoIdFuncCall) Results() []interface{
 	return []interface{}{c.Result0, c.Result1}
 }
 
+// SubRepoPermissionCheckerEnabledForUserFunc describes the behavior when
+// the EnabledForUser method of the parent MockSubRepoPermissionChecker
+// instance is invoked.
+type SubRepoPermissionCheckerEnabledForUserFunc struct {
+	defaultHook func(context.Context, int32, api.RepoName) (bool, error)
+	hooks       []func(context.Context, int32, api.RepoName) (bool, error)
+	history     []SubRepoPermissionCheckerEnabledForUserFuncCall
+	mutex       sync.Mutex
+}
+
+// EnabledForUser delegates to the next hook function in the queue and
+// stores the parameter and result values of this invocation.
+func (m *MockSubRepoPermissionChecker) EnabledForUser(v0 context.Context, v1 int32, v2 api.RepoName) (bool, error) {
+	r0, r1 := m.EnabledForUserFunc.nextHook()(v0, v1, v2)
+	m.EnabledForUserFunc.appendCall(SubRepoPermissionCheckerEnabledForUserFuncCall{v0, v1, v2, r0, r1})
+	return r0, r1
+}
+
+// SetDefaultHook sets function that is called when the EnabledForUser
+// method of the parent MockSubRepoPermissionChecker instance is invoked and
+// the hook queue is empty.
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) SetDefaultHook(hook func(context.Context, int32, api.RepoName) (bool, error)) {
+	f.defaultHook = hook
+}
+
+// PushHook adds a function to the end of hook queue. Each invocation of the
+// EnabledForUser method of the parent MockSubRepoPermissionChecker instance
+// invokes the hook at the front of the queue and discards it. After the
+// queue is empty, the default hook function is invoked for any future
+// action.
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) PushHook(hook func(context.Context, int32, api.RepoName) (bool, error)) {
+	f.mutex.Lock()
+	f.hooks = append(f.hooks, hook)
+	f.mutex.Unlock()
+}
+
+// SetDefaultReturn calls SetDefaultHook with a function that returns the
+// given values.
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) SetDefaultReturn(r0 bool, r1 error) {
+	f.SetDefaultHook(func(context.Context, int32, api.RepoName) (bool, error) {
+		return r0, r1
+	})
+}
+
+// PushReturn calls PushHook with a function that returns the given values.
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) PushReturn(r0 bool, r1 error) {
+	f.PushHook(func(context.Context, int32, api.RepoName) (bool, error) {
+		return r0, r1
+	})
+}
+
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) nextHook() func(context.Context, int32, api.RepoName) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.hooks) == 0 {
+		return f.defaultHook
+	}
+
+	hook := f.hooks[0]
+	f.hooks = f.hooks[1:]
+	return hook
+}
+
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) appendCall(r0 SubRepoPermissionCheckerEnabledForUserFuncCall) {
+	f.mutex.Lock()
+	f.history = append(f.history, r0)
+	f.mutex.Unlock()
+}
+
+// History returns a sequence of
+// SubRepoPermissionCheckerEnabledForUserFuncCall objects describing the
+// invocations of this function.
+func (f *SubRepoPermissionCheckerEnabledForUserFunc) History() []SubRepoPermissionCheckerEnabledForUserFuncCall {
+	f.mutex.Lock()
+	history := make([]SubRepoPermissionCheckerEnabledForUserFuncCall, len(f.history))
+	copy(history, f.history)
+	f.mutex.Unlock()
+
+	return history
+}
+
+// SubRepoPermissionCheckerEnabledForUserFuncCall is an object that
+// describes an invocation of method EnabledForUser on an instance of
+// MockSubRepoPermissionChecker.
+type SubRepoPermissionCheckerEnabledForUserFuncCall struct {
+	// Arg0 is the value of the 1st argument passed to this method
+	// invocation.
+	Arg0 context.Context
+	// Arg1 is the value of the 2nd argument passed to this method
+	// invocation.
+	Arg1 int32
+	// Arg2 is the value of the 3rd argument passed to this method
+	// invocation.
+	Arg2 api.RepoName
+	// Result0 is the value of the 1st result returned from this method
+	// invocation.
+	Result0 bool
+	// Result1 is the value of the 2nd result returned from this method
+	// invocation.
+	Result1 error
+}
+
+// Args returns an interface slice containing the arguments of this
+// invocation.
+func (c SubRepoPermissionCheckerEnabledForUserFuncCall) Args() []interface{} {
+	return []interface{}{c.Arg0, c.Arg1, c.Arg2}
+}
+
+// Results returns an interface slice containing the results of this
+// invocation.
+func (c SubRepoPermissionCheckerEnabledForUserFuncCall) Results() []interface{} {
+	return []interface{}{c.Result0, c.Result1}
+}
+
+// SubRepoPermissionCheckerFilterContentsFunc describes the behavior when
+// the FilterContents method of the parent MockSubRepoPermissionChecker
+// instance is invoked.
+type SubRepoPermissionCheckerFilterContentsFunc struct {
+	defaultHook func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error)
+	hooks       []func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error)
+	history     []SubRepoPermissionCheckerFilterContentsFuncCall
+	mutex       sync.Mutex
+}
+
+// FilterContents delegates to the next hook function in the queue and
+// stores the parameter and result values of this invocation.
+func (m *MockSubRepoPermissionChecker) FilterContents(v0 context.Context, v1 int32, v2 []RepoContent) (map[RepoContent]Perms, error) {
+	r0, r1 := m.FilterContentsFunc.nextHook()(v0, v1, v2)
+	m.FilterContentsFunc.appendCall(SubRepoPermissionCheckerFilterContentsFuncCall{v0, v1, v2, r0, r1})
+	return r0, r1
+}
+
+// SetDefaultHook sets function that is called when the FilterContents
+// method of the parent MockSubRepoPermissionChecker instance is invoked and
+// the hook queue is empty.
+func (f *SubRepoPermissionCheckerFilterContentsFunc) SetDefaultHook(hook func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error)) {
+	f.defaultHook = hook
+}
+
+// PushHook adds a function to the end of hook queue. Each invocation of the
+// FilterContents method of the parent MockSubRepoPermissionChecker instance
+// invokes the hook at the front of the queue and discards it. After the
+// queue is empty, the default hook function is invoked for any future
+// action.
+func (f *SubRepoPermissionCheckerFilterContentsFunc) PushHook(hook func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error)) {
+	f.mutex.Lock()
+	f.hooks = append(f.hooks, hook)
+	f.mutex.Unlock()
+}
+
+// SetDefaultReturn calls SetDefaultHook with a function that returns the
+// given values.
+func (f *SubRepoPermissionCheckerFilterContentsFunc) SetDefaultReturn(r0 map[RepoContent]Perms, r1 error) {
+	f.SetDefaultHook(func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error) {
+		return r0, r1
+	})
+}
+
+// PushReturn calls PushHook with a function that returns the given values.
+func (f *SubRepoPermissionCheckerFilterContentsFunc) PushReturn(r0 map[RepoContent]Perms, r1 error) {
+	f.PushHook(func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error) {
+		return r0, r1
+	})
+}
+
+func (f *SubRepoPermissionCheckerFilterContentsFunc) nextHook() func(context.Context, int32, []RepoContent) (map[RepoContent]Perms, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if len(f.hooks) == 0 {
+		return f.defaultHook
+	}
+
+	hook := f.hooks[0]
+	f.hooks = f.hooks[1:]
+	return hook
+}
+
+func (f *SubRepoPermissionCheckerFilterContentsFunc) appendCall(r0 SubRepoPermissionCheckerFilterContentsFuncCall) {
+	f.mutex.Lock()
+	f.history = append(f.history, r0)
+	f.mutex.Unlock()
+}
+
+// History returns a sequence of
+// SubRepoPermissionCheckerFilterContentsFuncCall objects describing the
+// invocations of this function.
+func (f *SubRepoPermissionCheckerFilterContentsFunc) History() []SubRepoPermissionCheckerFilterContentsFuncCall {
+	f.mutex.Lock()
+	history := make([]SubRepoPermissionCheckerFilterContentsFuncCall, len(f.history))
+	copy(history, f.history)
+	f.mutex.Unlock()
+
+	return history
+}
+
+// SubRepoPermissionCheckerFilterContentsFuncCall is an object that
+// describes an invocation of method FilterContents on an instance of
+// MockSubRepoPermissionChecker.
+type SubRepoPermissionCheckerFilterContentsFuncCall struct {
+	// Arg0 is the value of the 1st argument passed to this method
+	// invocation.
+	Arg0 context.Context
+	// Arg1 is the value of the 2nd argument passed to this method
+	// invocation.
+	Arg1 int32
+	// Arg2 is the value of the 3rd argument passed to this method
+	// invocation.
+	Arg2 []RepoContent
+	// Result0 is the value of the 1st result returned from this method
+	// invocation.
+	Result0 map[RepoContent]Perms
+	// Result1 is the value of the 2nd result returned from this method
+	// invocation.
+	Result1 error
+}
+
+// Args returns an interface slice containing the arguments of this
+// invocation.
+func (c SubRepoPermissionCheckerFilterContentsFuncCall) Args() []interface{} {
+	return []interface{}{c.Arg0, c.Arg1, c.Arg2}
+}
+
+// Results returns an interface slice containing the results of this
+// invocation.
+func (c SubRepoPermissionCheckerFilterContentsFuncCall) Results() []interface{} {
+	return []interface{}{c.Result0, c.Result1}
+}
+
 // SubRepoPermissionCheckerPermissionsFunc describes the behavior when the
 // Permissions method of the parent MockSubRepoPermissionChecker instance is
 // invoked.
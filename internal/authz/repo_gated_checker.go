@@ -0,0 +1,126 @@
+package authz
+
+import (
+	"context"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// RepoAuthorizer checks whether a user has access to a repository as a whole.
+type RepoAuthorizer interface {
+	// AuthorizedForRepo returns true if the user can read the repository.
+	AuthorizedForRepo(ctx context.Context, userID int32, repo api.RepoName) (bool, error)
+}
+
+// RepoAuthorizerFunc is a function that implements RepoAuthorizer.
+type RepoAuthorizerFunc func(ctx context.Context, userID int32, repo api.RepoName) (bool, error)
+
+func (f RepoAuthorizerFunc) AuthorizedForRepo(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	return f(ctx, userID, repo)
+}
+
+// repoGatedChecker is a SubRepoPermissionChecker that only grants access to content when the
+// user can access the repository itself. It is for call paths where repo-level access hasn't
+// already been checked.
+type repoGatedChecker struct {
+	repoAuthz RepoAuthorizer
+	subRepo   SubRepoPermissionChecker
+}
+
+var _ SubRepoPermissionChecker = &repoGatedChecker{}
+
+// NewRepoGatedChecker returns a SubRepoPermissionChecker that returns None unless repoAuthz
+// authorizes the repository, and otherwise defers to subRepo. If sub-repo permissions are
+// disabled, Read is granted to anyone authorized for the repository.
+//
+// The returned checker is always enabled so that the repo-level check is never skipped by
+// callers that short-circuit on disabled sub-repo permissions. For the same reason it doesn't
+// pass on a SubRepoPermsBypasser implemented by subRepo.
+func NewRepoGatedChecker(repoAuthz RepoAuthorizer, subRepo SubRepoPermissionChecker) SubRepoPermissionChecker {
+	return &repoGatedChecker{repoAuthz: repoAuthz, subRepo: subRepo}
+}
+
+func (c *repoGatedChecker) Permissions(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+	ok, err := c.repoAuthz.AuthorizedForRepo(ctx, userID, content.Repo)
+	if err != nil {
+		return None, errors.Wrap(err, "checking repo permissions")
+	}
+	if !ok {
+		return None, nil
+	}
+
+	enabled, err := SubRepoEnabledForRepo(ctx, c.subRepo, content.Repo)
+	if err != nil {
+		return None, errors.Wrap(err, "checking sub-repo permissions enabled")
+	}
+	if !enabled {
+		return Read, nil
+	}
+	return c.subRepo.Permissions(ctx, userID, content)
+}
+
+// FilterContents checks each distinct repo once, and passes the contents of the
+// repos with sub-repo permissions to subRepo in a single batch.
+func (c *repoGatedChecker) FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+	type repoAccess struct {
+		authorized bool
+		// restricted is true when sub-repo permissions apply to the repo.
+		restricted bool
+	}
+	repos := map[api.RepoName]repoAccess{}
+	perms := make(map[RepoContent]Perms, len(contents))
+	var restricted []RepoContent
+	for _, content := range contents {
+		access, ok := repos[content.Repo]
+		if !ok {
+			authorized, err := c.repoAuthz.AuthorizedForRepo(ctx, userID, content.Repo)
+			if err != nil {
+				return nil, errors.Wrap(err, "checking repo permissions")
+			}
+			access.authorized = authorized
+			if authorized {
+				access.restricted, err = SubRepoEnabledForRepo(ctx, c.subRepo, content.Repo)
+				if err != nil {
+					return nil, errors.Wrap(err, "checking sub-repo permissions enabled")
+				}
+			}
+			repos[content.Repo] = access
+		}
+		switch {
+		case !access.authorized:
+			perms[content] = None
+		case access.restricted:
+			restricted = append(restricted, content)
+		default:
+			perms[content] = Read
+		}
+	}
+
+	if len(restricted) > 0 {
+		subRepoPerms, err := c.subRepo.FilterContents(ctx, userID, restricted)
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range restricted {
+			perms[content] = subRepoPerms[content]
+		}
+	}
+	return perms, nil
+}
+
+func (c *repoGatedChecker) Enabled() bool {
+	return true
+}
+
+func (c *repoGatedChecker) EnabledForRepoId(ctx context.Context, repoId api.RepoID) (bool, error) {
+	return true, nil
+}
+
+func (c *repoGatedChecker) EnabledForRepo(ctx context.Context, repo api.RepoName) (bool, error) {
+	return true, nil
+}
+
+func (c *repoGatedChecker) EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,113 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+func TestRepoGatedChecker(t *testing.T) {
+	repoAuthz := RepoAuthorizerFunc(func(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+		if repo == "broken" {
+			return false, errors.New("boom")
+		}
+		return repo == "public", nil
+	})
+	newSubRepo := func(enabled bool) *MockSubRepoPermissionChecker {
+		subRepo := NewMockSubRepoPermissionChecker()
+		subRepo.EnabledFunc.SetDefaultReturn(enabled)
+		subRepo.EnabledForRepoFunc.SetDefaultReturn(enabled, nil)
+		subRepo.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+			if content.Path == "allowed" {
+				return Read, nil
+			}
+			return None, nil
+		})
+		return subRepo
+	}
+
+	for _, tc := range []struct {
+		name      string
+		subRepo   SubRepoPermissionChecker
+		repo      api.RepoName
+		path      string
+		wantPerms Perms
+		wantErr   bool
+	}{
+		{
+			name:      "repo denied, sub-repo allows",
+			subRepo:   newSubRepo(true),
+			repo:      "private",
+			path:      "allowed",
+			wantPerms: None,
+		},
+		{
+			name:      "repo denied, sub-repo disabled",
+			subRepo:   newSubRepo(false),
+			repo:      "private",
+			path:      "allowed",
+			wantPerms: None,
+		},
+		{
+			name:      "repo denied, no sub-repo checker",
+			subRepo:   nil,
+			repo:      "private",
+			path:      "allowed",
+			wantPerms: None,
+		},
+		{
+			name:      "repo check errors",
+			subRepo:   newSubRepo(true),
+			repo:      "broken",
+			path:      "allowed",
+			wantPerms: None,
+			wantErr:   true,
+		},
+		{
+			name:      "both allow",
+			subRepo:   newSubRepo(true),
+			repo:      "public",
+			path:      "allowed",
+			wantPerms: Read,
+		},
+		{
+			name:      "repo allows, sub-repo denies",
+			subRepo:   newSubRepo(true),
+			repo:      "public",
+			path:      "denied",
+			wantPerms: None,
+		},
+		{
+			name:      "repo allows, sub-repo disabled",
+			subRepo:   newSubRepo(false),
+			repo:      "public",
+			path:      "denied",
+			wantPerms: Read,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			checker := NewRepoGatedChecker(repoAuthz, tc.subRepo)
+			content := RepoContent{Repo: tc.repo, Path: tc.path}
+
+			perms, err := checker.Permissions(context.Background(), 1, content)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if perms != tc.wantPerms {
+				t.Errorf("want perms %v, got %v", tc.wantPerms, perms)
+			}
+
+			// Callers that short-circuit on disabled sub-repo permissions must still hit the repo gate.
+			perms, err = ActorPermissions(context.Background(), checker, &actor.Actor{UID: 1}, content)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error from ActorPermissions: %v", err)
+			}
+			if perms != tc.wantPerms {
+				t.Errorf("ActorPermissions: want perms %v, got %v", tc.wantPerms, perms)
+			}
+		})
+	}
+}
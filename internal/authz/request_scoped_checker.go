@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// requestScopedChecker is a SubRepoPermissionChecker that memoizes the results of
+// another checker for the duration of a request.
+type requestScopedChecker struct {
+	ctx  context.Context
+	base SubRepoPermissionChecker
+
+	mu    sync.Mutex
+	perms map[requestScopedKey]Perms
+}
+
+type requestScopedKey struct {
+	userID  int32
+	content RepoContent
+}
+
+var _ SubRepoPermissionChecker = &requestScopedChecker{}
+var _ SubRepoPermsBypasser = &requestScopedChecker{}
+
+// NewRequestScopedChecker returns a SubRepoPermissionChecker that remembers the
+// permissions returned by base for each user and content, so that checking the
+// same path several times while serving a request only calls base once. Errors
+// aren't remembered.
+//
+// The checker is meant to be created per request and discarded with it. Once
+// ctx is done, results are no longer remembered and every call goes to base,
+// so the checker can't outlive the request's view of the permissions.
+func NewRequestScopedChecker(ctx context.Context, base SubRepoPermissionChecker) SubRepoPermissionChecker {
+	return &requestScopedChecker{
+		ctx:   ctx,
+		base:  base,
+		perms: map[requestScopedKey]Perms{},
+	}
+}
+
+func (c *requestScopedChecker) Permissions(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+	if c.ctx.Err() != nil {
+		c.mu.Lock()
+		c.perms = nil
+		c.mu.Unlock()
+		return c.base.Permissions(ctx, userID, content)
+	}
+
+	key := requestScopedKey{userID: userID, content: content}
+	c.mu.Lock()
+	perms, ok := c.perms[key]
+	c.mu.Unlock()
+	if ok {
+		return perms, nil
+	}
+
+	perms, err := c.base.Permissions(ctx, userID, content)
+	if err != nil {
+		return perms, err
+	}
+
+	c.mu.Lock()
+	if c.perms != nil {
+		c.perms[key] = perms
+	}
+	c.mu.Unlock()
+	return perms, nil
+}
+
+// FilterContents only passes the contents that aren't remembered yet to base,
+// in a single batch.
+func (c *requestScopedChecker) FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+	if c.ctx.Err() != nil {
+		c.mu.Lock()
+		c.perms = nil
+		c.mu.Unlock()
+		return c.base.FilterContents(ctx, userID, contents)
+	}
+
+	perms := make(map[RepoContent]Perms, len(contents))
+	var missing []RepoContent
+	c.mu.Lock()
+	for _, content := range contents {
+		if p, ok := c.perms[requestScopedKey{userID: userID, content: content}]; ok {
+			perms[content] = p
+		} else {
+			missing = append(missing, content)
+		}
+	}
+	c.mu.Unlock()
+	if len(missing) == 0 {
+		return perms, nil
+	}
+
+	fetched, err := c.base.FilterContents(ctx, userID, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	for _, content := range missing {
+		perms[content] = fetched[content]
+		if c.perms != nil {
+			c.perms[requestScopedKey{userID: userID, content: content}] = fetched[content]
+		}
+	}
+	c.mu.Unlock()
+	return perms, nil
+}
+
+func (c *requestScopedChecker) Enabled() bool {
+	return c.base.Enabled()
+}
+
+func (c *requestScopedChecker) EnabledForRepoId(ctx context.Context, repoId api.RepoID) (bool, error) {
+	return c.base.EnabledForRepoId(ctx, repoId)
+}
+
+func (c *requestScopedChecker) EnabledForRepo(ctx context.Context, repo api.RepoName) (bool, error) {
+	return c.base.EnabledForRepo(ctx, repo)
+}
+
+func (c *requestScopedChecker) EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	return c.base.EnabledForUser(ctx, userID, repo)
+}
+
+// Bypassed lets actors bypass sub-repo permissions if the base checker does.
+func (c *requestScopedChecker) Bypassed(ctx context.Context, a *actor.Actor, content RepoContent) bool {
+	b, ok := c.base.(SubRepoPermsBypasser)
+	return ok && b.Bypassed(ctx, a, content)
+}
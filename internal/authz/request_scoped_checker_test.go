@@ -0,0 +1,122 @@
+package authz
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+func TestRequestScopedChecker(t *testing.T) {
+	newBase := func() *MockSubRepoPermissionChecker {
+		base := NewMockSubRepoPermissionChecker()
+		base.EnabledFunc.SetDefaultReturn(true)
+		base.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+			if content.Path == "/broken" {
+				return None, errors.New("boom")
+			}
+			if content.Path == "/secret" {
+				return None, nil
+			}
+			return Read, nil
+		})
+		base.FilterContentsFunc.SetDefaultHook(func(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+			perms := make(map[RepoContent]Perms, len(contents))
+			for _, content := range contents {
+				p, err := base.Permissions(ctx, userID, content)
+				if err != nil {
+					return nil, err
+				}
+				perms[content] = p
+			}
+			return perms, nil
+		})
+		return base
+	}
+
+	t.Run("memoizes per user and path", func(t *testing.T) {
+		base := newBase()
+		checker := NewRequestScopedChecker(context.Background(), base)
+
+		for i := 0; i < 3; i++ {
+			for _, tc := range []struct {
+				userID int32
+				path   string
+				want   Perms
+			}{
+				{1, "/a", Read},
+				{1, "/b", Read},
+				{1, "/secret", None},
+				{2, "/a", Read},
+			} {
+				have, err := checker.Permissions(context.Background(), tc.userID, RepoContent{Repo: "sample", Path: tc.path})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if have != tc.want {
+					t.Errorf("user %d, path %s: want %v, got %v", tc.userID, tc.path, tc.want, have)
+				}
+			}
+		}
+
+		if calls := len(base.PermissionsFunc.History()); calls != 4 {
+			t.Fatalf("want base called once per distinct user and path (4), got %d", calls)
+		}
+	})
+
+	t.Run("batches only pass on what isn't memoized", func(t *testing.T) {
+		base := newBase()
+		checker := NewRequestScopedChecker(context.Background(), base)
+
+		if _, err := checker.Permissions(context.Background(), 1, RepoContent{Repo: "sample", Path: "/a"}); err != nil {
+			t.Fatal(err)
+		}
+		contents := []RepoContent{{Repo: "sample", Path: "/a"}, {Repo: "sample", Path: "/secret"}}
+		for i := 0; i < 2; i++ {
+			perms, err := checker.FilterContents(context.Background(), 1, contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perms[contents[0]] != Read || perms[contents[1]] != None {
+				t.Fatalf("want Read and None, got %v", perms)
+			}
+		}
+
+		history := base.FilterContentsFunc.History()
+		if len(history) != 1 {
+			t.Fatalf("want base called once, got %d", len(history))
+		}
+		if batch := history[0].Arg2; len(batch) != 1 || batch[0].Path != "/secret" {
+			t.Fatalf("want only /secret passed to base, got %v", batch)
+		}
+	})
+
+	t.Run("errors are not memoized", func(t *testing.T) {
+		base := newBase()
+		checker := NewRequestScopedChecker(context.Background(), base)
+		for i := 0; i < 2; i++ {
+			if _, err := checker.Permissions(context.Background(), 1, RepoContent{Repo: "sample", Path: "/broken"}); err == nil {
+				t.Fatal("expected an error")
+			}
+		}
+		if calls := len(base.PermissionsFunc.History()); calls != 2 {
+			t.Fatalf("want base called for every failed check (2), got %d", calls)
+		}
+	})
+
+	t.Run("discarded with the request", func(t *testing.T) {
+		base := newBase()
+		ctx, cancel := context.WithCancel(context.Background())
+		checker := NewRequestScopedChecker(ctx, base)
+		content := RepoContent{Repo: "sample", Path: "/a"}
+
+		_, _ = checker.Permissions(context.Background(), 1, content)
+		_, _ = checker.Permissions(context.Background(), 1, content)
+		cancel()
+		_, _ = checker.Permissions(context.Background(), 1, content)
+
+		if calls := len(base.PermissionsFunc.History()); calls != 2 {
+			t.Fatalf("want base called again once the request is done (2), got %d", calls)
+		}
+	})
+}
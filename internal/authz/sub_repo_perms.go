@@ -2,28 +2,57 @@ package authz
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"io/fs"
+	"math/rand"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gobwas/glob"
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/inconshreveable/log15"
+	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 
 	"github.com/sourcegraph/sourcegraph/internal/actor"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/env"
+	"github.com/sourcegraph/sourcegraph/internal/trace/ot"
 	"github.com/sourcegraph/sourcegraph/lib/errors"
 )
 
-// RepoContent specifies data existing in a repo. It currently only supports
-// paths but will be extended in future to support other pieces of metadata, for
-// example branch.
+// RepoContent specifies data existing in a repo: a path, optionally on a branch.
 type RepoContent struct {
 	Repo api.RepoName
 	Path string
+	// Branch optionally names the branch the path is on, so that rules scoped
+	// to the branch apply. Without it, only the repo-wide rules apply.
+	Branch string
+	// Commit optionally scopes the check to the rules that applied at the given
+	// commit. It is only honoured by getters that implement
+	// ScopedSubRepoPermissionsGetter, otherwise current rules are used.
+	Commit api.CommitID
+	// Time optionally scopes the check to the rules that applied at the given
+	// time, such as the date of a commit. Like Commit, it is only honoured by
+	// getters that implement ScopedSubRepoPermissionsGetter.
+	Time time.Time
+}
+
+// rulesScope returns the scope of the rules that apply to the content. The time
+// is normalized so that equal instants share cached rules.
+func (c RepoContent) rulesScope() RulesScope {
+	return RulesScope{Commit: c.Commit, Time: c.Time.UTC()}
 }
 
 // SubRepoPermissionChecker is the interface exposed by the SubRepoPermsClient and is
@@ -35,6 +64,12 @@ type SubRepoPermissionChecker interface {
 	// If the userID represents an anonymous user, ErrUnauthenticated is returned.
 	Permissions(ctx context.Context, userID int32, content RepoContent) (Perms, error)
 
+	// FilterContents is like Permissions for many contents at once, possibly in
+	// different repos. It returns the level of access for each of the contents.
+	//
+	// If the userID represents an anonymous user, ErrUnauthenticated is returned.
+	FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error)
+
 	// Enabled indicates whether sub-repo permissions are enabled.
 	Enabled() bool
 
@@ -43,8 +78,21 @@ type SubRepoPermissionChecker interface {
 
 	// EnabledForRepo indicates whether sub-repo permissions are enabled for the given repo
 	EnabledForRepo(ctx context.Context, repo api.RepoName) (bool, error)
+
+	// EnabledForUser indicates whether sub-repo permissions restrict what the
+	// given user can read in the given repo, so callers can skip filtering
+	// content when they don't.
+	EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error)
 }
 
+// ErrSubRepoPermsNotSynced is returned along with None when a repo supports
+// sub-repo permissions but the user has no rules for it yet, which usually means
+// their permissions haven't been synced. It lets callers tell this apart from a
+// denial, for example to say that access is still being synced. ActorPermissions
+// and the helpers built on it deny such content without an error, see
+// OutcomeNotSynced.
+var ErrSubRepoPermsNotSynced = errors.New("sub-repo permissions not synced yet")
+
 // DefaultSubRepoPermsChecker allows us to use a single instance with a shared
 // cache and database connection. Since we don't have a database connection at
 // initialisation time, services that require this client should initialise it in
@@ -57,6 +105,14 @@ func (*noopPermsChecker) Permissions(ctx context.Context, userID int32, content
 	return None, nil
 }
 
+func (*noopPermsChecker) FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+	perms := make(map[RepoContent]Perms, len(contents))
+	for _, content := range contents {
+		perms[content] = None
+	}
+	return perms, nil
+}
+
 func (*noopPermsChecker) Enabled() bool {
 	return false
 }
@@ -69,7 +125,13 @@ func (*noopPermsChecker) EnabledForRepo(ctx context.Context, repo api.RepoName)
 	return false, nil
 }
 
+func (*noopPermsChecker) EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	return false, nil
+}
+
 var _ SubRepoPermissionChecker = &SubRepoPermsClient{}
+var _ LineRangePermissionChecker = &SubRepoPermsClient{}
+var _ SubRepoPermsBypasser = &SubRepoPermsClient{}
 
 // SubRepoPermissionsGetter allows getting sub repository permissions.
 type SubRepoPermissionsGetter interface {
@@ -83,6 +145,57 @@ type SubRepoPermissionsGetter interface {
 	RepoSupported(ctx context.Context, repo api.RepoName) (bool, error)
 }
 
+// RulesScope selects the sub-repo permissions rules that applied at a
+// particular commit or point in time. The zero value selects the current rules.
+type RulesScope struct {
+	Commit api.CommitID
+	Time   time.Time
+}
+
+// IsZero returns true if the scope selects the current rules.
+func (s RulesScope) IsZero() bool {
+	return s.Commit == "" && s.Time.IsZero()
+}
+
+func (s RulesScope) String() string {
+	if s.Commit != "" {
+		return string(s.Commit)
+	}
+	if !s.Time.IsZero() {
+		return s.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return "current"
+}
+
+// ScopedSubRepoPermissionsGetter is a SubRepoPermissionsGetter that can also
+// return the rules that applied historically, for compliance regimes where
+// access to old commits must be checked against the rules of the time.
+type ScopedSubRepoPermissionsGetter interface {
+	SubRepoPermissionsGetter
+
+	// GetByUserAt returns the sub repository permissions rules known for a user
+	// within the given scope. A zero scope is equivalent to GetByUser.
+	GetByUserAt(ctx context.Context, userID int32, scope RulesScope) (map[api.RepoName]SubRepoPermissions, error)
+}
+
+// NewScopedSubRepoPermissionsGetter adapts a getter that has no knowledge of
+// historical rules by returning the current rules for every scope. Getters that
+// already implement ScopedSubRepoPermissionsGetter are returned as is.
+func NewScopedSubRepoPermissionsGetter(g SubRepoPermissionsGetter) ScopedSubRepoPermissionsGetter {
+	if scoped, ok := g.(ScopedSubRepoPermissionsGetter); ok {
+		return scoped
+	}
+	return &currentRulesGetter{SubRepoPermissionsGetter: g}
+}
+
+type currentRulesGetter struct {
+	SubRepoPermissionsGetter
+}
+
+func (g *currentRulesGetter) GetByUserAt(ctx context.Context, userID int32, _ RulesScope) (map[api.RepoName]SubRepoPermissions, error) {
+	return g.GetByUser(ctx, userID)
+}
+
 // SubRepoPermsClient is a concrete implementation of SubRepoPermissionChecker.
 // Always use NewSubRepoPermsClient to instantiate an instance.
 type SubRepoPermsClient struct {
@@ -92,8 +205,45 @@ type SubRepoPermsClient struct {
 
 	group *singleflight.Group
 	cache *lru.Cache
+	// pool shares compiled rules between cached users. Entries evicted from the
+	// cache release their rules from the pool.
+	pool *compiledRulePool
+
+	// invariantCheckRate is the fraction of Read results served from cached rules
+	// that are rechecked against the rules from the getter, in the background.
+	// Divergences are counted and passed to onInvariantViolation.
+	invariantCheckRate   float64
+	onInvariantViolation func(error)
+	// invariantChecks bounds the checks in flight. Samples taken while it is
+	// full are dropped.
+	invariantChecks *semaphore.Weighted
+	// bypass reports whether an actor may skip sub-repo permissions, and
+	// onBypass records every check it lets through. By default the users in the
+	// bypassUserIDs site configuration may, see WithBypass.
+	bypass   func(a *actor.Actor) bool
+	onBypass func(ctx context.Context, a *actor.Actor, content RepoContent)
+	// bus broadcasts invalidations to other replicas. It defaults to
+	// NoopInvalidationBus, see UseInvalidationBus.
+	bus InvalidationBus
 }
 
+// checkInvariants enables rechecking cached grants against the underlying rules,
+// to catch caching bugs that keep serving Read after rules were tightened. Each
+// check costs a call to the getter off the request path, so it is meant for tests
+// and staging. Note that a divergence is also expected for up to the cache TTL
+// after rules change.
+var checkInvariants = env.Get("SRC_SUB_REPO_PERMS_CHECK_INVARIANTS", "", "If set, recheck a sample of cached sub-repo permissions grants against the underlying rules in the background, and log divergences. Meant for tests and staging.")
+
+const (
+	// defaultInvariantCheckRate is the fraction of cached grants rechecked when
+	// checkInvariants is set.
+	defaultInvariantCheckRate = 0.01
+	// maxInvariantChecksInFlight bounds the background invariant checks.
+	maxInvariantChecksInFlight = 4
+	// invariantCheckTimeout bounds a single background invariant check.
+	invariantCheckTimeout = 10 * time.Second
+)
+
 const defaultCacheSize = 1000
 const defaultCacheTTL = 10 * time.Second
 
@@ -101,11 +251,84 @@ const defaultCacheTTL = 10 * time.Second
 type cachedRules struct {
 	rules     map[api.RepoName]compiledRules
 	timestamp time.Time
+	// ttl is how long the entry is fresh for. It grows while the rules are
+	// unchanged across refreshes, see nextCacheTTL.
+	ttl time.Duration
+	// fingerprint identifies the uncompiled rules, to tell whether they changed.
+	fingerprint [sha256.Size]byte
+	// pooled are the rule sets taken from the pool, released on eviction.
+	pooled []ruleSetKey
+	// support remembers which repos without rules support sub-repo permissions.
+	// It expires and is invalidated along with the rules.
+	support *repoSupport
+}
+
+// repoSupport caches whether repos support sub-repo permissions, for the repos a
+// user has no rules for. A supported repo without rules isn't synced yet.
+type repoSupport struct {
+	mu        sync.Mutex
+	supported map[api.RepoName]bool
+}
+
+func newRepoSupport() *repoSupport {
+	return &repoSupport{supported: map[api.RepoName]bool{}}
+}
+
+// repoSupported returns whether the repo supports sub-repo permissions, asking the
+// getter only the first time a repo is looked up.
+func (r *repoSupport) repoSupported(ctx context.Context, getter SubRepoPermissionsGetter, repo api.RepoName) (bool, error) {
+	if r == nil {
+		return getter.RepoSupported(ctx, repo)
+	}
+	r.mu.Lock()
+	supported, ok := r.supported[repo]
+	r.mu.Unlock()
+	if ok {
+		return supported, nil
+	}
+	supported, err := getter.RepoSupported(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.supported[repo] = supported
+	r.mu.Unlock()
+	return supported, nil
+}
+
+// scopedCacheKey is the cache key for rules that are not the current rules.
+type scopedCacheKey struct {
+	userID int32
+	scope  RulesScope
 }
 
 type compiledRules struct {
 	includes []glob.Glob
 	excludes []glob.Glob
+	// allowsAll is true when the rules match every path, so they don't restrict
+	// anything.
+	allowsAll bool
+	// denyAllReason is set when the rules match no path, to the reason every
+	// path is denied for.
+	//
+	// Rules that allow or deny all paths are answered without matching the path,
+	// so their globs aren't kept.
+	denyAllReason string
+	// branches are the rules that only apply on some branches.
+	branches []compiledBranchRule
+	// lines are the line rules, which don't affect which paths match.
+	lines []compiledLineRule
+}
+
+type compiledBranchRule struct {
+	branch   glob.Glob
+	includes []glob.Glob
+	excludes []glob.Glob
+}
+
+type compiledLineRule struct {
+	path   glob.Glob
+	ranges []LineRange
 }
 
 // NewSubRepoPermsClient instantiates an instance of authz.SubRepoPermsClient
@@ -121,7 +344,12 @@ type compiledRules struct {
 // Note that sub-repo permissions are currently opt-in via the
 // experimentalFeatures.enableSubRepoPermissions option.
 func NewSubRepoPermsClient(permissionsGetter SubRepoPermissionsGetter) (*SubRepoPermsClient, error) {
-	cache, err := lru.New(defaultCacheSize)
+	pool := newCompiledRulePool(defaultPoolMaxEntries, defaultPoolMaxBytes)
+	cache, err := lru.NewWithEvict(defaultCacheSize, func(_, value any) {
+		if entry, ok := value.(cachedRules); ok {
+			pool.release(entry.pooled)
+		}
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "creating LRU cache")
 	}
@@ -132,13 +360,27 @@ func NewSubRepoPermsClient(permissionsGetter SubRepoPermissionsGetter) (*SubRepo
 		}
 	})
 
-	return &SubRepoPermsClient{
+	client := &SubRepoPermsClient{
 		permissionsGetter: permissionsGetter,
 		clock:             time.Now,
 		since:             time.Since,
 		group:             &singleflight.Group{},
 		cache:             cache,
-	}, nil
+		pool:              pool,
+		bus:               NoopInvalidationBus{},
+
+		bypass:   bypassedInSiteConfig,
+		onBypass: logBypass,
+
+		invariantChecks: semaphore.NewWeighted(maxInvariantChecksInFlight),
+		onInvariantViolation: func(err error) {
+			log15.Warn("sub-repo permissions cache diverged from rules", "error", err)
+		},
+	}
+	if checkInvariants != "" {
+		client.invariantCheckRate = defaultInvariantCheckRate
+	}
+	return client, nil
 }
 
 // WithGetter returns a new instance that uses the supplied getter. The cache
@@ -150,21 +392,110 @@ func (s *SubRepoPermsClient) WithGetter(g SubRepoPermissionsGetter) *SubRepoPerm
 		since:             s.since,
 		group:             s.group,
 		cache:             s.cache,
+		pool:              s.pool,
+
+		invariantCheckRate:   s.invariantCheckRate,
+		onInvariantViolation: s.onInvariantViolation,
+		invariantChecks:      s.invariantChecks,
+
+		bypass:   s.bypass,
+		onBypass: s.onBypass,
+
+		bus: s.bus,
 	}
 }
 
+// WithBypass returns a new instance that lets the actors for which bypass returns
+// true read all content regardless of sub-repo permissions. onBypass is called
+// with every check that is let through, as an audit trail. The cache from the
+// original instance is left intact.
+func (s *SubRepoPermsClient) WithBypass(bypass func(a *actor.Actor) bool, onBypass func(ctx context.Context, a *actor.Actor, content RepoContent)) *SubRepoPermsClient {
+	client := s.WithGetter(s.permissionsGetter)
+	client.bypass = bypass
+	client.onBypass = onBypass
+	return client
+}
+
 // subRepoPermsPermissionsDuration tracks the behaviour and performance of Permissions()
 var subRepoPermsPermissionsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Name: "authz_sub_repo_perms_permissions_duration_seconds",
 	Help: "Time spent syncing",
 }, []string{"error"})
 
+// subRepoPermsChecks counts checks of content by outcome: "read", "none" or
+// "error". Checks are only counted while sub-repo permissions are enabled.
+var subRepoPermsChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "authz_sub_repo_perms_checks_total",
+	Help: "The number of sub-repo perms checks of content, by outcome",
+}, []string{"outcome"})
+
+// countChecks adds the outcomes of checking contents to subRepoPermsChecks.
+func countChecks(perms []Perms, err error, contents int) {
+	if err != nil {
+		subRepoPermsChecks.WithLabelValues("error").Add(float64(contents))
+		return
+	}
+	var read, none float64
+	for _, p := range perms {
+		if p.Include(Read) {
+			read++
+		} else {
+			none++
+		}
+	}
+	if read > 0 {
+		subRepoPermsChecks.WithLabelValues("read").Add(read)
+	}
+	if none > 0 {
+		subRepoPermsChecks.WithLabelValues("none").Add(none)
+	}
+}
+
 // subRepoPermsCacheHit tracks the number of cache hits and misses for sub-repo permissions
 var subRepoPermsCacheHit = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "authz_sub_repo_perms_permissions_cache_count",
 	Help: "The number of sub-repo perms cache hits or misses",
 }, []string{"hit"})
 
+// subRepoPermsDenied counts denials by reason. A rise in "no_match" denials,
+// where no rule covered the path, usually indicates missing rules rather than
+// intended denial.
+var subRepoPermsDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "authz_sub_repo_perms_denied_total",
+	Help: "The number of sub-repo perms checks that denied access, by reason",
+}, []string{"reason"})
+
+const (
+	deniedReasonExclude = "exclude"
+	deniedReasonNoMatch = "no_match"
+	// deniedReasonEscape is for paths that escape the repo root, like `../x`.
+	deniedReasonEscape = "escape"
+	// deniedReasonNotSynced is for repos the user has no rules for yet, see
+	// ErrSubRepoPermsNotSynced.
+	deniedReasonNotSynced = "not_synced"
+)
+
+// RedactPath is applied to every path that sub-repo permission checks emit into
+// logs, traces, and metrics. Matching always uses the real path. It defaults to
+// HashPath and may be replaced at startup, for example with TruncatePath.
+var RedactPath = HashPath
+
+// HashPath replaces a path with a short, stable hash so that events about the
+// same path can still be correlated without revealing it.
+func HashPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// TruncatePath keeps only the top-level directory of a path.
+func TruncatePath(path string) string {
+	trimmed := strings.TrimPrefix(path, "/")
+	if i := strings.Index(trimmed, "/"); i >= 0 {
+		return trimmed[:i] + "/..."
+	}
+	return "..."
+}
+
 // Permissions return the current permissions granted to the given user on the
 // given content. If sub-repo permissions are disabled, it is a no-op that return
 // Read.
@@ -174,118 +505,1019 @@ func (s *SubRepoPermsClient) Permissions(ctx context.Context, userID int32, cont
 		return Read, nil
 	}
 
+	span, ctx := ot.StartSpanFromContext(ctx, "SubRepoPermsClient.Permissions")
+	span.SetTag("userID", userID)
+	span.SetTag("repo", string(content.Repo))
+	span.SetTag("path", RedactPath(content.Path))
+
+	// Only the rule fetching and matching is timed, not the check above.
 	began := time.Now()
 	defer func() {
 		took := time.Since(began).Seconds()
 		subRepoPermsPermissionsDuration.WithLabelValues(strconv.FormatBool(err != nil)).Observe(took)
+		countChecks([]Perms{perms}, err, 1)
+
+		span.SetTag("perms", perms.String())
+		if err != nil {
+			span.SetTag("error", true)
+			span.LogFields(otlog.Error(err))
+		}
+		span.Finish()
 	}()
 
+	batch, notSynced, err := s.evaluate(ctx, userID, []RepoContent{content})
+	if err != nil {
+		return None, err
+	}
+	if _, ok := notSynced[content.Repo]; ok {
+		return None, ErrSubRepoPermsNotSynced
+	}
+	return batch[0], nil
+}
+
+// FilterContents returns the permissions granted to the given user on each of
+// the given contents. If sub-repo permissions are disabled, all of them are
+// Read.
+func (s *SubRepoPermsClient) FilterContents(ctx context.Context, userID int32, contents []RepoContent) (map[RepoContent]Perms, error) {
+	batch, err := s.permissionsBatch(ctx, userID, contents)
+	if err != nil {
+		return nil, err
+	}
+	perms := make(map[RepoContent]Perms, len(contents))
+	for i, content := range contents {
+		perms[content] = batch[i]
+	}
+	return perms, nil
+}
+
+// VisiblePaths returns the paths of a tree listing in repo that the given user
+// can read, in their original order. The rules are compiled once for the whole
+// tree. A directory, with or without a trailing slash, that has children in the
+// tree is only kept if at least one of them is, so that directories whose
+// contents are all hidden don't show up empty. Other directories are checked
+// like files. If sub-repo permissions are disabled, the tree is returned
+// unchanged.
+func (s *SubRepoPermsClient) VisiblePaths(ctx context.Context, userID int32, repo api.RepoName, tree []string) ([]string, error) {
+	if !s.Enabled() {
+		return tree, nil
+	}
+
+	contents := make([]RepoContent, len(tree))
+	for i, p := range tree {
+		contents[i] = RepoContent{Repo: repo, Path: p}
+	}
+	perms, err := s.permissionsBatch(ctx, userID, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every ancestor of a path has children, and those of a readable path have
+	// visible children.
+	hasChildren := map[string]bool{}
+	for i, p := range tree {
+		visible := perms[i].Include(Read)
+		dir := strings.Trim(p, "/")
+		for j := strings.LastIndex(dir, "/"); j > 0; j = strings.LastIndex(dir, "/") {
+			dir = dir[:j]
+			hasChildren[dir] = hasChildren[dir] || visible
+		}
+	}
+
+	visible := make([]string, 0, len(tree))
+	for i, p := range tree {
+		if anyVisible, ok := hasChildren[strings.Trim(p, "/")]; ok {
+			if anyVisible {
+				visible = append(visible, p)
+			}
+			continue
+		}
+		if perms[i].Include(Read) {
+			visible = append(visible, p)
+		}
+	}
+	return visible, nil
+}
+
+// ReadableLineRanges returns the ranges of the first of the user's line rules for
+// the repo that matches the path. The ranges are as configured, callers clip and
+// merge them, see ActorReadableLineRanges.
+func (s *SubRepoPermsClient) ReadableLineRanges(ctx context.Context, userID int32, content RepoContent, lineCount int) ([]LineRange, bool, error) {
 	if s.permissionsGetter == nil {
-		return None, errors.New("PermissionsGetter is nil")
+		return nil, false, errors.New("PermissionsGetter is nil")
+	}
+	if userID == 0 {
+		return nil, false, &ErrUnauthenticated{}
+	}
+	repoRules, _, err := s.getCompiledRules(ctx, userID, content.rulesScope())
+	if err != nil {
+		return nil, false, errors.Wrap(err, "compiling match rules")
+	}
+	path, ok := cleanPath(content.Path)
+	if !ok {
+		return nil, false, nil
+	}
+	for _, rule := range repoRules[content.Repo].lines {
+		if rule.path.Match(path) {
+			return rule.ranges, true, nil
+		}
 	}
+	return nil, false, nil
+}
+
+// permissionsBatch is like Permissions for many contents at once, possibly in
+// different repos. The user's rules are fetched and compiled once for all of
+// them, and then each path is only matched, so the cost per path is a map lookup
+// and the glob matches. perms[i] is the permissions for contents[i].
+func (s *SubRepoPermsClient) permissionsBatch(ctx context.Context, userID int32, contents []RepoContent) (perms []Perms, err error) {
+	if !s.Enabled() {
+		perms = make([]Perms, len(contents))
+		for i := range perms {
+			perms[i] = Read
+		}
+		return perms, nil
+	}
+
+	span, ctx := ot.StartSpanFromContext(ctx, "SubRepoPermsClient.permissionsBatch")
+	span.SetTag("userID", userID)
+	span.SetTag("contents", len(contents))
+	began := time.Now()
+	defer func() {
+		subRepoPermsPermissionsDuration.WithLabelValues(strconv.FormatBool(err != nil)).Observe(time.Since(began).Seconds())
+		countChecks(perms, err, len(contents))
+		if err != nil {
+			span.SetTag("error", true)
+			span.LogFields(otlog.Error(err))
+		}
+		span.Finish()
+	}()
+
+	// Contents in repos that aren't synced yet are None, without an error for
+	// the whole batch.
+	perms, _, err = s.evaluate(ctx, userID, contents)
+	return perms, err
+}
 
+// evaluate does the work of Permissions and permissionsBatch, without their
+// tracing. It also returns the repos of contents that were denied because the
+// repo supports sub-repo permissions but the user has no rules for it yet.
+func (s *SubRepoPermsClient) evaluate(ctx context.Context, userID int32, contents []RepoContent) ([]Perms, map[api.RepoName]struct{}, error) {
+	if s.permissionsGetter == nil {
+		return nil, nil, errors.New("PermissionsGetter is nil")
+	}
 	if userID == 0 {
-		return None, &ErrUnauthenticated{}
+		return nil, nil, &ErrUnauthenticated{}
 	}
 
-	// An empty path is equivalent to repo permissions so we can assume it has
-	// already been checked at that level.
-	if content.Path == "" {
-		return Read, nil
+	// Rules only differ by scope, so contents with the same scope share them.
+	perms := make([]Perms, len(contents))
+	var entry cachedRules
+	var cached bool
+	var rulesScope RulesScope
+	var excluded, unmatched, escaped, unsynced float64
+	var notSynced map[api.RepoName]struct{}
+	for i, content := range contents {
+		if content.Path == "" {
+			perms[i] = Read
+			continue
+		}
+		if entry.rules == nil || content.rulesScope() != rulesScope {
+			var err error
+			entry, cached, err = s.getRules(ctx, userID, content.rulesScope())
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "compiling match rules")
+			}
+			rulesScope = content.rulesScope()
+		}
+
+		// Paths escaping the repo root are denied even in repos without rules.
+		cleaned, ok := cleanPath(content.Path)
+		if !ok {
+			escaped++
+			continue
+		}
+		rules, ok := entry.rules[content.Repo]
+		if !ok {
+			// Without rules for the repo, the user can read all of it, unless
+			// the repo supports sub-repo permissions. Then the rules just
+			// haven't been synced yet, and nothing is readable until they are.
+			supported, err := entry.support.repoSupported(ctx, s.permissionsGetter, content.Repo)
+			if err != nil {
+				return nil, nil, errors.Wrap(err, "checking whether repo supports sub-repo permissions")
+			}
+			if !supported {
+				perms[i] = Read
+				continue
+			}
+			if notSynced == nil {
+				notSynced = map[api.RepoName]struct{}{}
+			}
+			notSynced[content.Repo] = struct{}{}
+			unsynced++
+			continue
+		}
+		allowed, reason := rules.match(cleaned, content.Branch)
+		switch {
+		case allowed:
+			perms[i] = Read
+			if cached && s.invariantCheckRate > 0 && rand.Float64() < s.invariantCheckRate {
+				s.startInvariantCheck(userID, content.rulesScope(), content)
+			}
+		case reason == deniedReasonExclude:
+			excluded++
+		default:
+			unmatched++
+		}
+	}
+
+	// Denials are counted once per batch rather than once per path.
+	if excluded > 0 {
+		subRepoPermsDenied.WithLabelValues(deniedReasonExclude).Add(excluded)
+	}
+	if unmatched > 0 {
+		subRepoPermsDenied.WithLabelValues(deniedReasonNoMatch).Add(unmatched)
 	}
+	if escaped > 0 {
+		subRepoPermsDenied.WithLabelValues(deniedReasonEscape).Add(escaped)
+	}
+	if unsynced > 0 {
+		subRepoPermsDenied.WithLabelValues(deniedReasonNotSynced).Add(unsynced)
+	}
+	return perms, notSynced, nil
+}
 
-	repoRules, err := s.getCompiledRules(ctx, userID)
+// permissionsForUsersConcurrency bounds how many users' rules PermissionsForUsers
+// fetches at once.
+const permissionsForUsersConcurrency = 16
+
+// PermissionsForUsers returns the permissions each of the users has on a single
+// content, keyed by user ID. It is the transpose of checking many paths for one
+// user, and answers "who can see this file" for access reviews. Each user's rules
+// are fetched as in Permissions, a bounded number at a time.
+func (s *SubRepoPermsClient) PermissionsForUsers(ctx context.Context, userIDs []int32, content RepoContent) (map[int32]Perms, error) {
+	perms := make([]Perms, len(userIDs))
+	sem := semaphore.NewWeighted(permissionsForUsersConcurrency)
+	g, groupCtx := errgroup.WithContext(ctx)
+	for i, userID := range userIDs {
+		// avoid capturing loop variables below
+		i, userID := i, userID
+
+		if err := sem.Acquire(groupCtx, 1); err != nil {
+			break
+		}
+		g.Go(func() (err error) {
+			defer sem.Release(1)
+
+			perms[i], err = s.Permissions(groupCtx, userID, content)
+			return errors.Wrapf(err, "checking permissions for user %d", userID)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	// Acquire also stops early when ctx is done, without the group failing.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[int32]Perms, len(userIDs))
+	for i, userID := range userIDs {
+		byUser[userID] = perms[i]
+	}
+	return byUser, nil
+}
+
+// subRepoPermsInvariantViolations counts cached grants that the underlying rules
+// deny.
+var subRepoPermsInvariantViolations = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "authz_sub_repo_perms_invariant_violations_total",
+	Help: "The number of sampled sub-repo perms grants from cached rules that the current rules deny",
+})
+
+// startInvariantCheck runs checkInvariant in the background, so that the check
+// never delays or fails the permission check that sampled it. The check doesn't
+// inherit the caller's context, as it outlives the request.
+func (s *SubRepoPermsClient) startInvariantCheck(userID int32, scope RulesScope, content RepoContent) {
+	if !s.invariantChecks.TryAcquire(1) {
+		return
+	}
+	go func() {
+		defer s.invariantChecks.Release(1)
+		ctx, cancel := context.WithTimeout(context.Background(), invariantCheckTimeout)
+		defer cancel()
+		s.checkInvariant(ctx, userID, scope, content)
+	}()
+}
+
+// checkInvariant reports a violation if the rules from the getter deny content,
+// which cached rules granted Read to. The cache is left untouched.
+func (s *SubRepoPermsClient) checkInvariant(ctx context.Context, userID int32, scope RulesScope, content RepoContent) {
+	var repoPerms map[api.RepoName]SubRepoPermissions
+	var err error
+	if scopedGetter, ok := s.permissionsGetter.(ScopedSubRepoPermissionsGetter); ok && !scope.IsZero() {
+		repoPerms, err = scopedGetter.GetByUserAt(ctx, userID, scope)
+	} else {
+		repoPerms, err = s.permissionsGetter.GetByUser(ctx, userID)
+	}
+	if err != nil {
+		return
+	}
+	rules, ok := repoPerms[content.Repo]
+	if !ok {
+		return
+	}
+	compiled, err := compileRules(map[api.RepoName]SubRepoPermissions{content.Repo: rules})
 	if err != nil {
-		return None, errors.Wrap(err, "compiling match rules")
+		return
+	}
+	if allowed, _ := compiled[content.Repo].match(content.Path, content.Branch); allowed {
+		return
 	}
 
-	rules, ok := repoRules[content.Repo]
+	subRepoPermsInvariantViolations.Inc()
+	if s.onInvariantViolation != nil {
+		s.onInvariantViolation(errors.Newf("cached rules granted user %d Read on %s %s, which the current rules deny", userID, content.Repo, RedactPath(content.Path)))
+	}
+}
+
+// match reports whether the rules allow access to path. If they don't, the
+// reason for the denial is returned.
+func (r compiledRules) match(path, branch string) (allowed bool, deniedReason string) {
+	path, ok := cleanPath(path)
 	if !ok {
-		// If we make it this far it implies that we have access at the repo level.
-		// Having any empty set of rules here implies that we can access the whole repo.
-		// Repos that support sub-repo permissions will only have an entry in our
-		// repo_permissions table if after all sub-repo permissions have been processed.
-		return Read, nil
+		return false, deniedReasonEscape
+	}
+	if branch != "" && len(r.branches) > 0 {
+		return r.matchOnBranch(path, branch)
+	}
+	if r.allowsAll {
+		return true, ""
+	}
+	if r.denyAllReason != "" {
+		return false, r.denyAllReason
 	}
 
 	// The current path needs to either be included or NOT excluded and we'll give
 	// preference to exclusion.
-	for _, rule := range rules.excludes {
-		if rule.Match(content.Path) {
-			return None, nil
+	for _, rule := range r.excludes {
+		if rule.Match(path) {
+			return false, deniedReasonExclude
 		}
 	}
-	for _, rule := range rules.includes {
-		if rule.Match(content.Path) {
-			return Read, nil
+	for _, rule := range r.includes {
+		if rule.Match(path) {
+			return true, ""
 		}
 	}
 
-	// Return None if no rule matches to be safe
-	return None, nil
+	// Deny if no rule matches to be safe
+	return false, deniedReasonNoMatch
 }
 
-// getCompiledRules fetches rules for the given repo with caching.
-func (s *SubRepoPermsClient) getCompiledRules(ctx context.Context, userID int32) (map[api.RepoName]compiledRules, error) {
-	// Fast path for cached rules
-	item, _ := s.cache.Get(userID)
-	cached, ok := item.(cachedRules)
+// cleanPath normalizes `.`, `..` and repeated slashes in p, so that they can't
+// be used to sidestep rules. Whether p has a leading or trailing slash is kept,
+// since rules may be written either way and directories have a trailing slash.
+// It returns false if p escapes the repo root. Paths that are already clean are
+// returned as is, without allocating.
+func cleanPath(p string) (string, bool) {
+	rel := strings.TrimLeft(p, "/")
+	trimmed := strings.TrimRight(rel, "/")
+	if trimmed == "" {
+		return p, true
+	}
+	cleaned := path.Clean(trimmed)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	rooted, dir := len(rel) < len(p), len(trimmed) < len(rel)
+	if cleaned == trimmed && (!rooted || len(p)-len(rel) == 1) && (!dir || len(rel)-len(trimmed) == 1) {
+		return p, true
+	}
+
+	if cleaned == "." {
+		cleaned = ""
+	}
+	if rooted {
+		cleaned = "/" + cleaned
+	}
+	if dir && cleaned != "" && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+// matchOnBranch is like match, but also applies the rules of the branch rules
+// that match branch. Their excludes are checked first, and their includes only
+// grant paths that the repo-wide rules deny for lack of a match.
+func (r compiledRules) matchOnBranch(path, branch string) (allowed bool, deniedReason string) {
+	var matching []compiledBranchRule
+	for _, b := range r.branches {
+		if b.branch.Match(branch) {
+			matching = append(matching, b)
+		}
+	}
+	for _, b := range matching {
+		for _, rule := range b.excludes {
+			if rule.Match(path) {
+				return false, deniedReasonExclude
+			}
+		}
+	}
 
-	ttl := defaultCacheTTL
-	if c := conf.Get(); c.ExperimentalFeatures != nil && c.ExperimentalFeatures.SubRepoPermissions != nil && c.ExperimentalFeatures.SubRepoPermissions.UserCacheTTLSeconds > 0 {
-		ttl = time.Duration(c.ExperimentalFeatures.SubRepoPermissions.UserCacheTTLSeconds) * time.Second
+	allowed, deniedReason = r.match(path, "")
+	if allowed || deniedReason == deniedReasonExclude {
+		return allowed, deniedReason
 	}
+	for _, b := range matching {
+		for _, rule := range b.includes {
+			if rule.Match(path) {
+				return true, ""
+			}
+		}
+	}
+	return false, deniedReason
+}
+
+// getCompiledRules fetches rules for the given user and scope with caching, and
+// reports whether they came from the cache. Scopes are ignored unless the getter
+// supports them.
+func (s *SubRepoPermsClient) getCompiledRules(ctx context.Context, userID int32, scope RulesScope) (map[api.RepoName]compiledRules, bool, error) {
+	entry, cached, err := s.getRules(ctx, userID, scope)
+	return entry.rules, cached, err
+}
+
+// getRules is getCompiledRules, but returns the whole cache entry. Entries that
+// weren't cached, because compiling ran out of budget, have a support of their own.
+func (s *SubRepoPermsClient) getRules(ctx context.Context, userID int32, scope RulesScope) (cachedRules, bool, error) {
+	scopedGetter, ok := s.permissionsGetter.(ScopedSubRepoPermissionsGetter)
+	if !ok {
+		scope = RulesScope{}
+	}
+
+	var cacheKey any = userID
+	groupKey := strconv.FormatInt(int64(userID), 10)
+	if !scope.IsZero() {
+		cacheKey = scopedCacheKey{userID: userID, scope: scope}
+		groupKey += "@" + scope.String()
+	}
+
+	// Fast path for cached rules
+	item, _ := s.cache.Get(cacheKey)
+	entry, ok := item.(cachedRules)
+
+	minTTL, maxTTL := cacheTTLBounds()
+	ttl := clampTTL(entry.ttl, minTTL, maxTTL)
 
-	if ok && s.since(cached.timestamp) <= ttl {
+	if ok && s.since(entry.timestamp) <= ttl {
 		subRepoPermsCacheHit.WithLabelValues("true").Inc()
-		return cached.rules, nil
+		return entry, true, nil
 	}
 	subRepoPermsCacheHit.WithLabelValues("false").Inc()
 
 	// Slow path on cache miss or expiry. Ensure that only one goroutine is doing the
 	// work
-	groupKey := strconv.FormatInt(int64(userID), 10)
 	result, err, _ := s.group.Do(groupKey, func() (any, error) {
-		repoPerms, err := s.permissionsGetter.GetByUser(ctx, userID)
+		// A fetch that finished between the cache check above and joining the group
+		// has already cached fresh rules.
+		item, _ := s.cache.Get(cacheKey)
+		if fresh, ok := item.(cachedRules); ok && s.since(fresh.timestamp) <= clampTTL(fresh.ttl, minTTL, maxTTL) {
+			return fresh, nil
+		}
+		var repoPerms map[api.RepoName]SubRepoPermissions
+		var err error
+		if scope.IsZero() {
+			repoPerms, err = s.permissionsGetter.GetByUser(ctx, userID)
+		} else {
+			repoPerms, err = scopedGetter.GetByUserAt(ctx, userID, scope)
+		}
 		if err != nil {
 			return nil, errors.Wrap(err, "fetching rules")
 		}
-		toCache := cachedRules{
-			rules:     make(map[api.RepoName]compiledRules, len(repoPerms)),
-			timestamp: time.Time{},
+		fingerprint := fingerprintRules(repoPerms)
+		if ok && entry.fingerprint == fingerprint && s.pool.retain(entry.pooled) {
+			// The rules didn't change, so the compiled rules are kept rather than
+			// compiled again.
+			refreshed := cachedRules{
+				rules:       entry.rules,
+				timestamp:   s.clock(),
+				ttl:         clampTTL(2*ttl, minTTL, maxTTL),
+				fingerprint: fingerprint,
+				pooled:      entry.pooled,
+				support:     newRepoSupport(),
+			}
+			s.addToCache(cacheKey, refreshed)
+			return refreshed, nil
+		}
+		rules, pooled, err := s.compileWithinBudget(userID, repoPerms)
+		if err != nil {
+			return nil, err
+		}
+		if rules == nil {
+			return cachedRules{rules: compileFallback(repoPerms, entry, ok), support: newRepoSupport()}, nil
+		}
+		nextTTL := minTTL
+		if ok && entry.fingerprint == fingerprint {
+			nextTTL = clampTTL(2*ttl, minTTL, maxTTL)
+		}
+		fetched := cachedRules{
+			rules:       rules,
+			timestamp:   s.clock(),
+			ttl:         nextTTL,
+			fingerprint: fingerprint,
+			pooled:      pooled,
+			support:     newRepoSupport(),
+		}
+		s.addToCache(cacheKey, fetched)
+		return fetched, nil
+	})
+	if err != nil {
+		return cachedRules{}, false, err
+	}
+	return result.(cachedRules), false, nil
+}
+
+// subRepoPermsCompileDuration tracks the time spent compiling rules per request.
+var subRepoPermsCompileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "authz_sub_repo_perms_compile_duration_seconds",
+	Help:    "Time spent compiling a user's sub-repo perms rules on a cache miss",
+	Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+})
+
+// subRepoPermsCompileBudgetExceeded counts compilations that were cut short by
+// the compile budget.
+var subRepoPermsCompileBudgetExceeded = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "authz_sub_repo_perms_compile_budget_exceeded_total",
+	Help: "The number of times compiling a user's sub-repo perms rules exceeded the compile budget",
+})
+
+// compileWithinBudget compiles rules through the pool, giving up once the
+// configured compile budget is spent. In that case the returned rules are nil.
+func (s *SubRepoPermsClient) compileWithinBudget(userID int32, repoPerms map[api.RepoName]SubRepoPermissions) (map[api.RepoName]compiledRules, []ruleSetKey, error) {
+	var overBudget func() bool
+	began := s.clock()
+	if budget := compileBudget(); budget > 0 {
+		overBudget = func() bool { return s.since(began) > budget }
+	}
+	rules, pooled, err := s.pool.compile(repoPerms, overBudget)
+	subRepoPermsCompileDuration.Observe(s.since(began).Seconds())
+	if errors.Is(err, errCompileBudgetExceeded) {
+		subRepoPermsCompileBudgetExceeded.Inc()
+		log15.Warn("compiling sub-repo permissions rules exceeded the compile budget", "userID", userID, "repos", len(repoPerms))
+		return nil, nil, nil
+	}
+	return rules, pooled, err
+}
+
+// compileFallback returns the rules to use when compiling ran out of budget: the
+// previously cached rules if there are any, otherwise rules that deny access to
+// every repo with rules. Neither is cached, so the next request tries again.
+func compileFallback(repoPerms map[api.RepoName]SubRepoPermissions, entry cachedRules, cached bool) map[api.RepoName]compiledRules {
+	if cached {
+		return entry.rules
+	}
+	denyAll := make(map[api.RepoName]compiledRules, len(repoPerms))
+	for repo := range repoPerms {
+		denyAll[repo] = compiledRules{denyAllReason: deniedReasonNoMatch}
+	}
+	return denyAll
+}
+
+// compileBudget returns the configured soft cap on compile time per request, or
+// 0 if there is none.
+func compileBudget() time.Duration {
+	if c := conf.Get(); c.ExperimentalFeatures != nil && c.ExperimentalFeatures.SubRepoPermissions != nil {
+		return time.Duration(c.ExperimentalFeatures.SubRepoPermissions.CompileBudgetMilliseconds) * time.Millisecond
+	}
+	return 0
+}
+
+// addToCache caches the entry. Replacing an entry doesn't call the eviction
+// callback, so the old entry is removed first to release its pooled rules.
+func (s *SubRepoPermsClient) addToCache(key any, entry cachedRules) {
+	s.cache.Remove(key)
+	s.cache.Add(key, entry)
+}
+
+// cacheTTLBounds returns the TTL that cached rules start with, and the TTL they
+// can grow to while they don't change. Without a configured maximum, the TTL is
+// fixed.
+func cacheTTLBounds() (minTTL, maxTTL time.Duration) {
+	minTTL = defaultCacheTTL
+	if c := conf.Get(); c.ExperimentalFeatures != nil && c.ExperimentalFeatures.SubRepoPermissions != nil {
+		perms := c.ExperimentalFeatures.SubRepoPermissions
+		if perms.UserCacheTTLSeconds > 0 {
+			minTTL = time.Duration(perms.UserCacheTTLSeconds) * time.Second
+		}
+		if limit := time.Duration(perms.UserCacheMaxTTLSeconds) * time.Second; limit > minTTL {
+			return minTTL, limit
+		}
+	}
+	return minTTL, minTTL
+}
+
+// clampTTL bounds ttl, which also handles entries cached before the bounds
+// changed and entries without a TTL.
+func clampTTL(ttl, minTTL, maxTTL time.Duration) time.Duration {
+	if ttl < minTTL {
+		return minTTL
+	}
+	if ttl > maxTTL {
+		return maxTTL
+	}
+	return ttl
+}
+
+// fingerprintRules hashes rules so that refreshes can tell whether they changed.
+// Maps are marshalled with sorted keys, so equal rules hash the same.
+func fingerprintRules(repoPerms map[api.RepoName]SubRepoPermissions) [sha256.Size]byte {
+	b, _ := json.Marshal(repoPerms)
+	return sha256.Sum256(b)
+}
+
+// WarmCacheStats reports the work done by WarmCache.
+type WarmCacheStats struct {
+	// Users is the number of users whose rules were fetched.
+	Users int
+	// Repos is the number of repos with rules across all users.
+	Repos int
+	// Rules is the number of include and exclude patterns compiled.
+	Rules int
+	// EstimatedBytes is a rough estimate of the memory taken by the compiled rules.
+	EstimatedBytes int
+}
+
+// estimatedGlobOverheadBytes approximates the memory taken by a compiled glob in
+// addition to its pattern.
+const estimatedGlobOverheadBytes = 64
+
+// WarmCache fetches and compiles the current rules for the given users so that
+// their first permissions checks don't have to. With dryRun, the rules are still
+// fetched and compiled but not cached, which tells operators how much a real run
+// would add to the cache.
+func (s *SubRepoPermsClient) WarmCache(ctx context.Context, userIDs []int32, dryRun bool) (WarmCacheStats, error) {
+	var stats WarmCacheStats
+	if s.permissionsGetter == nil {
+		return stats, errors.New("PermissionsGetter is nil")
+	}
+
+	for _, userID := range userIDs {
+		repoPerms, err := s.permissionsGetter.GetByUser(ctx, userID)
+		if err != nil {
+			return stats, errors.Wrapf(err, "fetching rules for user %d", userID)
+		}
+		// A dry run doesn't cache the rules, so it mustn't hold on to pooled ones.
+		var rules map[api.RepoName]compiledRules
+		var pooled []ruleSetKey
+		if dryRun {
+			rules, err = compileRules(repoPerms)
+		} else {
+			rules, pooled, err = s.pool.compile(repoPerms, nil)
+		}
+		if err != nil {
+			return stats, errors.Wrapf(err, "compiling rules for user %d", userID)
 		}
-		for repo, perms := range repoPerms {
-			includes := make([]glob.Glob, 0, len(perms.PathIncludes))
-			for _, rule := range perms.PathIncludes {
-				g, err := glob.Compile(rule, '/')
-				if err != nil {
-					return nil, errors.Wrap(err, "building include matcher")
+
+		stats.Users++
+		stats.Repos += len(repoPerms)
+		for _, perms := range repoPerms {
+			for _, patterns := range rulePatterns(perms) {
+				for _, pattern := range patterns {
+					stats.Rules++
+					stats.EstimatedBytes += len(pattern) + estimatedGlobOverheadBytes
 				}
-				includes = append(includes, g)
 			}
-			excludes := make([]glob.Glob, 0, len(perms.PathExcludes))
-			for _, rule := range perms.PathExcludes {
-				g, err := glob.Compile(rule, '/')
-				if err != nil {
-					return nil, errors.Wrap(err, "building exclude matcher")
-				}
-				excludes = append(excludes, g)
+		}
+
+		if dryRun {
+			continue
+		}
+		s.addToCache(userID, cachedRules{
+			rules:       rules,
+			timestamp:   s.clock(),
+			fingerprint: fingerprintRules(repoPerms),
+			pooled:      pooled,
+			support:     newRepoSupport(),
+		})
+	}
+	return stats, nil
+}
+
+// EvaluateRules returns the permissions that rules would grant for each of the
+// contents, without the rules having to be stored. It lets admins preview a rule
+// change before saving it. The repo of each content is ignored since rules apply
+// to a single repo.
+//
+// Matching is the same as in Permissions, so the results agree with what users
+// would get once the rules are saved.
+func EvaluateRules(rules SubRepoPermissions, contents []RepoContent) ([]Perms, error) {
+	compiled, err := compileRules(map[api.RepoName]SubRepoPermissions{"": rules})
+	if err != nil {
+		return nil, errors.Wrap(err, "compiling match rules")
+	}
+
+	perms := make([]Perms, len(contents))
+	for i, content := range contents {
+		// As in Permissions, an empty path is covered by repo permissions.
+		if content.Path == "" {
+			perms[i] = Read
+			continue
+		}
+		if allowed, _ := compiled[""].match(content.Path, content.Branch); allowed {
+			perms[i] = Read
+		} else {
+			perms[i] = None
+		}
+	}
+	return perms, nil
+}
+
+// RuleSuggestion is the smallest change to rules that makes a path readable, as
+// returned by SuggestRuleChange.
+type RuleSuggestion struct {
+	// Readable is true if the rules already grant Read, so no change is needed.
+	Readable bool
+	// BlockingExcludes are the exclude rules that match the path, all of which
+	// have to be removed or narrowed.
+	BlockingExcludes []string
+	// AddInclude is an include rule that matches only the path, to add when no
+	// include matches it yet.
+	AddInclude string
+}
+
+// ruleList is a list of rules of one kind, with how to compile them.
+type ruleList struct {
+	rules   []string
+	compile func(string) (glob.Glob, error)
+}
+
+// matching returns the rules that match path.
+func (l ruleList) matching(path string) ([]string, error) {
+	var matching []string
+	for _, rule := range l.rules {
+		g, err := l.compile(rule)
+		if err != nil {
+			return nil, err
+		}
+		if g.Match(path) {
+			matching = append(matching, rule)
+		}
+	}
+	return matching, nil
+}
+
+// SuggestRuleChange works out how rules would have to change for the path of
+// content to be readable. Excludes take precedence in Permissions, so any that
+// match are reported as blocking. If no include matches, the suggested include is
+// the path itself rather than a broader pattern, granting the least extra access.
+// The rules are not modified.
+func SuggestRuleChange(rules SubRepoPermissions, content RepoContent) (RuleSuggestion, error) {
+	if content.Path == "" {
+		// As in Permissions, an empty path is covered by repo permissions.
+		return RuleSuggestion{Readable: true}, nil
+	}
+
+	compileGlobRule := func(rule string) (glob.Glob, error) { return compileGlob(rule, rules.GlobMode) }
+	var suggestion RuleSuggestion
+	for _, excludes := range []ruleList{
+		{rules.PathExcludes, compileGlobRule},
+		{rules.PathExcludeRegexps, compileRegexp},
+	} {
+		matching, err := excludes.matching(content.Path)
+		if err != nil {
+			return RuleSuggestion{}, errors.Wrap(err, "building exclude matcher")
+		}
+		suggestion.BlockingExcludes = append(suggestion.BlockingExcludes, matching...)
+	}
+
+	included := false
+	for _, includes := range []ruleList{
+		{rules.PathIncludes, compileGlobRule},
+		{rules.PathIncludeRegexps, compileRegexp},
+	} {
+		matching, err := includes.matching(content.Path)
+		if err != nil {
+			return RuleSuggestion{}, errors.Wrap(err, "building include matcher")
+		}
+		included = included || len(matching) > 0
+	}
+	if !included {
+		suggestion.AddInclude = glob.QuoteMeta(content.Path)
+	}
+
+	suggestion.Readable = included && len(suggestion.BlockingExcludes) == 0
+	return suggestion, nil
+}
+
+// AccessReport is the result of AssertEffectiveAccess. Paths are listed in the
+// order they were given.
+type AccessReport struct {
+	// OverGrants are readable paths that were not expected to be.
+	OverGrants []string
+	// UnderGrants are expected paths that can't be read.
+	UnderGrants []string
+}
+
+// OK returns true if effective access matched the expectation.
+func (r AccessReport) OK() bool {
+	return len(r.OverGrants) == 0 && len(r.UnderGrants) == 0
+}
+
+// AssertEffectiveAccess checks that of the candidate paths in repo, the user can
+// read exactly the expected ones, for compliance attestation. Expected paths are
+// checked even if they are not candidates. Access is evaluated as in Permissions.
+func (s *SubRepoPermsClient) AssertEffectiveAccess(ctx context.Context, userID int32, repo api.RepoName, expectedReadable []string, candidatePool []string) (AccessReport, error) {
+	report := AccessReport{}
+	expected := make(map[string]struct{}, len(expectedReadable))
+	for _, p := range expectedReadable {
+		expected[p] = struct{}{}
+	}
+
+	// Paths in repos whose rules aren't synced yet count as denied.
+	for _, p := range expectedReadable {
+		perms, err := s.Permissions(ctx, userID, RepoContent{Repo: repo, Path: p})
+		if err != nil && !errors.Is(err, ErrSubRepoPermsNotSynced) {
+			return AccessReport{}, errors.Wrapf(err, "checking %s", RedactPath(p))
+		}
+		if !perms.Include(Read) {
+			report.UnderGrants = append(report.UnderGrants, p)
+		}
+	}
+	for _, p := range candidatePool {
+		if _, ok := expected[p]; ok {
+			continue
+		}
+		perms, err := s.Permissions(ctx, userID, RepoContent{Repo: repo, Path: p})
+		if err != nil && !errors.Is(err, ErrSubRepoPermsNotSynced) {
+			return AccessReport{}, errors.Wrapf(err, "checking %s", RedactPath(p))
+		}
+		if perms.Include(Read) {
+			report.OverGrants = append(report.OverGrants, p)
+		}
+	}
+	return report, nil
+}
+
+// compileRules compiles the glob patterns of the given rules.
+func compileRules(repoPerms map[api.RepoName]SubRepoPermissions) (map[api.RepoName]compiledRules, error) {
+	compiled := make(map[api.RepoName]compiledRules, len(repoPerms))
+	for repo, perms := range repoPerms {
+		includes := make([]glob.Glob, 0, len(perms.PathIncludes)+len(perms.PathIncludeRegexps))
+		for _, rule := range perms.PathIncludes {
+			g, err := compileGlob(rule, perms.GlobMode)
+			if err != nil {
+				return nil, errors.Wrap(err, "building include matcher")
+			}
+			includes = append(includes, g)
+		}
+		excludes := make([]glob.Glob, 0, len(perms.PathExcludes)+len(perms.PathExcludeRegexps))
+		for _, rule := range perms.PathExcludes {
+			g, err := compileGlob(rule, perms.GlobMode)
+			if err != nil {
+				return nil, errors.Wrap(err, "building exclude matcher")
+			}
+			excludes = append(excludes, g)
+		}
+		for _, rule := range perms.PathIncludeRegexps {
+			g, err := compileRegexp(rule)
+			if err != nil {
+				return nil, errors.Wrap(err, "building include matcher")
 			}
-			toCache.rules[repo] = compiledRules{
+			includes = append(includes, g)
+		}
+		for _, rule := range perms.PathExcludeRegexps {
+			g, err := compileRegexp(rule)
+			if err != nil {
+				return nil, errors.Wrap(err, "building exclude matcher")
+			}
+			excludes = append(excludes, g)
+		}
+		branches, err := compileBranchRules(perms.BranchRules, perms.GlobMode)
+		if err != nil {
+			return nil, err
+		}
+		lines, err := compileLineRules(perms.LineRules, perms.GlobMode)
+		if err != nil {
+			return nil, err
+		}
+		// The rules are compiled regardless, so that invalid rules are reported.
+		switch reason := deniesAll(perms); {
+		case allowsAll(perms):
+			compiled[repo] = compiledRules{allowsAll: true, branches: branches, lines: lines}
+		case reason != "":
+			compiled[repo] = compiledRules{denyAllReason: reason, branches: branches, lines: lines}
+		default:
+			compiled[repo] = compiledRules{
 				includes: includes,
 				excludes: excludes,
+				branches: branches,
+				lines:    lines,
 			}
 		}
-		toCache.timestamp = s.clock()
-		s.cache.Add(userID, toCache)
-		return toCache.rules, nil
-	})
+	}
+	return compiled, nil
+}
+
+func compileBranchRules(rules []BranchRule, mode GlobMode) ([]compiledBranchRule, error) {
+	var compiled []compiledBranchRule
+	for _, rule := range rules {
+		branch, err := compileGlob(rule.Branch, mode)
+		if err != nil {
+			return nil, errors.Wrap(err, "building branch matcher")
+		}
+		b := compiledBranchRule{branch: branch}
+		for _, pattern := range rule.PathIncludes {
+			g, err := compileGlob(pattern, mode)
+			if err != nil {
+				return nil, errors.Wrap(err, "building branch include matcher")
+			}
+			b.includes = append(b.includes, g)
+		}
+		for _, pattern := range rule.PathExcludes {
+			g, err := compileGlob(pattern, mode)
+			if err != nil {
+				return nil, errors.Wrap(err, "building branch exclude matcher")
+			}
+			b.excludes = append(b.excludes, g)
+		}
+		compiled = append(compiled, b)
+	}
+	return compiled, nil
+}
+
+func compileLineRules(rules []LineRule, mode GlobMode) ([]compiledLineRule, error) {
+	var compiled []compiledLineRule
+	for _, rule := range rules {
+		g, err := compileGlob(rule.Path, mode)
+		if err != nil {
+			return nil, errors.Wrap(err, "building line rule matcher")
+		}
+		compiled = append(compiled, compiledLineRule{
+			path:   g,
+			ranges: append([]LineRange(nil), rule.Ranges...),
+		})
+	}
+	return compiled, nil
+}
+
+// allowsAll returns true if the rules grant every path: nothing is excluded and
+// an include matches anything.
+func allowsAll(perms SubRepoPermissions) bool {
+	if len(perms.PathExcludes) > 0 || len(perms.PathExcludeRegexps) > 0 {
+		return false
+	}
+	for _, rule := range perms.PathIncludes {
+		if matchesAll(rule, perms.GlobMode) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniesAll returns the reason the rules deny every path, or "" if they may
+// grant some: nothing is included, or an exclude matches anything.
+func deniesAll(perms SubRepoPermissions) string {
+	for _, rule := range perms.PathExcludes {
+		if matchesAll(rule, perms.GlobMode) {
+			return deniedReasonExclude
+		}
+	}
+	if len(perms.PathIncludes) == 0 && len(perms.PathIncludeRegexps) == 0 {
+		return deniedReasonNoMatch
+	}
+	return ""
+}
+
+// matchesAll returns true if the rule matches every path.
+func matchesAll(rule string, mode GlobMode) bool {
+	return rule == "**" || (rule == "*" && mode == GlobCrossDirectory)
+}
+
+// regexpMatcher adapts a regexp to the glob.Glob interface, so that regexp and
+// glob rules are matched alike.
+type regexpMatcher struct {
+	*regexp.Regexp
+}
+
+func (m regexpMatcher) Match(s string) bool {
+	return m.MatchString(s)
+}
+
+// compileRegexp compiles a single regexp rule, anchored to match the whole path
+// like a glob.
+func compileRegexp(rule string) (glob.Glob, error) {
+	re, err := regexp.Compile(`^(?:` + rule + `)$`)
 	if err != nil {
 		return nil, err
 	}
+	return regexpMatcher{re}, nil
+}
 
-	compiled := result.(map[api.RepoName]compiledRules)
-	return compiled, nil
+// compileGlob compiles a single rule, with or without `/` as the separator
+// depending on the mode.
+func compileGlob(rule string, mode GlobMode) (glob.Glob, error) {
+	if mode == GlobCrossDirectory {
+		return glob.Compile(rule)
+	}
+	return glob.Compile(rule, '/')
 }
 
 func (s *SubRepoPermsClient) Enabled() bool {
@@ -303,29 +1535,198 @@ func (s *SubRepoPermsClient) EnabledForRepo(ctx context.Context, repo api.RepoNa
 	return s.permissionsGetter.RepoSupported(ctx, repo)
 }
 
+// EnabledForUser returns true only when sub-repo permissions are enabled, the
+// repo supports them, and the user's rules for the repo restrict some paths or
+// lines. A user without rules for the repo, or with rules that allow everything,
+// can read the whole repo.
+func (s *SubRepoPermsClient) EnabledForUser(ctx context.Context, userID int32, repo api.RepoName) (bool, error) {
+	if !s.Enabled() {
+		return false, nil
+	}
+	if s.permissionsGetter == nil {
+		return false, errors.New("PermissionsGetter is nil")
+	}
+
+	supported, err := s.permissionsGetter.RepoSupported(ctx, repo)
+	if err != nil || !supported {
+		return false, err
+	}
+
+	if userID == 0 {
+		return false, &ErrUnauthenticated{}
+	}
+	repoRules, _, err := s.getCompiledRules(ctx, userID, RulesScope{})
+	if err != nil {
+		return false, errors.Wrap(err, "compiling match rules")
+	}
+	rules, ok := repoRules[repo]
+	return ok && (!rules.allowsAll || len(rules.lines) > 0), nil
+}
+
 // ActorPermissions returns the level of access the given actor has for the requested
 // content.
 //
 // If the context is unauthenticated, ErrUnauthenticated is returned. If the context is
-// internal, Read permissions is granted.
+// internal, Read permissions is granted. Use ActorPermissionsOutcome to find out why None
+// was returned.
 func ActorPermissions(ctx context.Context, s SubRepoPermissionChecker, a *actor.Actor, content RepoContent) (Perms, error) {
+	perms, _, err := ActorPermissionsOutcome(ctx, s, a, content)
+	return perms, err
+}
+
+// PermsOutcome describes why ActorPermissionsOutcome returned the permissions it did.
+// It lets callers tell apart outcomes that all result in None, for example to decide
+// between responding with a 401, 403 or 404.
+type PermsOutcome int
+
+const (
+	// OutcomeError means the permissions could not be determined. The accompanying
+	// error is non-nil.
+	OutcomeError PermsOutcome = iota
+	// OutcomeDisabled means sub-repo permissions are disabled, so access is granted.
+	OutcomeDisabled
+	// OutcomeInternal means the actor is internal, so access is granted.
+	OutcomeInternal
+	// OutcomeUnauthenticated means the actor is not authenticated. The accompanying
+	// error is ErrUnauthenticated.
+	OutcomeUnauthenticated
+	// OutcomeAllowed means the rules for the actor grant access.
+	OutcomeAllowed
+	// OutcomeDenied means the rules for the actor explicitly deny access.
+	OutcomeDenied
+	// OutcomeBypassed means the actor is allowed to bypass sub-repo permissions,
+	// so access is granted.
+	OutcomeBypassed
+	// OutcomeNotSynced means the repo supports sub-repo permissions but the
+	// actor's rules for it aren't synced yet, so access is denied.
+	OutcomeNotSynced
+)
+
+func (o PermsOutcome) String() string {
+	switch o {
+	case OutcomeError:
+		return "error"
+	case OutcomeDisabled:
+		return "disabled"
+	case OutcomeInternal:
+		return "internal"
+	case OutcomeUnauthenticated:
+		return "unauthenticated"
+	case OutcomeAllowed:
+		return "allowed"
+	case OutcomeDenied:
+		return "denied"
+	case OutcomeBypassed:
+		return "bypassed"
+	case OutcomeNotSynced:
+		return "not_synced"
+	}
+	return "PermsOutcome(" + strconv.Itoa(int(o)) + ")"
+}
+
+// ActorPermissionsOutcome is like ActorPermissions but also returns the outcome that
+// led to the permissions.
+func ActorPermissionsOutcome(ctx context.Context, s SubRepoPermissionChecker, a *actor.Actor, content RepoContent) (Perms, PermsOutcome, error) {
 	// Check config here, despite checking again in the s.Permissions implementation,
 	// because we also make some permissions decisions here.
 	if !SubRepoEnabled(s) {
-		return Read, nil
+		return Read, OutcomeDisabled, nil
 	}
+	return enabledActorPermissionsOutcome(ctx, s, a, content)
+}
+
+// enabledActorPermissionsOutcome is ActorPermissionsOutcome for a checker that
+// is known to be enabled, so that callers checking many contents only check that
+// once.
+func enabledActorPermissionsOutcome(ctx context.Context, s SubRepoPermissionChecker, a *actor.Actor, content RepoContent) (Perms, PermsOutcome, error) {
 	if a.IsInternal() {
-		return Read, nil
+		return Read, OutcomeInternal, nil
 	}
 	if !a.IsAuthenticated() {
-		return None, &ErrUnauthenticated{}
+		return None, OutcomeUnauthenticated, &ErrUnauthenticated{}
+	}
+	if b, ok := s.(SubRepoPermsBypasser); ok && b.Bypassed(ctx, a, content) {
+		return Read, OutcomeBypassed, nil
 	}
 
 	perms, err := s.Permissions(ctx, a.UID, content)
+	if errors.Is(err, ErrSubRepoPermsNotSynced) {
+		return None, OutcomeNotSynced, nil
+	}
 	if err != nil {
-		return None, errors.Wrapf(err, "getting actor permissions for actor: %d", a.UID)
+		outcome := OutcomeError
+		if errors.HasType(err, &ErrUnauthenticated{}) {
+			outcome = OutcomeUnauthenticated
+		}
+		return None, outcome, errors.Wrapf(err, "getting actor permissions for actor: %d, path: %s", a.UID, RedactPath(content.Path))
 	}
-	return perms, nil
+	if perms == None {
+		return None, OutcomeDenied, nil
+	}
+	return perms, OutcomeAllowed, nil
+}
+
+// SubRepoPermsBypasser is implemented by a SubRepoPermissionChecker that lets
+// some authenticated actors read all content regardless of sub-repo permissions,
+// for service accounts such as CI or indexers. Unlike internal actors, these are
+// regular users whose access is only widened here.
+type SubRepoPermsBypasser interface {
+	// Bypassed reports whether the actor may read content without checking
+	// sub-repo permissions, and records the bypass if so.
+	Bypassed(ctx context.Context, a *actor.Actor, content RepoContent) bool
+}
+
+// Bypassed implements SubRepoPermsBypasser with the predicate and audit trail
+// the client was created with, see WithBypass.
+func (s *SubRepoPermsClient) Bypassed(ctx context.Context, a *actor.Actor, content RepoContent) bool {
+	if s.bypass == nil || !s.bypass(a) {
+		return false
+	}
+	subRepoPermsBypassed.Inc()
+	if s.onBypass != nil {
+		s.onBypass(ctx, a, content)
+	}
+	return true
+}
+
+// bypassedInSiteConfig reports whether the actor is listed in the bypassUserIDs
+// site configuration.
+func bypassedInSiteConfig(a *actor.Actor) bool {
+	c := conf.Get()
+	if c.ExperimentalFeatures == nil || c.ExperimentalFeatures.SubRepoPermissions == nil {
+		return false
+	}
+	for _, uid := range c.ExperimentalFeatures.SubRepoPermissions.BypassUserIDs {
+		if int32(uid) == a.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// BypassUIDs returns a bypass predicate for WithBypass that allows the given user
+// IDs.
+func BypassUIDs(uids ...int32) func(a *actor.Actor) bool {
+	allowed := make(map[int32]struct{}, len(uids))
+	for _, uid := range uids {
+		allowed[uid] = struct{}{}
+	}
+	return func(a *actor.Actor) bool {
+		_, ok := allowed[a.UID]
+		return ok
+	}
+}
+
+// subRepoPermsBypassed counts the checks that were let through by a bypass.
+var subRepoPermsBypassed = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "authz_sub_repo_perms_bypassed_total",
+	Help: "The number of sub-repo perms checks skipped because the actor may bypass them",
+})
+
+// logBypass is the default audit trail of bypassed checks. It logs every read
+// that sub-repo permissions would otherwise have checked.
+func logBypass(ctx context.Context, a *actor.Actor, content RepoContent) {
+	log15.Info("sub-repo permissions bypassed", "userID", a.UID, "repo", content.Repo, "path", RedactPath(content.Path))
 }
 
 // SubRepoEnabled takes a SubRepoPermissionChecker and returns true if the checker is not nil and is enabled
@@ -370,7 +1771,7 @@ func CanReadAllPaths(ctx context.Context, checker SubRepoPermissionChecker, repo
 
 	for _, p := range paths {
 		c.Path = p
-		perms, err := checker.Permissions(ctx, a.UID, c)
+		perms, _, err := enabledActorPermissionsOutcome(ctx, checker, a, c)
 		if err != nil {
 			return false, err
 		}
@@ -383,15 +1784,24 @@ func CanReadAllPaths(ctx context.Context, checker SubRepoPermissionChecker, repo
 }
 
 // FilterActorPaths will filter the given list of paths for the given actor
-// returning on paths they are allowed to read.
+// returning on paths they are allowed to read. All paths are returned when
+// sub-repo permissions are disabled or the actor is internal, which is checked
+// once rather than for each path. The result never shares memory with paths.
 func FilterActorPaths(ctx context.Context, checker SubRepoPermissionChecker, a *actor.Actor, repo api.RepoName, paths []string) ([]string, error) {
+	if !SubRepoEnabled(checker) || a.IsInternal() {
+		return append(make([]string, 0, len(paths)), paths...), nil
+	}
+
 	filtered := make([]string, 0, len(paths))
 	for _, p := range paths {
-		include, err := FilterActorPath(ctx, checker, a, repo, p)
+		perms, _, err := enabledActorPermissionsOutcome(ctx, checker, a, RepoContent{
+			Repo: repo,
+			Path: p,
+		})
 		if err != nil {
 			return nil, errors.Wrap(err, "checking sub-repo permissions")
 		}
-		if include {
+		if perms.Include(Read) {
 			filtered = append(filtered, p)
 		}
 	}
@@ -0,0 +1,456 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/glob"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+// This file contains a benchmark harness for comparing sub-repo permissions
+// matcher engines. The "glob" engine is what SubRepoPermsClient uses today; the
+// others are prototypes that candidate engine changes can be measured against.
+// TestMatcherEnginesAgree checks that every engine agrees with "glob" on all of
+// the fixtures, so a faster engine can't silently change who sees what.
+
+// ruleEngine compiles a rule set into a function reporting whether a path is
+// allowed.
+type ruleEngine struct {
+	name    string
+	compile func(rules SubRepoPermissions) (func(path string) bool, error)
+}
+
+var ruleEngines = []ruleEngine{
+	{name: "glob", compile: compileGlobEngine},
+	{name: "regexp-union", compile: compileRegexpUnionEngine},
+	{name: "extension-fast-path", compile: fastPathEngine(extensionFastPath)},
+	{name: "literal-prefix", compile: fastPathEngine(literalPrefixFastPath)},
+}
+
+// ruleSetFixture is a rule set together with a corpus of paths to check
+// against it.
+type ruleSetFixture struct {
+	name  string
+	rules SubRepoPermissions
+	paths []string
+}
+
+// ruleSetFixtures returns rule sets shaped like the ones we see in practice.
+// They are generated from a fixed seed so results are comparable across runs.
+func ruleSetFixtures() []ruleSetFixture {
+	rng := rand.New(rand.NewSource(1))
+
+	var fixtures []ruleSetFixture
+
+	fixtures = append(fixtures, ruleSetFixture{
+		name: "few",
+		rules: SubRepoPermissions{
+			PathIncludes: []string{"/**"},
+			PathExcludes: []string{"/secret/**", "/internal/keys/*"},
+		},
+		paths: randomPaths(rng, 1000, []string{"src", "secret", "internal", "keys", "docs"}, 6, []string{".go", ".md", ".pem"}),
+	})
+
+	var many SubRepoPermissions
+	var teams []string
+	for i := 0; i < 200; i++ {
+		team := fmt.Sprintf("team%03d", i)
+		teams = append(teams, team)
+		many.PathIncludes = append(many.PathIncludes, "/"+team+"/**")
+		if i%4 == 0 {
+			many.PathExcludes = append(many.PathExcludes, "/"+team+"/private/**")
+		}
+	}
+	// Also include teams that have no rules, so that some paths are denied.
+	for i := 200; i < 250; i++ {
+		teams = append(teams, fmt.Sprintf("team%03d", i))
+	}
+	fixtures = append(fixtures, ruleSetFixture{
+		name:  "many",
+		rules: many,
+		paths: randomPathsUnder(rng, 1000, teams, []string{"private", "src", "lib", "cmd"}, 5, []string{".go", ".ts"}),
+	})
+
+	fixtures = append(fixtures, ruleSetFixture{
+		name: "extension-heavy",
+		rules: SubRepoPermissions{
+			PathIncludes: []string{"**.go", "**.ts", "**.tsx", "**.md", "**.json", "**.{yml,yaml}", "**/*.proto", "**/*.sql"},
+			PathExcludes: []string{"**/*.pem", "**/*.key", "**.env", "**/*.p12"},
+		},
+		paths: randomPaths(rng, 1000, []string{"src", "config", "certs", "web", "db"}, 6, []string{".go", ".ts", ".tsx", ".md", ".json", ".yml", ".yaml", ".proto", ".sql", ".pem", ".key", ".env", ".p12", ".bin", ".txt"}),
+	})
+
+	var prefix SubRepoPermissions
+	var pkgs []string
+	for i := 0; i < 100; i++ {
+		pkg := fmt.Sprintf("pkg%02d", i)
+		pkgs = append(pkgs, "src/"+pkg)
+		prefix.PathIncludes = append(prefix.PathIncludes, "/src/"+pkg+"/**")
+		prefix.PathExcludes = append(prefix.PathExcludes, "/src/"+pkg+"/testdata/**")
+	}
+	pkgs = append(pkgs, "vendor", "third_party")
+	fixtures = append(fixtures, ruleSetFixture{
+		name:  "prefix-heavy",
+		rules: prefix,
+		paths: randomPathsUnder(rng, 1000, pkgs, []string{"testdata", "internal", "util"}, 4, []string{".go", ".txt"}),
+	})
+
+	fixtures = append(fixtures, ruleSetFixture{
+		name: "deep-paths",
+		rules: SubRepoPermissions{
+			PathIncludes: []string{"/**/src/**", "/services/*/api/**", "/lib/**"},
+			PathExcludes: []string{"/**/vendor/**", "/**/generated/**/*.go"},
+		},
+		paths: randomPaths(rng, 1000, []string{"services", "src", "api", "vendor", "generated", "lib", "a", "b", "c"}, 20, []string{".go", ".ts"}),
+	})
+
+	return fixtures
+}
+
+// randomPaths returns n absolute paths made from the given directory names, at
+// most maxDepth deep, ending in a file with one of the given extensions.
+func randomPaths(rng *rand.Rand, n int, dirs []string, maxDepth int, exts []string) []string {
+	paths := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		var b strings.Builder
+		for d := rng.Intn(maxDepth); d >= 0; d-- {
+			b.WriteString("/")
+			b.WriteString(dirs[rng.Intn(len(dirs))])
+		}
+		fmt.Fprintf(&b, "/file%d%s", rng.Intn(100), exts[rng.Intn(len(exts))])
+		paths = append(paths, b.String())
+	}
+	return paths
+}
+
+// randomPathsUnder is like randomPaths but every path starts with one of the
+// given roots.
+func randomPathsUnder(rng *rand.Rand, n int, roots []string, dirs []string, maxDepth int, exts []string) []string {
+	paths := randomPaths(rng, n, dirs, maxDepth, exts)
+	for i, p := range paths {
+		paths[i] = "/" + roots[rng.Intn(len(roots))] + p
+	}
+	return paths
+}
+
+func compileGlobEngine(rules SubRepoPermissions) (func(string) bool, error) {
+	compiled, err := compileRules(map[api.RepoName]SubRepoPermissions{"repo": rules})
+	if err != nil {
+		return nil, err
+	}
+	r := compiled["repo"]
+	return func(path string) bool {
+		allowed, _ := r.match(path, "")
+		return allowed
+	}, nil
+}
+
+// compileRegexpUnionEngine combines all includes and all excludes into one
+// regular expression each.
+func compileRegexpUnionEngine(rules SubRepoPermissions) (func(string) bool, error) {
+	union := func(patterns []string) (*regexp.Regexp, error) {
+		if len(patterns) == 0 {
+			return nil, nil
+		}
+		alternatives := make([]string, 0, len(patterns))
+		for _, p := range patterns {
+			re, err := globToRegexp(p)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, re)
+		}
+		return regexp.Compile("^(?:" + strings.Join(alternatives, "|") + ")$")
+	}
+	includes, err := union(rules.PathIncludes)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := union(rules.PathExcludes)
+	if err != nil {
+		return nil, err
+	}
+	return func(path string) bool {
+		if excludes != nil && excludes.MatchString(path) {
+			return false
+		}
+		return includes != nil && includes.MatchString(path)
+	}, nil
+}
+
+// globToRegexp translates a glob with '/' as the separator into an equivalent
+// regular expression. It supports the subset of the syntax used in the
+// fixtures: *, **, ?, {a,b} and escapes.
+func globToRegexp(pattern string) (string, error) {
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '{':
+			b.WriteString("(?:")
+			depth++
+		case '}':
+			if depth == 0 {
+				return "", errors.Newf("unbalanced } in %q", pattern)
+			}
+			b.WriteString(")")
+			depth--
+		case ',':
+			if depth > 0 {
+				b.WriteString("|")
+			} else {
+				b.WriteString(",")
+			}
+		case '\\':
+			if i+1 == len(pattern) {
+				return "", errors.Newf("trailing escape in %q", pattern)
+			}
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			return "", errors.Newf("character classes are not supported: %q", pattern)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if depth != 0 {
+		return "", errors.Newf("unbalanced { in %q", pattern)
+	}
+	return b.String(), nil
+}
+
+// fastPathEngine returns an engine that uses fastPath for patterns it
+// recognises and falls back to globs for the rest.
+func fastPathEngine(fastPath func(pattern string) func(string) bool) func(SubRepoPermissions) (func(string) bool, error) {
+	compile := func(patterns []string) ([]func(string) bool, error) {
+		matchers := make([]func(string) bool, 0, len(patterns))
+		for _, p := range patterns {
+			if m := fastPath(p); m != nil {
+				matchers = append(matchers, m)
+				continue
+			}
+			g, err := glob.Compile(p, '/')
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, g.Match)
+		}
+		return matchers, nil
+	}
+	return func(rules SubRepoPermissions) (func(string) bool, error) {
+		includes, err := compile(rules.PathIncludes)
+		if err != nil {
+			return nil, err
+		}
+		excludes, err := compile(rules.PathExcludes)
+		if err != nil {
+			return nil, err
+		}
+		return func(path string) bool {
+			for _, m := range excludes {
+				if m(path) {
+					return false
+				}
+			}
+			for _, m := range includes {
+				if m(path) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+}
+
+const globMetaChars = `*?[]{}\`
+
+// extensionFastPath matches "**.ext" and "**/*.ext" with a suffix check.
+func extensionFastPath(pattern string) func(string) bool {
+	switch {
+	case strings.HasPrefix(pattern, "**/*."):
+		ext := pattern[len("**/*"):]
+		if strings.ContainsAny(ext, globMetaChars+"/") {
+			return nil
+		}
+		return func(path string) bool {
+			return strings.HasSuffix(path, ext) && strings.Contains(path, "/")
+		}
+	case strings.HasPrefix(pattern, "**."):
+		ext := pattern[len("**"):]
+		if strings.ContainsAny(ext, globMetaChars) {
+			return nil
+		}
+		return func(path string) bool {
+			return strings.HasSuffix(path, ext)
+		}
+	}
+	return nil
+}
+
+// literalPrefixFastPath matches literal patterns and "prefix**" with string
+// comparisons.
+func literalPrefixFastPath(pattern string) func(string) bool {
+	if !strings.ContainsAny(pattern, globMetaChars) {
+		return func(path string) bool {
+			return path == pattern
+		}
+	}
+	if prefix := strings.TrimSuffix(pattern, "**"); prefix != pattern && !strings.ContainsAny(prefix, globMetaChars) {
+		return func(path string) bool {
+			return strings.HasPrefix(path, prefix)
+		}
+	}
+	return nil
+}
+
+func TestMatcherEnginesAgree(t *testing.T) {
+	for _, fixture := range ruleSetFixtures() {
+		reference, err := compileGlobEngine(fixture.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var allowed, denied int
+		for _, path := range fixture.paths {
+			if reference(path) {
+				allowed++
+			} else {
+				denied++
+			}
+		}
+		if allowed == 0 || denied == 0 {
+			t.Errorf("%s: corpus should contain both allowed and denied paths, got %d allowed and %d denied", fixture.name, allowed, denied)
+		}
+
+		for _, engine := range ruleEngines[1:] {
+			t.Run(fixture.name+"/"+engine.name, func(t *testing.T) {
+				match, err := engine.compile(fixture.rules)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, path := range fixture.paths {
+					if want, got := reference(path), match(path); want != got {
+						t.Errorf("path %q: glob says %v, %s says %v", path, want, engine.name, got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMatcherEngines(b *testing.B) {
+	for _, fixture := range ruleSetFixtures() {
+		for _, engine := range ruleEngines {
+			fixture, engine := fixture, engine
+			b.Run(fixture.name+"/"+engine.name+"/match", func(b *testing.B) {
+				match, err := engine.compile(fixture.rules)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_ = match(fixture.paths[i%len(fixture.paths)])
+				}
+			})
+			b.Run(fixture.name+"/"+engine.name+"/compile", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := engine.compile(fixture.rules); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// multiRepoCorpus is a user's rules across many repos, with paths spread over
+// them as in search results. Repos come in a few shapes so that some share rule
+// sets, as they do when rules come from roles.
+func multiRepoCorpus(repos, paths int) (map[api.RepoName]SubRepoPermissions, []RepoContent) {
+	rng := rand.New(rand.NewSource(1))
+	shapes := []SubRepoPermissions{
+		{PathIncludes: []string{"/**"}, PathExcludes: []string{"/secret/**", "/internal/keys/*"}},
+		{PathIncludes: []string{"/src/**", "/docs/**"}, PathExcludes: []string{"/src/vendor/**"}},
+		{PathIncludes: []string{"/team*/**"}, PathExcludes: []string{"/team*/private/**"}},
+	}
+
+	rules := map[api.RepoName]SubRepoPermissions{}
+	var names []api.RepoName
+	for i := 0; i < repos; i++ {
+		name := api.RepoName(fmt.Sprintf("github.com/org/repo%03d", i))
+		names = append(names, name)
+		// Every fifth repo has no rules, so all of it is readable.
+		if i%5 != 0 {
+			rules[name] = shapes[i%len(shapes)]
+		}
+	}
+
+	dirs := []string{"src", "docs", "secret", "internal", "keys", "vendor", "team1", "private"}
+	contents := make([]RepoContent, 0, paths)
+	for _, path := range randomPaths(rng, paths, dirs, 6, []string{".go", ".md", ".pem"}) {
+		contents = append(contents, RepoContent{Repo: names[rng.Intn(len(names))], Path: path})
+	}
+	return rules, contents
+}
+
+// BenchmarkPermissionsBatch compares checking search results spanning many repos
+// path by path against checking them in one batch. The batch fetches the rules
+// once and only matches per path.
+func BenchmarkPermissionsBatch(b *testing.B) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{Enabled: true},
+			},
+		},
+	})
+	b.Cleanup(func() { conf.Mock(nil) })
+
+	rules, contents := multiRepoCorpus(50, 5000)
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(rules, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+
+	b.Run("per-path", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, content := range contents {
+				if _, err := client.Permissions(ctx, 1, content); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := client.permissionsBatch(ctx, 1, contents); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
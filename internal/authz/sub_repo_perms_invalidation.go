@@ -0,0 +1,94 @@
+package authz
+
+import (
+	"context"
+
+	"github.com/inconshreveable/log15"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// Invalidation describes cached sub-repo permissions that are stale, usually
+// because rules were synced. Exactly one of UserID and Repo is set.
+type Invalidation struct {
+	UserID int32        `json:"userID,omitempty"`
+	Repo   api.RepoName `json:"repo,omitempty"`
+}
+
+// InvalidationBus broadcasts invalidations to the SubRepoPermsClient of every
+// replica, so that a sync on one node doesn't leave the others serving stale
+// rules until their cache expires. Implementations are typically backed by a
+// pub/sub system.
+type InvalidationBus interface {
+	// Publish sends the invalidation to every subscriber, on any replica. The
+	// publisher may receive its own invalidation.
+	Publish(ctx context.Context, invalidation Invalidation) error
+
+	// Subscribe calls f with every invalidation published on any replica until
+	// unsubscribe is called.
+	Subscribe(f func(Invalidation)) (unsubscribe func())
+}
+
+// NoopInvalidationBus is the InvalidationBus for single-node deployments, where
+// invalidating the local cache is enough.
+type NoopInvalidationBus struct{}
+
+func (NoopInvalidationBus) Publish(context.Context, Invalidation) error { return nil }
+
+func (NoopInvalidationBus) Subscribe(func(Invalidation)) func() { return func() {} }
+
+// UseInvalidationBus makes the client publish its invalidations on the bus and
+// apply the invalidations published by other replicas. It should be called once
+// at startup. The returned function stops applying invalidations from the bus.
+func (s *SubRepoPermsClient) UseInvalidationBus(bus InvalidationBus) (unsubscribe func()) {
+	s.bus = bus
+	return bus.Subscribe(s.invalidate)
+}
+
+// InvalidateUser drops the cached rules of the user, on this and every other
+// replica, for example after the user's permissions were synced.
+func (s *SubRepoPermsClient) InvalidateUser(ctx context.Context, userID int32) error {
+	return s.invalidateEverywhere(ctx, Invalidation{UserID: userID})
+}
+
+// InvalidateRepo drops cached rules that may be stale after the rules of the repo
+// were synced, on this and every other replica. Rules are cached by user and any
+// user may have gained rules for the repo, so this drops the rules of every user.
+func (s *SubRepoPermsClient) InvalidateRepo(ctx context.Context, repo api.RepoName) error {
+	return s.invalidateEverywhere(ctx, Invalidation{Repo: repo})
+}
+
+// invalidateEverywhere applies the invalidation locally, then broadcasts it. The
+// local cache is invalidated even if broadcasting fails.
+func (s *SubRepoPermsClient) invalidateEverywhere(ctx context.Context, invalidation Invalidation) error {
+	s.invalidate(invalidation)
+	if err := s.bus.Publish(ctx, invalidation); err != nil {
+		return errors.Wrap(err, "broadcasting sub-repo permissions invalidation")
+	}
+	return nil
+}
+
+// invalidate drops the cached rules affected by the invalidation from the local
+// cache. Removed entries release their rules from the pool.
+func (s *SubRepoPermsClient) invalidate(invalidation Invalidation) {
+	switch {
+	case invalidation.UserID != 0:
+		for _, key := range s.cache.Keys() {
+			switch k := key.(type) {
+			case int32:
+				if k == invalidation.UserID {
+					s.cache.Remove(key)
+				}
+			case scopedCacheKey:
+				if k.userID == invalidation.UserID {
+					s.cache.Remove(key)
+				}
+			}
+		}
+	case invalidation.Repo != "":
+		s.cache.Purge()
+	default:
+		log15.Warn("ignoring empty sub-repo permissions invalidation")
+	}
+}
@@ -0,0 +1,137 @@
+package authz
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+// fakeInvalidationBus delivers invalidations to every subscriber, like a pub/sub
+// system shared by replicas.
+type fakeInvalidationBus struct {
+	mu          sync.Mutex
+	subscribers map[int]func(Invalidation)
+	next        int
+}
+
+func (b *fakeInvalidationBus) Publish(ctx context.Context, invalidation Invalidation) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.subscribers {
+		f(invalidation)
+	}
+	return nil
+}
+
+func (b *fakeInvalidationBus) Subscribe(f func(Invalidation)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = f
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+func TestSubRepoPermsInvalidationBus(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	ctx := context.Background()
+	content := RepoContent{Repo: api.RepoName("thing"), Path: "/stuff"}
+	bus := &fakeInvalidationBus{subscribers: map[int]func(Invalidation){}}
+
+	newReplica := func() (*SubRepoPermsClient, *MockSubRepoPermissionsGetter, func()) {
+		getter := NewMockSubRepoPermissionsGetter()
+		client, err := NewSubRepoPermsClient(getter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, getter, client.UseInvalidationBus(bus)
+	}
+	calls := func(getter *MockSubRepoPermissionsGetter) int {
+		return len(getter.GetByUserFunc.History())
+	}
+	check := func(client *SubRepoPermsClient, userID int32) {
+		if _, err := client.Permissions(ctx, userID, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, getterA, _ := newReplica()
+	b, getterB, unsubscribeB := newReplica()
+
+	// Both replicas cache the rules of users 1 and 2.
+	for _, client := range []*SubRepoPermsClient{a, b} {
+		check(client, 1)
+		check(client, 2)
+		check(client, 1)
+	}
+	if calls(getterA) != 2 || calls(getterB) != 2 {
+		t.Fatalf("expected each replica to fetch rules twice, got %d and %d", calls(getterA), calls(getterB))
+	}
+
+	// Invalidating a user on one replica clears it on the other, but not other users.
+	if err := a.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(b, 1)
+	check(b, 2)
+	if calls(getterB) != 3 {
+		t.Fatalf("expected the other replica to refetch only the invalidated user, got %d fetches", calls(getterB))
+	}
+	check(a, 1)
+	if calls(getterA) != 3 {
+		t.Fatalf("expected the invalidating replica to refetch the user, got %d fetches", calls(getterA))
+	}
+
+	// Invalidating a repo clears every user.
+	if err := a.InvalidateRepo(ctx, content.Repo); err != nil {
+		t.Fatal(err)
+	}
+	check(b, 1)
+	check(b, 2)
+	if calls(getterB) != 5 {
+		t.Fatalf("expected the other replica to refetch every user, got %d fetches", calls(getterB))
+	}
+
+	// After unsubscribing, invalidations from other replicas are no longer applied.
+	unsubscribeB()
+	if err := a.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(b, 1)
+	if calls(getterB) != 5 {
+		t.Fatalf("expected an unsubscribed replica to keep its cache, got %d fetches", calls(getterB))
+	}
+
+	// Without a bus, invalidation only applies locally.
+	getter := NewMockSubRepoPermissionsGetter()
+	single, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(single, 1)
+	if err := single.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	check(single, 1)
+	if calls(getter) != 2 {
+		t.Fatalf("expected the user to be refetched, got %d fetches", calls(getter))
+	}
+}
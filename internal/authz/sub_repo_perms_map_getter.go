@@ -0,0 +1,86 @@
+package authz
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// MapSubRepoPermissionsGetter is a SubRepoPermissionsGetter backed by an
+// in-memory map from user ID to the rules of each repo. It allows constructing
+// a SubRepoPermsClient without a database, for example in tests or small
+// deployments where rules come from configuration. It is safe for concurrent
+// use.
+type MapSubRepoPermissionsGetter struct {
+	mu    sync.RWMutex
+	perms map[int32]map[api.RepoName]SubRepoPermissions
+}
+
+var _ SubRepoPermissionsGetter = &MapSubRepoPermissionsGetter{}
+
+// NewMapSubRepoPermissionsGetter returns a getter serving the given rules. The
+// map is copied, so later changes to it have no effect.
+func NewMapSubRepoPermissionsGetter(perms map[int32]map[api.RepoName]SubRepoPermissions) *MapSubRepoPermissionsGetter {
+	g := &MapSubRepoPermissionsGetter{perms: make(map[int32]map[api.RepoName]SubRepoPermissions, len(perms))}
+	for userID, repoPerms := range perms {
+		g.perms[userID] = copyRepoPerms(repoPerms)
+	}
+	return g
+}
+
+// Set replaces the rules of a user. Note that SubRepoPermsClient caches rules,
+// so the change may take a little while to be picked up.
+func (g *MapSubRepoPermissionsGetter) Set(userID int32, repoPerms map[api.RepoName]SubRepoPermissions) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.perms[userID] = copyRepoPerms(repoPerms)
+}
+
+// GetByUser returns a copy of the rules of the user.
+func (g *MapSubRepoPermissionsGetter) GetByUser(_ context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return copyRepoPerms(g.perms[userID]), nil
+}
+
+// RepoSupported returns true if any user has rules for the repo.
+func (g *MapSubRepoPermissionsGetter) RepoSupported(_ context.Context, repo api.RepoName) (bool, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, repoPerms := range g.perms {
+		if _, ok := repoPerms[repo]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RepoIdSupported always returns false since rules are keyed by repo name and
+// the getter has no way to map IDs to names.
+func (g *MapSubRepoPermissionsGetter) RepoIdSupported(_ context.Context, _ api.RepoID) (bool, error) {
+	return false, nil
+}
+
+func copyRepoPerms(repoPerms map[api.RepoName]SubRepoPermissions) map[api.RepoName]SubRepoPermissions {
+	copied := make(map[api.RepoName]SubRepoPermissions, len(repoPerms))
+	for repo, perms := range repoPerms {
+		var branchRules []BranchRule
+		for _, rule := range perms.BranchRules {
+			branchRules = append(branchRules, BranchRule{
+				Branch:       rule.Branch,
+				PathIncludes: append([]string(nil), rule.PathIncludes...),
+				PathExcludes: append([]string(nil), rule.PathExcludes...),
+			})
+		}
+		copied[repo] = SubRepoPermissions{
+			PathIncludes:       append([]string(nil), perms.PathIncludes...),
+			PathExcludes:       append([]string(nil), perms.PathExcludes...),
+			GlobMode:           perms.GlobMode,
+			PathIncludeRegexps: append([]string(nil), perms.PathIncludeRegexps...),
+			PathExcludeRegexps: append([]string(nil), perms.PathExcludeRegexps...),
+			BranchRules:        branchRules,
+		}
+	}
+	return copied
+}
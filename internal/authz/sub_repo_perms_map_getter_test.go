@@ -0,0 +1,91 @@
+package authz
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+func TestMapSubRepoPermissionsGetter(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	ctx := context.Background()
+	getter := NewMapSubRepoPermissionsGetter(map[int32]map[api.RepoName]SubRepoPermissions{
+		1: {"sample": {PathIncludes: []string{"/**"}, PathExcludes: []string{"/secret/**"}}},
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content RepoContent
+		want    Perms
+	}{
+		{name: "included", content: RepoContent{Repo: "sample", Path: "/src/main.go"}, want: Read},
+		{name: "excluded", content: RepoContent{Repo: "sample", Path: "/secret/key.pem"}, want: None},
+		{name: "repo not in map", content: RepoContent{Repo: "other", Path: "/secret/key.pem"}, want: Read},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := client.Permissions(ctx, 1, tc.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tc.want {
+				t.Errorf("want %v, got %v", tc.want, have)
+			}
+		})
+	}
+
+	t.Run("repo supported", func(t *testing.T) {
+		for repo, want := range map[api.RepoName]bool{"sample": true, "other": false} {
+			have, err := client.EnabledForRepo(ctx, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != want {
+				t.Errorf("%s: want supported %v, got %v", repo, want, have)
+			}
+		}
+	})
+
+	t.Run("returned rules are copies", func(t *testing.T) {
+		perms, _ := getter.GetByUser(ctx, 1)
+		perms["sample"].PathExcludes[0] = "/nothing"
+		perms, _ = getter.GetByUser(ctx, 1)
+		if perms["sample"].PathExcludes[0] != "/secret/**" {
+			t.Fatal("modifying returned rules changed the getter")
+		}
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := int32(0); i < 10; i++ {
+			wg.Add(2)
+			go func(userID int32) {
+				defer wg.Done()
+				getter.Set(userID, map[api.RepoName]SubRepoPermissions{"sample": {PathIncludes: []string{"/**"}}})
+			}(i + 2)
+			go func(userID int32) {
+				defer wg.Done()
+				_, _ = getter.GetByUser(ctx, userID)
+				_, _ = getter.RepoSupported(ctx, "sample")
+			}(i + 2)
+		}
+		wg.Wait()
+	})
+}
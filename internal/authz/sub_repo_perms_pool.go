@@ -0,0 +1,184 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+)
+
+// defaultPoolMaxEntries and defaultPoolMaxBytes bound the compiled rule pool.
+// Rule sets that don't fit are compiled for the user alone.
+const (
+	defaultPoolMaxEntries = 10000
+	defaultPoolMaxBytes   = 8 << 20
+)
+
+// ruleSetKey identifies the rules of a single repo by content, so that users
+// with identical rules share the key.
+type ruleSetKey [sha256.Size]byte
+
+// fingerprintRuleSet hashes the rules of a single repo, including how they are
+// compiled.
+func fingerprintRuleSet(perms SubRepoPermissions) ruleSetKey {
+	b, _ := json.Marshal(perms)
+	return sha256.Sum256(b)
+}
+
+// compiledRulePool shares compiled rules between users with identical rule sets,
+// which is common when rules are derived from roles. Entries are reference
+// counted by the cached rules that use them and dropped when the last of those is
+// evicted.
+type compiledRulePool struct {
+	mu      sync.Mutex
+	entries map[ruleSetKey]*pooledRules
+	bytes   int
+
+	maxEntries int
+	maxBytes   int
+}
+
+type pooledRules struct {
+	rules compiledRules
+	refs  int
+	bytes int
+}
+
+func newCompiledRulePool(maxEntries, maxBytes int) *compiledRulePool {
+	return &compiledRulePool{
+		entries:    map[ruleSetKey]*pooledRules{},
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// errCompileBudgetExceeded is returned by compiledRulePool.compile when compiling
+// takes too long.
+var errCompileBudgetExceeded = errors.New("compile budget exceeded")
+
+// compile is like compileRules, but takes rule sets from the pool where possible.
+// It returns the keys of the pooled rule sets, which must be passed to release
+// once the rules are no longer used.
+//
+// If overBudget is not nil, it is called before each rule set that isn't pooled
+// yet, and compiling stops with errCompileBudgetExceeded once it returns true.
+func (p *compiledRulePool) compile(repoPerms map[api.RepoName]SubRepoPermissions, overBudget func() bool) (map[api.RepoName]compiledRules, []ruleSetKey, error) {
+	compiled := make(map[api.RepoName]compiledRules, len(repoPerms))
+	var keys []ruleSetKey
+	for repo, perms := range repoPerms {
+		rules, key, pooled, err := p.acquire(perms, overBudget)
+		if err != nil {
+			p.release(keys)
+			return nil, nil, err
+		}
+		if pooled {
+			keys = append(keys, key)
+		}
+		compiled[repo] = rules
+	}
+	return compiled, keys, nil
+}
+
+// acquire returns the compiled rules for perms and takes a reference to them if
+// they are pooled.
+func (p *compiledRulePool) acquire(perms SubRepoPermissions, overBudget func() bool) (rules compiledRules, key ruleSetKey, pooled bool, err error) {
+	key = fingerprintRuleSet(perms)
+
+	p.mu.Lock()
+	if entry, ok := p.entries[key]; ok {
+		entry.refs++
+		p.mu.Unlock()
+		return entry.rules, key, true, nil
+	}
+	p.mu.Unlock()
+
+	if overBudget != nil && overBudget() {
+		return compiledRules{}, key, false, errCompileBudgetExceeded
+	}
+
+	// Compile outside the lock. If another goroutine pools the same rules in the
+	// meantime, theirs are used and ours are dropped.
+	compiled, err := compileRules(map[api.RepoName]SubRepoPermissions{"": perms})
+	if err != nil {
+		return compiledRules{}, key, false, err
+	}
+	rules = compiled[""]
+	size := estimatedRuleSetBytes(perms)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if entry, ok := p.entries[key]; ok {
+		entry.refs++
+		return entry.rules, key, true, nil
+	}
+	if len(p.entries) >= p.maxEntries || p.bytes+size > p.maxBytes {
+		return rules, key, false, nil
+	}
+	p.entries[key] = &pooledRules{rules: rules, refs: 1, bytes: size}
+	p.bytes += size
+	return rules, key, true, nil
+}
+
+// release drops a reference to each of the rule sets, removing those that are no
+// longer used.
+func (p *compiledRulePool) release(keys []ruleSetKey) {
+	if len(keys) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		entry, ok := p.entries[key]
+		if !ok {
+			continue
+		}
+		entry.refs--
+		if entry.refs <= 0 {
+			delete(p.entries, key)
+			p.bytes -= entry.bytes
+		}
+	}
+}
+
+// retain takes another reference to each of the rule sets, so that they can be
+// kept by a new cache entry. It returns false without taking any references if
+// one of them was dropped from the pool.
+func (p *compiledRulePool) retain(keys []ruleSetKey) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := p.entries[key]; !ok {
+			return false
+		}
+	}
+	for _, key := range keys {
+		p.entries[key].refs++
+	}
+	return true
+}
+
+// estimatedRuleSetBytes estimates the memory taken by the compiled rules, in the
+// same way as WarmCacheStats.
+func estimatedRuleSetBytes(perms SubRepoPermissions) int {
+	size := 0
+	for _, patterns := range rulePatterns(perms) {
+		for _, pattern := range patterns {
+			size += len(pattern) + estimatedGlobOverheadBytes
+		}
+	}
+	return size
+}
+
+// rulePatterns returns all the globs of the rules, grouped as they are compiled.
+func rulePatterns(perms SubRepoPermissions) [][]string {
+	patterns := [][]string{perms.PathIncludes, perms.PathExcludes, perms.PathIncludeRegexps, perms.PathExcludeRegexps}
+	for _, rule := range perms.BranchRules {
+		patterns = append(patterns, []string{rule.Branch}, rule.PathIncludes, rule.PathExcludes)
+	}
+	for _, rule := range perms.LineRules {
+		patterns = append(patterns, []string{rule.Path})
+	}
+	return patterns
+}
@@ -3,16 +3,25 @@ package authz
 import (
 	"context"
 	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/sourcegraph/sourcegraph/internal/actor"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/trace/ot"
 	"github.com/sourcegraph/sourcegraph/internal/vcs/util"
+	"github.com/sourcegraph/sourcegraph/lib/errors"
+	"github.com/sourcegraph/sourcegraph/lib/log/logtest"
 	"github.com/sourcegraph/sourcegraph/schema"
 )
 
@@ -178,6 +187,72 @@ func TestFilterActorPaths(t *testing.T) {
 	if diff := cmp.Diff(want, filtered); diff != "" {
 		t.Fatal(diff)
 	}
+	if n := len(checker.EnabledFunc.History()); n != 1 {
+		t.Fatalf("want a single enabled check, got %d", n)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultReturn(false)
+
+		filtered, err := FilterActorPaths(ctx, checker, a, repo, testPaths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(testPaths, filtered); diff != "" {
+			t.Fatal(diff)
+		}
+		if n := len(checker.EnabledFunc.History()); n != 1 {
+			t.Fatalf("want a single enabled check, got %d", n)
+		}
+		if n := len(checker.PermissionsFunc.History()); n != 0 {
+			t.Fatalf("want no permissions checks, got %d", n)
+		}
+	})
+
+	t.Run("internal actor", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultReturn(true)
+
+		filtered, err := FilterActorPaths(ctx, checker, &actor.Actor{Internal: true}, repo, testPaths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(testPaths, filtered); diff != "" {
+			t.Fatal(diff)
+		}
+		if n := len(checker.PermissionsFunc.History()); n != 0 {
+			t.Fatalf("want no permissions checks, got %d", n)
+		}
+	})
+
+	t.Run("result doesn't alias the input", func(t *testing.T) {
+		for name, checker := range map[string]*MockSubRepoPermissionChecker{"enabled": checker, "disabled": NewMockSubRepoPermissionChecker()} {
+			paths := append(make([]string, 0, len(testPaths)+1), testPaths...)
+			filtered, err := FilterActorPaths(ctx, checker, a, repo, paths)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filtered = append(filtered, "appended")
+			filtered[0] = "changed"
+			if diff := cmp.Diff(testPaths, paths[:len(testPaths)]); diff != "" {
+				t.Fatalf("%s: the input changed (-want +got):\n%s", name, diff)
+			}
+			if extra := paths[:cap(paths)][len(testPaths)]; extra != "" {
+				t.Fatalf("%s: appending to the result wrote %q into the input", name, extra)
+			}
+		}
+	})
+
+	t.Run("unauthenticated actor", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultReturn(true)
+
+		_, err := FilterActorPaths(ctx, checker, &actor.Actor{}, repo, testPaths)
+		if !errors.HasType(err, &ErrUnauthenticated{}) {
+			t.Fatalf("want ErrUnauthenticated, got %v", err)
+		}
+	})
 }
 
 func TestCanReadAllPaths(t *testing.T) {
@@ -275,55 +350,2288 @@ func TestSubRepoPermsPermissionsCache(t *testing.T) {
 	}
 }
 
-func TestSubRepoEnabled(t *testing.T) {
-	t.Run("checker is nil", func(t *testing.T) {
-		if SubRepoEnabled(nil) {
-			t.Errorf("expected checker to be invalid since it is nil")
+func TestSubRepoPermsConcurrentFetches(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	// The getter blocks until every caller has started, so that the callers
+	// overlap with the fetch.
+	var calls int32
+	release := make(chan struct{})
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(ctx context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return map[api.RepoName]SubRepoPermissions{
+			"thing": {PathIncludes: []string{"**"}},
+		}, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const callers = 50
+	var started, done sync.WaitGroup
+	started.Add(callers)
+	done.Add(callers)
+	perms := make([]Perms, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		go func(i int) {
+			defer done.Done()
+			started.Done()
+			perms[i], errs[i] = client.Permissions(context.Background(), 1, RepoContent{Repo: "thing", Path: "a/b.go"})
+		}(i)
+	}
+	started.Wait()
+	close(release)
+	done.Wait()
+
+	for i := range perms {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if perms[i] != Read {
+			t.Fatalf("caller %d: want %s, got %s", i, Read, perms[i])
 		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("want the getter called once, got %d calls", n)
+	}
+}
+
+func TestSubRepoPermsAdaptiveCacheTTL(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled:                true,
+					UserCacheTTLSeconds:    10,
+					UserCacheMaxTTLSeconds: 40,
+				},
+			},
+		},
 	})
-	t.Run("checker is not enabled", func(t *testing.T) {
-		checker := NewMockSubRepoPermissionChecker()
-		checker.EnabledFunc.SetDefaultHook(func() bool {
-			return false
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules := map[api.RepoName]SubRepoPermissions{
+		"thing": {PathIncludes: []string{"**"}},
+	}
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(context.Context, int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return rules, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	client.clock = func() time.Time { return now }
+	client.since = func(t time.Time) time.Duration { return now.Sub(t) }
+
+	ctx := context.Background()
+	content := RepoContent{Repo: "thing", Path: "/stuff"}
+	// step advances the clock, checks permissions and returns whether the getter
+	// was called along with the TTL of the cached rules.
+	step := func(d time.Duration) (bool, time.Duration) {
+		t.Helper()
+		now = now.Add(d)
+		calls := len(getter.GetByUserFunc.History())
+		if _, err := client.Permissions(ctx, 1, content); err != nil {
+			t.Fatal(err)
+		}
+		item, _ := client.cache.Get(int32(1))
+		return len(getter.GetByUserFunc.History()) > calls, item.(cachedRules).ttl
+	}
+
+	for _, tc := range []struct {
+		name      string
+		advance   time.Duration
+		change    bool
+		wantFetch bool
+		wantTTL   time.Duration
+	}{
+		{name: "first check", advance: 0, wantFetch: true, wantTTL: 10 * time.Second},
+		{name: "fresh", advance: 5 * time.Second, wantFetch: false, wantTTL: 10 * time.Second},
+		{name: "unchanged doubles", advance: 6 * time.Second, wantFetch: true, wantTTL: 20 * time.Second},
+		{name: "fresh for longer", advance: 15 * time.Second, wantFetch: false, wantTTL: 20 * time.Second},
+		{name: "unchanged doubles again", advance: 6 * time.Second, wantFetch: true, wantTTL: 40 * time.Second},
+		{name: "capped at max", advance: 41 * time.Second, wantFetch: true, wantTTL: 40 * time.Second},
+		{name: "change resets", advance: 41 * time.Second, change: true, wantFetch: true, wantTTL: 10 * time.Second},
+		{name: "short again", advance: 11 * time.Second, wantFetch: true, wantTTL: 20 * time.Second},
+	} {
+		if tc.change {
+			rules = map[api.RepoName]SubRepoPermissions{
+				"thing": {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+			}
+		}
+		fetched, ttl := step(tc.advance)
+		if fetched != tc.wantFetch {
+			t.Errorf("%s: want fetch %t, got %t", tc.name, tc.wantFetch, fetched)
+		}
+		if ttl != tc.wantTTL {
+			t.Errorf("%s: want TTL %s, got %s", tc.name, tc.wantTTL, ttl)
+		}
+	}
+
+	t.Run("fixed without a max", func(t *testing.T) {
+		conf.Mock(&conf.Unified{
+			SiteConfiguration: schema.SiteConfiguration{
+				ExperimentalFeatures: &schema.ExperimentalFeatures{
+					SubRepoPermissions: &schema.SubRepoPermissions{
+						Enabled:             true,
+						UserCacheTTLSeconds: 10,
+					},
+				},
+			},
 		})
-		if SubRepoEnabled(checker) {
-			t.Errorf("expected checker to be invalid since it is disabled")
+		if minTTL, maxTTL := cacheTTLBounds(); minTTL != 10*time.Second || maxTTL != minTTL {
+			t.Fatalf("want a fixed TTL of 10s, got %s to %s", minTTL, maxTTL)
 		}
 	})
-	t.Run("checker is enabled", func(t *testing.T) {
-		checker := NewMockSubRepoPermissionChecker()
-		checker.EnabledFunc.SetDefaultHook(func() bool {
-			return true
-		})
-		if !SubRepoEnabled(checker) {
-			t.Errorf("expected checker to be valid since it is enabled")
+}
+
+func TestSubRepoPermsWarmCache(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(ctx context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return map[api.RepoName]SubRepoPermissions{
+			"a": {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+			"b": {PathIncludes: []string{"/docs/**"}},
+		}, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	users := []int32{1, 2}
+
+	want := WarmCacheStats{
+		Users:          2,
+		Repos:          4,
+		Rules:          6,
+		EstimatedBytes: 2 * (len("**") + len("/secret/**") + len("/docs/**") + 3*estimatedGlobOverheadBytes),
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		stats, err := client.WarmCache(ctx, users, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, stats); diff != "" {
+			t.Fatal(diff)
+		}
+		if n := client.cache.Len(); n != 0 {
+			t.Fatalf("expected the cache to be empty after a dry run, got %d entries", n)
+		}
+	})
+
+	t.Run("real run", func(t *testing.T) {
+		stats, err := client.WarmCache(ctx, users, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, stats); diff != "" {
+			t.Fatal(diff)
+		}
+		if n := client.cache.Len(); n != 2 {
+			t.Fatalf("expected 2 cache entries, got %d", n)
+		}
+
+		// Permissions checks are served from the cache.
+		calls := len(getter.GetByUserFunc.History())
+		if _, err := client.Permissions(ctx, 1, RepoContent{Repo: "a", Path: "/x"}); err != nil {
+			t.Fatal(err)
+		}
+		if len(getter.GetByUserFunc.History()) != calls {
+			t.Fatal("expected rules to come from the cache")
 		}
 	})
 }
 
-func TestRepoContentFromFileInfo(t *testing.T) {
-	repo := api.RepoName("my-repo")
-	t.Run("adding trailing slash to directory", func(t *testing.T) {
-		fi := &util.FileInfo{
-			Name_: "app",
-			Mode_: fs.ModeDir,
+func TestSubRepoPermsPermissionsBatch(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules, contents := multiRepoCorpus(20, 500)
+	contents = append(contents, RepoContent{Repo: "github.com/org/repo001", Path: ""})
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(rules, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	got, err := client.permissionsBatch(ctx, 1, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(getter.GetByUserFunc.History()); n != 1 {
+		t.Fatalf("want rules fetched once, got %d calls", n)
+	}
+	var read, none int
+	for i, content := range contents {
+		want, err := client.Permissions(ctx, 1, content)
+		if err != nil {
+			t.Fatal(err)
 		}
-		rc := repoContentFromFileInfo(repo, fi)
-		expected := RepoContent{
-			Repo: repo,
-			Path: "app/",
+		if got[i] != want {
+			t.Fatalf("%s %s: batch says %s, Permissions says %s", content.Repo, content.Path, got[i], want)
 		}
-		assert.Equal(t, expected, rc)
+		if want == Read {
+			read++
+		} else {
+			none++
+		}
+	}
+	if read == 0 || none == 0 {
+		t.Fatalf("expected the corpus to have readable and denied paths, got %d and %d", read, none)
+	}
+
+	// Once the rules are cached, allocations don't grow with the number of paths.
+	allocs := testing.AllocsPerRun(10, func() {
+		_, _ = client.permissionsBatch(ctx, 1, contents)
 	})
-	t.Run("doesn't add trailing slash if not directory", func(t *testing.T) {
-		fi := &util.FileInfo{
-			Name_: "my-file.txt",
+	if allocs > 20 {
+		t.Fatalf("want at most 20 allocations per batch, got %v", allocs)
+	}
+
+	if _, err := client.permissionsBatch(ctx, 0, contents); !errors.HasType(err, &ErrUnauthenticated{}) {
+		t.Fatalf("want ErrUnauthenticated for an anonymous user, got %v", err)
+	}
+}
+
+func TestSubRepoPermsFilterContents(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"frontend": {PathIncludes: []string{"/src/**"}, PathExcludes: []string{"/src/secret/**"}},
+		"backend":  {PathIncludes: []string{"/**"}, PathExcludes: []string{"/config/*"}},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[RepoContent]Perms{
+		{Repo: "frontend", Path: "/src/app.ts"}:         Read,
+		{Repo: "frontend", Path: "/src/secret/key.ts"}:  None, // Excludes win over includes
+		{Repo: "frontend", Path: "/README.md"}:          None,
+		{Repo: "backend", Path: "/main.go"}:             Read,
+		{Repo: "backend", Path: "/config/prod.yaml"}:    None,
+		{Repo: "unrestricted", Path: "/anything.txt"}:   Read,
+		{Repo: "unrestricted", Path: "/src/secret/key"}: Read,
+	}
+	contents := make([]RepoContent, 0, len(want))
+	for content := range want {
+		contents = append(contents, content)
+	}
+
+	got, err := client.FilterContents(context.Background(), 1, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected permissions (-want +got):\n%s", diff)
+	}
+	// The rules of every repo come from a single fetch.
+	if n := len(getter.GetByUserFunc.History()); n != 1 {
+		t.Fatalf("want rules fetched once for the batch, got %d calls", n)
+	}
+	// Only the repo without rules is checked for support, once.
+	if n := len(getter.RepoSupportedFunc.History()); n != 1 {
+		t.Fatalf("want a single RepoSupported call, got %d", n)
+	}
+
+	// Each content gets the same answer from Permissions.
+	for content, perms := range want {
+		have, err := client.Permissions(context.Background(), 1, content)
+		if err != nil {
+			t.Fatal(err)
 		}
-		rc := repoContentFromFileInfo(repo, fi)
-		expected := RepoContent{
-			Repo: repo,
-			Path: "my-file.txt",
+		if have != perms {
+			t.Errorf("%s %s: want %s from Permissions, got %s", content.Repo, content.Path, perms, have)
 		}
-		assert.Equal(t, expected, rc)
+	}
+
+	if _, err := client.FilterContents(context.Background(), 0, contents); !errors.HasType(err, &ErrUnauthenticated{}) {
+		t.Fatalf("want ErrUnauthenticated for an anonymous user, got %v", err)
+	}
+}
+
+func TestSubRepoPermsPermissionsForUsers(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	repo := api.RepoName("sample")
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(ctx context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+		switch userID {
+		case 1:
+			// Can read everything.
+			return map[api.RepoName]SubRepoPermissions{
+				repo: {PathIncludes: []string{"**"}},
+			}, nil
+		case 2:
+			// Excluded from the secrets.
+			return map[api.RepoName]SubRepoPermissions{
+				repo: {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+			}, nil
+		case 3:
+			// No rules for the repo at all.
+			return map[api.RepoName]SubRepoPermissions{}, nil
+		case 4:
+			// Only included elsewhere.
+			return map[api.RepoName]SubRepoPermissions{
+				repo: {PathIncludes: []string{"/docs/**"}},
+			}, nil
+		}
+		return nil, errors.Errorf("unexpected user %d", userID)
 	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	content := RepoContent{Repo: repo, Path: "/secret/key.pem"}
+	got, err := client.PermissionsForUsers(ctx, []int32{1, 2, 3, 4}, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int32]Perms{1: Read, 2: None, 3: Read, 4: None}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected permissions (-want +got):\n%s", diff)
+	}
+
+	if _, err := client.PermissionsForUsers(ctx, []int32{1, 5}, content); err == nil {
+		t.Fatal("want an error when fetching a user's rules fails")
+	}
+}
+
+func TestSubRepoPermsSharedRulePool(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	// Both users get identical rules, as they would from a shared role.
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(ctx context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return map[api.RepoName]SubRepoPermissions{
+			"sample": {PathIncludes: []string{"/src/**"}, PathExcludes: []string{"/src/secret/**"}},
+		}, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for _, userID := range []int32{1, 2} {
+		perms, err := client.Permissions(ctx, userID, RepoContent{Repo: "sample", Path: "/src/main.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != Read {
+			t.Fatalf("user %d: want Read, got %s", userID, perms)
+		}
+	}
+
+	if n := len(client.pool.entries); n != 1 {
+		t.Fatalf("want a single pooled rule set, got %d", n)
+	}
+	for _, entry := range client.pool.entries {
+		if entry.refs != 2 {
+			t.Fatalf("want 2 references, got %d", entry.refs)
+		}
+	}
+	rules := func(userID int32) compiledRules {
+		item, _ := client.cache.Peek(userID)
+		return item.(cachedRules).rules["sample"]
+	}
+	if &rules(1).includes[0] != &rules(2).includes[0] {
+		t.Fatal("expected both users to share the compiled rules")
+	}
+
+	// Refreshing unchanged rules keeps the user's reference.
+	client.since = func(time.Time) time.Duration { return defaultCacheTTL + 1 }
+	if _, err := client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/src/main.go"}); err != nil {
+		t.Fatal(err)
+	}
+	client.since = time.Since
+	for _, entry := range client.pool.entries {
+		if entry.refs != 2 {
+			t.Fatalf("want 2 references after refreshing, got %d", entry.refs)
+		}
+	}
+
+	// Evicting a user drops their reference, and the last one drops the entry.
+	client.cache.Remove(int32(1))
+	for _, entry := range client.pool.entries {
+		if entry.refs != 1 {
+			t.Fatalf("want 1 reference after eviction, got %d", entry.refs)
+		}
+	}
+	client.cache.Remove(int32(2))
+	if n := len(client.pool.entries); n != 0 {
+		t.Fatalf("want an empty pool, got %d entries", n)
+	}
+	if client.pool.bytes != 0 {
+		t.Fatalf("want no pooled bytes, got %d", client.pool.bytes)
+	}
+}
+
+func TestSuggestRuleChange(t *testing.T) {
+	rules := SubRepoPermissions{
+		PathIncludes: []string{"/src/**", "/docs/*.md"},
+		PathExcludes: []string{"/src/secret/**", "/src/*/keys/**"},
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		want RuleSuggestion
+	}{
+		{
+			name: "already readable",
+			path: "/src/main.go",
+			want: RuleSuggestion{Readable: true},
+		},
+		{
+			name: "exclude blocking",
+			path: "/src/secret/token",
+			want: RuleSuggestion{BlockingExcludes: []string{"/src/secret/**"}},
+		},
+		{
+			name: "several excludes blocking",
+			path: "/src/secret/keys/id_rsa",
+			want: RuleSuggestion{BlockingExcludes: []string{"/src/secret/**", "/src/*/keys/**"}},
+		},
+		{
+			name: "missing include",
+			path: "/docs/guide/intro.md",
+			want: RuleSuggestion{AddInclude: "/docs/guide/intro.md"},
+		},
+		{
+			name: "missing include is escaped",
+			path: "/build/[id]/out*.txt",
+			want: RuleSuggestion{AddInclude: `/build/\[id\]/out\*.txt`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := SuggestRuleChange(rules, RepoContent{Repo: "sample", Path: tc.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("unexpected suggestion (-want +got):\n%s", diff)
+			}
+
+			// Applying the suggestion makes the path readable.
+			changed := SubRepoPermissions{PathIncludes: rules.PathIncludes}
+			if got.AddInclude != "" {
+				changed.PathIncludes = append(append([]string{}, rules.PathIncludes...), got.AddInclude)
+			}
+			blocking := map[string]bool{}
+			for _, exclude := range got.BlockingExcludes {
+				blocking[exclude] = true
+			}
+			for _, exclude := range rules.PathExcludes {
+				if !blocking[exclude] {
+					changed.PathExcludes = append(changed.PathExcludes, exclude)
+				}
+			}
+			perms, err := EvaluateRules(changed, []RepoContent{{Path: tc.path}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perms[0] != Read {
+				t.Fatalf("want the path readable after applying the suggestion, got %s", perms[0])
+			}
+		})
+	}
+}
+
+func TestAssertEffectiveAccess(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"/docs/**", "/src/**"}, PathExcludes: []string{"/src/secret/**"}},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := []string{"/docs/a.md", "/src/main.go", "/src/secret/key", "/README.md"}
+	for _, tc := range []struct {
+		name     string
+		expected []string
+		want     AccessReport
+	}{
+		{
+			name:     "exact",
+			expected: []string{"/docs/a.md", "/src/main.go"},
+			want:     AccessReport{},
+		},
+		{
+			name:     "over-grant",
+			expected: []string{"/docs/a.md"},
+			want:     AccessReport{OverGrants: []string{"/src/main.go"}},
+		},
+		{
+			name:     "under-grant",
+			expected: []string{"/docs/a.md", "/src/main.go", "/src/secret/key", "/LICENSE"},
+			want:     AccessReport{UnderGrants: []string{"/src/secret/key", "/LICENSE"}},
+		},
+		{
+			name:     "both",
+			expected: []string{"/README.md"},
+			want:     AccessReport{OverGrants: []string{"/docs/a.md", "/src/main.go"}, UnderGrants: []string{"/README.md"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := client.AssertEffectiveAccess(context.Background(), 1, "sample", tc.expected, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, report); diff != "" {
+				t.Fatalf("unexpected report (-want +got):\n%s", diff)
+			}
+			if report.OK() != (tc.name == "exact") {
+				t.Fatalf("unexpected OK %t", report.OK())
+			}
+		})
+	}
+}
+
+func TestSubRepoPermsCompileBudget(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled:                   true,
+					CompileBudgetMilliseconds: 5,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules := map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"/**"}},
+	}
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(context.Context, int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return rules, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	content := RepoContent{Repo: "sample", Path: "/src/main.go"}
+	check := func(userID int32, want Perms) {
+		t.Helper()
+		perms, err := client.Permissions(ctx, userID, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != want {
+			t.Fatalf("user %d: want %s, got %s", userID, want, perms)
+		}
+	}
+
+	// Within budget, rules are compiled and cached as usual.
+	check(1, Read)
+
+	// Make every compile look expensive. This also expires the cached rules.
+	client.since = func(time.Time) time.Duration { return time.Second }
+	rules = map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"/docs/**"}},
+	}
+
+	t.Run("falls back to cached rules", func(t *testing.T) {
+		check(1, Read)
+		item, _ := client.cache.Get(int32(1))
+		if got := item.(cachedRules).fingerprint; got == fingerprintRules(rules) {
+			t.Fatal("expected the rules compiled over budget not to be cached")
+		}
+	})
+
+	t.Run("denies without cached rules", func(t *testing.T) {
+		check(2, None)
+		if client.cache.Contains(int32(2)) {
+			t.Fatal("expected the fallback not to be cached")
+		}
+	})
+
+	t.Run("no cap", func(t *testing.T) {
+		conf.Mock(&conf.Unified{
+			SiteConfiguration: schema.SiteConfiguration{
+				ExperimentalFeatures: &schema.ExperimentalFeatures{
+					SubRepoPermissions: &schema.SubRepoPermissions{
+						Enabled: true,
+					},
+				},
+			},
+		})
+		rules = map[api.RepoName]SubRepoPermissions{
+			"sample": {PathIncludes: []string{"/src/**"}},
+		}
+		check(2, Read)
+	})
+}
+
+// scopedGetter is a ScopedSubRepoPermissionsGetter that returns rules from a
+// fixed history keyed by commit or time.
+type scopedGetter struct {
+	*MockSubRepoPermissionsGetter
+	byCommit map[api.CommitID]SubRepoPermissions
+	byTime   func(time.Time) SubRepoPermissions
+	scopes   []RulesScope
+}
+
+func (g *scopedGetter) GetByUserAt(ctx context.Context, userID int32, scope RulesScope) (map[api.RepoName]SubRepoPermissions, error) {
+	g.scopes = append(g.scopes, scope)
+	if scope.Commit != "" {
+		return map[api.RepoName]SubRepoPermissions{"sample": g.byCommit[scope.Commit]}, nil
+	}
+	return map[api.RepoName]SubRepoPermissions{"sample": g.byTime(scope.Time)}, nil
+}
+
+func TestEvaluateRules(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules := SubRepoPermissions{
+		PathIncludes: []string{"/src/**", "/README.md"},
+		PathExcludes: []string{"/src/secret/**"},
+	}
+	var contents []RepoContent
+	for _, path := range []string{"", "/README.md", "/src/main.go", "/src/secret/key.pem", "/docs/index.md"} {
+		contents = append(contents, RepoContent{Repo: "sample", Path: path})
+	}
+
+	preview, err := EvaluateRules(rules, contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]Perms{Read, Read, Read, None, None}, preview); diff != "" {
+		t.Fatalf("unexpected preview (-want +got):\n%s", diff)
+	}
+
+	// The preview must agree with what the rules grant once saved.
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{"sample": rules}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, content := range contents {
+		persisted, err := client.Permissions(context.Background(), 1, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if persisted != preview[i] {
+			t.Errorf("path %q: preview says %v, persisted rules say %v", content.Path, preview[i], persisted)
+		}
+	}
+
+	t.Run("invalid rules", func(t *testing.T) {
+		if _, err := EvaluateRules(SubRepoPermissions{PathIncludes: []string{"/src/[a"}}, contents); err == nil {
+			t.Fatal("expected an error for an invalid pattern")
+		}
+	})
+}
+
+func TestGlobMode(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	var contents []RepoContent
+	for _, path := range []string{"/secrets/a.txt", "/secrets/a/b.txt", "/public/a.txt"} {
+		contents = append(contents, RepoContent{Repo: "sample", Path: path})
+	}
+
+	for _, tc := range []struct {
+		name string
+		mode GlobMode
+		want []Perms
+	}{
+		{
+			name: "strict by default",
+			mode: GlobStrict,
+			want: []Perms{None, Read, Read},
+		},
+		{
+			name: "cross directory",
+			mode: GlobCrossDirectory,
+			want: []Perms{None, None, Read},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := SubRepoPermissions{
+				PathIncludes: []string{"**"},
+				PathExcludes: []string{"/secrets/*"},
+				GlobMode:     tc.mode,
+			}
+			got, err := EvaluateRules(rules, contents)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Fatalf("unexpected perms (-want +got):\n%s", diff)
+			}
+
+			getter := NewMockSubRepoPermissionsGetter()
+			getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{"sample": rules}, nil)
+			client, err := NewSubRepoPermsClient(getter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, content := range contents {
+				perms, err := client.Permissions(context.Background(), 1, content)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if perms != tc.want[i] {
+					t.Errorf("path %q: want %v, got %v", content.Path, tc.want[i], perms)
+				}
+			}
+		})
+	}
+}
+
+func TestSubRepoPermsScopedRules(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	ctx := context.Background()
+	current := map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+	}
+	old := SubRepoPermissions{PathIncludes: []string{"**"}}
+
+	t.Run("commit scoped rules", func(t *testing.T) {
+		mock := NewMockSubRepoPermissionsGetter()
+		mock.GetByUserFunc.SetDefaultReturn(current, nil)
+		getter := &scopedGetter{
+			MockSubRepoPermissionsGetter: mock,
+			byCommit:                     map[api.CommitID]SubRepoPermissions{"old": old},
+		}
+		client, err := NewSubRepoPermsClient(getter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Current rules deny the path
+		perms, err := client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, None, perms)
+
+		// The rules at the old commit allowed it
+		for i := 0; i < 2; i++ {
+			perms, err = client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file", Commit: "old"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, Read, perms)
+		}
+
+		// Scoped rules are cached separately from current rules
+		assert.Len(t, mock.GetByUserFunc.History(), 1)
+		assert.Equal(t, []RulesScope{{Commit: "old"}}, getter.scopes)
+	})
+
+	t.Run("time scoped rules", func(t *testing.T) {
+		cutoff := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		getter := &scopedGetter{
+			MockSubRepoPermissionsGetter: NewMockSubRepoPermissionsGetter(),
+			byTime: func(at time.Time) SubRepoPermissions {
+				if at.Before(cutoff) {
+					return old
+				}
+				return current["sample"]
+			},
+		}
+
+		client, err := NewSubRepoPermsClient(getter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The rules before the cutoff allowed the path
+		before := cutoff.Add(-time.Hour)
+		perms, err := client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file", Time: before})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, Read, perms)
+
+		// The same instant in another location shares the cached rules
+		perms, err = client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file", Time: before.In(time.FixedZone("EST", -5*60*60))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, Read, perms)
+
+		// The rules after it deny the path
+		perms, err = client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file", Time: cutoff.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, None, perms)
+		assert.Equal(t, []RulesScope{{Time: before}, {Time: cutoff.Add(time.Hour)}}, getter.scopes)
+	})
+
+	t.Run("default adapter returns current rules", func(t *testing.T) {
+		mock := NewMockSubRepoPermissionsGetter()
+		mock.GetByUserFunc.SetDefaultReturn(current, nil)
+		adapted := NewScopedSubRepoPermissionsGetter(mock)
+
+		for _, scope := range []RulesScope{{}, {Commit: "old"}, {Time: time.Now().Add(-time.Hour)}} {
+			rules, err := adapted.GetByUserAt(ctx, 1, scope)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, current, rules)
+		}
+
+		// Getters that already support scopes are used as is
+		scoped := &scopedGetter{MockSubRepoPermissionsGetter: mock}
+		assert.Same(t, scoped, NewScopedSubRepoPermissionsGetter(scoped))
+	})
+
+	t.Run("unscoped getters ignore the commit", func(t *testing.T) {
+		mock := NewMockSubRepoPermissionsGetter()
+		mock.GetByUserFunc.SetDefaultReturn(current, nil)
+		client, err := NewSubRepoPermsClient(mock)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		perms, err := client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: "/secret/file", Commit: "old"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, None, perms)
+	})
+}
+
+func TestSubRepoPermsDeniedMetric(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"sample": {
+			PathIncludes: []string{"/src/**"},
+			PathExcludes: []string{"/src/secret/**"},
+		},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		path        string
+		want        Perms
+		wantExclude float64
+		wantNoMatch float64
+	}{
+		{name: "allowed", path: "/src/main.go", want: Read},
+		{name: "matched an exclude rule", path: "/src/secret/key", want: None, wantExclude: 1},
+		{name: "no rule matched", path: "/docs/README", want: None, wantNoMatch: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			exclude := testutil.ToFloat64(subRepoPermsDenied.WithLabelValues(deniedReasonExclude))
+			noMatch := testutil.ToFloat64(subRepoPermsDenied.WithLabelValues(deniedReasonNoMatch))
+
+			perms, err := client.Permissions(context.Background(), 1, RepoContent{Repo: "sample", Path: tc.path})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.want, perms)
+			assert.Equal(t, tc.wantExclude, testutil.ToFloat64(subRepoPermsDenied.WithLabelValues(deniedReasonExclude))-exclude)
+			assert.Equal(t, tc.wantNoMatch, testutil.ToFloat64(subRepoPermsDenied.WithLabelValues(deniedReasonNoMatch))-noMatch)
+		})
+	}
+}
+
+func TestSubRepoPermsChecksMetric(t *testing.T) {
+	enable := func(enabled bool) {
+		conf.Mock(&conf.Unified{
+			SiteConfiguration: schema.SiteConfiguration{
+				ExperimentalFeatures: &schema.ExperimentalFeatures{
+					SubRepoPermissions: &schema.SubRepoPermissions{
+						Enabled: enabled,
+					},
+				},
+			},
+		})
+	}
+	enable(true)
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(ctx context.Context, userID int32) (map[api.RepoName]SubRepoPermissions, error) {
+		if userID == 2 {
+			return nil, errors.New("boom")
+		}
+		return map[api.RepoName]SubRepoPermissions{
+			"sample": {PathIncludes: []string{"/src/**"}, PathExcludes: []string{"/src/secret/**"}},
+		}, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// delta returns how much each outcome was counted while running f.
+	delta := func(f func()) map[string]float64 {
+		outcomes := []string{"read", "none", "error"}
+		before := map[string]float64{}
+		for _, outcome := range outcomes {
+			before[outcome] = testutil.ToFloat64(subRepoPermsChecks.WithLabelValues(outcome))
+		}
+		f()
+		counted := map[string]float64{}
+		for _, outcome := range outcomes {
+			counted[outcome] = testutil.ToFloat64(subRepoPermsChecks.WithLabelValues(outcome)) - before[outcome]
+		}
+		return counted
+	}
+	ctx := context.Background()
+	secret := RepoContent{Repo: "sample", Path: "/src/secret/key"}
+	mainFile := RepoContent{Repo: "sample", Path: "/src/main.go"}
+
+	for _, tc := range []struct {
+		name string
+		f    func()
+		want map[string]float64
+	}{
+		{
+			name: "denied",
+			f:    func() { _, _ = client.Permissions(ctx, 1, secret) },
+			want: map[string]float64{"read": 0, "none": 1, "error": 0},
+		},
+		{
+			name: "allowed",
+			f:    func() { _, _ = client.Permissions(ctx, 1, mainFile) },
+			want: map[string]float64{"read": 1, "none": 0, "error": 0},
+		},
+		{
+			name: "error",
+			f:    func() { _, _ = client.Permissions(ctx, 2, mainFile) },
+			want: map[string]float64{"read": 0, "none": 0, "error": 1},
+		},
+		{
+			name: "batch",
+			f:    func() { _, _ = client.FilterContents(ctx, 1, []RepoContent{secret, mainFile, mainFile}) },
+			want: map[string]float64{"read": 2, "none": 1, "error": 0},
+		},
+		{
+			name: "disabled",
+			f: func() {
+				enable(false)
+				defer enable(true)
+				_, _ = client.Permissions(ctx, 1, secret)
+			},
+			want: map[string]float64{"read": 0, "none": 0, "error": 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, delta(tc.f)); diff != "" {
+				t.Fatalf("unexpected counts (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSubRepoEnabled(t *testing.T) {
+	t.Run("checker is nil", func(t *testing.T) {
+		if SubRepoEnabled(nil) {
+			t.Errorf("expected checker to be invalid since it is nil")
+		}
+	})
+	t.Run("checker is not enabled", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultHook(func() bool {
+			return false
+		})
+		if SubRepoEnabled(checker) {
+			t.Errorf("expected checker to be invalid since it is disabled")
+		}
+	})
+	t.Run("checker is enabled", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultHook(func() bool {
+			return true
+		})
+		if !SubRepoEnabled(checker) {
+			t.Errorf("expected checker to be valid since it is enabled")
+		}
+	})
+}
+
+func TestActorPermissionsOutcome(t *testing.T) {
+	newChecker := func(enabled bool) *MockSubRepoPermissionChecker {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultReturn(enabled)
+		checker.PermissionsFunc.SetDefaultHook(func(ctx context.Context, userID int32, content RepoContent) (Perms, error) {
+			if content.Path == "allowed" {
+				return Read, nil
+			}
+			return None, nil
+		})
+		return checker
+	}
+	content := func(path string) RepoContent {
+		return RepoContent{Repo: "sample", Path: path}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		checker     SubRepoPermissionChecker
+		actor       *actor.Actor
+		content     RepoContent
+		wantPerms   Perms
+		wantOutcome PermsOutcome
+		wantErr     bool
+	}{
+		{
+			name:        "disabled feature",
+			checker:     newChecker(false),
+			actor:       &actor.Actor{},
+			content:     content("denied"),
+			wantPerms:   Read,
+			wantOutcome: OutcomeDisabled,
+		},
+		{
+			name:        "nil checker",
+			checker:     nil,
+			actor:       &actor.Actor{},
+			content:     content("denied"),
+			wantPerms:   Read,
+			wantOutcome: OutcomeDisabled,
+		},
+		{
+			name:        "internal actor",
+			checker:     newChecker(true),
+			actor:       actor.FromContext(actor.WithInternalActor(context.Background())),
+			content:     content("denied"),
+			wantPerms:   Read,
+			wantOutcome: OutcomeInternal,
+		},
+		{
+			name:        "unauthenticated",
+			checker:     newChecker(true),
+			actor:       &actor.Actor{},
+			content:     content("allowed"),
+			wantPerms:   None,
+			wantOutcome: OutcomeUnauthenticated,
+			wantErr:     true,
+		},
+		{
+			name:        "allowed",
+			checker:     newChecker(true),
+			actor:       &actor.Actor{UID: 1},
+			content:     content("allowed"),
+			wantPerms:   Read,
+			wantOutcome: OutcomeAllowed,
+		},
+		{
+			name:        "explicit deny",
+			checker:     newChecker(true),
+			actor:       &actor.Actor{UID: 1},
+			content:     content("denied"),
+			wantPerms:   None,
+			wantOutcome: OutcomeDenied,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			perms, outcome, err := ActorPermissionsOutcome(context.Background(), tc.checker, tc.actor, tc.content)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.wantOutcome == OutcomeUnauthenticated && !errors.HasType(err, &ErrUnauthenticated{}) {
+				t.Fatalf("want ErrUnauthenticated, got %v", err)
+			}
+			if perms != tc.wantPerms {
+				t.Errorf("want perms %v, got %v", tc.wantPerms, perms)
+			}
+			if outcome != tc.wantOutcome {
+				t.Errorf("want outcome %v, got %v", tc.wantOutcome, outcome)
+			}
+
+			// ActorPermissions must agree on the permissions and error.
+			perms, err = ActorPermissions(context.Background(), tc.checker, tc.actor, tc.content)
+			if perms != tc.wantPerms || (err != nil) != tc.wantErr {
+				t.Errorf("ActorPermissions disagrees: got %v, %v", perms, err)
+			}
+		})
+	}
+
+	t.Run("checker errors", func(t *testing.T) {
+		checker := newChecker(true)
+		checker.PermissionsFunc.SetDefaultReturn(None, errors.New("boom"))
+		_, outcome, err := ActorPermissionsOutcome(context.Background(), checker, &actor.Actor{UID: 1}, content("allowed"))
+		if err == nil || outcome != OutcomeError {
+			t.Fatalf("want error outcome, got %v, %v", outcome, err)
+		}
+	})
+}
+
+func TestSubRepoPermsBypass(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled:       true,
+					BypassUserIDs: []int{7},
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	// The rules deny everything.
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"sample": {},
+	}, nil)
+	base, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type bypass struct {
+		userID int32
+		path   string
+	}
+	var bypasses []bypass
+	checker := base.WithBypass(BypassUIDs(42), func(_ context.Context, a *actor.Actor, content RepoContent) {
+		bypasses = append(bypasses, bypass{userID: a.UID, path: content.Path})
+	})
+
+	ctx := context.Background()
+	content := RepoContent{Repo: "sample", Path: "/secret/key"}
+
+	t.Run("allowlisted actor", func(t *testing.T) {
+		bypasses = nil
+		before := testutil.ToFloat64(subRepoPermsBypassed)
+		perms, outcome, err := ActorPermissionsOutcome(ctx, checker, &actor.Actor{UID: 42}, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != Read || outcome != OutcomeBypassed {
+			t.Fatalf("want Read and bypassed, got %v and %v", perms, outcome)
+		}
+		if len(getter.GetByUserFunc.History()) != 0 {
+			t.Fatal("expected the rules not to be consulted")
+		}
+		if diff := cmp.Diff([]bypass{{userID: 42, path: "/secret/key"}}, bypasses, cmp.AllowUnexported(bypass{})); diff != "" {
+			t.Fatalf("unexpected audit events (-want +got):\n%s", diff)
+		}
+		if got := testutil.ToFloat64(subRepoPermsBypassed) - before; got != 1 {
+			t.Fatalf("want 1 bypass counted, got %v", got)
+		}
+	})
+
+	t.Run("other actor", func(t *testing.T) {
+		bypasses = nil
+		perms, outcome, err := ActorPermissionsOutcome(ctx, checker, &actor.Actor{UID: 1}, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != None || outcome != OutcomeDenied {
+			t.Fatalf("want None and denied, got %v and %v", perms, outcome)
+		}
+		if len(bypasses) != 0 {
+			t.Fatalf("expected no audit events, got %v", bypasses)
+		}
+	})
+
+	t.Run("CanReadAllPaths", func(t *testing.T) {
+		bypasses = nil
+		ok, err := CanReadAllPaths(actor.WithActor(ctx, &actor.Actor{UID: 42}), checker, "sample", []string{"/secret/key", "/secret/cert"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("want the allowlisted actor to read all paths")
+		}
+		if len(bypasses) != 2 {
+			t.Fatalf("want 2 audit events, got %v", bypasses)
+		}
+
+		ok, err = CanReadAllPaths(actor.WithActor(ctx, &actor.Actor{UID: 1}), checker, "sample", []string{"/secret/key"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("want other actors to be denied")
+		}
+	})
+
+	t.Run("wrapped checkers", func(t *testing.T) {
+		logger, _ := logtest.Captured(t)
+		for name, wrapped := range map[string]SubRepoPermissionChecker{
+			"logging":        WithLogging(checker, logger),
+			"request scoped": NewRequestScopedChecker(ctx, checker),
+		} {
+			_, outcome, err := ActorPermissionsOutcome(ctx, wrapped, &actor.Actor{UID: 42}, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outcome != OutcomeBypassed {
+				t.Fatalf("%s: want the bypass to be passed through, got %v", name, outcome)
+			}
+		}
+
+		gated := NewRepoGatedChecker(RepoAuthorizerFunc(func(context.Context, int32, api.RepoName) (bool, error) {
+			return false, nil
+		}), checker)
+		perms, _, err := ActorPermissionsOutcome(ctx, gated, &actor.Actor{UID: 42}, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != None {
+			t.Fatalf("want the repo gate to apply to bypassing actors, got %v", perms)
+		}
+	})
+
+	t.Run("site configuration", func(t *testing.T) {
+		_, outcome, err := ActorPermissionsOutcome(ctx, base, &actor.Actor{UID: 7}, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome != OutcomeBypassed {
+			t.Fatalf("want the configured actor to bypass, got %v", outcome)
+		}
+		_, outcome, err = ActorPermissionsOutcome(ctx, base, &actor.Actor{UID: 42}, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outcome != OutcomeDenied {
+			t.Fatalf("want actors missing from the configuration denied, got %v", outcome)
+		}
+	})
+}
+
+func TestRepoContentFromFileInfo(t *testing.T) {
+	repo := api.RepoName("my-repo")
+	t.Run("adding trailing slash to directory", func(t *testing.T) {
+		fi := &util.FileInfo{
+			Name_: "app",
+			Mode_: fs.ModeDir,
+		}
+		rc := repoContentFromFileInfo(repo, fi)
+		expected := RepoContent{
+			Repo: repo,
+			Path: "app/",
+		}
+		assert.Equal(t, expected, rc)
+	})
+	t.Run("doesn't add trailing slash if not directory", func(t *testing.T) {
+		fi := &util.FileInfo{
+			Name_: "my-file.txt",
+		}
+		rc := repoContentFromFileInfo(repo, fi)
+		expected := RepoContent{
+			Repo: repo,
+			Path: "my-file.txt",
+		}
+		assert.Equal(t, expected, rc)
+	})
+}
+
+func TestSubRepoPermsRedactsPaths(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	tracer := mocktracer.New()
+	original := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(original) })
+
+	RedactPath = func(path string) string { return "redacted" }
+	t.Cleanup(func() { RedactPath = HashPath })
+
+	secretPath := "secrets/production.key"
+
+	t.Run("traced path is redacted", func(t *testing.T) {
+		getter := NewMockSubRepoPermissionsGetter()
+		getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+			"sample": {PathExcludes: []string{"secrets/*"}},
+		}, nil)
+		client, err := NewSubRepoPermsClient(getter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := ot.WithShouldTrace(context.Background(), true)
+		if _, err := client.Permissions(ctx, 1, RepoContent{Repo: "sample", Path: secretPath}); err != nil {
+			t.Fatal(err)
+		}
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("expected 1 span, got %d", len(spans))
+		}
+		if have := spans[0].Tag("path"); have != "redacted" {
+			t.Fatalf("expected redacted path tag, got %v", have)
+		}
+		for _, tag := range spans[0].Tags() {
+			if tag == secretPath {
+				t.Fatal("span contains unredacted path")
+			}
+		}
+	})
+
+	t.Run("error path is redacted", func(t *testing.T) {
+		checker := NewMockSubRepoPermissionChecker()
+		checker.EnabledFunc.SetDefaultReturn(true)
+		checker.PermissionsFunc.SetDefaultReturn(None, errors.New("boom"))
+
+		_, err := ActorPermissions(context.Background(), checker, &actor.Actor{UID: 1}, RepoContent{Repo: "sample", Path: secretPath})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		if strings.Contains(err.Error(), secretPath) {
+			t.Fatalf("error contains unredacted path: %s", err)
+		}
+		if !strings.Contains(err.Error(), "redacted") {
+			t.Fatalf("error does not contain redacted path: %s", err)
+		}
+	})
+}
+
+func TestPathRedactors(t *testing.T) {
+	if HashPath("a/b") != HashPath("a/b") {
+		t.Fatal("expected HashPath to be stable")
+	}
+	if HashPath("a/b") == HashPath("a/c") {
+		t.Fatal("expected HashPath to distinguish paths")
+	}
+	if strings.Contains(HashPath("secrets/key"), "secrets") {
+		t.Fatal("expected HashPath to hide the path")
+	}
+	for path, want := range map[string]string{
+		"secrets/key":      "secrets/...",
+		"/secrets/sub/key": "secrets/...",
+		"README.md":        "...",
+	} {
+		if have := TruncatePath(path); have != want {
+			t.Errorf("TruncatePath(%q): have %q, want %q", path, have, want)
+		}
+	}
+}
+
+func TestSubRepoPermsInvariantCheck(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules := map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"**"}},
+	}
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(context.Context, int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return rules, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var violations []error
+	client.invariantCheckRate = 1
+	client.onInvariantViolation = func(err error) { violations = append(violations, err) }
+
+	ctx := context.Background()
+	content := RepoContent{Repo: "sample", Path: "/secret/key.pem"}
+	// check waits for the background invariant check it may have started, by
+	// taking every slot of the semaphore bounding them.
+	check := func() Perms {
+		t.Helper()
+		perms, err := client.Permissions(ctx, 1, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.invariantChecks.Acquire(ctx, maxInvariantChecksInFlight); err != nil {
+			t.Fatal(err)
+		}
+		client.invariantChecks.Release(maxInvariantChecksInFlight)
+		return perms
+	}
+
+	// The first check fills the cache, the second is served from it and agrees
+	// with the rules.
+	check()
+	if perms := check(); perms != Read {
+		t.Fatalf("want Read, got %v", perms)
+	}
+	if len(violations) != 0 {
+		t.Fatalf("unexpected violations: %v", violations)
+	}
+	calls := len(getter.GetByUserFunc.History())
+
+	// Tighten the rules behind the cache's back.
+	rules = map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+	}
+	if perms := check(); perms != Read {
+		t.Fatalf("want the stale Read from the cache, got %v", perms)
+	}
+	if len(violations) != 1 {
+		t.Fatalf("want 1 violation, got %v", violations)
+	}
+	if got := len(getter.GetByUserFunc.History()); got != calls+1 {
+		t.Fatalf("want 1 call to the getter for the check, got %d", got-calls)
+	}
+
+	// The check must not refresh the cache, so it keeps detecting the divergence.
+	check()
+	if len(violations) != 2 {
+		t.Fatalf("want 2 violations, got %v", violations)
+	}
+	if got := testutil.ToFloat64(subRepoPermsInvariantViolations); got < 2 {
+		t.Fatalf("want at least 2 violations counted, got %v", got)
+	}
+
+	// A check that can't reach the getter doesn't fail the permission check it
+	// was sampled from.
+	getter.GetByUserFunc.SetDefaultHook(func(context.Context, int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return nil, errors.New("boom")
+	})
+	if perms := check(); perms != Read {
+		t.Fatalf("want Read despite the failing check, got %v", perms)
+	}
+	if len(violations) != 2 {
+		t.Fatalf("want no new violations, got %v", violations)
+	}
+}
+
+func TestSubRepoPermsEnabledForUser(t *testing.T) {
+	repo := api.RepoName("sample")
+	setEnabled := func(enabled bool) {
+		conf.Mock(&conf.Unified{
+			SiteConfiguration: schema.SiteConfiguration{
+				ExperimentalFeatures: &schema.ExperimentalFeatures{
+					SubRepoPermissions: &schema.SubRepoPermissions{
+						Enabled: enabled,
+					},
+				},
+			},
+		})
+	}
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	newClient := func(supported bool, rules map[api.RepoName]SubRepoPermissions) *SubRepoPermsClient {
+		getter := NewMockSubRepoPermissionsGetter()
+		getter.RepoSupportedFunc.SetDefaultReturn(supported, nil)
+		getter.GetByUserFunc.SetDefaultReturn(rules, nil)
+		client, err := NewSubRepoPermsClient(getter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+	restricted := map[api.RepoName]SubRepoPermissions{
+		repo: {PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		enabled   bool
+		supported bool
+		rules     map[api.RepoName]SubRepoPermissions
+		want      bool
+	}{
+		{name: "restricted", enabled: true, supported: true, rules: restricted, want: true},
+		{name: "feature disabled", enabled: false, supported: true, rules: restricted},
+		{name: "repo not supported", enabled: true, supported: false, rules: restricted},
+		{name: "no rules for the repo", enabled: true, supported: true, rules: map[api.RepoName]SubRepoPermissions{"other": restricted[repo]}},
+		{name: "allow-all rules", enabled: true, supported: true, rules: map[api.RepoName]SubRepoPermissions{repo: {PathIncludes: []string{"**"}}}},
+		{name: "cross-directory allow-all rules", enabled: true, supported: true, rules: map[api.RepoName]SubRepoPermissions{repo: {PathIncludes: []string{"*"}, GlobMode: GlobCrossDirectory}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnabled(tc.enabled)
+			got, err := newClient(tc.supported, tc.rules).EnabledForUser(context.Background(), 1, repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %t, got %t", tc.want, got)
+			}
+		})
+	}
+
+	setEnabled(true)
+	if _, err := newClient(true, restricted).EnabledForUser(context.Background(), 0, repo); !errors.HasType(err, &ErrUnauthenticated{}) {
+		t.Fatalf("want ErrUnauthenticated for an anonymous user, got %v", err)
+	}
+}
+
+func TestSubRepoPermsCollapsedRules(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		perms     SubRepoPermissions
+		wantAllow bool
+		wantDeny  string
+		wantGlobs bool
+	}{
+		{name: "allow all", perms: SubRepoPermissions{PathIncludes: []string{"/src/**", "**"}}, wantAllow: true},
+		{name: "allow all across directories", perms: SubRepoPermissions{PathIncludes: []string{"*"}, GlobMode: GlobCrossDirectory}, wantAllow: true},
+		{name: "star in strict mode", perms: SubRepoPermissions{PathIncludes: []string{"*"}}, wantGlobs: true},
+		{name: "deny all by exclude", perms: SubRepoPermissions{PathIncludes: []string{"**"}, PathExcludes: []string{"**"}}, wantDeny: deniedReasonExclude},
+		{name: "deny all without includes", perms: SubRepoPermissions{PathExcludes: []string{"/secret/**"}}, wantDeny: deniedReasonNoMatch},
+		{name: "restricted", perms: SubRepoPermissions{PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}}, wantGlobs: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			compiled, err := compileRules(map[api.RepoName]SubRepoPermissions{"repo": tc.perms})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules := compiled["repo"]
+			if rules.allowsAll != tc.wantAllow || rules.denyAllReason != tc.wantDeny {
+				t.Fatalf("want allowsAll %t and denyAllReason %q, got %t and %q", tc.wantAllow, tc.wantDeny, rules.allowsAll, rules.denyAllReason)
+			}
+			if hasGlobs := len(rules.includes)+len(rules.excludes) > 0; hasGlobs != tc.wantGlobs {
+				t.Fatalf("want globs kept %t, got %t", tc.wantGlobs, hasGlobs)
+			}
+		})
+	}
+
+	if _, err := compileRules(map[api.RepoName]SubRepoPermissions{"repo": {PathIncludes: []string{"**", "[bad"}}}); err == nil {
+		t.Fatal("expected invalid rules to fail compiling even when they allow all")
+	}
+
+	// Changing collapsed rules takes effect once the cached rules expire.
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	repo := api.RepoName("repo")
+	getter := NewMockSubRepoPermissionsGetter()
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := false
+	client.since = func(time.Time) time.Duration {
+		if expired {
+			return defaultCacheTTL + 1
+		}
+		return 0
+	}
+	check := func(rules SubRepoPermissions, path string, want Perms) {
+		t.Helper()
+		getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{repo: rules}, nil)
+		expired = true
+		if _, err := client.Permissions(context.Background(), 1, RepoContent{Repo: repo, Path: "/"}); err != nil {
+			t.Fatal(err)
+		}
+		expired = false
+		perms, err := client.Permissions(context.Background(), 1, RepoContent{Repo: repo, Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != want {
+			t.Fatalf("want %s on %s with rules %+v, got %s", want, path, rules, perms)
+		}
+	}
+
+	check(SubRepoPermissions{PathIncludes: []string{"**"}}, "/secret/key", Read)
+	check(SubRepoPermissions{PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}}, "/secret/key", None)
+	check(SubRepoPermissions{PathIncludes: []string{"**"}, PathExcludes: []string{"/secret/**"}}, "/public/readme", Read)
+	check(SubRepoPermissions{PathExcludes: []string{"**"}}, "/public/readme", None)
+	check(SubRepoPermissions{PathIncludes: []string{"/public/**"}}, "/public/readme", Read)
+}
+
+func TestSubRepoPermsCompiledRulesCache(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled:       true,
+					UserCacheSize: 1,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	rules := map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"/src/**"}},
+	}
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultHook(func(context.Context, int32) (map[api.RepoName]SubRepoPermissions, error) {
+		return rules, nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without pooling, only the cache keeps rules from being compiled again.
+	client.pool = newCompiledRulePool(0, 0)
+
+	ctx := context.Background()
+	check := func(userID int32, path string, want Perms) {
+		t.Helper()
+		perms, err := client.Permissions(ctx, userID, RepoContent{Repo: "sample", Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != want {
+			t.Fatalf("%s: want %s, got %s", path, want, perms)
+		}
+	}
+	compiled := func() compiledRules {
+		item, _ := client.cache.Peek(int32(1))
+		return item.(cachedRules).rules["sample"]
+	}
+	expire := func() {
+		client.since = func(time.Time) time.Duration { return defaultCacheTTL + 1 }
+		t.Cleanup(func() { client.since = time.Since })
+	}
+
+	check(1, "/src/main.go", Read)
+	before := compiled()
+
+	// Refreshing unchanged rules keeps the compiled globs.
+	expire()
+	check(1, "/src/main.go", Read)
+	if &compiled().includes[0] != &before.includes[0] {
+		t.Fatal("expected unchanged rules not to be compiled again")
+	}
+
+	// Changed rules are compiled again once the cached rules expire.
+	rules = map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"/src/**"}, PathExcludes: []string{"/src/secret/**"}},
+	}
+	client.since = time.Since
+	check(1, "/src/secret/key.go", Read)
+	expire()
+	check(1, "/src/secret/key.go", None)
+	if len(compiled().excludes) != 1 {
+		t.Fatal("expected the changed rules to be compiled")
+	}
+	if n := len(getter.GetByUserFunc.History()); n != 3 {
+		t.Fatalf("want 3 fetches, got %d", n)
+	}
+
+	// The cache is bounded by the configured size.
+	check(2, "/src/main.go", Read)
+	if n := client.cache.Len(); n != 1 {
+		t.Fatalf("want 1 cached user, got %d", n)
+	}
+}
+
+func TestSubRepoPermsBranchRules(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"sample": {
+			PathIncludes: []string{"**"},
+			BranchRules: []BranchRule{
+				{Branch: "release/*", PathExcludes: []string{"secrets/**"}},
+			},
+		},
+		"narrow": {
+			PathIncludes: []string{"src/**"},
+			PathExcludes: []string{"src/internal/**"},
+			BranchRules: []BranchRule{
+				{Branch: "docs", PathIncludes: []string{"docs/**", "src/internal/**"}},
+			},
+		},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		content RepoContent
+		want    Perms
+	}{
+		{
+			name:    "no branch uses the repo-wide rules",
+			content: RepoContent{Repo: "sample", Path: "secrets/prod.key"},
+			want:    Read,
+		},
+		{
+			name:    "branch without rules uses the repo-wide rules",
+			content: RepoContent{Repo: "sample", Path: "secrets/prod.key", Branch: "main"},
+			want:    Read,
+		},
+		{
+			name:    "branch exclude",
+			content: RepoContent{Repo: "sample", Path: "secrets/prod.key", Branch: "release/1.0"},
+			want:    None,
+		},
+		{
+			name:    "branch exclude only covers its paths",
+			content: RepoContent{Repo: "sample", Path: "src/main.go", Branch: "release/1.0"},
+			want:    Read,
+		},
+		{
+			name:    "branch glob doesn't cross directories",
+			content: RepoContent{Repo: "sample", Path: "secrets/prod.key", Branch: "release/1.0/hotfix"},
+			want:    Read,
+		},
+		{
+			name:    "branch include",
+			content: RepoContent{Repo: "narrow", Path: "docs/index.md", Branch: "docs"},
+			want:    Read,
+		},
+		{
+			name:    "branch include without the branch",
+			content: RepoContent{Repo: "narrow", Path: "docs/index.md"},
+			want:    None,
+		},
+		{
+			name:    "repo-wide exclude wins over a branch include",
+			content: RepoContent{Repo: "narrow", Path: "src/internal/db.go", Branch: "docs"},
+			want:    None,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			have, err := client.Permissions(context.Background(), 1, tc.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, have)
+			}
+		})
+	}
+
+	t.Run("invalid branch glob", func(t *testing.T) {
+		_, err := EvaluateRules(SubRepoPermissions{
+			PathIncludes: []string{"**"},
+			BranchRules:  []BranchRule{{Branch: "release/[", PathExcludes: []string{"secrets/**"}}},
+		}, []RepoContent{{Path: "secrets/prod.key", Branch: "release/1.0"}})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestSubRepoPermsNormalizesPaths(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"sample": {PathIncludes: []string{"**"}, PathExcludes: []string{"secrets/*", "/private/**", "docs/internal/"}},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		repo api.RepoName
+		path string
+		want Perms
+	}{
+		{"sample", "secrets/key.pem", None},
+		{"sample", "secrets/../secrets/key.pem", None},
+		{"sample", "src/../secrets/key.pem", None},
+		{"sample", "./secrets/key.pem", None},
+		{"sample", "secrets//key.pem", None},
+		{"sample", "secrets/./key.pem", None},
+		{"sample", "//private/key.pem", None},
+		{"sample", "/src/../private/key.pem", None},
+		{"sample", "docs/internal/./", None},
+		{"sample", "docs//internal//", None},
+		{"sample", "src/main.go", Read},
+		{"sample", "secrets/../src/main.go", Read},
+		{"sample", "../secrets/key.pem", None},
+		{"sample", "src/../../sample/src/main.go", None},
+		{"sample", "/..", None},
+		{"unrestricted", "../other/file", None},
+		{"unrestricted", "src/main.go", Read},
+	} {
+		have, err := client.Permissions(context.Background(), 1, RepoContent{Repo: tc.repo, Path: tc.path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tc.want {
+			t.Errorf("%s %q: want %s, got %s", tc.repo, tc.path, tc.want, have)
+		}
+	}
+}
+
+func TestSubRepoPermsNotSynced(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"synced": {PathIncludes: []string{"src/**"}},
+	}, nil)
+	getter.RepoSupportedFunc.SetDefaultHook(func(ctx context.Context, repo api.RepoName) (bool, error) {
+		return repo == "synced" || repo == "unsynced", nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name          string
+		content       RepoContent
+		want          Perms
+		wantNotSynced bool
+	}{
+		{name: "rules grant the path", content: RepoContent{Repo: "synced", Path: "src/main.go"}, want: Read},
+		{name: "rules match nothing", content: RepoContent{Repo: "synced", Path: "docs/README.md"}, want: None},
+		{name: "repo without sub-repo permissions", content: RepoContent{Repo: "plain", Path: "src/main.go"}, want: Read},
+		{name: "repo rules missing", content: RepoContent{Repo: "unsynced", Path: "src/main.go"}, want: None, wantNotSynced: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			perms, err := client.Permissions(ctx, 1, tc.content)
+			if errors.Is(err, ErrSubRepoPermsNotSynced) != tc.wantNotSynced {
+				t.Fatalf("want not synced %t, got error %v", tc.wantNotSynced, err)
+			}
+			if !tc.wantNotSynced && err != nil {
+				t.Fatal(err)
+			}
+			if perms != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, perms)
+			}
+		})
+	}
+
+	t.Run("through ActorPermissions", func(t *testing.T) {
+		perms, outcome, err := ActorPermissionsOutcome(ctx, client, &actor.Actor{UID: 1}, RepoContent{Repo: "unsynced", Path: "src/main.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms != None || outcome != OutcomeNotSynced {
+			t.Fatalf("want None and not synced, got %v and %v", perms, outcome)
+		}
+	})
+
+	t.Run("batches deny without an error", func(t *testing.T) {
+		perms, err := client.FilterContents(ctx, 1, []RepoContent{
+			{Repo: "synced", Path: "src/main.go"},
+			{Repo: "unsynced", Path: "src/main.go"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms[RepoContent{Repo: "synced", Path: "src/main.go"}] != Read || perms[RepoContent{Repo: "unsynced", Path: "src/main.go"}] != None {
+			t.Fatalf("want Read and None, got %v", perms)
+		}
+
+		paths, err := FilterActorPaths(ctx, client, &actor.Actor{UID: 1}, "unsynced", []string{"src/main.go"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 0 {
+			t.Fatalf("want no readable paths, got %v", paths)
+		}
+	})
+
+	t.Run("helpers deny without an error", func(t *testing.T) {
+		a := &actor.Actor{UID: 1}
+		unsynced := api.RepoName("unsynced")
+
+		ok, err := FilterActorPath(ctx, client, a, unsynced, "src/main.go")
+		if err != nil || ok {
+			t.Fatalf("FilterActorPath: want false, got %t, %v", ok, err)
+		}
+
+		fi := &util.FileInfo{Name_: "main.go"}
+		ok, err = FilterActorFileInfo(ctx, client, a, unsynced, fi)
+		if err != nil || ok {
+			t.Fatalf("FilterActorFileInfo: want false, got %t, %v", ok, err)
+		}
+		fis, err := FilterActorFileInfos(ctx, client, a, unsynced, []fs.FileInfo{fi})
+		if err != nil || len(fis) != 0 {
+			t.Fatalf("FilterActorFileInfos: want no file infos, got %v, %v", fis, err)
+		}
+
+		ok, err = CanReadAllPaths(actor.WithActor(ctx, a), client, unsynced, []string{"src/main.go"})
+		if err != nil || ok {
+			t.Fatalf("CanReadAllPaths: want false, got %t, %v", ok, err)
+		}
+
+		report, err := client.AssertEffectiveAccess(ctx, 1, unsynced, []string{"src/main.go"}, []string{"src/other.go"})
+		if err != nil {
+			t.Fatalf("AssertEffectiveAccess: %v", err)
+		}
+		if diff := cmp.Diff(AccessReport{UnderGrants: []string{"src/main.go"}}, report); diff != "" {
+			t.Fatalf("AssertEffectiveAccess: unexpected report (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestSubRepoPermsRepoSupportedCached(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{}, nil)
+	getter.RepoSupportedFunc.SetDefaultHook(func(ctx context.Context, repo api.RepoName) (bool, error) {
+		return repo == "unsynced", nil
+	})
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	client.clock = func() time.Time { return now }
+	client.since = func(t time.Time) time.Duration { return now.Sub(t) }
+	ctx := context.Background()
+
+	check := func() {
+		t.Helper()
+		perms, err := client.FilterContents(ctx, 1, []RepoContent{
+			{Repo: "plain", Path: "a"},
+			{Repo: "plain", Path: "b"},
+			{Repo: "unsynced", Path: "a"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perms[RepoContent{Repo: "plain", Path: "a"}] != Read || perms[RepoContent{Repo: "unsynced", Path: "a"}] != None {
+			t.Fatalf("unexpected perms %v", perms)
+		}
+	}
+	supportedCalls := func() int { return len(getter.RepoSupportedFunc.History()) }
+
+	// Each repo is looked up once, and again only once the cached rules are gone.
+	check()
+	if got := supportedCalls(); got != 2 {
+		t.Fatalf("want 2 RepoSupported calls, got %d", got)
+	}
+	check()
+	if got := supportedCalls(); got != 2 {
+		t.Fatalf("want cached RepoSupported results, got %d calls", got)
+	}
+
+	if err := client.InvalidateUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	if got := supportedCalls(); got != 4 {
+		t.Fatalf("want RepoSupported calls after invalidation, got %d", got)
+	}
+
+	now = now.Add(2 * defaultCacheTTL)
+	check()
+	if got := supportedCalls(); got != 6 {
+		t.Fatalf("want RepoSupported calls after the rules expired, got %d", got)
+	}
+}
+
+func TestSubRepoPermsRegexpRules(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"mixed": {
+			PathIncludes:       []string{"config/**"},
+			PathExcludeRegexps: []string{`.*_secret_.*\.ya?ml`},
+		},
+		"regexp-only": {
+			PathIncludeRegexps: []string{`src/[a-z]+\.go`},
+		},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		repo api.RepoName
+		path string
+		want Perms
+	}{
+		{"mixed", "config/app.yaml", Read},
+		{"mixed", "config/db_secret_prod.yaml", None},
+		{"mixed", "config/nested/db_secret_prod.yml", None},
+		{"mixed", "config/db_secret_prod.yaml.bak", Read},
+		{"mixed", "docs/README.md", None},
+		{"regexp-only", "src/main.go", Read},
+		{"regexp-only", "src/main_test.go", None},
+		{"regexp-only", "vendor/src/main.go", None},
+	} {
+		have, err := client.Permissions(context.Background(), 1, RepoContent{Repo: tc.repo, Path: tc.path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tc.want {
+			t.Errorf("%s %s: want %s, got %s", tc.repo, tc.path, tc.want, have)
+		}
+	}
+
+	t.Run("suggestions", func(t *testing.T) {
+		suggestion, err := SuggestRuleChange(SubRepoPermissions{
+			PathIncludes:       []string{"config/**"},
+			PathExcludeRegexps: []string{`.*_secret_.*\.ya?ml`},
+		}, RepoContent{Path: "config/db_secret_prod.yaml"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := RuleSuggestion{BlockingExcludes: []string{`.*_secret_.*\.ya?ml`}}
+		if diff := cmp.Diff(want, suggestion); diff != "" {
+			t.Fatalf("unexpected suggestion (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid regexp", func(t *testing.T) {
+		_, err := EvaluateRules(SubRepoPermissions{PathExcludeRegexps: []string{`(unclosed`}}, []RepoContent{{Path: "a"}})
+		if err == nil || !strings.Contains(err.Error(), "building exclude matcher") {
+			t.Fatalf("want a wrapped compile error, got %v", err)
+		}
+	})
+}
+
+func TestSubRepoPermsVisiblePaths(t *testing.T) {
+	tree := []string{
+		"README.md",
+		"docs/",
+		"docs/guide.md",
+		"secrets/",
+		"secrets/prod/",
+		"secrets/prod/key.pem",
+		"secrets/dev.env",
+		"src",
+		"src/main.go",
+		"src/internal/token.go",
+		"empty/",
+	}
+
+	getter := NewMockSubRepoPermissionsGetter()
+	getter.GetByUserFunc.SetDefaultReturn(map[api.RepoName]SubRepoPermissions{
+		"repo": {
+			PathIncludes: []string{"**"},
+			PathExcludes: []string{"secrets/**", "src/internal/**"},
+		},
+	}, nil)
+	client, err := NewSubRepoPermsClient(getter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	t.Run("disabled", func(t *testing.T) {
+		have, err := client.VisiblePaths(ctx, 1, "repo", tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tree, have); diff != "" {
+			t.Fatalf("want the tree unchanged (-want +got):\n%s", diff)
+		}
+	})
+
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			ExperimentalFeatures: &schema.ExperimentalFeatures{
+				SubRepoPermissions: &schema.SubRepoPermissions{
+					Enabled: true,
+				},
+			},
+		},
+	})
+	t.Cleanup(func() { conf.Mock(nil) })
+
+	have, err := client.VisiblePaths(ctx, 1, "repo", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// secrets/ has only hidden children, so it is dropped. src is partially
+	// visible, so it is kept along with its visible children. empty/ has no
+	// children in the tree, so it is checked on its own.
+	want := []string{
+		"README.md",
+		"docs/",
+		"docs/guide.md",
+		"src",
+		"src/main.go",
+		"empty/",
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Fatalf("unexpected visible paths (-want +got):\n%s", diff)
+	}
+	if n := len(getter.GetByUserFunc.History()); n != 1 {
+		t.Fatalf("want rules fetched once, got %d calls", n)
+	}
 }
@@ -18,6 +18,7 @@ import (
 func TestApplySubRepoFiltering(t *testing.T) {
 	unauthorizedFileName := "README.md"
 	errorFileName := "file.go"
+	unsyncedFileName := "unsynced.go"
 	var userWithSubRepoPerms int32 = 1234
 
 	checker := authz.NewMockSubRepoPermissionChecker()
@@ -31,6 +32,9 @@ func TestApplySubRepoFiltering(t *testing.T) {
 			case errorFileName:
 				// Simulate an error case, should be filtered out
 				return authz.None, errors.New(errorFileName)
+			case unsyncedFileName:
+				// Rules not synced yet, should be filtered out without an error
+				return authz.None, authz.ErrSubRepoPermsNotSynced
 			}
 		}
 		return authz.Read, nil
@@ -137,6 +141,31 @@ func TestApplySubRepoFiltering(t *testing.T) {
 			},
 			wantErr: "subRepoFilterFunc",
 		},
+		{
+			name: "drop match without an error for user whose rules aren't synced",
+			args: args{
+				ctxActor: actor.FromUser(userWithSubRepoPerms),
+				matches: []result.Match{
+					&result.FileMatch{
+						File: result.File{
+							Path: unsyncedFileName,
+						},
+					},
+					&result.FileMatch{
+						File: result.File{
+							Path: "random-name.md",
+						},
+					},
+				},
+			},
+			wantMatches: []result.Match{
+				&result.FileMatch{
+					File: result.File{
+						Path: "random-name.md",
+					},
+				},
+			},
+		},
 		{
 			name: "repo matches should be ignored",
 			args: args{
@@ -183,6 +212,8 @@ func TestApplySubRepoFiltering(t *testing.T) {
 				if !strings.Contains(err.Error(), tt.wantErr) {
 					t.Fatalf("expected err %q, got %q", tt.wantErr, err.Error())
 				}
+			} else if err != nil {
+				t.Fatalf("unexpected err %v", err)
 			}
 		})
 	}
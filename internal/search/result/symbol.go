@@ -7,6 +7,8 @@ import (
 	"strings"
 
 	"github.com/sourcegraph/go-lsp"
+
+	"github.com/sourcegraph/sourcegraph/internal/types"
 )
 
 // Symbol is a code symbol.
@@ -24,6 +26,13 @@ type Symbol struct {
 	Parent     string
 	ParentKind string
 	Signature  string
+	// Scope is the chain of symbols enclosing this one, outermost first. Only some symbol
+	// providers set it.
+	Scope []types.SymbolScope `json:",omitempty"`
+	// StableID identifies the symbol independently of its position, so it is the same across
+	// commits as long as the symbol keeps its name, kind and enclosing scopes. Only some symbol
+	// providers set it.
+	StableID string `json:",omitempty"`
 
 	FileLimited bool
 }
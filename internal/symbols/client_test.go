@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/neelance/parallel"
+
 	"github.com/sourcegraph/sourcegraph/internal/actor"
 	"github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/search"
@@ -84,6 +87,56 @@ func TestSearchWithFiltering(t *testing.T) {
 	}
 }
 
+func TestSearchWithFilteringNotSynced(t *testing.T) {
+	fixture := search.SymbolsResponse{
+		Symbols: result.Symbols{
+			result.Symbol{
+				Name: "foo1",
+				Path: "file1",
+			},
+			result.Symbol{
+				Name: "foo2",
+				Path: "unsynced/file2",
+			},
+		}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(fixture)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	// Files whose rules aren't synced yet are left out, rather than failing the
+	// whole request.
+	checker := authz.NewMockSubRepoPermissionChecker()
+	checker.EnabledFunc.SetDefaultReturn(true)
+	checker.PermissionsFunc.SetDefaultHook(func(ctx context.Context, i int32, content authz.RepoContent) (authz.Perms, error) {
+		if strings.HasPrefix(content.Path, "unsynced/") {
+			return authz.None, authz.ErrSubRepoPermsNotSynced
+		}
+		return authz.Read, nil
+	})
+	client := &Client{
+		URL:                 srv.URL,
+		HTTPClient:          defaultDoer,
+		HTTPLimiter:         parallel.NewRun(500),
+		SubRepoPermsChecker: func() authz.SubRepoPermissionChecker { return checker },
+	}
+
+	ctx := actor.WithActor(context.Background(), &actor.Actor{UID: 1})
+	results, err := client.Search(ctx, search.SymbolsParameters{
+		Repo:     "foo",
+		CommitID: "HEAD",
+		Query:    "abc",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Path != "file1" {
+		t.Fatalf("want only the symbol from file1, got %v", results)
+	}
+}
+
 func TestDefinitionWithFiltering(t *testing.T) {
 	// This test conflicts with the previous use of httptest.NewServer, but passes in isolation.
 	t.Skip()
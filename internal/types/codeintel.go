@@ -141,6 +141,8 @@ func (r RepoCommitPath) String() string {
 
 type LocalCodeIntelPayload struct {
 	Symbols []Symbol `json:"symbols"`
+	// Truncated is true when symbols were omitted because the file has too many.
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 type RepoCommitPathRange struct {
@@ -187,6 +189,34 @@ func (r Range) String() string {
 type SymbolInfo struct {
 	Definition RepoCommitPathMaybeRange `json:"definition"`
 	Hover      *string                  `json:"hover,omitempty"`
+	// LowConfidence is true when the definition was found with a heuristic that may be wrong.
+	LowConfidence bool `json:"lowConfidence,omitempty"`
+	// External is true when the symbol is defined outside of the repository, e.g. in the standard
+	// library. The definition has no path or range in that case.
+	External bool `json:"external,omitempty"`
+	// QualifiedName is the name of an external symbol, e.g. fmt.Println.
+	QualifiedName string `json:"qualifiedName,omitempty"`
+	// PreviewLines is the line of the definition surrounded by a few lines of context, when
+	// previews were requested.
+	PreviewLines []string `json:"previewLines,omitempty"`
+	// Redacted is true when a definition was found in a file the user can't read. The definition,
+	// hover and preview are left out in that case, unlike a nil SymbolInfo which means that nothing
+	// was found.
+	Redacted bool `json:"redacted,omitempty"`
+	// Scope is the chain of symbols enclosing the definition, outermost first, when requested.
+	Scope []SymbolScope `json:"scope,omitempty"`
+	// Signature is the one-line signature of a definition that is a function, method or
+	// constructor, when requested.
+	Signature string `json:"signature,omitempty"`
+	// StableID identifies the definition independently of its position, when requested. It is only
+	// set for definitions that are reported as symbols of their file.
+	StableID string `json:"stableID,omitempty"`
+}
+
+// SymbolScope is a symbol that encloses another, like the class of a method.
+type SymbolScope struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
 }
 
 func (s SymbolInfo) String() string {
@@ -631,6 +631,8 @@ type ExperimentalFeatures struct {
 	SearchIndexRevisions []*SearchIndexRevisionsRule `json:"search.index.revisions,omitempty"`
 	// SearchMultipleRevisionsPerRepository description: DEPRECATED. Always on. Will be removed in 3.19.
 	SearchMultipleRevisionsPerRepository *bool `json:"searchMultipleRevisionsPerRepository,omitempty"`
+	// Squirrel description: Enables squirrel, the tree-sitter based local code intelligence and definition resolver used by the symbols service. Set to "disabled" to turn it off immediately, for example during an incident.
+	Squirrel string `json:"squirrel,omitempty"`
 	// StructuralSearch description: Enables structural search.
 	StructuralSearch   string              `json:"structuralSearch,omitempty"`
 	SubRepoPermissions *SubRepoPermissions `json:"subRepoPermissions,omitempty"`
@@ -2005,8 +2007,14 @@ type Step struct {
 	Run string `json:"run"`
 }
 type SubRepoPermissions struct {
+	// BypassUserIDs description: IDs of users, such as service accounts for CI or indexers, that may read all content regardless of sub-repo permissions. Every bypassed check is counted and logged at debug level
+	BypassUserIDs []int `json:"bypassUserIDs,omitempty"`
+	// CompileBudgetMilliseconds description: A soft cap on the time spent compiling a user's rules in a single request. When exceeded, the user's previously cached rules are used if there are any, and access to repos with rules is denied otherwise. Unset means no cap
+	CompileBudgetMilliseconds int `json:"compileBudgetMilliseconds,omitempty"`
 	// Enabled description: Enables sub-repo permission checking
 	Enabled bool `json:"enabled,omitempty"`
+	// UserCacheMaxTTLSeconds description: When greater than userCacheTTLSeconds, the TTL for a user's cached permissions doubles each time their rules are unchanged on refresh, up to this many seconds, and drops back to userCacheTTLSeconds when they change
+	UserCacheMaxTTLSeconds int `json:"userCacheMaxTTLSeconds,omitempty"`
 	// UserCacheSize description: The number of user permissions to cache
 	UserCacheSize int `json:"userCacheSize,omitempty"`
 	// UserCacheTTLSeconds description: The TTL in seconds for cached user permissions